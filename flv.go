@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"fmt"
@@ -44,7 +45,9 @@ func FlvTransmit(p *Stream, s *Stream, exitChan chan int, w http.ResponseWriter,
 	td := time.Duration(p.PlaybackTimeout)
 	ticker := time.NewTicker(td * time.Second)
 	defer ticker.Stop()
-	defer p.Wg.Done()
+	//发布者可能被替换, 退出时通知当前的发布者
+	defer PlayerPuberDone(s)
+	defer HookPlayerStop(s)
 	rc := http.NewResponseController(w)
 
 	for {
@@ -56,11 +59,15 @@ func FlvTransmit(p *Stream, s *Stream, exitChan chan int, w http.ResponseWriter,
 				exitChan <- 0
 				return
 			}
-		case <-p.Ctx.Done():
-			p.log.Printf("publish stop then flv live stop: %s", s.Key)
+		case <-s.Ctx.Done():
+			s.log.Printf("publish stop then flv live stop: %s", s.Key)
 			exitChan <- 0
 			return
 		case <-ticker.C:
+			//发布者断线 等待重连期间 不能断开播放者
+			if p.PuberGrace == true {
+				continue
+			}
 			p.log.Printf("flv %s recv timeout %d second stop", s.Key, td)
 			exitChan <- 0
 			return
@@ -88,6 +95,8 @@ func FlvTransmit(p *Stream, s *Stream, exitChan chan int, w http.ResponseWriter,
 			exitChan <- 0
 			return
 		}
+		MetricsAdd(MetricsOutBytes, "flv", uint64(len(c.MsgData)))
+		PlayerOutBytesAdd(s, len(c.MsgData))
 
 		//s.log.Printf("SendData, type:%s, size:%d", c.DataType, c.MsgLength)
 	}
@@ -118,6 +127,12 @@ func GetFlv(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	var err error
 	app, sid, _ := GetPlayInfo(r.URL.String())
 	addr := r.RemoteAddr
+	//播放地址签名不对的, HttpErrorSend()返回403
+	err = PlaySignCheck(app, sid, r.URL.RawQuery, addr)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
 	//log.Printf("app:%s, sid:%s, addr:%s", app, sid, addr)
 
 	//判断发布者是否存在 不存在直接返回错误
@@ -125,9 +140,23 @@ func GetFlv(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	key := sid
 	log.Printf("publisher key is %s", key)
 
-	v, ok := RtmpPuberMap.Load(key)
+	p, ok := HubPuberGet(key)
 	if ok == false { // 发布者不存在, 断开连接并返回错误
-		err = fmt.Errorf("publisher %s isn't exist", key)
+		err = HttpErr(http.StatusNotFound, "publisher %s isn't exist", key)
+		log.Println(err)
+		return nil, err
+	}
+	//超过播放者个数限制, HttpErrorSend()返回503
+	t, err := PlayAdmit(app, sid)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	//http请求结束时 播放者已退出
+	defer PlayRelease(t)
+	//生命周期回调拒绝的, HttpErrorSend()返回403
+	err = HookPlay("flv", app, sid, addr, r.URL.RawQuery)
+	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
@@ -182,8 +211,6 @@ func GetFlv(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 		}
 	}
 
-	p, _ := v.(*Stream)
-
 	s := NewFlvStream(addr)
 	s.Type = "flvPlayer"
 	s.AmfInfo.App = app
@@ -195,21 +222,23 @@ func GetFlv(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	if strings.Contains(r.URL.String(), "encrypt=0") {
 		s.FlvPlayEncrypt = true
 	}
-	if strings.Contains(r.URL.String(), "startmode=low") {
-		s.PlayStartMode = "low"
-	} else if strings.Contains(r.URL.String(), "startmode=fastlow") {
-		s.PlayStartMode = "fastlow"
+	//Enhanced RTMP, 播放器支持的视频编码, 如fourCcList=hvc1,av01
+	if fcl := r.FormValue("fourCcList"); fcl != "" {
+		s.FourCcList = strings.Split(fcl, ",")
 	}
+	s.PlayStartMode = PlayStartModeParse(r.URL.RawQuery)
 
-	s.LogFn = fmt.Sprintf("%s/%s/play_flv_%s.log", conf.Log.StreamLogPath, sid, addr)
+	s.LogFn = fmt.Sprintf("%s/%s/play_flv_%s.log", Conf().Log.StreamLogPath, sid, addr)
 	s.log, s.LogFp, err = StreamLogCreate(s.LogFn)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 	p.Wg.Add(1)
+	s.Puber = p
+	s.Ctx, s.Cancel = context.WithCancel(context.Background())
 	//先启动播放转发协程, 再添加到发布者的players里
-	s.PlayChan = make(chan *Chunk, conf.PlayStockMax)
+	s.PlayChan = make(chan *Chunk, Conf().PlayStockMax)
 	//要通过w发送数据给播放器, 所以这个http请求不能提前结束
 	exitChan := make(chan int)
 	defer close(exitChan)
@@ -223,6 +252,7 @@ func GetFlv(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 
 	s.Key = fmt.Sprintf("%s_%s_%s", app, sid, addr)
 	s.log.Printf("player key is %s, AesKey=%s, Bitrate=%dkbps", s.Key, p.PubAuth.Data.AesKey, p.GopBitrate)
+	s.BeginTime = utils.GetTimestamp("ms")
 	p.Players.Store(s.Key, s)
 
 	<-exitChan //阻塞等待 结束http请求
@@ -257,7 +287,8 @@ func GetFlv(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 		PlayLocks.Unlock()
 	}
 
-	return nil, err
+	//数据已经通过w发送, 不能再写响应
+	return nil, ErrHttpSent
 }
 
 /**********************************************************/
@@ -363,35 +394,13 @@ func GopCacheFastlowSendFlv(pub, s *Stream, gop *GopCache) error {
 	h.PreTagSize = 0x0
 	s.log.Printf("%#v", h)
 
-	//TODO: use sync.Mutex
-	goplocks.Lock()
-	var chunkNum, videoChunkNum, audioChunkNum int
-	var lastChunk, videoChunk, audioChunk Chunk
-	for e := gop.MediaData.Back(); e != nil; e = e.Prev() {
-		c := (e.Value).(*Chunk)
-		if chunkNum == 0 {
-			lastChunk = *c
-		}
-		chunkNum++
-		if videoChunkNum == 0 && (c.DataType == "VideoKeyFrame" || c.DataType == "VideoInterFrame") {
-			videoChunk = *c
-			videoChunkNum++
-		}
-		if audioChunkNum == 0 && c.DataType == "AudioAacFrame" {
-			audioChunk = *c
-			audioChunkNum++
-		}
-		s.log.Printf("<== videoChunkNum :%d, audioChunkNum %d: DataType:%s, Timestamp:%d", videoChunkNum, audioChunkNum, c.DataType, c.Timestamp)
-		if videoChunkNum > 0 && audioChunkNum > 0 {
-			break
-		}
-	}
-	s.log.Printf("<== videoChunkNum :%d, audioChunkNum %d", videoChunkNum, audioChunkNum)
+	//从缓存中最新的关键帧开始发送, 见GopStartChunks()
+	cs := GopStartChunks(gop, StartModeFastlow)
+	s.log.Printf("<== GopCacheFastlowSendFlv() ChunkNum=%d", len(cs))
 
 	//当推流数据没来VideoHeader等数据时, 这时候播放应该失败
 	err := FlvSendHead(s, h)
 	if err != nil {
-		goplocks.Unlock()
 		return err
 	}
 
@@ -400,54 +409,35 @@ func GopCacheFastlowSendFlv(pub, s *Stream, gop *GopCache) error {
 	if ok == false {
 		s.log.Printf("meta data is not exist %v", pub.Key)
 	} else {
-		v1 := v.(*Chunk)
-		if chunkNum > 0 {
-			s.log.Printf("<== set meta data timestamp %d to %d", v1.Timestamp, lastChunk.Timestamp)
-			v1.Timestamp = lastChunk.Timestamp
-			err = FlvSendMetaData(pub, s, *v1)
-			if err != nil {
-				goplocks.Unlock()
-				return err
-			}
-			timestamp = lastChunk.Timestamp
-		} else {
-			s.log.Printf("<== set meta data timestamp %d", v1.Timestamp)
-			err = FlvSendMetaData(pub, s, *v1)
-			if err != nil {
-				goplocks.Unlock()
-				return err
-			}
-			timestamp = v1.Timestamp
+		v1 := *(v.(*Chunk))
+		timestamp = v1.Timestamp
+		if len(cs) > 0 {
+			timestamp = cs[0].Timestamp
+		}
+		s.log.Printf("<== set meta data timestamp %d to %d", v1.Timestamp, timestamp)
+		v1.Timestamp = timestamp
+		err = FlvSendMetaData(pub, s, v1)
+		if err != nil {
+			return err
 		}
 	}
-
-	if chunkNum > 0 {
-		timestamp = lastChunk.Timestamp
+	if len(cs) > 0 {
+		timestamp = cs[0].Timestamp
 	}
 	err = FlvSendMetaDataAes(pub, s, timestamp) // 发送解密信息
 	if err != nil {
-		goplocks.Unlock()
 		return err
 	}
+
 	v, ok = gop.VideoHeader.Load(pub.Key)
 	if ok == false {
 		s.log.Printf("video header is not exist %v", pub.Key)
 	} else {
-		v1 := v.(*Chunk)
-		if videoChunkNum > 0 {
-			s.log.Printf("<== set video header timestamp %d to %d", v1.Timestamp, videoChunk.Timestamp)
-			v1.Timestamp = videoChunk.Timestamp
-			err = FlvSendVideoHead(pub, s, *v1)
-			if err != nil {
-				goplocks.Unlock()
-				return err
-			}
-		} else {
-			err = FlvSendVideoHead(pub, s, *v1)
-			if err != nil {
-				goplocks.Unlock()
-				return err
-			}
+		v1 := *(v.(*Chunk))
+		v1.Timestamp = timestamp
+		err = FlvSendVideoHead(pub, s, v1)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -455,43 +445,23 @@ func GopCacheFastlowSendFlv(pub, s *Stream, gop *GopCache) error {
 	if ok == false {
 		s.log.Printf("audio header is not exist %v", pub.Key)
 	} else {
-		v1 := v.(*Chunk)
-		if audioChunkNum > 0 {
-			s.log.Printf("<== set audio header timestamp %d to %d", v1.Timestamp, audioChunk.Timestamp)
-			v1.Timestamp = audioChunk.Timestamp
-			err = FlvSendAudioHead(pub, s, *v1)
-			if err != nil {
-				goplocks.Unlock()
-				return err
-			}
-
-			//need send one audio chuck, some player need audio data to initial
-			err = MessageSendFlv(pub, s, audioChunk)
-			if err != nil {
-				s.log.Println(err)
-				goplocks.Unlock()
-				return err
-			}
-		} else {
-			if videoChunkNum > 0 {
-				s.log.Printf("<== set audio header timestamp %d to %d", v1.Timestamp, videoChunk.Timestamp)
-				v1.Timestamp = videoChunk.Timestamp
-			}
-			err = FlvSendAudioHead(pub, s, *v1)
-			if err != nil {
-				goplocks.Unlock()
-				return err
-			}
+		v1 := *(v.(*Chunk))
+		v1.Timestamp = timestamp
+		err = FlvSendAudioHead(pub, s, v1)
+		if err != nil {
+			return err
 		}
 	}
 
-	if gop.MediaData.Len() > 0 {
-		err = FlvSendFastlowData(pub, s, gop.MediaData, videoChunk.Timestamp)
-	}
-	goplocks.Unlock()
-	if err != nil {
-		return err
+	for i := 0; i < len(cs); i++ {
+		err = MessageSendFlv(pub, s, cs[i])
+		if err != nil {
+			s.log.Println(err)
+			return err
+		}
+		s.log.Printf("<== Send %d: DataType:%s, MsgLength:%d, Timestamp:%d", i, cs[i].DataType, cs[i].MsgLength, cs[i].Timestamp)
 	}
+	s.log.Println("<== GopCache MediaData send ok")
 	return nil
 }
 
@@ -530,7 +500,7 @@ func GopCacheSendFlv(pub, s *Stream, gop *GopCache) error {
 			videoChunk = *c
 			videoChunkNum++
 		}
-		if audioChunkNum == 0 && c.DataType == "AudioAacFrame" {
+		if audioChunkNum == 0 && AudioFrameCheck(c.DataType) {
 			audioChunk = *c
 			audioChunkNum++
 		}
@@ -719,34 +689,6 @@ func FlvSendAudioHead(pub, s *Stream, c Chunk) error {
 	return nil
 }
 
-func FlvSendFastlowData(pub, s *Stream, md *list.List, timestamp uint32) error {
-	s.log.Printf("<== GopCache MediaData Len=%d", md.Len())
-	var err error
-	if md == nil {
-		err = fmt.Errorf("error: MediaData list is nil")
-		s.log.Println(err)
-		return err
-	}
-
-	i := 0
-	for e := md.Front(); e != nil; e = e.Next() {
-		c := (e.Value).(*Chunk)
-		if c.DataType == "AudioAacFrame" {
-			continue
-		}
-		c.Timestamp = timestamp
-		err = MessageSendFlv(pub, s, *c)
-		if err != nil {
-			s.log.Println(err)
-			return err
-		}
-		s.log.Printf("<== Send %d: DataType:%s, MsgLength:%d, Timestamp:%d", i, c.DataType, c.MsgLength, c.Timestamp)
-		i++
-	}
-	s.log.Println("<== GopCache MediaData send ok")
-	return nil
-}
-
 func FlvSendData(pub, s *Stream, md *list.List) error {
 	s.log.Printf("<== GopCache MediaData Len=%d", md.Len())
 	var err error
@@ -795,6 +737,8 @@ func AesEncrypt(orgData, key, iv []byte) []byte {
 
 // s是发布者, p是播放者
 func MessageSendFlv(s, p *Stream, c Chunk) error {
+	c = *ExVideoTagForPlayer(p, &c)
+
 	var t FlvTag
 	t.TagType = uint8(c.MsgTypeId)
 	t.DataSize = c.MsgLength
@@ -851,20 +795,20 @@ func MessageSendFlv(s, p *Stream, c Chunk) error {
 	ck.MsgData = buf[:]
 
 	//发送数据给播放者
-	if len(p.PlayChan) < conf.PlayStockMax {
+	if len(p.PlayChan) < Conf().PlayStockMax {
 		p.PlayChan <- &ck
 	} else {
-		p.log.Printf("PlayChanNum=%d(%d), DropDataType=%s", len(p.PlayChan), conf.PlayStockMax, c.DataType)
+		p.log.Printf("PlayChanNum=%d(%d), DropDataType=%s", len(p.PlayChan), Conf().PlayStockMax, c.DataType)
 	}
 
 	//为了 play_flv_xxx.log 能有周期性打印
 	p.FlvSendDataSize += c.MsgLength
-	if p.FlvSendDataSize >= conf.Flv.FlvSendDataSize {
-		p.log.Printf("send data %d(2MB) + %d byte", conf.Flv.FlvSendDataSize, p.FlvSendDataSize-conf.Flv.FlvSendDataSize)
+	if p.FlvSendDataSize >= Conf().Flv.FlvSendDataSize {
+		p.log.Printf("send data %d(2MB) + %d byte", Conf().Flv.FlvSendDataSize, p.FlvSendDataSize-Conf().Flv.FlvSendDataSize)
 		p.FlvSendDataSize = 0
 	}
 
-	if conf.Nt.Enable == false {
+	if Conf().Nt.Enable == false {
 		return nil
 	}
 
@@ -875,7 +819,7 @@ func MessageSendFlv(s, p *Stream, c Chunk) error {
 		p.StartTime = cTime
 	}
 	p.Duration = cTime - p.StartTime
-	if p.Duration >= conf.Nt.Interval {
+	if p.Duration >= Conf().Nt.Interval {
 		go TrafficReport(p, p.TrafficInfo, "play", "http-flv")
 		p.StartTime = cTime
 		p.DataSize = 0
@@ -18,7 +18,7 @@ func NewGb28181Stream(key string, rqst GbRqst) (*Stream, error) {
 	s.Type = "GbPub"
 	s.GbRqst = rqst
 
-	s.LogFn = fmt.Sprintf("%s/%s/GbPub_%s.log", conf.Log.StreamLogPath, rqst.StreamId, utils.GetYMD())
+	s.LogFn = fmt.Sprintf("%s/%s/GbPub_%s.log", Conf().Log.StreamLogPath, rqst.StreamId, utils.GetYMD())
 	s.log, s.LogFp, _ = StreamLogCreate(s.LogFn)
 	return &s, nil
 }
@@ -32,26 +32,24 @@ func NewGb28181Stream(key string, rqst GbRqst) (*Stream, error) {
 //每路流都有一个唯一的streamId和一个唯一的ssrc
 //cc下发任务	必带streamId 不定ssrc, del接口就没有
 //设备推流上来	必无streamId 必带ssrc
-//Stream代表每路流, StreamMap是sync.Map类型全局变量
-//map的key用ssrc时     接收音视频数据方便, 但是处理cc任务不方便
-//map的key用streamId时 接收音视频数据不方便, 但是处理cc任务方便
-//由于map不能同时有2个key
-//所以最总 使用两个map来存放 并且 增加互相查找的函数
-//StreamMap key:StreamId, val:Stream
-//SsrcMap   key:uint32,	  val:*Stream
-var (
-	StreamMap sync.Map
-	SsrcMap   sync.Map
-)
+//Stream代表每路流, 存在StreamHub的HubStream.Gb里, key为streamId 处理cc任务方便
+//接收音视频数据时 按ssrc遍历StreamHub查找, 不再单独用map存ssrc
+
+//停止接收gb28181的流, 设备还在推流 需要cc发送BYE
+func Gb28181Stop(s *Stream) {
+	HubGbDelete(s)
+
+	//关闭连接, RtpRecvTcp()接收出错后 释放资源
+	if s.Conn0 != nil {
+		s.Conn0.Close()
+	}
+}
 
 func SsrcFindStream(ssrc uint32) (*Stream, error) {
-	var err error
-	v, ok := SsrcMap.Load(ssrc)
+	s, ok := HubGbBySsrc(ssrc)
 	if ok == false {
-		err = fmt.Errorf("unkonw ssrc %.10d", ssrc)
-		return nil, err
+		return nil, fmt.Errorf("unkonw ssrc %.10d", ssrc)
 	}
-	s := v.(*Stream)
 	return s, nil
 }
 
@@ -75,6 +73,8 @@ type GbPub struct {
 	RtpTsCurt   uint32   //当前rtp包的时间戳
 	RtpPkgCache sync.Map //期待rtp序号为10的包, 来了序号为11的包, 要先缓存上
 
+	RtpSeqStat RtpSeqStat //rtp丢包和乱序统计, 见metrics.go
+
 	AhcFlag bool //AudioHeaderChangeFlag
 	VhcFlag bool //VideoHeaderChangeFlag
 }
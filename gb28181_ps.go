@@ -400,10 +400,10 @@ func ParsePs(s *Stream, pps *PsPacket) error {
 			continue
 		}
 
-		if len(s.PsPktChan) < conf.RtpRtcp.PsPktChanNum {
+		if len(s.PsPktChan) < Conf().RtpRtcp.PsPktChanNum {
 			s.PsPktChan <- pp
 		} else {
-			s.log.Printf("PsPktChanLen=%d, MaxLen=%d", len(s.PsPktChan), conf.RtpRtcp.PsPktChanNum)
+			s.log.Printf("PsPktChanLen=%d, MaxLen=%d", len(s.PsPktChan), Conf().RtpRtcp.PsPktChanNum)
 		}
 	}
 	return nil
@@ -10,7 +10,61 @@ import (
 /*************************************************/
 /* Gb28181媒体数据走内存发送给自己RtmpServer
 /*************************************************/
+//作为内存发布者发布到StreamHub, metadata和音视频头的处理 同GbNetPushRtmp()
+//PsPktChan关闭 或 发布者被踢掉 就停止发布
 func Gb281812Mem2RtmpServer(s *Stream) {
+	app := s.App
+	if app == "" {
+		app = "live"
+	}
+
+	sm, err := HubMemPuberNew(app, s.StreamId, "gb28181")
+	if err != nil {
+		s.log.Println(err)
+		return
+	}
+	err = HubPublish(sm)
+	if err != nil {
+		s.log.Println(err)
+		RtmpPublishStop1(sm)
+		return
+	}
+	s.log.Printf("publish %s to StreamHub", s.StreamId)
+
+	//TODO 此处metadata不包含音视频参数
+	_, err = CreateSendMetaData(sm)
+	if err != nil {
+		s.log.Println(err)
+	}
+
+	var p *PsPacket
+	var ok bool
+	for {
+		p, ok = <-s.PsPktChan
+		if ok == false {
+			sm.log.Printf("%s, Gb281812Mem2RtmpServer() stop", sm.StreamId)
+			HubUnpublish(sm)
+			return
+		}
+		if sm.TransmitSwitch == "off" {
+			//ParsePs()写PsPktChan不阻塞, 不用读走
+			sm.log.Printf("%s, Gb281812Mem2RtmpServer() stop, publisher is kicked", sm.StreamId)
+			HubUnpublish(sm)
+			return
+		}
+		//sm.log.Printf("PsType=%s, PsTs=%d, PsLen=%d, PsData=%x", p.Type, p.Timestamp, len(p.Data), p.Data)
+		sm.log.Printf("PsType=%s, PsTs=%d, PsLen=%d", p.Type, p.Timestamp, len(p.Data))
+
+		switch p.Type {
+		case "video":
+			err = VideoHandler(s, sm, p)
+		case "audio":
+			err = AudioHandler(s, sm, p)
+		}
+		if err != nil {
+			sm.log.Println(err)
+		}
+	}
 }
 
 /*************************************************/
@@ -37,7 +91,7 @@ func RtmpConn(s *Stream) (*Stream, error) {
 	sm.App = s.App
 	sm.StreamId = s.StreamId
 
-	fn := fmt.Sprintf("%s/%s/publish_rtmp_%s.log", conf.Log.StreamLogPath, sm.StreamId, utils.GetYMD())
+	fn := fmt.Sprintf("%s/%s/publish_rtmp_%s.log", Conf().Log.StreamLogPath, sm.StreamId, utils.GetYMD())
 	StreamLogRename(sm.LogFn, fn)
 
 	sm.log.Println("==============================")
@@ -125,7 +179,7 @@ func AudioHandler(s, sm *Stream, p *PsPacket) error {
 	ck.Timestamp = p.Timestamp / 90
 
 	//sm.log.Printf("<-- aLen=%d, aData=%x", len(d), d)
-	err := MessageSplit(sm, ck, false)
+	err := PuberMsgSend(sm, ck, false)
 	if err != nil {
 		sm.log.Println(err)
 		return err
@@ -160,7 +214,7 @@ func CreateSendMetaData(sm *Stream) ([]byte, error) {
 	//sm.log.Printf("MetaData:%s", string(d)) //有乱码
 
 	rc := CreateMessage(MsgTypeIdDataAmf0, uint32(len(d)), d)
-	err = MessageSplit(sm, &rc, true)
+	err = PuberMsgSend(sm, &rc, true)
 	if err != nil {
 		sm.log.Println(err)
 		return nil, err
@@ -426,7 +480,7 @@ func HandleAvcSequenceHeader(s, sm *Stream, p *PsPacket, nis []*NaluInfo) error
 		ck.Timestamp = p.Timestamp / 90
 
 		sm.log.Printf("<-- SeqHeadLen=%d, SeqHeadData=%x", len(s.AvcSH), s.AvcSH)
-		err := MessageSplit(sm, ck, true)
+		err := PuberMsgSend(sm, ck, true)
 		if err != nil {
 			sm.log.Println(err)
 			return err
@@ -480,7 +534,7 @@ func VideoHandler(s, sm *Stream, p *PsPacket) error {
 	ck.Timestamp = p.Timestamp / 90
 
 	//sm.log.Printf("<-- vLen=%d, vData=%x", len(ds), ds[:50])
-	err = MessageSplit(sm, ck, false)
+	err = PuberMsgSend(sm, ck, false)
 	if err != nil {
 		sm.log.Println(err)
 		return err
@@ -508,6 +562,8 @@ func GbNetPushRtmp(s *Stream) {
 		p, ok = <-s.PsPktChan
 		if ok == false {
 			sm.log.Printf("%s, GbNetPushRtmp() stop", sm.StreamId)
+			//断开rtmp推流, 否则rtmp发布者会一直存在
+			RtmpStop(sm)
 			break
 		}
 		//sm.log.Printf("PsType=%s, PsTs=%d, PsLen=%d, PsData=%x", p.Type, p.Timestamp, len(p.Data), p.Data)
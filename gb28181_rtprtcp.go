@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"utils"
 )
 
 func PrintList(s *Stream, l *list.List) {
@@ -138,11 +139,10 @@ func RtpReceiverUdp(c *net.UDPConn) {
 }
 
 func RtpServerUdp() {
-	addr := fmt.Sprintf(":%d", conf.RtpRtcp.FixedRtpPort)
+	addr := fmt.Sprintf(":%d", Conf().RtpRtcp.FixedRtpPort)
 	log.Printf("listen rtp(udp) on %s", addr)
 
-	laddr, _ := net.ResolveUDPAddr("udp", addr)
-	l, err := net.ListenUDP("udp", laddr)
+	l, err := UpgradeListenPacket(nil, "rtp_udp", "udp", addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -168,11 +168,13 @@ func GbRtpPktHandler(s *Stream) {
 		rp, ok = <-s.RtpPktChan
 		if ok == false {
 			s.log.Printf("GbRtpPktHandler() stop")
+			close(s.PsPktChan)
 			break
 		}
 		//s.log.Printf("--> RtpLen=%d(0x%x), SeqNum=%d, Pt=%s(%d), Ts=%d, Mark=%d", rp.Len, rp.Len, rp.SeqNum, rp.PtStr, rp.PayloadType, rp.Timestamp, rp.Marker)
 		//s.log.Printf("rtpData:%x", rp.Data)
 
+		RtpSeqCount("gb28181", &s.RtpSeqStat, rp.SeqNum)
 		if s.RtpPktNeedSeq != rp.SeqNum {
 			s.log.Printf("RtpPktNeedSeq(%d) != RtpSeq(%d)", s.RtpPktNeedSeq, rp.SeqNum)
 		}
@@ -204,7 +206,7 @@ func GbRtpPktHandler(s *Stream) {
 		}
 		//s.log.Printf("PsPkt type=%s, dLen=%d, PsTs=%d, RtpPktCrtTs=%d ", pp.Type, len(pp.Data), pp.Timestamp, s.RtpPktCrtTs)
 
-		//通过chan发送给GbNetPushRtmp()
+		//通过chan发送给Gb281812Mem2RtmpServer()或GbNetPushRtmp()
 		err = ParsePs(s, pp)
 		if err != nil {
 			s.log.Println(err)
@@ -230,8 +232,7 @@ func RtpRecvTcp(c net.Conn) {
 			if s != nil {
 				s.log.Println(err)
 				//TODO: 释放资源
-				StreamMap.Delete(s.Key)
-				SsrcMap.Delete(s.RtpSsrcUint)
+				HubGbDelete(s)
 			}
 			break
 		}
@@ -267,8 +268,8 @@ func RtpRecvTcp(c net.Conn) {
 
 			s.Conn0 = c
 			s.RemoteAddr = c.RemoteAddr().String()
-			s.RtpPktChan = make(chan *RtpPacket, conf.RtpRtcp.RtpPktChanNum)
-			s.PsPktChan = make(chan *PsPacket, conf.RtpRtcp.PsPktChanNum)
+			s.RtpPktChan = make(chan *RtpPacket, Conf().RtpRtcp.RtpPktChanNum)
+			s.PsPktChan = make(chan *PsPacket, Conf().RtpRtcp.PsPktChanNum)
 			s.RtpPktNeedSeq = rp.SeqNum
 			s.RtpPktCrtTs = int64(rp.Timestamp)
 
@@ -276,25 +277,35 @@ func RtpRecvTcp(c net.Conn) {
 			s.log.Printf("rAddr=%s, ssrc=%.10d, streamId=%s", s.RemoteAddr, rp.Ssrc, s.Key)
 			s.log.Printf("%#v", rp.RtpHeader)
 
-			//go GbMemPushRtmp(s)
-			go GbNetPushRtmp(s)
+			if Conf().RtpRtcp.MemPush == true {
+				go Gb281812Mem2RtmpServer(s)
+			} else {
+				go GbNetPushRtmp(s)
+			}
 			go GbRtpPktHandler(s)
 		}
 		i++
+		s.RecvLastTime = utils.GetTimestamp("ms")
 
-		if len(s.RtpPktChan) < conf.RtpRtcp.RtpPktChanNum {
+		if len(s.RtpPktChan) < Conf().RtpRtcp.RtpPktChanNum {
 			s.RtpPktChan <- rp
 		} else {
-			s.log.Printf("RtpPktChanLen=%d, MaxLen=%d", len(s.RtpPktChan), conf.RtpRtcp.RtpPktChanNum)
+			s.log.Printf("RtpPktChanLen=%d, MaxLen=%d", len(s.RtpPktChan), Conf().RtpRtcp.RtpPktChanNum)
 		}
 	}
+
+	//RtpPktChan只有这里写入, 关闭后 GbRtpPktHandler() Gb281812Mem2RtmpServer()/GbNetPushRtmp() 依次退出
+	c.Close()
+	if s != nil && s.RtpPktChan != nil {
+		close(s.RtpPktChan)
+	}
 }
 
 func RtpServerTcp() {
-	addr := fmt.Sprintf(":%d", conf.RtpRtcp.FixedRtpPort)
+	addr := fmt.Sprintf(":%d", Conf().RtpRtcp.FixedRtpPort)
 	log.Printf("listen rtp(tcp) on %s", addr)
 
-	l, err := net.Listen("tcp", addr)
+	l, err := UpgradeListen(nil, "rtp_tcp", "tcp", addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -304,6 +315,9 @@ func RtpServerTcp() {
 		c, err = l.Accept()
 		if err != nil {
 			log.Println(err)
+			if UpgradeStopped() == true {
+				return
+			}
 			continue
 		}
 		log.Println("------ new rtp(tcp) connect ------")
@@ -334,8 +348,7 @@ func RtcpRecvTcp(c net.Conn) {
 			if s != nil {
 				s.log.Println(err)
 				//TODO: 释放资源
-				StreamMap.Delete(s.Key)
-				SsrcMap.Delete(s.RtpSsrcUint)
+				HubGbDelete(s)
 			}
 			break
 		}
@@ -352,10 +365,10 @@ func RtcpRecvTcp(c net.Conn) {
 }
 
 func RtcpServerTcp() {
-	addr := fmt.Sprintf(":%d", conf.RtpRtcp.FixedRtcpPort)
+	addr := fmt.Sprintf(":%d", Conf().RtpRtcp.FixedRtcpPort)
 	log.Printf("listen rtcp(tcp) on %s", addr)
 
-	l, err := net.Listen("tcp", addr)
+	l, err := UpgradeListen(nil, "rtcp_tcp", "tcp", addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -365,6 +378,9 @@ func RtcpServerTcp() {
 		c, err = l.Accept()
 		if err != nil {
 			log.Println(err)
+			if UpgradeStopped() == true {
+				return
+			}
 			continue
 		}
 		log.Println("------ new rtcp(tcp) connect ------")
@@ -12,6 +12,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"utils"
 )
@@ -317,48 +318,79 @@ func GetPlayInfo(url string) (string, string, string) {
 		if len(s) < 3 {
 			return "", "", ""
 		}
-		ss := strings.Split(s[2], ".")
-		if len(ss) < 1 {
-			return "", "", ""
-		}
-		return s[1], ss[0], s[2] // /app, streamid, fn
+		//streamId里可能有., 只去掉扩展名
+		return s[1], strings.TrimSuffix(s[2], ext), s[2] // /app, streamid, fn
 	case ".ts":
 		dir := path.Dir(p[0]) // /app
-		fn := path.Base(p[0]) // streamid_0.ts
-		s := strings.Split(fn, "_")
-		return dir, s[0], fn
+		fn := path.Base(p[0]) // streamid_20230101120000_0.ts
+		//streamId里可能有_, 去掉最后两段
+		sid := strings.TrimSuffix(fn, ext)
+		for i := 0; i < 2; i++ {
+			if n := strings.LastIndex(sid, "_"); n > 0 {
+				sid = sid[:n]
+			}
+		}
+		return dir, sid, fn
 	}
 	return "", "", ""
 }
 
 func GetTs(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	//app, stream, fn := GetPlayInfo(r.URL.String())
-	//file := fmt.Sprintf("%s/%s_%s/%s", conf.HlsLive.MemPath, app, stream, fn)
-	_, stream, fn := GetPlayInfo(r.URL.String())
-	file := fmt.Sprintf("%s/%s/%s", conf.HlsLive.MemPath, stream, fn)
+	//file := fmt.Sprintf("%s/%s_%s/%s", Conf().HlsLive.MemPath, app, stream, fn)
+	dir, stream, fn := GetPlayInfo(r.URL.String())
+	file := fmt.Sprintf("%s/%s/%s", Conf().HlsLive.MemPath, stream, fn)
 	log.Println(file)
 
+	//ts地址里的sign和expire 是GetM3u8()加上的
+	err := PlaySignCheck(strings.TrimPrefix(dir, "/"), stream, r.URL.RawQuery, r.RemoteAddr)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
 	d, err := utils.ReadAllFile(file)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
+	HlsVisit(stream)
+	HlsSessionVisit(stream, r.RemoteAddr)
+	MetricsAdd(MetricsOutBytes, "hls", uint64(len(d)))
+	if p, ok := HubPuberGet(stream); ok == true {
+		atomic.AddUint64(&p.OutBytes, uint64(len(d)))
+	}
 	return d, nil
 }
 
 // HTTP/1.1 GET /SP3bnx69BgxI/GSP3bnx69BgxI-gCec0oMfJT.m3u8?mediaServerIp=172.20.25.20&codeType=H264
 func GetM3u8(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	//app, stream, fn := GetPlayInfo(r.URL.String())
-	//file := fmt.Sprintf("%s/%s_%s/%s", conf.HlsLive.MemPath, app, stream, fn)
-	_, stream, fn := GetPlayInfo(r.URL.String())
-	file := fmt.Sprintf("%s/%s/%s", conf.HlsLive.MemPath, stream, fn)
+	//file := fmt.Sprintf("%s/%s_%s/%s", Conf().HlsLive.MemPath, app, stream, fn)
+	app, stream, fn := GetPlayInfo(r.URL.String())
+	file := fmt.Sprintf("%s/%s/%s", Conf().HlsLive.MemPath, stream, fn)
 	log.Println(file)
 
+	//播放地址签名不对的, HttpErrorSend()返回403
+	err := PlaySignCheck(app, stream, r.URL.RawQuery, r.RemoteAddr)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
 	d, err := utils.ReadAllFile(file)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
+	//新的hls会话 超过播放者个数限制, HttpErrorSend()返回503, 被踢掉的 回调拒绝的返回403
+	err = HlsSessionAdmit(app, stream, r.RemoteAddr, r.URL.RawQuery)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	HlsVisit(stream)
+	//startmode=low 或 startmode=fastlow, 在m3u8末尾选择ts
+	d = M3u8StartTrim(d, PlayStartModeParse(r.URL.RawQuery))
+	d = M3u8SignAdd(d, r.URL.RawQuery)
 	log.Println(string(d))
 	return d, nil
 }
@@ -405,8 +437,9 @@ func M3u8Update(s *Stream) {
 	if s.TsPath == "" {
 		return
 	}
+	MetricsHistObserve(MetricsHlsDur["rec"], s.TsExtInfo)
 	//s.TsNum 初始值为0, conf.Hls.M3u8TsNum 通常为6
-	if s.TsNum >= uint32(conf.HlsRec.M3u8TsNum) {
+	if s.TsNum >= uint32(Conf().HlsRec.M3u8TsNum) {
 		e := s.TsList.Front()
 		// 如果不开启录制, 我们要删除ts文件
 		// 如果开启录制, 我们不能删除ts文件, 由上传程序删除
@@ -445,7 +478,7 @@ func M3u8Update(s *Stream) {
 	//if 中有多个 && 或者 || 的执行顺序是?
 	//对于&&, 从左往右, 遇到一个false, 则停止其它条件的判断, 返回false
 	//对于||, 从左往右, 如果遇到一个true, 则停止其它条件的判断, 返回true
-	if conf.Mqtt.Enable == true && s.PubAuth.Data.HlsUpload == 1 {
+	if Conf().Mqtt.Enable == true && s.PubAuth.Data.HlsUpload == 1 {
 		tiStrs := fmt.Sprintf("%s\n", tiStr)
 		tis := TsInfo{tiStrs, s.TsExtInfo, "", 0}
 		tis.TsRecType = s.PubAuth.Data.RecordType
@@ -457,6 +490,9 @@ func M3u8Update(s *Stream) {
 			s.log.Printf("TsInfoChan ChanNum=%d overflow", len(TsInfoChan))
 		}
 	}
+	if s.PubAuth.Data.HlsUpload == 1 {
+		HookRecord(s)
+	}
 	tiStr = fmt.Sprintf("%s\n", tiStr)
 	ti := TsInfo{tiStr, s.TsExtInfo, "", 0}
 	ti.TsFilepath = s.TsPath
@@ -1110,7 +1146,7 @@ func TsPacketCreate(s *Stream, c Chunk, data []byte, pcr uint64, first bool) ([]
 	}
 	th.TransportPriority = 0x0
 	th.PID = VideoPid
-	if c.DataType == "AudioAacFrame" {
+	if AudioFrameCheck(c.DataType) {
 		th.PID = AudioPid
 	}
 	th.TransportScramblingControl = 0x0
@@ -1456,7 +1492,7 @@ func PesDataCreateVideoFrame(s *Stream, c Chunk, phd []byte) []byte {
 		e0 += 4
 	}
 
-	if strings.Contains(s.Key, conf.Debug.StreamId) {
+	if strings.Contains(s.Key, Conf().Debug.StreamId) {
 		s.log.Printf("%s write in dType=%s, NaluNum=%d, dLen=%d", path.Base(s.TsPath), c.DataType, c.NaluNum, len(data))
 	}
 	return data
@@ -1498,6 +1534,18 @@ func PesDataCreateAacFrame(s *Stream, c Chunk, phd []byte) []byte {
 	return data
 }
 
+//mp3帧自带帧头, 不需要adts, pes header后直接放rtmp音频数据(去掉1字节音频头)
+func PesDataCreateMp3Frame(s *Stream, c Chunk, phd []byte) []byte {
+	if len(c.MsgData) < 2 {
+		s.log.Printf("mp3 frame len %d less then 2", len(c.MsgData))
+		return nil
+	}
+	data := make([]byte, len(phd)+len(c.MsgData)-1)
+	copy(data, phd)
+	copy(data[len(phd):], c.MsgData[1:])
+	return data
+}
+
 /*************************************************/
 /* pat
 /*************************************************/
@@ -1654,6 +1702,9 @@ func PmtCreate(s *Stream) (*Pmt, []byte) {
 	//if s.AudioCodecType != "" && s.VideoCodecType != "" { //音视频都有
 	pmt.PmtStream = make([]PmtStream, 2)
 	pmt.PmtStream[0].StreamType = 0xf
+	if s.AudioCodecType == "MP3" && s.AudioStreamType != 0 {
+		pmt.PmtStream[0].StreamType = s.AudioStreamType
+	}
 	pmt.PmtStream[0].Reserved4 = 0x7
 	pmt.PmtStream[0].ElementaryPID = AudioPid
 	pmt.PmtStream[0].Reserved5 = 0xf
@@ -1790,7 +1841,7 @@ func TsFileCreate(s *Stream, c Chunk) {
 	}
 
 	TsFileAppend(s, c)
-	if s.AudioChunk.DataType == "AudioAacFrame" {
+	if AudioFrameCheck(s.AudioChunk.DataType) {
 		//s.log.Printf("create ts about add audio chunk after video")
 		TsFileAppend(s, s.AudioChunk)
 		s.AudioChunk.DataType = ""
@@ -1812,6 +1863,8 @@ func TsFileAppend(s *Stream, c Chunk) {
 		pesData = PesDataCreateVideoFrame(s, c, pesHeaderData)
 	case "AudioAacFrame":
 		pesData = PesDataCreateAacFrame(s, c, pesHeaderData)
+	case "AudioMp3Frame":
+		pesData = PesDataCreateMp3Frame(s, c, pesHeaderData)
 	}
 
 	pesDataLen := len(pesData)
@@ -1916,8 +1969,8 @@ func TsCreate(s *Stream, c Chunk) bool {
 	//这是最后的保障, 为了纠正上面对时间戳计算可能发生的错误 或 其他意外情况
 	//1小时=3600秒=3600000毫秒
 	if s.TsPath != "" && dv >= 3600000 {
-		s.log.Printf("dv >= 3600000ms, force dv = %fms", conf.HlsRec.TsMaxTime*1000)
-		dv = uint32(conf.HlsRec.TsMaxTime * 1000)
+		s.log.Printf("dv >= 3600000ms, force dv = %fms", Conf().HlsRec.TsMaxTime*1000)
+		dv = uint32(Conf().HlsRec.TsMaxTime * 1000)
 	}
 
 	//rtmp里的timestamp单位是毫秒, 除以1000变为秒
@@ -1925,9 +1978,9 @@ func TsCreate(s *Stream, c Chunk) bool {
 	//TODO: when all of the video timestamp is equal to zero, force set ts duration.
 	//when ts size is equal to 10MB, suppose bitrate is 3Mb, the duration is about 30s
 	if dv == 0 {
-		if s.TsMaxCutSize >= conf.HlsRec.TsMaxSize && c.DataType == "VideoKeyFrame" {
+		if s.TsMaxCutSize >= Conf().HlsRec.TsMaxSize && c.DataType == "VideoKeyFrame" {
 			s.TsExtInfo = 30
-		} else if s.TsMaxCutSize >= 2*conf.HlsRec.TsMaxSize {
+		} else if s.TsMaxCutSize >= 2*Conf().HlsRec.TsMaxSize {
 			s.TsExtInfo = 60
 		}
 	}
@@ -1940,17 +1993,26 @@ func TsCreate(s *Stream, c Chunk) bool {
 	//纯音频支持切片
 	_, ok = s.GopCache.VideoHeader.Load(s.Key)
 	//s.log.Printf("test andrew res:%v, key:%s, type:%s, %v", ok, s.Key, c.DataType, s.TsExtInfo)
-	if s.TsPath == "" || (s.TsExtInfo >= float64(conf.HlsRec.TsMaxTime) && c.DataType == "VideoKeyFrame") || s.TsExtInfo >= float64(3*conf.HlsRec.TsMaxTime) ||
-		(s.TsMaxCutSize >= conf.HlsRec.TsMaxSize && c.DataType == "VideoKeyFrame") || s.TsMaxCutSize >= 2*conf.HlsRec.TsMaxSize ||
-		(ok == false && s.TsExtInfo >= float64(conf.HlsRec.TsMaxTime) && c.DataType == "AudioAacFrame") {
+	//发布者断线重连后, 从首个关键帧(纯音频为首个音频帧)切新的ts, 新ts前加一个#EXT-X-DISCONTINUITY
+	resume := false
+	if s.HlsResume == true && (c.DataType == "VideoKeyFrame" || (ok == false && AudioFrameCheck(c.DataType))) {
+		s.HlsResume = false
+		resume = true
+	}
+	if resume == true || s.TsPath == "" || (s.TsExtInfo >= float64(Conf().HlsRec.TsMaxTime) && c.DataType == "VideoKeyFrame") || s.TsExtInfo >= float64(3*Conf().HlsRec.TsMaxTime) ||
+		(s.TsMaxCutSize >= Conf().HlsRec.TsMaxSize && c.DataType == "VideoKeyFrame") || s.TsMaxCutSize >= 2*Conf().HlsRec.TsMaxSize ||
+		(ok == false && s.TsExtInfo >= float64(Conf().HlsRec.TsMaxTime) && AudioFrameCheck(c.DataType)) {
 		//s.log.Printf("create ts previous data type:%s, cur data type: %s", s.AudioChunk.DataType, c.DataType)
 		TsFileCreate(s, c)
+		if resume == true {
+			s.HlsAddDiscFlag = true
+		}
 		ok = true
 		s.TsMaxCutSize = 0
 	} else {
 		//s.log.Printf("append ts previous data type:%s, cur data type: %s", s.AudioChunk.DataType, c.DataType)
-		if c.DataType == "AudioAacFrame" {
-			if s.AudioChunk.DataType == "AudioAacFrame" {
+		if AudioFrameCheck(c.DataType) {
+			if AudioFrameCheck(s.AudioChunk.DataType) {
 				TsFileAppend(s, s.AudioChunk)
 			}
 			s.AudioChunk = c
@@ -2019,7 +2081,7 @@ func HlsCreator(s *Stream) {
 			s.log.Printf("publish stop then hls stop")
 			return
 		}
-		if strings.Contains(s.Key, conf.Debug.StreamId) {
+		if strings.Contains(s.Key, Conf().Debug.StreamId) {
 			s.log.Printf("HlsMsgIdx=%d, fmt=%d, csid=%d, ts=%d, MsgLen=%d, MsgTypeId=%d, DataType=%s, NaluNum=%d", i, c.Fmt, c.Csid, c.Timestamp, c.MsgLength, c.MsgTypeId, c.DataType, c.NaluNum)
 		}
 		i++
@@ -2035,17 +2097,32 @@ func HlsCreator(s *Stream) {
 				PrepareSpsPpsDataH265(s, &c)
 			default:
 			}
-			s.HlsAddDiscFlag = true
+			//断线重连时 在切ts的地方加, 这里不加
+			if s.HlsResume == false {
+				s.HlsAddDiscFlag = true
+			}
 			continue // 此数据不该直接写入ts
 		case "AudioHeader":
 			PrepareAdtsData(s, &c)
 			//ParseAdtsData(s)
-			s.HlsAddDiscFlag = true
+			//断线重连时 在切ts的地方加, 这里不加
+			if s.HlsResume == false {
+				s.HlsAddDiscFlag = true
+			}
 			continue // 此数据不该直接写入ts
 		default:
 			//这里是 音视频数据 和 未定义类型数据
 		}
 
+		//ts不支持av1和vp9, 这些视频数据不写入ts
+		if c.MsgTypeId == MsgTypeIdVideo && s.VideoCodecType != "H264" && s.VideoCodecType != "H265" {
+			continue
+		}
+		//ts只支持aac和mp3, g711和speex不写入ts
+		if c.MsgTypeId == MsgTypeIdAudio && s.AudioCodecType != "AAC" && s.AudioCodecType != "MP3" {
+			continue
+		}
+
 		TsCreate(s, c)
 	}
 }
@@ -2062,7 +2139,7 @@ func HlsLiveClear(dir string, s *Stream) {
 		}
 
 		curTime := time.Now().Unix()
-		if uint32(curTime-modTime) > conf.DelayDeleteThred {
+		if uint32(curTime-modTime) > Conf().DelayDeleteThred {
 			s.log.Println("hlslive delete m3u8 ", s.M3u8LivePath)
 			err = os.Remove(s.M3u8LivePath)
 			if err != nil {
@@ -2143,7 +2220,7 @@ func HlsLiveClear(dir string, s *Stream) {
 						tsName = line
 					}
 					tis := fmt.Sprintf("%s\n%s\n", tiStr, line)
-					TsFilepath = fmt.Sprintf("%s/%s/%s", conf.HlsLive.MemPath, s.AmfInfo.StreamId, tsName)
+					TsFilepath = fmt.Sprintf("%s/%s/%s", Conf().HlsLive.MemPath, s.AmfInfo.StreamId, tsName)
 
 					ti := TsInfo{tis, s.TsLiveExtInfo, "", 0}
 					ti.TsFilepath = TsFilepath
@@ -2165,7 +2242,7 @@ func HlsLiveClear(dir string, s *Stream) {
 					}
 					s.TsLiveLastSeq = uint32(v)
 					//s.log.Println("ts seq:", s.TsLiveLastSeq)
-					if s.TsLiveNum > uint32(conf.HlsLive.M3u8TsNum) {
+					if s.TsLiveNum > uint32(Conf().HlsLive.M3u8TsNum) {
 						e := s.TsLiveList.Front()
 						ti := (e.Value).(TsInfo)
 						s.TsLiveRemainName = ti.TsFilepath
@@ -2251,6 +2328,7 @@ func M3u8LiveUpdate(s *Stream) {
 	if s.TsLivePath == "" {
 		return
 	}
+	MetricsHistObserve(MetricsHlsDur["live"], s.TsLiveExtInfo)
 	if s.TsLiveRemainName != "" {
 		err := os.Remove(s.TsLiveRemainName)
 		if err != nil {
@@ -2259,7 +2337,7 @@ func M3u8LiveUpdate(s *Stream) {
 		//s.log.Printf("live delete ts %s", s.TsLiveRemainName)
 	}
 	//s.TsNum 初始值为0, conf.HlsLive.M3u8TsNum 至少为3
-	if s.TsLiveNum >= uint32(conf.HlsLive.M3u8TsNum) {
+	if s.TsLiveNum >= uint32(Conf().HlsLive.M3u8TsNum) {
 		e := s.TsLiveList.Front()
 		ti := (e.Value).(TsInfo)
 		s.TsLiveRemainName = ti.TsFilepath
@@ -2288,7 +2366,7 @@ func M3u8LiveUpdate(s *Stream) {
 	//s.log.Println(tiStr)
 
 	//ti := TsInfo{tiStr, s.TsLiveExtInfo, "", 0}
-	tiStr = fmt.Sprintf("%s?mediaServerIp=%s&codeType=%s\n", tiStr, conf.IpInner, s.VideoCodecType)
+	tiStr = fmt.Sprintf("%s?mediaServerIp=%s&codeType=%s\n", tiStr, Conf().IpInner, s.VideoCodecType)
 	ti := TsInfo{tiStr, s.TsLiveExtInfo, "", 0}
 	ti.TsFilepath = s.TsLivePath
 	s.TsLiveList.PushBack(ti)
@@ -2314,7 +2392,7 @@ func M3u8LiveUpdate(s *Stream) {
 			s.M3u8LiveFile.Close()
 			s.M3u8LiveFile = nil
 		}
-		dir := fmt.Sprintf("%s/%s", conf.HlsLive.MemPath, s.AmfInfo.StreamId)
+		dir := fmt.Sprintf("%s/%s", Conf().HlsLive.MemPath, s.AmfInfo.StreamId)
 		err := os.Mkdir(dir, 0755)
 		if err != nil {
 			s.log.Println(err)
@@ -2399,7 +2477,7 @@ func TsLiveFileCreate(s *Stream, c Chunk) {
 
 	//GSP3bnx69BgxI-avEc0oE4C4_44.ts
 	//GSP63nBbfmlbW-fnMebne7hU_20220222164158_29306.ts
-	s.TsLivePath = fmt.Sprintf("%s/%s/%s_%s_%d.ts", conf.HlsLive.MemPath, s.AmfInfo.StreamId, s.AmfInfo.StreamId, utils.GetYMDHMS(), s.TsLiveLastSeq)
+	s.TsLivePath = fmt.Sprintf("%s/%s/%s_%s_%d.ts", Conf().HlsLive.MemPath, s.AmfInfo.StreamId, s.AmfInfo.StreamId, utils.GetYMDHMS(), s.TsLiveLastSeq)
 
 	var err error
 	s.TsLiveFile, err = os.OpenFile(s.TsLivePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
@@ -2448,7 +2526,7 @@ func TsLiveFileCreate(s *Stream, c Chunk) {
 	}
 
 	TsLiveFileAppend(s, c)
-	if s.AudioLiveChunk.DataType == "AudioAacFrame" {
+	if AudioFrameCheck(s.AudioLiveChunk.DataType) {
 		//s.log.Printf("create ts about add audio chunk after video")
 		TsLiveFileAppend(s, s.AudioLiveChunk)
 		s.AudioLiveChunk.DataType = ""
@@ -2794,7 +2872,7 @@ func PesLiveDataCreateVideoFrame(s *Stream, c Chunk, phd []byte) []byte {
 		e0 += 4
 	}
 
-	if strings.Contains(s.Key, conf.Debug.StreamId) {
+	if strings.Contains(s.Key, Conf().Debug.StreamId) {
 		s.log.Printf("hlslive %s write in dType=%s, NaluNum=%d, dLen=%d", path.Base(s.TsLivePath), c.DataType, c.NaluNum, len(data))
 	}
 	return data
@@ -2848,7 +2926,7 @@ func TsLivePacketCreate(s *Stream, c Chunk, data []byte, pcr uint64, first bool)
 	}
 	th.TransportPriority = 0x0
 	th.PID = VideoPid
-	if c.DataType == "AudioAacFrame" {
+	if AudioFrameCheck(c.DataType) {
 		th.PID = AudioPid
 	}
 	th.TransportScramblingControl = 0x0
@@ -2948,6 +3026,8 @@ func TsLiveFileAppend(s *Stream, c Chunk) {
 		pesData = PesLiveDataCreateVideoFrame(s, c, pesHeaderData)
 	case "AudioAacFrame":
 		pesData = PesLiveDataCreateAacFrame(s, c, pesHeaderData)
+	case "AudioMp3Frame":
+		pesData = PesDataCreateMp3Frame(s, c, pesHeaderData)
 	}
 
 	pesDataLen := len(pesData)
@@ -3036,8 +3116,8 @@ func TsLiveCreate(s *Stream, c Chunk) bool {
 	//这是最后的保障, 为了纠正上面对时间戳计算可能发生的错误 或 其他意外情况
 	//1小时=3600秒=3600000毫秒
 	if s.TsLivePath != "" && dv >= 3600000 {
-		s.log.Printf("hlslive dv >= 3600000ms, force dv = %fms", conf.HlsLive.TsMaxTime*1000)
-		dv = uint32(conf.HlsLive.TsMaxTime * 1000)
+		s.log.Printf("hlslive dv >= 3600000ms, force dv = %fms", Conf().HlsLive.TsMaxTime*1000)
+		dv = uint32(Conf().HlsLive.TsMaxTime * 1000)
 	}
 
 	//rtmp里的timestamp单位是毫秒, 除以1000变为秒
@@ -3045,9 +3125,9 @@ func TsLiveCreate(s *Stream, c Chunk) bool {
 	//TODO: when all of the video timestamp is equal to zero, force set ts duration.
 	//when ts size is equal to 10MB, suppose bitrate is 3Mb, the duration is about 30s
 	if dv == 0 {
-		if s.TsLiveMaxCutSize >= conf.HlsLive.TsMaxSize && c.DataType == "VideoKeyFrame" {
+		if s.TsLiveMaxCutSize >= Conf().HlsLive.TsMaxSize && c.DataType == "VideoKeyFrame" {
 			s.TsLiveExtInfo = 5
-		} else if s.TsLiveMaxCutSize >= 2*conf.HlsLive.TsMaxSize {
+		} else if s.TsLiveMaxCutSize >= 2*Conf().HlsLive.TsMaxSize {
 			s.TsLiveExtInfo = 10
 		}
 	}
@@ -3060,17 +3140,26 @@ func TsLiveCreate(s *Stream, c Chunk) bool {
 	//纯音频支持切片
 	_, ok = s.GopCache.VideoHeader.Load(s.Key)
 	//s.log.Printf("test andrew res:%v, key:%s, type:%s, %v, %s", ok, s.Key, c.DataType, s.TsLiveExtInfo, s.TsLivePath)
-	if s.TsLivePath == "" || (s.TsLiveExtInfo >= float64(conf.HlsLive.TsMaxTime) && c.DataType == "VideoKeyFrame") || s.TsLiveExtInfo >= 60 ||
-		(s.TsLiveMaxCutSize >= conf.HlsLive.TsMaxSize && c.DataType == "VideoKeyFrame") || s.TsLiveMaxCutSize >= 2*conf.HlsLive.TsMaxSize ||
-		(ok == false && s.TsLiveExtInfo >= float64(conf.HlsLive.TsMaxTime) && c.DataType == "AudioAacFrame") {
+	//发布者断线重连后, 从首个关键帧(纯音频为首个音频帧)切新的ts, 新ts前加一个#EXT-X-DISCONTINUITY
+	resume := false
+	if s.HlsLiveResume == true && (c.DataType == "VideoKeyFrame" || (ok == false && AudioFrameCheck(c.DataType))) {
+		s.HlsLiveResume = false
+		resume = true
+	}
+	if resume == true || s.TsLivePath == "" || (s.TsLiveExtInfo >= float64(Conf().HlsLive.TsMaxTime) && c.DataType == "VideoKeyFrame") || s.TsLiveExtInfo >= 60 ||
+		(s.TsLiveMaxCutSize >= Conf().HlsLive.TsMaxSize && c.DataType == "VideoKeyFrame") || s.TsLiveMaxCutSize >= 2*Conf().HlsLive.TsMaxSize ||
+		(ok == false && s.TsLiveExtInfo >= float64(Conf().HlsLive.TsMaxTime) && AudioFrameCheck(c.DataType)) {
 		//s.log.Printf("create ts previous data type:%s, cur data type: %s", s.AudioLiveChunk.DataType, c.DataType)
 		TsLiveFileCreate(s, c)
+		if resume == true {
+			s.HlsLiveAddDiscFlag = true
+		}
 		ok = true
 		s.TsLiveMaxCutSize = 0
 	} else {
 		//s.log.Printf("append ts previous data type:%s, cur data type: %s", s.AudioLiveChunk.DataType, c.DataType)
-		if c.DataType == "AudioAacFrame" {
-			if s.AudioLiveChunk.DataType == "AudioAacFrame" {
+		if AudioFrameCheck(c.DataType) {
+			if AudioFrameCheck(s.AudioLiveChunk.DataType) {
 				TsLiveFileAppend(s, s.AudioLiveChunk)
 			}
 			s.AudioLiveChunk = c
@@ -3085,7 +3174,7 @@ func TsLiveCreate(s *Stream, c Chunk) bool {
 
 func HlsLiveCreator(s *Stream) {
 	defer s.Wg.Done()
-	dir := fmt.Sprintf("%s/%s", conf.HlsLive.MemPath, s.AmfInfo.StreamId)
+	dir := fmt.Sprintf("%s/%s", Conf().HlsLive.MemPath, s.AmfInfo.StreamId)
 	err := utils.DirExist(dir, true)
 	if err != nil {
 		s.log.Println(err)
@@ -3138,17 +3227,32 @@ func HlsLiveCreator(s *Stream) {
 				PrepareSpsPpsLiveDataH265(s, &c)
 			default:
 			}
-			s.HlsLiveAddDiscFlag = true
+			//断线重连时 在切ts的地方加, 这里不加
+			if s.HlsLiveResume == false {
+				s.HlsLiveAddDiscFlag = true
+			}
 			continue // 此数据不该直接写入ts
 		case "AudioHeader":
 			PrepareAdtsLiveData(s, &c)
 			//ParseAdtsData(s)
-			s.HlsLiveAddDiscFlag = true
+			//断线重连时 在切ts的地方加, 这里不加
+			if s.HlsLiveResume == false {
+				s.HlsLiveAddDiscFlag = true
+			}
 			continue // 此数据不该直接写入ts
 		default:
 			//这里是 音视频数据 和 未定义类型数据
 		}
 
+		//ts不支持av1和vp9, 这些视频数据不写入ts
+		if c.MsgTypeId == MsgTypeIdVideo && s.VideoCodecType != "H264" && s.VideoCodecType != "H265" {
+			continue
+		}
+		//ts只支持aac和mp3, g711和speex不写入ts
+		if c.MsgTypeId == MsgTypeIdAudio && s.AudioCodecType != "AAC" && s.AudioCodecType != "MP3" {
+			continue
+		}
+
 		TsLiveCreate(s, c)
 	}
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"utils"
+)
+
+/*************************************************/
+/* 生命周期回调 webhook
+/*************************************************/
+//和cc的推流鉴权 流状态上报 互不影响, Hook.Enable为true时 按事件POST给配置的url, 数据见HookRqst
+//1 on_connect: rtmp的connect命令, rtsp的OPTIONS请求, 只通知
+//2 on_publish: rtmp的publish命令, rtsp的ANNOUNCE请求, 拉流代理和gb28181是我们发起的 不回调
+//3 on_play: rtmp的play命令, flv请求, rtsp的PLAY请求, hls新会话的m3u8请求
+//4 on_stop: StreamHub的发布者停止(被新发布者踢掉的除外), rtmp flv rtsp播放者断开, 只通知
+//5 on_record: HlsRec录制(hlsUpload为1)的ts文件完成, 只通知
+//on_publish和on_play同步回调, 所有url都返回http 200 且body为{"code":200} 才放行
+//  拒绝时 rtmp回复onStatus失败后断开, http返回403, rtsp返回403
+//  请求失败(超时 连接不上 5xx等)时 FailAllow为true放行, false拒绝
+//其他事件异步回调, 失败只打日志
+//app在Apps里 且配置了这个事件的url 用app的, 否则用全局的
+//Secret不为空时 带签名头, X-Hook-Signature = hex(hmac_sha256(Secret, X-Hook-Timestamp + "." + body))
+const (
+	HookOnConnect = "on_connect"
+	HookOnPublish = "on_publish"
+	HookOnPlay    = "on_play"
+	HookOnStop    = "on_stop"
+	HookOnRecord  = "on_record"
+)
+
+var ErrHookDeny = errors.New("denied by hook")
+
+type HookRqst struct {
+	Event      string  `json:"event"`
+	App        string  `json:"app"`
+	StreamId   string  `json:"streamId"`
+	Protocol   string  `json:"protocol"` //rtmp flv rtsp hls gb28181
+	Role       string  `json:"role"`     //publisher player, on_connect时为空
+	ClientAddr string  `json:"clientAddr"`
+	Args       string  `json:"args"` //url里?后面的参数, 可以带token等
+	ServerIp   string  `json:"serverIp"`
+	Time       int64   `json:"time"`               //毫秒
+	Duration   int64   `json:"duration,omitempty"` //on_stop: 推流或播放的毫秒数
+	BytesIn    uint64  `json:"bytesIn,omitempty"`  //on_stop
+	BytesOut   uint64  `json:"bytesOut,omitempty"` //on_stop
+	File       string  `json:"file,omitempty"`     //on_record: ts文件路径
+	FileDur    float64 `json:"fileDur,omitempty"`  //on_record: ts时长(秒)
+}
+
+type HookRsps struct {
+	Code int    `json:"code"`
+	Msg  string `json:"message"`
+}
+
+func HookUrlsGet(app, event string) []string {
+	if u, ok := Conf().Hook.Apps[app]; ok == true {
+		if us := HookUrlsOf(u, event); len(us) > 0 {
+			return us
+		}
+	}
+	return HookUrlsOf(Conf().Hook.Urls, event)
+}
+
+func HookUrlsOf(u HookUrls, event string) []string {
+	switch event {
+	case HookOnConnect:
+		return u.OnConnect
+	case HookOnPublish:
+		return u.OnPublish
+	case HookOnPlay:
+		return u.OnPlay
+	case HookOnStop:
+		return u.OnStop
+	case HookOnRecord:
+		return u.OnRecord
+	}
+	return nil
+}
+
+//url?后面的参数, rtmp的publishName和streamId可能带参数 如cctv1?token=xxx
+func HookArgs(s string) string {
+	ss := strings.SplitN(s, "?", 2)
+	if len(ss) < 2 {
+		return ""
+	}
+	return ss[1]
+}
+
+//发布者的app, 内存发布者的AmfInfo.App可能为空
+func HookPuberApp(s *Stream) string {
+	if s.App != "" {
+		return s.App
+	}
+	return s.AmfInfo.App
+}
+
+//同步回调, 返回nil表示放行
+func HookCheck(hr HookRqst) error {
+	if Conf().Hook.Enable == false {
+		return nil
+	}
+	for _, url := range HookUrlsGet(hr.App, hr.Event) {
+		allow, err := HookSend(url, hr)
+		if err != nil {
+			log.Println(err)
+			if Conf().Hook.FailAllow == true {
+				continue
+			}
+			return fmt.Errorf("%w, %s %s", ErrHookDeny, hr.Event, err)
+		}
+		if allow == false {
+			err = fmt.Errorf("%w, %s %s %s", ErrHookDeny, hr.Event, url, hr.StreamId)
+			log.Println(err)
+			return err
+		}
+	}
+	return nil
+}
+
+//异步回调, 只通知
+func HookNotify(hr HookRqst) {
+	if Conf().Hook.Enable == false {
+		return
+	}
+	for _, url := range HookUrlsGet(hr.App, hr.Event) {
+		go func(url string) {
+			if _, err := HookSend(url, hr); err != nil {
+				log.Println(err)
+			}
+		}(url)
+	}
+}
+
+//返回true表示放行, 连接失败和5xx重试Retry次
+func HookSend(url string, hr HookRqst) (bool, error) {
+	hr.ServerIp = Conf().IpOuter
+	hr.Time = utils.GetTimestamp("ms")
+	d, err := json.Marshal(hr)
+	if err != nil {
+		return false, err
+	}
+	to := Conf().Hook.TimeoutSec
+	if to <= 0 {
+		to = 3
+	}
+	client := &http.Client{Timeout: time.Duration(to) * time.Second}
+	n := Conf().Hook.Retry
+	if n < 0 {
+		n = 0
+	}
+
+	var rsps *http.Response
+	for i := 0; i <= n; i++ {
+		rqst, err := http.NewRequest("POST", url, bytes.NewReader(d))
+		if err != nil {
+			return false, err
+		}
+		rqst.Header.Set("Content-Type", HttpCtypeJson)
+		rqst.Header.Set("X-Hook-Event", hr.Event)
+		if Conf().Hook.Secret != "" {
+			ts := fmt.Sprintf("%d", hr.Time)
+			rqst.Header.Set("X-Hook-Timestamp", ts)
+			rqst.Header.Set("X-Hook-Signature", HookSign(Conf().Hook.Secret, ts, d))
+		}
+
+		rsps, err = client.Do(rqst)
+		if err == nil && rsps.StatusCode < 500 {
+			break
+		}
+		if err == nil {
+			err = fmt.Errorf("hook %s %s status %d", hr.Event, url, rsps.StatusCode)
+			rsps.Body.Close()
+			rsps = nil
+		}
+		if i == n {
+			return false, err
+		}
+		log.Printf("hook %s %s retry %d, %s", hr.Event, url, i+1, err)
+	}
+	defer rsps.Body.Close()
+
+	d, err = ioutil.ReadAll(rsps.Body)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("hook %s %s %s, status=%d, rsps=%s", hr.Event, url, hr.StreamId, rsps.StatusCode, string(d))
+	if rsps.StatusCode != http.StatusOK {
+		return false, nil
+	}
+	//只通知的事件 不看body
+	if hr.Event != HookOnPublish && hr.Event != HookOnPlay {
+		return true, nil
+	}
+	var hrs HookRsps
+	if err = json.Unmarshal(d, &hrs); err != nil {
+		log.Println(err)
+		return false, nil
+	}
+	return hrs.Code == 200, nil
+}
+
+func HookSign(secret, ts string, d []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(ts))
+	m.Write([]byte("."))
+	m.Write(d)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+/*************************************************/
+/* 各事件的数据
+/*************************************************/
+func HookRtmpConnect(s *Stream) {
+	HookNotify(HookRqst{Event: HookOnConnect, App: s.AmfInfo.App, Protocol: "rtmp",
+		ClientAddr: s.RemoteAddr, Args: HookArgs(s.AmfInfo.TcUrl)})
+}
+
+func HookRtmpPublish(s *Stream) error {
+	return HookCheck(HookRqst{Event: HookOnPublish, App: s.AmfInfo.App, StreamId: s.AmfInfo.StreamId,
+		Protocol: "rtmp", Role: "publisher", ClientAddr: s.RemoteAddr, Args: HookArgs(s.AmfInfo.PublishName)})
+}
+
+//rtmp flv hls播放者, 这时播放者还没创建
+func HookPlay(ptcl, app, sid, addr, args string) error {
+	return HookCheck(HookRqst{Event: HookOnPlay, App: app, StreamId: sid,
+		Protocol: ptcl, Role: "player", ClientAddr: addr, Args: args})
+}
+
+func HookRtsp(rs *RtspStream, event, role string) HookRqst {
+	return HookRqst{Event: event, App: rs.UrlArgs.Path[0], StreamId: rs.StreamId,
+		Protocol: "rtsp", Role: role, ClientAddr: rs.RAddr, Args: rs.UrlArgs.Args}
+}
+
+func HookPuberStop(s *Stream) {
+	hr := HookRqst{Event: HookOnStop, App: HookPuberApp(s), StreamId: s.Key, Protocol: MetricsPuberPtcl(s),
+		Role: "publisher", ClientAddr: s.RemoteAddr}
+	hr.Duration = utils.GetTimestamp("ms") - s.BeginTime
+	hr.BytesIn = atomic.LoadUint64(&s.InBytes)
+	hr.BytesOut = atomic.LoadUint64(&s.OutBytes)
+	HookNotify(hr)
+}
+
+func HookPlayerStop(p *Stream) {
+	hr := HookRqst{Event: HookOnStop, App: p.AmfInfo.App, StreamId: p.AmfInfo.StreamId, Protocol: MetricsPlayerPtcl(p),
+		Role: "player", ClientAddr: p.RemoteAddr}
+	hr.Duration = utils.GetTimestamp("ms") - p.BeginTime
+	hr.BytesOut = atomic.LoadUint64(&p.OutBytes)
+	HookNotify(hr)
+}
+
+func HookRtspPlayerStop(p *RtspStream) {
+	hr := HookRtsp(p, HookOnStop, "player")
+	hr.Duration = utils.GetTimestamp("ms") - p.BeginTime
+	hr.BytesOut = atomic.LoadUint64(&p.OutBytes)
+	HookNotify(hr)
+}
+
+func HookRecord(s *Stream) {
+	HookNotify(HookRqst{Event: HookOnRecord, App: HookPuberApp(s), StreamId: s.Key, Protocol: MetricsPuberPtcl(s),
+		Role: "publisher", ClientAddr: s.RemoteAddr, File: s.TsPath, FileDur: s.TsExtInfo})
+}
@@ -119,13 +119,18 @@ type PubAuthResult struct {
 	ResultCode int    `json:"resultCode"` // 鉴权结果, 0失败, 1成功
 	AesKey     string `json:"aesKey"`     // 空为不加密, "Encry_i9oD5fFqnE"
 	RecordType int    `json:"recordType"` // 录制类型
+	PlayerMax  int    `json:"playerMax"`  // 播放者个数限制, 0用配置的MaxPlayerNum, -1不限制
 }
 
 func PublishAuth(s *Stream) {
+	if s.PubAuthDone != nil {
+		defer close(s.PubAuthDone)
+	}
+
 	var par PubAuthRqst
 	par.IpPusher = s.RemoteIp
-	par.IpOuter = conf.IpOuter
-	par.IpInner = conf.IpInner
+	par.IpOuter = Conf().IpOuter
+	par.IpInner = Conf().IpInner
 	par.StreamId = s.AmfInfo.StreamId
 	par.AppName = s.AmfInfo.App
 	par.PushDomain = s.RemoteIp
@@ -138,7 +143,7 @@ func PublishAuth(s *Stream) {
 	par.Auth = utils.Md5Sum(ss)
 
 	//http://172.20.25.29:20093/api/stream/pushAuth
-	url := fmt.Sprintf("%s%s", conf.Cc.Server, conf.Cc.ApiAuth)
+	url := fmt.Sprintf("%s%s", Conf().Cc.Server, Conf().Cc.ApiAuth)
 	s.log.Printf("PubAuthUrl: %s", url)
 	s.log.Printf("PubAuthData: %#v", par)
 
@@ -148,7 +153,9 @@ func PublishAuth(s *Stream) {
 		return
 	}
 
+	st := time.Now()
 	d, err = HttpRequest("POST", url, d, 5, 3)
+	MetricsCcObserve("auth", st, err)
 	if err != nil {
 		s.log.Println(err)
 		s.TransmitSwitch = "off"
@@ -177,6 +184,14 @@ func PublishAuth(s *Stream) {
 	}
 }
 
+//等待PublishAuth()结束, 返回鉴权是否通过
+func PublishAuthWait(s *Stream) bool {
+	if s.PubAuthDone != nil {
+		<-s.PubAuthDone
+	}
+	return s.TransmitSwitch != "off"
+}
+
 /*************************************************/
 /* Stream State Report
 /*************************************************/
@@ -186,6 +201,7 @@ type StreamStateRqst struct {
 	IpInner     string `json:"innerIp"`     // 本服务内网ip
 	StreamId    string `json:"streamId"`    // "GSP3bnx69BgxI-gCec0oMfJT"
 	StreamState int    `json:"streamState"` // 1直播开始, 2直播结束
+	Reason      string `json:"reason"`      // 直播结束的原因, idle:无人观看自动断流
 	ReportTime  string `json:"reportTime"`  // "20221108115326"
 	Width       int    `json:"width"`       // 1920
 	Height      int    `json:"height"`      // 1080
@@ -197,20 +213,21 @@ type StreamStateRsps struct {
 	Msg  string `json:"message"`
 }
 
-func StreamStateReport(s *Stream, state int) {
+func StreamStateReport(s *Stream, state int, reason string) {
 	var ssr StreamStateRqst
 	ssr.IpPusher = s.RemoteIp
-	ssr.IpOuter = conf.IpOuter
-	ssr.IpInner = conf.IpInner
+	ssr.IpOuter = Conf().IpOuter
+	ssr.IpInner = Conf().IpInner
 	ssr.StreamId = s.AmfInfo.StreamId
 	ssr.StreamState = state
+	ssr.Reason = reason
 	ssr.ReportTime = utils.GetYMDHMS()
 	ssr.Width = s.Width
 	ssr.Height = s.Height
 	ssr.CodeType = s.VideoCodecType
 
 	//http://172.20.25.29:20093/api/stream/streamStateChange
-	url := fmt.Sprintf("%s%s", conf.Cc.Server, conf.Cc.ApiReport)
+	url := fmt.Sprintf("%s%s", Conf().Cc.Server, Conf().Cc.ApiReport)
 	s.log.Printf("StreamStateUrl: %s", url)
 	s.log.Printf("StreamStateData: %#v", ssr)
 
@@ -230,7 +247,9 @@ func StreamStateReport(s *Stream, state int) {
 		redoNum = 3
 	}
 
+	st := time.Now()
 	d, err = HttpRequest("POST", url, d, to, redoNum)
+	MetricsCcObserve("report", st, err)
 	if err != nil {
 		s.log.Println(err)
 		return
@@ -296,32 +315,39 @@ func GB28181Create(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, er
 	key := fmt.Sprintf("%s", rqst.StreamId)
 	log.Printf("stream key %s", key)
 
-	_, ok := StreamMap.Load(key)
-	if ok == true { //流id已存在, 断开连接并返回错误
-		err = fmt.Errorf("streamId %s exist", key)
-		log.Println(err)
-		return nil, err
+	HubPubMutex.Lock()
+	old, ok := HubGbGet(key)
+	if ok == true { //流id已存在, 按配置 返回错误 或 踢掉旧的
+		if TakeoverCheck(old.RecvLastTime) == false {
+			HubPubMutex.Unlock()
+			err = fmt.Errorf("streamId %s exist, takeover=%s", key, TakeoverPolicy())
+			log.Println(err)
+			return nil, err
+		}
+		log.Printf("streamId %s exist, kick old", key)
+		Gb28181Kick(old)
 	}
 
 	s, _ := NewGb28181Stream(key, rqst)
+	s.RecvLastTime = utils.GetTimestamp("ms")
 	log.Printf("log %s", s.LogFn)
 	s.log.Println("==============================")
 	s.log.Printf("%#v", rqst)
 
-	StreamMap.Store(key, s)
-	SsrcMap.Store(rqst.RtpSsrcUint, s)
+	HubGbStore(s)
+	HubPubMutex.Unlock()
 
 	var rsps GbRsps
 	rsps.Code = 200
 	rsps.Msg = "ok"
 	rsps.StreamId = rqst.StreamId
-	rsps.Ip = conf.IpOuter
+	rsps.Ip = Conf().IpOuter
 
 	var tcp, udp DataPort
-	tcp.Rtp = conf.RtpRtcp.FixedRtpPort
-	tcp.Rtcp = conf.RtpRtcp.FixedRtcpPort
-	udp.Rtp = conf.RtpRtcp.FixedRtpPort
-	udp.Rtcp = conf.RtpRtcp.FixedRtcpPort
+	tcp.Rtp = Conf().RtpRtcp.FixedRtpPort
+	tcp.Rtcp = Conf().RtpRtcp.FixedRtcpPort
+	udp.Rtp = Conf().RtpRtcp.FixedRtpPort
+	udp.Rtcp = Conf().RtpRtcp.FixedRtcpPort
 	rsps.TcpPort = &tcp
 	rsps.UdpPort = &udp
 
@@ -345,27 +371,24 @@ func GB28181Start(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, err
 	key := fmt.Sprintf("%s", rqst.StreamId)
 	log.Printf("stream key %s", key)
 
-	v, ok := StreamMap.Load(key)
+	s, ok := HubGbGet(key)
 	if ok == false { //流id不存在, 断开连接并返回错误
-		err = fmt.Errorf("streamId %s is't exist", key)
+		err = HttpErr(http.StatusNotFound, "streamId %s is't exist", key)
 		log.Println(err)
 		return nil, err
 	}
-	s := v.(*Stream)
 
+	//HubGbBySsrc()在锁内读ssrc
+	HubMapMutex.Lock()
 	s.GbRqst.RtpSsrc = rqst.RtpSsrc
 	n, _ := strconv.ParseUint(rqst.RtpSsrc, 10, 0)
 	s.GbRqst.RtpSsrcUint = uint32(n)
+	HubMapMutex.Unlock()
 	s.GbRqst.RemoteIp = rqst.RemoteIp
 	s.GbRqst.RemoteVideoPort = rqst.RemoteVideoPort
 	s.GbRqst.RemoteAudioPort = rqst.RemoteAudioPort
 	s.log.Printf("%#v", s.GbRqst)
 
-	if s.GbRqst.RtpSsrcTmp != s.GbRqst.RtpSsrc {
-		SsrcMap.Delete(s.GbRqst.RtpSsrcUintTmp)
-		SsrcMap.Store(s.GbRqst.RtpSsrcUint, s)
-	}
-
 	var rsps GbRsps
 	rsps.Code = 200
 	rsps.Msg = "ok"
@@ -398,14 +421,12 @@ func GB28181Delete(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, er
 	rsps.Msg = "SUCCESS"
 	rsps.StreamId = rqst.StreamId
 
-	v, ok := StreamMap.Load(key)
+	s, ok := HubGbGet(key)
 	if ok == false {
 		rsps.Code = 6002
 		rsps.Msg = "stream nunexist"
 	} else {
-		s := v.(*Stream)
-		SsrcMap.Delete(s.GbRqst.RtpSsrcUint)
-		StreamMap.Delete(key)
+		HubGbDelete(s)
 	}
 
 	dd, _ := json.Marshal(rsps)
@@ -429,10 +450,10 @@ func GB28181StreamList(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	rsps.Ts = utils.GetTimestamp("ms")
 
 	var i int
-	var s *Stream
-	SsrcMap.Range(func(k, v interface{}) bool {
-		s, _ = v.(*Stream)
-		log.Printf("%d, ssrc=%.10d, streamid=%s", i, k, s.GbRqst.StreamId)
+	rsps.List = make([]string, 0)
+	HubGbRange(func(s *Stream) bool {
+		log.Printf("%d, ssrc=%.10d, streamid=%s", i, s.RtpSsrcUint, s.GbRqst.StreamId)
+		rsps.List = append(rsps.List, s.GbRqst.StreamId)
 		i++
 		return true
 	})
@@ -494,6 +515,7 @@ type RtspRqst struct {
 	PullSid  string
 	PullArgs string
 
+	PushPtcl string //rtmp或rtmps
 	PushIp   string
 	PushPort string
 	PushPath []string
@@ -503,6 +525,7 @@ type RtspRqst struct {
 
 	PullKey string //PullIp_PullPort_PullPath[0]_PullPath[n]
 	PushKey string //PushIp_PushPort_PushPath[0]_PushPath[n]
+	PushMem bool   //推给自己, 数据走内存发布到StreamHub
 }
 
 func RtspRqstUrlParse(rqst *RtspRqst) error {
@@ -537,6 +560,7 @@ func RtspRqstUrlParse(rqst *RtspRqst) error {
 	}
 	//log.Printf("%#v", ua)
 
+	rqst.PushPtcl = ua.Ptcl
 	rqst.PushIp = ua.Ip
 	rqst.PushPort = ua.Port
 	rqst.PushPath = ua.Path
@@ -569,16 +593,17 @@ func HttpApiRtspPullCreate(w http.ResponseWriter, r *http.Request, d []byte) ([]
 		return nil, err
 	}
 	if rqst.PushUrl == "" {
+		rqst.PushMem = true
 		rqst.PushIp = "127.0.0.1"
 		rqst.PushPort = "1935"
 		rqst.PushUrl = fmt.Sprintf("rtmp://%s:%s/%s/%s", rqst.PushIp, rqst.PushPort, rqst.PushApp, rqst.PushSid)
 	}
 	if rqst.ReportUrl == "" {
-		rqst.ReportUrl = conf.Rtsp.ReportUrl
+		rqst.ReportUrl = Conf().Rtsp.ReportUrl
 	}
 
 	//是否后门推流, 仅用于测试, 后门字符串 不能出现在配置和日志中
-	if strings.Contains(rqst.PushUrl, BackDoor) == false && conf.Rtsp.PushBackDoor == true {
+	if strings.Contains(rqst.PushUrl, BackDoor) == false && Conf().Rtsp.PushBackDoor == true {
 		if strings.Contains(rqst.PushUrl, "?") == true {
 			rqst.PushUrl = fmt.Sprintf("%s&%s", rqst.PushUrl, BackDoor)
 		} else {
@@ -597,9 +622,10 @@ func HttpApiRtspPullCreate(w http.ResponseWriter, r *http.Request, d []byte) ([]
 	rs.log.Println("==============================")
 
 	//判断拉流任务是否已经存在
-	_, ok := RtspPuberMap.Load(rqst.PushKey)
-	if ok == true {
-		err = fmt.Errorf("rtsp pull %s is exist", rqst.PullUrl)
+	rs.Rqst = &rqst
+	rs.StreamId = rqst.PushSid
+	if HubRtspStoreNew(rqst.PushKey, rs) == false {
+		err = HttpErr(http.StatusConflict, "rtsp pull %s is exist", rqst.PullUrl)
 		log.Println(err)
 
 		log.Printf("rm %s", rs.LogFn)
@@ -607,9 +633,6 @@ func HttpApiRtspPullCreate(w http.ResponseWriter, r *http.Request, d []byte) ([]
 		_ = os.Remove(rs.LogFn)
 		return nil, err
 	}
-	rs.Rqst = &rqst
-	rs.StreamId = rqst.PushSid
-	RtspPuberMap.Store(rqst.PushKey, rs)
 
 	go RtspPuller(rs)
 
@@ -632,24 +655,477 @@ func HttpApiRtspPullDelete(w http.ResponseWriter, r *http.Request, d []byte) ([]
 		return nil, err
 	}
 	if rqst.ReportUrl == "" {
-		rqst.ReportUrl = conf.Rtsp.ReportUrl
+		rqst.ReportUrl = Conf().Rtsp.ReportUrl
 	}
 
 	rqst.PushKey = fmt.Sprintf("%s_%s", rqst.PushApp, rqst.PushSid)
 	log.Printf("%#v", rqst)
 
 	//判断拉流任务是否已经存在
-	v, ok := RtspPuberMap.Load(rqst.PushKey)
+	rs, ok := HubRtspGet(rqst.PushKey)
+	if ok == false {
+		err = HttpErr(http.StatusNotFound, "rtsp pull %s is not exist", rqst.PullUrl)
+		log.Println(err)
+		return nil, err
+	}
+	RtspPullStop(rqst.PushKey, rs)
+
+	rsps := GetRsps(200, "ok")
+	return rsps, nil
+}
+
+/*************************************************/
+/* rtmp forward api
+/*************************************************/
+//POST /api/v1/forward?action=create_forward
+//{"streamId":"GSPb4ohbi65Wm-eZTaaou4ol","url":"rtmp://live.cdn.com/live/test001?key=xxx"}
+//POST /api/v1/forward?action=delete_forward
+//{"streamId":"GSPb4ohbi65Wm-eZTaaou4ol","url":"rtmp://live.cdn.com/live/test001?key=xxx"}
+//GET /api/v1/forward?action=get_forwards&streamId=GSPb4ohbi65Wm-eZTaaou4ol
+//{"code":200,"message":"ok","streamId":"GSPb4ohbi65Wm-eZTaaou4ol","forwards":[{"url":"rtmp://...","state":"pushing",...}]}
+type ForwardRqst struct {
+	StreamId string `json:"streamId"` //发布者的key
+	Url      string `json:"url"`      //转推地址, rtmp或rtmps
+}
+
+type ForwardRsps struct {
+	Code     int             `json:"code"`
+	Msg      string          `json:"message"`
+	StreamId string          `json:"streamId"`
+	Forwards []ForwardStatus `json:"forwards"`
+}
+
+func ForwardPuberGet(key string) (*Stream, error) {
+	s, ok := HubPuberGet(key)
+	if ok == false {
+		err := HttpErr(http.StatusNotFound, "publisher %s is not exist", key)
+		log.Println(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+func HttpApiForwardCreate(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, error) {
+	var rqst ForwardRqst
+	err := json.Unmarshal(d, &rqst)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if rqst.StreamId == "" || rqst.Url == "" {
+		err = fmt.Errorf("streamId or url is empty")
+		log.Println(err)
+		return nil, err
+	}
+
+	s, err := ForwardPuberGet(rqst.StreamId)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = ForwardAdd(s, rqst.Url)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	rsps := GetRsps(200, "ok")
+	return rsps, nil
+}
+
+func HttpApiForwardDelete(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, error) {
+	var rqst ForwardRqst
+	err := json.Unmarshal(d, &rqst)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	s, err := ForwardPuberGet(rqst.StreamId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ForwardDelete(s, rqst.Url)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	rsps := GetRsps(200, "ok")
+	return rsps, nil
+}
+
+func HttpApiForwardList(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	key := r.FormValue("streamId")
+	s, err := ForwardPuberGet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var rsps ForwardRsps
+	rsps.Code = 200
+	rsps.Msg = "ok"
+	rsps.StreamId = key
+	rsps.Forwards = []ForwardStatus{}
+
+	s.Forwards.Range(func(k, v interface{}) bool {
+		f := v.(*Forwarder)
+		rsps.Forwards = append(rsps.Forwards, ForwardStatusGet(f))
+		return true
+	})
+
+	dd, _ := json.Marshal(rsps)
+	log.Println(string(dd))
+	return dd, nil
+}
+
+/*************************************************/
+/* 时间戳修正统计
+/*************************************************/
+//GET /api/v1/streams?action=get_tsFix&streamId=test001
+//{"code":200,"message":"ok","streamId":"test001","video":{"jumpNum":0,...},"audio":{...}}
+type TsFixRsps struct {
+	Code     int       `json:"code"`
+	Msg      string    `json:"message"`
+	StreamId string    `json:"streamId"`
+	Video    TsFixStat `json:"video"`
+	Audio    TsFixStat `json:"audio"`
+}
+
+func HttpApiTsFixGet(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	key := r.FormValue("streamId")
+	s, err := ForwardPuberGet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var rsps TsFixRsps
+	rsps.Code = 200
+	rsps.Msg = "ok"
+	rsps.StreamId = key
+	rsps.Video, rsps.Audio = TsFixStatGet(s)
+
+	dd, _ := json.Marshal(rsps)
+	log.Println(string(dd))
+	return dd, nil
+}
+
+/*************************************************/
+/* 播放者拥塞丢帧统计
+/*************************************************/
+//GET /api/v1/streams?action=get_playDrops&streamId=test001
+//{"code":200,"message":"ok","streamId":"test001","players":[{"key":"live_test001_1.2.3.4:5678",...}]}
+type PlayDropInfo struct {
+	Key         string `json:"key"`
+	Type        string `json:"type"`
+	Congest     string `json:"congest"`
+	PlayChanNum int    `json:"playChanNum"`
+	PlayDropStat
+}
+
+type PlayDropsRsps struct {
+	Code     int            `json:"code"`
+	Msg      string         `json:"message"`
+	StreamId string         `json:"streamId"`
+	Players  []PlayDropInfo `json:"players"`
+}
+
+func HttpApiPlayDropsGet(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	key := r.FormValue("streamId")
+	s, err := ForwardPuberGet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var rsps PlayDropsRsps
+	rsps.Code = 200
+	rsps.Msg = "ok"
+	rsps.StreamId = key
+	rsps.Players = make([]PlayDropInfo, 0)
+	s.Players.Range(func(k, v interface{}) bool {
+		p := v.(*Stream)
+		pi := PlayDropInfo{Key: p.Key, Type: p.Type, Congest: PlayCongestMode(p)}
+		pi.PlayChanNum = len(p.PlayChan)
+		pi.PlayDropStat = PlayDropGet(p)
+		rsps.Players = append(rsps.Players, pi)
+		return true
+	})
+
+	dd, _ := json.Marshal(rsps)
+	log.Println(string(dd))
+	return dd, nil
+}
+
+/*************************************************/
+/* rtmp pull proxy api
+/*************************************************/
+//POST /api/v1/streams?action=create_rtmpProxy
+//{"sourceUrl":"rtmps://live.cdn.com/live/test001?key=xxx","app":"live","streamId":"test001","retry":3,"hookUrl":""}
+//POST /api/v1/streams?action=delete_rtmpProxy
+//{"streamId":"test001"}
+//GET /api/v1/streams?action=get_rtmpProxys
+//{"code":200,"message":"ok","proxyList":[{"app":"live","streamId":"test001","sourceUrl":"rtmps://...","state":"pulling",...}]}
+type RtmpPullRsps struct {
+	Code int              `json:"code"`
+	Msg  string           `json:"message"`
+	List []RtmpPullStatus `json:"proxyList"`
+}
+
+func HttpApiRtmpPullCreate(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, error) {
+	var rqst RtmpPullRqst
+	err := json.Unmarshal(d, &rqst)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	//判断参数是否合法
+	if rqst.PullUrl == "" {
+		err = fmt.Errorf("rtmp pull url is empty")
+		log.Println(err)
+		return nil, err
+	}
+	if rqst.ReportUrl == "" {
+		rqst.ReportUrl = Conf().Rtsp.ReportUrl
+	}
+
+	_, err = RtmpPullCreate(rqst)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	rsps := GetRsps(200, "ok")
+	return rsps, nil
+}
+
+func HttpApiRtmpPullDelete(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, error) {
+	var rqst RtmpPullRqst
+	err := json.Unmarshal(d, &rqst)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	if rqst.StreamId == "" {
+		err = fmt.Errorf("streamId is empty")
+		log.Println(err)
+		return nil, err
+	}
+
+	err = RtmpPullDelete(rqst.StreamId)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	rsps := GetRsps(200, "ok")
+	return rsps, nil
+}
+
+func HttpApiRtmpPullList(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var rsps RtmpPullRsps
+	rsps.Code = 200
+	rsps.Msg = "ok"
+	rsps.List = []RtmpPullStatus{}
+
+	RtmpPullMap.Range(func(k, v interface{}) bool {
+		t := v.(*RtmpPullTask)
+		rsps.List = append(rsps.List, RtmpPullStatusGet(t))
+		return true
+	})
+
+	dd, _ := json.Marshal(rsps)
+	log.Println(string(dd))
+	return dd, nil
+}
+
+/*************************************************/
+/* 配置热加载
+/*************************************************/
+//POST /api/v1/streams?action=reload_config
+//{"code":200,"message":"ok","applied":["Log.SaveDay","HlsLive.TsMaxTime"],"restart":["Rtmp.Port"]}
+func HttpApiConfReload(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, error) {
+	rsps, err := ConfReload()
+	if err != nil {
+		return nil, err
+	}
+
+	dd, _ := json.Marshal(rsps)
+	log.Println(string(dd))
+	return dd, nil
+}
+
+/*************************************************/
+/* 流列表和详情
+/*************************************************/
+//GET /api/v1/streams?action=get_streams&app=live&protocol=rtsp, app和protocol可以不带
+//{"code":200,"message":"ok","streamList":[{"app":"live","streamId":"test001","protocol":"rtsp",...}]}
+//GET /api/v1/streams?action=get_stream&streamId=test001
+//{"code":200,"message":"ok","stream":{"app":"live","streamId":"test001",...,"players":[{"protocol":"flv",...}]}}
+type StreamListRsps struct {
+	Code int          `json:"code"`
+	Msg  string       `json:"message"`
+	List []StreamInfo `json:"streamList"`
+}
+
+type StreamGetRsps struct {
+	Code   int        `json:"code"`
+	Msg    string     `json:"message"`
+	Stream StreamInfo `json:"stream"`
+}
+
+func HttpApiStreamList(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var rsps StreamListRsps
+	rsps.Code = 200
+	rsps.Msg = "ok"
+	rsps.List = StreamInfoList(r.FormValue("app"), r.FormValue("protocol"))
+
+	dd, _ := json.Marshal(rsps)
+	log.Println(string(dd))
+	return dd, nil
+}
+
+func HttpApiStreamGet(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	sid := r.FormValue("streamId")
+	si, ok := StreamInfoGet(sid, true)
 	if ok == false {
-		err = fmt.Errorf("rtsp pull %s is not exist", rqst.PullUrl)
+		err := HttpErr(http.StatusNotFound, "stream %s is not exist", sid)
+		log.Println(err)
+		return nil, err
+	}
+
+	var rsps StreamGetRsps
+	rsps.Code = 200
+	rsps.Msg = "ok"
+	rsps.Stream = si
+
+	dd, _ := json.Marshal(rsps)
+	log.Println(string(dd))
+	return dd, nil
+}
+
+/*************************************************/
+/* 踢掉发布者 或 播放者
+/*************************************************/
+//POST /api/v1/streams?action=kick_publisher
+//{"streamId":"test001"}
+//POST /api/v1/streams?action=kick_player
+//{"streamId":"test001","remoteAddr":"10.3.214.236:52368"}, remoteAddr见get_stream返回的players, hls只用ip
+//{"code":200,"message":"ok"}, 不存在的返回404
+type KickRqst struct {
+	StreamId   string `json:"streamId"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+func HttpApiPuberKick(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, error) {
+	var rqst KickRqst
+	err := json.Unmarshal(d, &rqst)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	if rqst.StreamId == "" {
+		err = HttpErr(http.StatusBadRequest, "streamId is empty")
+		log.Println(err)
+		return nil, err
+	}
+
+	err = PuberKick(rqst.StreamId)
+	if err != nil {
+		return nil, err
+	}
+
+	rsps := GetRsps(200, "ok")
+	return rsps, nil
+}
+
+func HttpApiPlayerKick(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, error) {
+	var rqst KickRqst
+	err := json.Unmarshal(d, &rqst)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	if rqst.StreamId == "" || rqst.RemoteAddr == "" {
+		err = HttpErr(http.StatusBadRequest, "streamId or remoteAddr is empty")
 		log.Println(err)
 		return nil, err
 	}
-	rs := v.(*RtspStream)
-	rs.Stop = true
-	//这里从map删除, 不影响之前获得指针的使用
-	RtspPuberMap.Delete(rqst.PushKey)
+
+	err = PlayerKick(rqst.StreamId, rqst.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
 
 	rsps := GetRsps(200, "ok")
 	return rsps, nil
 }
+
+/*************************************************/
+/* 播放地址签名
+/*************************************************/
+//GET /api/v1/streams?action=get_playSign&app=live&streamId=test001&expire=3600&ip=10.3.214.236
+//Authorization: Bearer <PlaySign.ApiToken>
+//expire为有效秒数 默认3600, 最大PlaySign.ExpireMax, ip在PlaySign.BindIp为true时必须带
+//{"code":200,"message":"ok","sign":"xxx","expire":1700000000,"query":"expire=1700000000&sign=xxx"}
+type PlaySignRsps struct {
+	Code   int    `json:"code"`
+	Msg    string `json:"message"`
+	Sign   string `json:"sign"`
+	Expire int64  `json:"expire"`
+	Query  string `json:"query"` //加在播放地址?后面
+}
+
+func HttpApiPlaySignGet(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if err := PlaySignApiAuth(r); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	app := r.FormValue("app")
+	sid := r.FormValue("streamId")
+	ip := r.FormValue("ip")
+	if app == "" || sid == "" {
+		err := HttpErr(http.StatusBadRequest, "app or streamId is empty")
+		log.Println(err)
+		return nil, err
+	}
+	if Conf().PlaySign.BindIp == true && ip == "" {
+		err := HttpErr(http.StatusBadRequest, "ip is empty, PlaySign.BindIp is true")
+		log.Println(err)
+		return nil, err
+	}
+	if Conf().PlaySign.BindIp == false {
+		ip = ""
+	}
+	secret := PlaySignSecret(app)
+	if secret == "" {
+		err := HttpErr(http.StatusNotFound, "app %s has no play sign secret", app)
+		log.Println(err)
+		return nil, err
+	}
+	sec, _ := strconv.ParseInt(r.FormValue("expire"), 10, 64)
+	if sec <= 0 {
+		sec = 3600
+	}
+	if sec > PlaySignExpireMax() {
+		err := HttpErr(http.StatusBadRequest, "expire %d > %d(PlaySign.ExpireMax)", sec, PlaySignExpireMax())
+		log.Println(err)
+		return nil, err
+	}
+
+	var rsps PlaySignRsps
+	rsps.Code = 200
+	rsps.Msg = "ok"
+	rsps.Expire = time.Now().Unix() + sec
+	rsps.Sign = PlaySignMake(secret, app, sid, rsps.Expire, ip)
+	rsps.Query = fmt.Sprintf("expire=%d&sign=%s", rsps.Expire, rsps.Sign)
+
+	dd, _ := json.Marshal(rsps)
+	log.Println(string(dd))
+	return dd, nil
+}
@@ -2,126 +2,287 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path"
 	"strconv"
 	"strings"
 )
 
-func HttpGetHandler(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-	var rsps []byte
-	var err error
-
-	url := r.URL.String()
-	if strings.Contains(url, "/api/version") {
-		rsps, err = GetVersion(w, r)
-		w.Header().Set("Content-Type", "application/json")
-	} else if strings.Contains(url, ".flv") {
-		rsps, err = GetFlv(w, r)
-	} else if strings.Contains(url, ".m3u8") {
-		rsps, err = GetM3u8(w, r)
-		//safari地址栏输入播放地址  必须有这个 才能播放
-		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-	} else if strings.Contains(url, ".ts") {
-		rsps, err = GetTs(w, r)
-	} else if strings.Contains(url, "action=get_pushChannels") {
-		rsps, err = GB28181StreamList(w, r)
-		w.Header().Set("Content-Type", "application/json")
-	} else {
-		err = fmt.Errorf("undefined GET request")
-		return nil, err
-	}
-	return rsps, err
+/*************************************************/
+/* http路由
+/*************************************************/
+//业务api 管理 播放 分开监听, 端口分别是PortApi PortMng PortPlay, 端口为空的不监听
+//几个端口相同的 共用一个监听, 路由合并, 默认配置三个端口相同 和以前一样
+//1 api和管理接口 按路径完全匹配, /api/v1/streams 再按?action=的值完全匹配
+//2 播放按路径的扩展名匹配, .flv .m3u8 .ts
+//3 路径匹配但方法不对的 返回405, 没有匹配的返回404
+//4 出错时返回 {"code":xxx,"message":"xxx"}, code和http状态码相同
+const (
+	HttpApiPath   = "/api/v1/streams"
+	HttpCtypeJson = "application/json"
+)
+
+type HttpHandlerFunc func(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, error)
+
+type HttpRoute struct {
+	Method  string
+	Path    string //以.开头的 按扩展名匹配
+	Action  string //?action=的值, 为空的不看action
+	Ctype   string //Content-Type
+	Handler HttpHandlerFunc
 }
 
-func HttpPostHandler(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-	d, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-	log.Printf("PostData: %s", string(d))
-
-	var rsps []byte
-	url := r.URL.String()
-
-	if strings.Contains(url, "action=create_pullChannel") {
-		rsps, err = GB28181Create(w, r, d)
-	} else if strings.Contains(url, "action=start_pullChannel") {
-		rsps, err = GB28181Start(w, r, d)
-	} else if strings.Contains(url, "action=delete_pullChannel") {
-		rsps, err = GB28181Delete(w, r, d)
-	} else if strings.Contains(url, "action=create_streamProxy") {
-		rsps, err = HttpApiRtspPullCreate(w, r, d)
-	} else if strings.Contains(url, "action=delete_streamProxy") {
-		rsps, err = HttpApiRtspPullDelete(w, r, d)
-	} else {
-		err = fmt.Errorf("undefined POST request")
-		return nil, err
-	}
-	w.Header().Set("Content-Type", "application/json")
-	return rsps, err
+//业务api
+var HttpApiRoutes = []HttpRoute{
+	{"GET", "/api/version", "", HttpCtypeJson, HttpGet(GetVersion)},
+	{"GET", HttpApiPath, "get_pushChannels", HttpCtypeJson, HttpGet(GB28181StreamList)},
+	{"GET", HttpApiPath, "get_forwards", HttpCtypeJson, HttpGet(HttpApiForwardList)},
+	{"GET", HttpApiPath, "get_rtmpProxys", HttpCtypeJson, HttpGet(HttpApiRtmpPullList)},
+	{"GET", HttpApiPath, "get_streams", HttpCtypeJson, HttpGet(HttpApiStreamList)},
+	{"GET", HttpApiPath, "get_stream", HttpCtypeJson, HttpGet(HttpApiStreamGet)},
+	{"POST", HttpApiPath, "create_pullChannel", HttpCtypeJson, GB28181Create},
+	{"POST", HttpApiPath, "start_pullChannel", HttpCtypeJson, GB28181Start},
+	{"POST", HttpApiPath, "delete_pullChannel", HttpCtypeJson, GB28181Delete},
+	{"POST", HttpApiPath, "create_streamProxy", HttpCtypeJson, HttpApiRtspPullCreate},
+	{"POST", HttpApiPath, "delete_streamProxy", HttpCtypeJson, HttpApiRtspPullDelete},
+	{"POST", HttpApiPath, "create_forward", HttpCtypeJson, HttpApiForwardCreate},
+	{"POST", HttpApiPath, "delete_forward", HttpCtypeJson, HttpApiForwardDelete},
+	{"POST", HttpApiPath, "create_rtmpProxy", HttpCtypeJson, HttpApiRtmpPullCreate},
+	{"POST", HttpApiPath, "delete_rtmpProxy", HttpCtypeJson, HttpApiRtmpPullDelete},
+}
+
+//管理 监控
+var HttpMngRoutes = []HttpRoute{
+	{"GET", "/metrics", "", "text/plain; version=0.0.4", HttpGet(MetricsGet)},
+	{"GET", HttpApiPath, "get_tsFix", HttpCtypeJson, HttpGet(HttpApiTsFixGet)},
+	{"GET", HttpApiPath, "get_playDrops", HttpCtypeJson, HttpGet(HttpApiPlayDropsGet)},
+	{"POST", HttpApiPath, "reload_config", HttpCtypeJson, HttpApiConfReload},
+	{"POST", HttpApiPath, "kick_publisher", HttpCtypeJson, HttpApiPuberKick},
+	{"POST", HttpApiPath, "kick_player", HttpCtypeJson, HttpApiPlayerKick},
+	{"GET", HttpApiPath, "get_playSign", HttpCtypeJson, HttpGet(HttpApiPlaySignGet)},
+}
+
+//播放, flv是边发边写 不返回数据
+var HttpPlayRoutes = []HttpRoute{
+	{"GET", ".flv", "", "", HttpGet(GetFlv)},
+	//safari地址栏输入播放地址  必须有这个 才能播放
+	{"GET", ".m3u8", "", "application/vnd.apple.mpegurl", HttpGet(GetM3u8)},
+	{"GET", ".ts", "", "video/mp2t", HttpGet(GetTs)},
+}
+
+//处理函数已经自己写完响应, 不用再发送
+var ErrHttpSent = errors.New("http response is sent")
+
+//带http状态码的错误, 没有状态码的按HttpErrorCode()判断
+type HttpError struct {
+	Code int
+	Err  error
+}
+
+func (e *HttpError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HttpError) Unwrap() error {
+	return e.Err
 }
 
-func HttpHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("====== new httpApi request ======")
-	log.Println(r.Proto, r.Method, r.URL, r.RemoteAddr, r.Host)
+func HttpErr(code int, format string, a ...interface{}) error {
+	return &HttpError{Code: code, Err: fmt.Errorf(format, a...)}
+}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Server", AppName)
+//GET请求没有body
+func HttpGet(f func(w http.ResponseWriter, r *http.Request) ([]byte, error)) HttpHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, d []byte) ([]byte, error) {
+		return f(w, r)
+	}
+}
 
-	var rsps []byte
-	var err error
-	if r.Method == "GET" {
-		rsps, err = HttpGetHandler(w, r)
-	} else if r.Method == "POST" {
-		rsps, err = HttpPostHandler(w, r)
-	} else {
-		err = fmt.Errorf("undefined %s request", r.Method)
+func HttpRouteFind(rs []HttpRoute, w http.ResponseWriter, r *http.Request) (*HttpRoute, error) {
+	p := r.URL.Path
+	act := r.URL.Query().Get("action")
+	var allow []string
+	for i := 0; i < len(rs); i++ {
+		rt := &rs[i]
+		if strings.HasPrefix(rt.Path, ".") {
+			if path.Ext(p) != rt.Path {
+				continue
+			}
+		} else if p != rt.Path {
+			continue
+		}
+		if rt.Action != "" && rt.Action != act {
+			continue
+		}
+		if rt.Method != r.Method {
+			allow = append(allow, rt.Method)
+			continue
+		}
+		return rt, nil
 	}
-	if err != nil {
-		log.Println(err)
-		goto ERR
+	if len(allow) > 0 {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		return nil, HttpErr(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+	if p == HttpApiPath {
+		return nil, HttpErr(http.StatusNotFound, "undefined action %s", act)
 	}
+	return nil, HttpErr(http.StatusNotFound, "undefined %s %s request", r.Method, p)
+}
 
-	w.Header().Set("Connection", "Keep-Alive")
-	w.Header().Set("Content-length", strconv.Itoa(len(rsps)))
-	w.Write(rsps)
-	return
-ERR:
-	rsps = GetRsps(500, err.Error())
+func HttpErrorCode(err error) int {
+	var he *HttpError
+	var se *json.SyntaxError
+	var ue *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &he) == true:
+		return he.Code
+	case errors.Is(err, ErrPlayLimit) == true: //超过播放者个数限制
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrHookDeny) == true: //生命周期回调拒绝
+		return http.StatusForbidden
+	case errors.Is(err, ErrPlaySign) == true: //播放地址签名不对 或 已过期
+		return http.StatusForbidden
+	case errors.As(err, &se) == true || errors.As(err, &ue) == true: //请求的json有误
+		return http.StatusBadRequest
+	case errors.Is(err, os.ErrNotExist) == true: //m3u8或ts文件不存在
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func HttpErrorSend(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrHttpSent) == true {
+		return
+	}
+	code := HttpErrorCode(err)
+	rsps := GetRsps(code, err.Error())
+	w.Header().Set("Content-Type", HttpCtypeJson)
 	w.Header().Set("Content-length", strconv.Itoa(len(rsps)))
+	w.WriteHeader(code)
 	w.Write(rsps)
 }
 
+func HttpHandler(rs []HttpRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("====== new httpApi request ======")
+		log.Println(r.Proto, r.Method, r.URL, r.RemoteAddr, r.Host)
+
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Server", AppName)
+
+		var rsps, d []byte
+		rt, err := HttpRouteFind(rs, w, r)
+		if err == nil && r.Method == "POST" {
+			d, err = ioutil.ReadAll(r.Body)
+			log.Printf("PostData: %s", string(d))
+		}
+		if err == nil {
+			rsps, err = rt.Handler(w, r, d)
+		}
+		if err != nil {
+			log.Println(err)
+			HttpErrorSend(w, err)
+			return
+		}
+
+		if rt.Ctype != "" {
+			w.Header().Set("Content-Type", rt.Ctype)
+		}
+		w.Header().Set("Connection", "Keep-Alive")
+		w.Header().Set("Content-length", strconv.Itoa(len(rsps)))
+		w.Write(rsps)
+	}
+}
+
+type HttpListen struct {
+	Name   string //不停服升级时 socket的名称
+	Port   string
+	Routes []HttpRoute
+}
+
+//管理端口和播放端口相同时 不注册get_playSign, 见play_sign.go
+func HttpMngRoutesGet(mng, play string) []HttpRoute {
+	if mng == "" || mng != play {
+		return HttpMngRoutes
+	}
+	var rs []HttpRoute
+	for _, rt := range HttpMngRoutes {
+		if rt.Action == "get_playSign" {
+			log.Printf("PortMng == PortPlay(%s), get_playSign is disabled", mng)
+			continue
+		}
+		rs = append(rs, rt)
+	}
+	return rs
+}
+
 func HttpServer() {
-	http.HandleFunc("/", HttpHandler)
+	HttpListenAll([]HttpListen{
+		{"http", Conf().Http.PortApi, HttpApiRoutes},
+		{"http_mng", Conf().Http.PortMng, HttpMngRoutesGet(Conf().Http.PortMng, Conf().Http.PortPlay)},
+		{"http_play", Conf().Http.PortPlay, HttpPlayRoutes},
+	}, false)
+
+	if Conf().Https.Enable == true {
+		HttpListenAll([]HttpListen{
+			{"https", Conf().Https.PortApi, HttpApiRoutes},
+			{"https_mng", Conf().Https.PortMng, HttpMngRoutesGet(Conf().Https.PortMng, Conf().Https.PortPlay)},
+			{"https_play", Conf().Https.PortPlay, HttpPlayRoutes},
+		}, true)
+	}
+}
+
+//端口相同的 共用一个监听, 名称用第一个的
+func HttpListenAll(hls []HttpListen, isTls bool) {
+	var ports []string
+	names := make(map[string]string)
+	routes := make(map[string][]HttpRoute)
+	for _, hl := range hls {
+		if hl.Port == "" {
+			continue
+		}
+		if _, ok := routes[hl.Port]; ok == false {
+			ports = append(ports, hl.Port)
+			names[hl.Port] = hl.Name
+		}
+		routes[hl.Port] = append(routes[hl.Port], hl.Routes...)
+	}
+	for _, port := range ports {
+		HttpListenStart(names[port], port, routes[port], isTls)
+	}
+}
+
+func HttpListenStart(name, port string, rs []HttpRoute, isTls bool) {
+	addr := fmt.Sprintf("%s:%s", "0.0.0.0", port)
+	log.Printf("==> %s listen on %s", name, addr)
+	l, err := UpgradeListen(nil, name, "tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	addr := fmt.Sprintf("%s:%s", "0.0.0.0", conf.Http.PortApi)
-	log.Printf("==> http listen on %s", addr)
+	hs := &http.Server{
+		Addr:    addr,
+		Handler: HttpHandler(rs),
+	}
 	go func() {
-		err := http.ListenAndServe(addr, nil)
-		if err != nil {
+		//升级时关闭监听 Serve()会返回错误, 已有的连接不受影响
+		if isTls == true {
+			hs.TLSConfig = &tls.Config{
+				CipherSuites: CsArr,
+			}
+			err = hs.ServeTLS(l, Conf().Https.PubKey, Conf().Https.PriKey)
+		} else {
+			err = hs.Serve(l)
+		}
+		if err != nil && UpgradeStopped() == false {
 			log.Fatal(err)
 		}
 	}()
-
-	if conf.Https.Enable == true {
-		addr = fmt.Sprintf("%s:%s", "0.0.0.0", conf.Https.PortApi)
-		log.Println("==> https listen on %s", addr)
-		go func() {
-			https := &http.Server{
-				Addr: addr,
-				TLSConfig: &tls.Config{
-					CipherSuites: CsArr,
-				},
-			}
-			err := https.ListenAndServeTLS(conf.Https.PubKey, conf.Https.PriKey)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}()
-	}
 }
@@ -17,6 +17,14 @@ type UrlArgs struct {
 	Key  string   //ip_port_path[1]_path[n]
 }
 
+var PtclDefaultPort = map[string]string{
+	"rtmp":  "1935",
+	"rtmps": "443",
+	"rtsp":  "554",
+	"http":  "80",
+	"https": "443",
+}
+
 func UrlParse(url string) (UrlArgs, error) {
 	var ua UrlArgs
 	var err error
@@ -44,15 +52,17 @@ func UrlParse(url string) (UrlArgs, error) {
 	}
 
 	s1 := strings.Split(sArr[2], "@")
-	if len(s1) == 1 {
-		s1 = strings.Split(s1[0], ":")
-		ua.Ip = s1[0]
-		ua.Port = s1[1]
-	} else if len(s1) == 2 {
+	if len(s1) == 2 {
 		ua.Auth = s1[0]
-		s1 = strings.Split(s1[1], ":")
-		ua.Ip = s1[0]
+		s1 = s1[1:]
+	}
+	s1 = strings.Split(s1[0], ":")
+	ua.Ip = s1[0]
+	if len(s1) > 1 {
 		ua.Port = s1[1]
+	} else {
+		//url中没有端口, 使用协议默认端口
+		ua.Port = PtclDefaultPort[ua.Ptcl]
 	}
 
 	ua.Key = fmt.Sprintf("%s_%s", ua.Ip, ua.Port)
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+/*************************************************/
+/* 踢掉发布者 或 单个播放者
+/*************************************************/
+//发布者按streamId踢, 拉流的任务也一起删除 不会自动重拉
+//1 rtmp推流: 取消Ctx 关闭连接, 不等待重连, RtmpPublisher0()接收出错后 调用RtmpPublishStop()释放资源
+//2 rtmp拉流: RtmpPullDelete(), rtsp拉流: RtspPullStop(), gb28181: Gb28181Stop()
+//3 rtsp推流: RtspPuberCancel(), rtp_tcp和rtp_udp的都会停止 再调用RtspPuberStop()释放资源
+//4 rtsp和gb28181的内存发布者 关闭源后依次退出, 再置TransmitSwitch为off 收到下个包时退出
+//先找到要踢的 再通过流状态回调上报直播结束, reason为kick, 不存在的不上报
+func PuberKick(sid string) error {
+	_, pull := RtmpPullMap.Load(sid)
+	h, _ := HubStreamCopy(sid)
+	found := pull == true || h.Puber != nil || h.Gb != nil
+	for _, rs := range h.Rtsps {
+		if rs.Rqst != nil || rs.IsPuber == true {
+			found = true
+		}
+	}
+	if found == false {
+		err := HttpErr(http.StatusNotFound, "publisher %s is not exist", sid)
+		log.Println(err)
+		return err
+	}
+	//发布者还在时上报, 才能带上它的宽高编码等信息
+	StreamStopReport(sid, "kick")
+
+	if pull == true {
+		_ = RtmpPullDelete(sid)
+	}
+	for k, rs := range h.Rtsps {
+		if rs.Rqst != nil {
+			log.Printf("kick rtsp pull %s", rs.Key)
+			RtspPullStop(k, rs)
+		} else if rs.IsPuber == true {
+			log.Printf("kick rtsp publisher %s %s", rs.Key, rs.RAddr)
+			rs.log.Printf("kicked by api")
+			RtspPuberCancel(rs)
+		}
+	}
+	if gs := h.Gb; gs != nil {
+		log.Printf("kick gb28181 %s", sid)
+		Gb28181Stop(gs)
+	}
+	if s := h.Puber; s != nil {
+		log.Printf("kick publisher %s %s", sid, s.RemoteAddr)
+		s.log.Printf("kicked by api")
+		s.TransmitSwitch = "off"
+		//等待重连的 RtmpPublishGrace()收到Ctx.Done()后返回
+		if s.Cancel != nil {
+			s.Cancel()
+		}
+		if s.Conn0 != nil {
+			s.Conn0.Close()
+		}
+	}
+	return nil
+}
+
+//播放者按streamId和remoteAddr找, remoteAddr为ip:port, hls没有连接 remoteAddr只用ip
+//1 rtmp/flv: 取消Ctx 关闭连接, 从发布者的Players删除, flv的http请求随后结束
+//2 rtsp: 关闭连接, 从发布者的Players删除
+//3 hls: 删除会话, HlsSessionSec秒内 同一ip再请求m3u8 返回403, PlayLimit或Hook开启时才有hls会话
+func PlayerKick(sid, addr string) error {
+	var n int
+	if s, ok := HubPuberGet(sid); ok == true {
+		s.Players.Range(func(k, v interface{}) bool {
+			p := v.(*Stream)
+			if p.RemoteAddr != addr {
+				return true
+			}
+			log.Printf("kick player %s", p.Key)
+			p.log.Printf("kicked by api")
+			p.PlayClose = true
+			if p.Cancel != nil {
+				p.Cancel()
+			}
+			if p.Conn0 != nil {
+				p.Conn0.Close()
+			}
+			s.Players.Delete(k)
+			n++
+			return true
+		})
+	}
+	for _, rs := range HubRtspsGet(sid) {
+		rs.Players.Range(func(k, v interface{}) bool {
+			p := v.(*RtspStream)
+			if p.RAddr != addr {
+				return true
+			}
+			log.Printf("kick rtsp player %s %s", p.Key, p.RAddr)
+			p.log.Printf("kicked by api")
+			p.Conn.Close()
+			rs.Players.Delete(k)
+			HookRtspPlayerStop(p)
+			PlayRelease(p.PlayTicket)
+			n++
+			return true
+		})
+	}
+	//rtmp flv rtsp都没有的 再找hls, 避免同ip的hls会话被误踢
+	if n == 0 && HlsSessionKick(sid, addr) == true {
+		n++
+	}
+
+	if n == 0 {
+		err := HttpErr(http.StatusNotFound, "player %s of %s is not exist", addr, sid)
+		log.Println(err)
+		return err
+	}
+	return nil
+}
@@ -30,7 +30,7 @@ import (
 //ptcl is protocol
 func GetTempLogFn(ptcl string) string {
 	ts := utils.GetTimestamp("ns")
-	s := fmt.Sprintf("%s/stream_%s_%d.log", conf.Log.StreamLogPath, ptcl, ts)
+	s := fmt.Sprintf("%s/stream_%s_%d.log", Conf().Log.StreamLogPath, ptcl, ts)
 	log.Printf("TempLogFn: %s", s)
 	return s
 }
@@ -82,8 +82,8 @@ func TryDelFile(fis []utils.FileInfo) {
 	var dfn int
 
 	ct := utils.GetTimestamp("s")
-	pdt := ct - int64(conf.Log.PubLogSaveDay*86400)
-	fdt := ct - int64(conf.Log.PlayLogDelete*60)
+	pdt := ct - int64(Conf().Log.PubLogSaveDay*86400)
+	fdt := ct - int64(Conf().Log.PlayLogDelete*60)
 	l := len(fis)
 
 	for i := 0; i < l; i++ {
@@ -109,18 +109,18 @@ func TryDelFile(fis []utils.FileInfo) {
 
 func PlayerLogDeleteTimer() {
 	log.Println("LogDeleteTimer() start")
-	err := utils.DirExist(conf.Log.StreamLogPath, true)
+	err := utils.DirExist(Conf().Log.StreamLogPath, true)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
 	var fis []utils.FileInfo
-	m := time.Duration(conf.Log.PlayLogCheck)
+	m := time.Duration(Conf().Log.PlayLogCheck)
 	for {
 		log.Println("=== delete PlayLogFile start ===")
 		//获取所有文件全路径和最后修改时间
-		fis, err = utils.GetAllFile(conf.Log.StreamLogPath)
+		fis, err = utils.GetAllFile(Conf().Log.StreamLogPath)
 		if err != nil {
 			log.Println(err)
 			time.Sleep(m * time.Minute)
@@ -130,7 +130,7 @@ func PlayerLogDeleteTimer() {
 		//删除一小时之前的播放日志文件 和 7天之前的publish日志
 		TryDelFile(fis)
 		//删除streamlog/streamid空目录
-		utils.DelEmptyDir(conf.Log.StreamLogPath)
+		utils.DelEmptyDir(Conf().Log.StreamLogPath)
 
 		log.Println("=== delete PlayLogFile stop ===")
 		time.Sleep(m * time.Minute)
@@ -142,7 +142,7 @@ func PlayerLogDeleteTimer() {
 /*************************************************/
 func PuberLogCutoffTimer() {
 	log.Println("LogCutoffTimer() start")
-	err := utils.DirExist(conf.Log.StreamLogPath, true)
+	err := utils.DirExist(Conf().Log.StreamLogPath, true)
 	if err != nil {
 		log.Fatal(err)
 		return
@@ -156,10 +156,8 @@ func PuberLogCutoffTimer() {
 	log.Printf("=== slepp %d second, cutoff publish log ===", iTime)
 	time.Sleep(time.Second * time.Duration(iTime))
 
-	var p *Stream
 	for {
-		StreamMap.Range(func(k, v interface{}) bool {
-			p, _ = v.(*Stream)
+		HubGbRange(func(p *Stream) bool {
 			p.LogCutoff = true
 			return true
 		})
@@ -173,7 +171,7 @@ func PuberLogCutoffTimer() {
 //sleep时间差, 然后 通过chan 发送日志切割消息给
 func LogCutoffAction(s *Stream, pType string) error {
 	/*
-		folder := fmt.Sprintf("%s/%s", conf.Log.StreamLogPath, s.AmfInfo.StreamId)
+		folder := fmt.Sprintf("%s/%s", Conf().Log.StreamLogPath, s.AmfInfo.StreamId)
 		fn := fmt.Sprintf("%s/publish_%s_%s.log", folder, pType, utils.GetYMD())
 
 		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	utils "utilsGIT"
 
@@ -26,14 +27,14 @@ const (
 )
 
 var (
-	CompileDate     string
-	h, v, d, u      bool
-	c, RunPath      string
-	conf            Config
-	RtmpPuberMap    sync.Map //所有rtmp发布者, 含其他协议推rtmp
-	RtspPuberMap    sync.Map //所有rtsp发布者, 含其他协议推rtsp
-	RtspRtpPortMap  sync.Map //RtpTcp多端口, RtpUdp单/多端口
-	GB28181PuberMap sync.Map //所有gb28181发布者, 含其他协议推gb28181
+	CompileDate    string
+	h, v, d, u     bool
+	c, RunPath     string
+	RtmpPullMap    sync.Map //所有rtmp拉流代理任务, key为streamId
+	RtspRtpPortMap sync.Map //RtpTcp多端口, RtpUdp单/多端口
+	HlsVisitMap    sync.Map //hls最后请求时间(毫秒), key为streamId
+	LogWriter      *lumberjack.Logger
+	confVal        atomic.Value
 
 	//SSL/TLS协议信息泄露漏洞(CVE-2016-2183)
 	//解决方法 建议：避免使用DES算法
@@ -79,6 +80,16 @@ type Config struct {
 	RtpRtcp   RtpRtcpConf
 	Rtsp      RtspConf
 	Rtmp      RtmpConf
+	Rtmps     RtmpsConf
+	Publish   PublishConf
+	IdleStop  IdleStopConf
+	TsFix     TsFixConf
+	Congest   CongestConf
+	PlayLimit PlayLimitConf
+	PlaySign  PlaySignConf
+	Upgrade   UpgradeConf
+	Forward   ForwardConf
+	Hook      HookConf
 	Flv       FlvConf
 	HlsLive   HlsLiveConf
 	HlsRec    HlsRecConf
@@ -88,8 +99,6 @@ type Config struct {
 	Nt        NetworkTrafficConf
 	Cc        CcConf
 
-	AdjustDts          bool
-	AdjustPktNum       uint32
 	DelayDeleteThred   uint32
 	PlayStockMax       int
 	DataStockMax       int
@@ -97,8 +106,8 @@ type Config struct {
 	StreamStatekMax    int
 	PlayStockWarn      int
 	PlaySendBlockMax   int
-	MaxPlayerNum       int
-	DelayDeleteTime    int
+	MaxPlayerNum       int //每个流的播放者个数限制, PlayLimit.Enable为true时生效
+	DelayDeleteTime    int //发布者断线后 等待重连的秒数, 0表示不等待
 }
 
 type CpuConf struct {
@@ -149,6 +158,7 @@ type RtpRtcpConf struct {
 	RtpPktChanNum  int
 	RtcpPktChanNum int
 	PsPktChanNum   int
+	MemPush        bool //true走内存发布到StreamHub, false走网络推给127.0.0.1:1935
 }
 
 type RtspConf struct {
@@ -174,6 +184,108 @@ type RtmpConf struct {
 	GopFrameNum       uint32
 	BitrateGopNum     uint32
 	PublishTimeout    int
+	PullRetryMinSec   int //拉流代理重连间隔初始值, 每次失败翻倍
+	PullRetryMaxSec   int //拉流代理重连间隔最大值
+}
+
+//rtmps证书 复用Https的PubKey和PriKey
+type RtmpsConf struct {
+	Enable     bool
+	Port       string
+	SkipVerify bool //rtmps推拉流时 是否跳过对方证书校验
+}
+
+//同一个streamId已有发布者时 新发布者的处理, rtmp/rtsp/gb28181都一样
+//Takeover取值 reject:拒绝新的(默认), kick:踢掉旧的, idle:旧的空闲IdleSec秒才踢掉
+//踢掉旧的发布者时 播放者不断开, 转到新的发布者
+type PublishConf struct {
+	Takeover string
+	IdleSec  int
+}
+
+//按需拉流 无人观看自动断流, 分钟数为0 表示这类拉流不自动断流
+//播放者包括rtmp/flv/rtsp播放, hls按最后一次请求m3u8或ts的时间算
+type IdleStopConf struct {
+	Enable      bool
+	CheckSec    int //检查间隔, 默认10秒
+	RtspPullMin int //create_streamProxy的rtsp拉流
+	RtmpPullMin int //create_rtmpProxy的rtmp拉流
+	Gb28181Min  int //create_pullChannel的gb28181流
+	RtspPlayMin int //rtsp播放触发的rtsp订阅
+}
+
+//音视频时间戳修正, 所有接入的流都经过RtmpSender() 在那里修正
+type TsFixConf struct {
+	Enable       bool
+	JumpMs       uint32 //相邻两帧差值超过这个值 认为是跳变, 默认1000
+	DriftMs      uint32 //音频超前或落后视频超过这个值 开始修正, 0不修正
+	VideoDeltaMs uint32 //metadata没有framerate时 视频的默认帧间隔
+	AudioDeltaMs uint32 //音频的默认帧间隔
+}
+
+//播放者网络差 PlayChan积压时的处理方式, 按输出协议配置
+//close: 积压到PlayStockMax 断开播放者(原来的方式)
+//drop: 积压超过NonRefPct% 丢非参考帧, 超过GopPct% 音视频一起丢 直到积压小于NonRefPct%后的关键帧
+type CongestConf struct {
+	Enable    bool
+	Rtmp      string //rtmp播放, close或drop
+	Flv       string //flv播放, close或drop
+	NonRefPct int
+	GopPct    int
+}
+
+//播放者个数限制, 每个流的限制为MaxPlayerNum, 0表示不限制, 详见play_limit.go
+type PlayLimitConf struct {
+	Enable        bool
+	AppMax        map[string]int //key为app
+	GlobalMax     int            //整个服务
+	HlsSessionSec int            //hls会话多少秒没有请求 就不算播放者, 默认30
+}
+
+//播放地址签名, 详见play_sign.go
+type PlaySignConf struct {
+	Enable     bool
+	Secret     string            //默认密钥
+	AppSecrets map[string]string //key为app, 有的用它 没有的用Secret
+	BindIp     bool              //签名是否包含客户端ip
+	ApiToken   string            //get_playSign接口的token, 为空时接口不可用
+	ExpireMax  int               //get_playSign的expire最大秒数, 默认86400
+}
+
+//不停服升级, 详见upgrade.go
+type UpgradeConf struct {
+	Enable   bool
+	DrainSec int //老进程等待发布者断开的最长时间, 默认600秒
+}
+
+//转推, 一路推流 转推给多个cdn
+//Targets的key为streamId, 这个流开始推流时 自动转推给value里的地址
+type ForwardConf struct {
+	Enable      bool
+	ChanNum     int //每个转推目标独立的数据队列长度
+	RetryMinSec int //重推间隔初始值, 每次失败翻倍
+	RetryMaxSec int //重推间隔最大值
+	Targets     map[string][]string
+}
+
+//生命周期回调, 详见hook.go
+//Apps的key为app, 配置了某个事件url的app 这个事件用它的url, 其他事件还用Urls里的
+type HookConf struct {
+	Enable     bool
+	TimeoutSec int    //每次请求的超时时间, 默认3秒
+	Retry      int    //连接失败和5xx的重试次数
+	FailAllow  bool   //on_publish和on_play请求失败时 是否放行
+	Secret     string //签名密钥, 为空不签名
+	Urls       HookUrls
+	Apps       map[string]HookUrls
+}
+
+type HookUrls struct {
+	OnConnect []string
+	OnPublish []string
+	OnPlay    []string
+	OnStop    []string
+	OnRecord  []string
 }
 
 type FlvConf struct {
@@ -240,21 +352,23 @@ func InitConf(file string) error {
 		return err
 	}
 
-	err = json.Unmarshal(s, &conf)
+	var nc Config
+	err = json.Unmarshal(s, &nc)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
+	confVal.Store(&nc)
 
-	if conf.Cpu.Enable == true {
+	if Conf().Cpu.Enable == true {
 		ncpu := runtime.NumCPU()
-		if conf.Cpu.UseNum < ncpu {
-			ncpu = conf.Cpu.UseNum
+		if Conf().Cpu.UseNum < ncpu {
+			ncpu = Conf().Cpu.UseNum
 		}
 		runtime.GOMAXPROCS(ncpu)
 	}
 
-	err = utils.DirExist(conf.Log.StreamLogPath, true)
+	err = utils.DirExist(Conf().Log.StreamLogPath, true)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -265,10 +379,11 @@ func InitConf(file string) error {
 func InitLog(file string) {
 	//return // 前台打印日志
 	l := new(lumberjack.Logger)
-	l.Filename = conf.Log.FileName
-	l.MaxSize = conf.Log.FileSize   // 200BM
-	l.MaxBackups = conf.Log.FileNum // 10
-	l.MaxAge = conf.Log.SaveDay     // 15
+	LogWriter = l
+	l.Filename = Conf().Log.FileName
+	l.MaxSize = Conf().Log.FileSize   // 200BM
+	l.MaxBackups = Conf().Log.FileNum // 10
+	l.MaxAge = Conf().Log.SaveDay     // 15
 
 	log.SetOutput(l)
 	log.Printf("========================================")
@@ -280,7 +395,7 @@ func InitLog(file string) {
 	log.Printf("========================================")
 	log.Printf("Args: h=%t, v=%t, d=%t, u=%t", h, v, d, u)
 	log.Printf("ConfigFile: %s", c)
-	log.Printf("%#v", conf)
+	log.Printf("%#v", *Conf())
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGHUP)
@@ -288,6 +403,7 @@ func InitLog(file string) {
 		for {
 			<-ch
 			l.Rotate()
+			ConfReload() //kill -HUP 重新加载配置
 		}
 	}()
 }
@@ -306,11 +422,14 @@ func (p *program) run() {
 		return
 	}
 
-	InitLog(conf.Log.FileName)
+	InitLog(Conf().Log.FileName)
 	//go PlayerLogDeleteTimer() //定期清理不更新的播放者日志
 	//go PuberLogCutoffTimer() //每天0点分割清理发布者日志
 	//go NetworkTrafficTimer() //流量统计与上报
 
+	//升级启动时 接过老进程的gb28181会话 和 rtsp的udp包转发, 见upgrade.go
+	UpgradeHandover()
+
 	go SipServerTcp()  //for gb28181
 	go SipServerUdp()  //for gb28181
 	go RtpServerTcp()  //for gb28181
@@ -319,6 +438,11 @@ func (p *program) run() {
 	//go RtcpServerUdp() //for gb28181
 	go RtspServer()
 	go RtmpServer()
+	go RtmpsServer()
+	go IdleStopTimer() //按需拉流 无人观看自动断流
+	go UpgradeSignal() //kill -USR2 不停服升级
+	//hls会话过期删除
+	go HlsSessionTimer()
 
 	HttpServer() //api, mng, flvPlay, hlsPlay
 	select {}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*************************************************/
+/* prometheus监控 GET /metrics
+/*************************************************/
+//在管理端口Http.PortMng上, 路由见http_server.go
+//1 计数器(counter) 在数据经过的地方累加, 用atomic 不加锁
+//  ingest按RtmpSender()收到的rtmp消息长度算, egress按写给播放者的数据长度算
+//2 状态值(gauge) 在请求/metrics时 遍历StreamHub现算
+//3 hls切片时长和cc接口耗时 用直方图(histogram)
+//每个流的码率 帧率 通道积压 带stream标签, 流很多时 采集间隔不要太短
+var MetricsPtcls = []string{"rtmp", "flv", "rtsp", "gb28181", "hls"}
+
+var (
+	MetricsInBytes  = MetricsPtclMap() //接收的字节数, key为协议
+	MetricsOutBytes = MetricsPtclMap() //发送给播放者的字节数, key为协议
+	MetricsRtpLoss  = MetricsPtclMap() //rtp丢包个数, 只有rtsp和gb28181
+	MetricsRtpOoo   = MetricsPtclMap() //rtp乱序个数, 只有rtsp和gb28181
+
+	MetricsCcErrors = map[string]*uint64{"auth": new(uint64), "report": new(uint64)}
+	MetricsCcTime   = map[string]*MetricsHist{
+		"auth":   MetricsHistNew([]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}),
+		"report": MetricsHistNew([]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}),
+	}
+	MetricsHlsDur = map[string]*MetricsHist{
+		"live": MetricsHistNew([]float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20, 30}),
+		"rec":  MetricsHistNew([]float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20, 30}),
+	}
+)
+
+type MetricsHist struct {
+	Mutex  sync.Mutex
+	Bounds []float64 //桶的上限, 从小到大
+	Counts []uint64  //小于等于Bounds[i]的个数
+	Sum    float64
+	Num    uint64
+}
+
+//map创建后只读, 值用atomic修改
+func MetricsPtclMap() map[string]*uint64 {
+	m := make(map[string]*uint64)
+	for _, p := range MetricsPtcls {
+		m[p] = new(uint64)
+	}
+	return m
+}
+
+func MetricsAdd(m map[string]*uint64, key string, n uint64) {
+	if v, ok := m[key]; ok == true {
+		atomic.AddUint64(v, n)
+	}
+}
+
+func MetricsHistNew(bounds []float64) *MetricsHist {
+	return &MetricsHist{Bounds: bounds, Counts: make([]uint64, len(bounds))}
+}
+
+func MetricsHistObserve(h *MetricsHist, v float64) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for i, b := range h.Bounds {
+		if v <= b {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += v
+	h.Num++
+}
+
+//发布者的接入协议, 内存发布者的RemoteAddr是rtsp或gb28181
+func MetricsPuberPtcl(s *Stream) string {
+	if s.Type == "MemPuber" {
+		return s.RemoteAddr
+	}
+	return "rtmp"
+}
+
+//播放者的协议
+func MetricsPlayerPtcl(p *Stream) string {
+	if p.Type == "flvPlayer" {
+		return "flv"
+	}
+	return "rtmp"
+}
+
+//cc接口调用结束时调用, api为auth或report
+func MetricsCcObserve(api string, st time.Time, err error) {
+	if err != nil {
+		atomic.AddUint64(MetricsCcErrors[api], 1)
+	}
+	MetricsHistObserve(MetricsCcTime[api], time.Since(st).Seconds())
+}
+
+/*************************************************/
+/* rtp丢包和乱序统计
+/*************************************************/
+type RtpSeqStat struct {
+	Init bool
+	Need uint16 //期待的下一个rtp包序号
+}
+
+//序号比期待的大 中间的算丢包, 比期待的小 算乱序(晚到的包)
+//相差超过1000的 认为是重新开始计数 不统计
+func RtpSeqCount(ptcl string, rs *RtpSeqStat, seq uint16) {
+	if rs.Init == false {
+		rs.Init = true
+		rs.Need = seq + 1
+		return
+	}
+	d := int16(seq - rs.Need)
+	switch {
+	case d > 1000 || d < -1000:
+		rs.Need = seq + 1
+	case d > 0:
+		MetricsAdd(MetricsRtpLoss, ptcl, uint64(d))
+		rs.Need = seq + 1
+	case d < 0:
+		MetricsAdd(MetricsRtpOoo, ptcl, 1)
+	default:
+		rs.Need = seq + 1
+	}
+}
+
+/*************************************************/
+/* /metrics输出
+/*************************************************/
+type MetricsWriter struct {
+	b    strings.Builder
+	name string //当前指标名, 换指标时输出HELP和TYPE
+}
+
+func MetricsHead(mw *MetricsWriter, name, typ, help string) {
+	mw.name = fmt.Sprintf("sms_%s", name)
+	mw.b.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", mw.name, help, mw.name, typ))
+}
+
+//labels为 k1, v1, k2, v2 ...
+func MetricsLine(mw *MetricsWriter, v float64, labels ...string) {
+	MetricsLineSuffix(mw, "", v, labels...)
+}
+
+func MetricsLineSuffix(mw *MetricsWriter, suffix string, v float64, labels ...string) {
+	mw.b.WriteString(mw.name + suffix)
+	if len(labels) > 0 {
+		ls := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			lv := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+			ls = append(ls, fmt.Sprintf("%s=\"%s\"", labels[i], lv))
+		}
+		mw.b.WriteString("{" + strings.Join(ls, ",") + "}")
+	}
+	mw.b.WriteString(fmt.Sprintf(" %v\n", v))
+}
+
+func MetricsPtclLines(mw *MetricsWriter, m map[string]*uint64, ptcls []string) {
+	for _, p := range ptcls {
+		MetricsLine(mw, float64(atomic.LoadUint64(m[p])), "protocol", p)
+	}
+}
+
+func MetricsHistLines(mw *MetricsWriter, h *MetricsHist, k, v string) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for i, b := range h.Bounds {
+		MetricsLineSuffix(mw, "_bucket", float64(h.Counts[i]), k, v, "le", fmt.Sprintf("%v", b))
+	}
+	MetricsLineSuffix(mw, "_bucket", float64(h.Num), k, v, "le", "+Inf")
+	MetricsLineSuffix(mw, "_sum", h.Sum, k, v)
+	MetricsLineSuffix(mw, "_count", float64(h.Num), k, v)
+}
+
+type MetricsStream struct {
+	Sid        string
+	GopBitrate uint32
+	VideoFps   uint32
+	AudioFps   uint32
+	Chans      map[string][2]int //key为通道名, value为长度和容量
+}
+
+func MetricsCollect() string {
+	var mw MetricsWriter
+	pubs := make(map[string]int)
+	plays := make(map[string]int)
+	var mss []MetricsStream
+
+	HubPuberRange(func(s *Stream) bool {
+		pubs[MetricsPuberPtcl(s)]++
+		ms := MetricsStream{Sid: s.Key, GopBitrate: s.GopBitrate, VideoFps: s.VideoFps, AudioFps: s.AudioFps}
+		ms.Chans = map[string][2]int{
+			"DataChan":    {len(s.DataChan), cap(s.DataChan)},
+			"HlsChan":     {len(s.HlsChan), cap(s.HlsChan)},
+			"HlsLiveChan": {len(s.HlsLiveChan), cap(s.HlsLiveChan)},
+		}
+		//播放者的PlayChan 取积压最多的
+		var pc [2]int
+		s.Players.Range(func(k, v interface{}) bool {
+			p := v.(*Stream)
+			plays[MetricsPlayerPtcl(p)]++
+			if len(p.PlayChan) >= pc[0] {
+				pc = [2]int{len(p.PlayChan), cap(p.PlayChan)}
+			}
+			return true
+		})
+		ms.Chans["PlayChan"] = pc
+		mss = append(mss, ms)
+		return true
+	})
+	HubRtspRange(func(k string, rs *RtspStream) bool {
+		rs.Players.Range(func(k, v interface{}) bool {
+			plays["rtsp"]++
+			return true
+		})
+		return true
+	})
+	for _, n := range HlsSessionNums() {
+		plays["hls"] += n
+	}
+	//gb28181的rtp包通道 在gb28181会话上, 不在发布者上
+	gbs := make(map[string][2]int)
+	HubGbRange(func(s *Stream) bool {
+		if s.RtpPktChan != nil {
+			gbs[s.Key] = [2]int{len(s.RtpPktChan), cap(s.RtpPktChan)}
+		}
+		return true
+	})
+	sort.Slice(mss, func(i, j int) bool { return mss[i].Sid < mss[j].Sid })
+
+	MetricsHead(&mw, "publishers", "gauge", "Current publishers by ingest protocol.")
+	for _, p := range []string{"rtmp", "rtsp", "gb28181"} {
+		MetricsLine(&mw, float64(pubs[p]), "protocol", p)
+	}
+	MetricsHead(&mw, "players", "gauge", "Current players by egress protocol.")
+	for _, p := range []string{"rtmp", "flv", "rtsp", "hls"} {
+		MetricsLine(&mw, float64(plays[p]), "protocol", p)
+	}
+	MetricsHead(&mw, "ingest_bytes_total", "counter", "Media bytes received from publishers.")
+	MetricsPtclLines(&mw, MetricsInBytes, []string{"rtmp", "rtsp", "gb28181"})
+	MetricsHead(&mw, "egress_bytes_total", "counter", "Media bytes sent to players.")
+	MetricsPtclLines(&mw, MetricsOutBytes, []string{"rtmp", "flv", "rtsp", "hls"})
+	MetricsHead(&mw, "rtp_lost_packets_total", "counter", "RTP packets missing by sequence number.")
+	MetricsPtclLines(&mw, MetricsRtpLoss, []string{"rtsp", "gb28181"})
+	MetricsHead(&mw, "rtp_reordered_packets_total", "counter", "RTP packets arrived out of order.")
+	MetricsPtclLines(&mw, MetricsRtpOoo, []string{"rtsp", "gb28181"})
+
+	MetricsHead(&mw, "stream_gop_bitrate_kbps", "gauge", "Bitrate of the stream measured over GOPs.")
+	for _, ms := range mss {
+		MetricsLine(&mw, float64(ms.GopBitrate), "stream", ms.Sid)
+	}
+	MetricsHead(&mw, "stream_fps", "gauge", "Frame rate of the stream.")
+	for _, ms := range mss {
+		MetricsLine(&mw, float64(ms.VideoFps), "stream", ms.Sid, "track", "video")
+		MetricsLine(&mw, float64(ms.AudioFps), "stream", ms.Sid, "track", "audio")
+	}
+	MetricsHead(&mw, "chan_len", "gauge", "Queued items in the channel, PlayChan is the most backlogged player.")
+	for _, ms := range mss {
+		for _, n := range []string{"DataChan", "HlsChan", "HlsLiveChan", "PlayChan"} {
+			MetricsLine(&mw, float64(ms.Chans[n][0]), "stream", ms.Sid, "chan", n)
+		}
+	}
+	for sid, c := range gbs {
+		MetricsLine(&mw, float64(c[0]), "stream", sid, "chan", "RtpPktChan")
+	}
+	MetricsHead(&mw, "chan_cap", "gauge", "Capacity of the channel.")
+	for _, ms := range mss {
+		for _, n := range []string{"DataChan", "HlsChan", "HlsLiveChan", "PlayChan"} {
+			MetricsLine(&mw, float64(ms.Chans[n][1]), "stream", ms.Sid, "chan", n)
+		}
+	}
+	for sid, c := range gbs {
+		MetricsLine(&mw, float64(c[1]), "stream", sid, "chan", "RtpPktChan")
+	}
+
+	MetricsHead(&mw, "hls_segment_seconds", "histogram", "Duration of finished HLS segments.")
+	for _, t := range []string{"live", "rec"} {
+		MetricsHistLines(&mw, MetricsHlsDur[t], "type", t)
+	}
+	MetricsHead(&mw, "cc_request_seconds", "histogram", "Latency of requests to the control center.")
+	for _, a := range []string{"auth", "report"} {
+		MetricsHistLines(&mw, MetricsCcTime[a], "api", a)
+	}
+	MetricsHead(&mw, "cc_request_errors_total", "counter", "Failed requests to the control center.")
+	for _, a := range []string{"auth", "report"} {
+		MetricsLine(&mw, float64(atomic.LoadUint64(MetricsCcErrors[a])), "api", a)
+	}
+	return mw.b.String()
+}
+
+func MetricsGet(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	return []byte(MetricsCollect()), nil
+}
@@ -44,7 +44,7 @@ func TrafficReport(s *Stream, ti TrafficInfo, dataType, dataProtocol string) {
 	rqst.StreamId = s.AmfInfo.StreamId
 	rqst.StartTime = ti.StartTime
 	rqst.Duration = ti.Duration
-	rqst.IpInner = conf.IpInner
+	rqst.IpInner = Conf().IpInner
 	//rqst.IpOuter = conf.IpOuter
 	rqst.IpClient = "127.0.0.1"
 	rqst.DataType = dataType
@@ -52,7 +52,7 @@ func TrafficReport(s *Stream, ti TrafficInfo, dataType, dataProtocol string) {
 	rqst.DataSize = ti.DataSize
 
 	//http://127.0.0.1:8999/api/v1/flowReport
-	url := fmt.Sprintf(conf.Nt.Server)
+	url := fmt.Sprintf(Conf().Nt.Server)
 	//s.log.Printf("TrafficUrl: %s", url)
 	//s.log.Printf("TrafficData: %#v", rqst)
 
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+/*************************************************/
+/* 播放者拥塞 丢帧
+/*************************************************/
+//每个播放者有PlayChan, 播放者网络差时 PlayChan会积压
+//以前积压到PlayStockMax 就断开播放者, 现在可以按CongestConf 逐级丢帧
+//1 积压超过NonRefPct%, 丢非参考帧(h264的nal_ref_idc=0, h265的TRAIL_N等), 不影响其他帧解码
+//2 积压超过GopPct%, 音视频一起丢 直到下一个关键帧, 积压还没降下来的 继续丢下一个gop
+//3 音频跟视频一起恢复, 从关键帧开始 音视频同步
+//4 PlayChan连续PlaySendBlockMax次是满的 还是断开
+//5 metadata和音视频头不丢, 丢帧次数按播放者统计, 通过action=get_playDrops查询
+//  统计在发送协程里修改 在http协程里读, 都用atomic
+type PlayDropStat struct {
+	NonRefNum uint32 `json:"nonRefNum"` //丢弃的非参考帧
+	GopNum    uint32 `json:"gopNum"`    //开始丢gop的次数
+	VideoNum  uint32 `json:"videoNum"`  //丢gop时丢弃的视频帧
+	AudioNum  uint32 `json:"audioNum"`  //丢gop时丢弃的音频帧
+}
+
+// 播放者的拥塞处理方式, close或drop
+func PlayCongestMode(p *Stream) string {
+	if Conf().Congest.Enable == false {
+		return "close"
+	}
+	switch p.Type {
+	case "rtmpPlayer":
+		return Conf().Congest.Rtmp
+	case "flvPlayer":
+		return Conf().Congest.Flv
+	}
+	return "close"
+}
+
+// 要求0 < NonRefPct < GopPct <= 100, 否则积压为0时就丢帧, 不满足的用默认值50和80
+func PlayCongestPct() (int, int) {
+	nr, gop := Conf().Congest.NonRefPct, Conf().Congest.GopPct
+	if nr <= 0 || gop <= nr || gop > 100 {
+		return 50, 80
+	}
+	return nr, gop
+}
+
+// 读丢帧统计
+func PlayDropGet(p *Stream) PlayDropStat {
+	var ds PlayDropStat
+	ds.NonRefNum = atomic.LoadUint32(&p.PlayDrop.NonRefNum)
+	ds.GopNum = atomic.LoadUint32(&p.PlayDrop.GopNum)
+	ds.VideoNum = atomic.LoadUint32(&p.PlayDrop.VideoNum)
+	ds.AudioNum = atomic.LoadUint32(&p.PlayDrop.AudioNum)
+	return ds
+}
+
+// s是发布者, p是播放者, 只在LiveDataSend()中调用, 返回true表示c要丢弃
+func PlayCongestDrop(s, p *Stream, c *Chunk) bool {
+	if PlayCongestMode(p) != "drop" {
+		return false
+	}
+	n := len(p.PlayChan)
+	//一直满的 播放者可能已经断开, 连续PlaySendBlockMax次 就断开
+	if n >= Conf().PlayStockMax {
+		p.PlayBlockNum++
+		if Conf().PlaySendBlockMax > 0 && p.PlayBlockNum > Conf().PlaySendBlockMax {
+			p.log.Printf("congest PlayChanNum=%d(%d) %d times, stop play", n, Conf().PlayStockMax, p.PlayBlockNum)
+			p.PlayClose = true
+		}
+	} else {
+		p.PlayBlockNum = 0
+	}
+	nr, gop := PlayCongestPct()
+	nl := Conf().PlayStockMax * nr / 100
+	gl := Conf().PlayStockMax * gop / 100
+	video := c.DataType == "VideoKeyFrame" || c.DataType == "VideoInterFrame"
+	audio := AudioFrameCheck(c.DataType)
+	if video == false && audio == false {
+		return n >= Conf().PlayStockMax
+	}
+
+	if p.PlayDropGop == true {
+		//没有视频的流 音频积压降下来就恢复
+		if n < nl && (c.DataType == "VideoKeyFrame" || (audio == true && s.VideoCodecType == "")) {
+			p.PlayDropGop = false
+			p.log.Printf("congest resume, PlayChanNum=%d(%d), drop %#v", n, Conf().PlayStockMax, PlayDropGet(p))
+			return false
+		}
+		PlayDropCount(p, video)
+		return true
+	}
+
+	if n >= gl || n >= Conf().PlayStockMax {
+		p.PlayDropGop = true
+		atomic.AddUint32(&p.PlayDrop.GopNum, 1)
+		p.log.Printf("congest drop gop, PlayChanNum=%d(%d), DataType=%s", n, Conf().PlayStockMax, c.DataType)
+		PlayDropCount(p, video)
+		return true
+	}
+	if n >= nl && c.DataType == "VideoInterFrame" && ChunkIsNonRef(c) == true {
+		nn := atomic.AddUint32(&p.PlayDrop.NonRefNum, 1)
+		if nn%100 == 1 {
+			p.log.Printf("congest drop non-ref frame, PlayChanNum=%d(%d), NonRefNum=%d", n, Conf().PlayStockMax, nn)
+		}
+		return true
+	}
+	return false
+}
+
+func PlayDropCount(p *Stream, video bool) {
+	if video == true {
+		atomic.AddUint32(&p.PlayDrop.VideoNum, 1)
+	} else {
+		atomic.AddUint32(&p.PlayDrop.AudioNum, 1)
+	}
+}
+
+// 视频帧是否为非参考帧, 看第一个slice
+// h264: nal_ref_idc=0; h265: TRAIL_N TSA_N STSA_N RADL_N RASL_N 等偶数类型
+func ChunkIsNonRef(c *Chunk) bool {
+	f, err := ChunkVideo2AvFrame(c)
+	if err != nil {
+		return false
+	}
+	for _, n := range f.Nalus {
+		if len(n) == 0 {
+			continue
+		}
+		switch f.CodecId {
+		case AvCodecIdH264:
+			t := n[0] & 0x1f
+			if t >= 1 && t <= 5 {
+				return n[0]&0x60 == 0
+			}
+		case AvCodecIdH265:
+			t := (n[0] >> 1) & 0x3f
+			if t < 32 {
+				return t < 16 && t%2 == 0
+			}
+		default:
+			return false
+		}
+	}
+	return false
+}
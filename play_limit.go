@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"utils"
+)
+
+/*************************************************/
+/* 播放者个数限制
+/*************************************************/
+//rtmp flv rtsp播放者 和 活跃的hls会话 都算播放者, 按流 按app 按整个服务 分别限制
+//1 每个流的限制为MaxPlayerNum, 推流鉴权返回playerMax的 用返回的, -1表示不限制
+//2 每个app的限制为PlayLimit.AppMax[app], 整个服务的限制为PlayLimit.GlobalMax, 0表示不限制
+//3 超过限制的新播放者 rtmp返回onStatus NetStream.Play.Failed, http返回503, rtsp返回453
+//4 hls没有连接, PlayLimit.HlsSessionSec秒内 请求过m3u8或ts的ip 算一个播放者
+//5 PlayAdmit()在锁内 检查和加1一起完成, 同时来的播放者 不会都通过检查
+//  返回的PlayTicket 在播放者退出 或 之后的步骤(如 生命周期回调)失败时 调用PlayRelease()减1
+//  不管是否开启限制 都计数, 重载配置开启限制后 个数也是准的
+var ErrPlayLimit = errors.New("player num limit")
+
+//播放者占用的名额, PlayRelease()只减一次
+type PlayTicket struct {
+	App  string
+	Sid  string
+	Done int32
+}
+
+var (
+	PlayNumMutex sync.Mutex
+	PlayNumSid   = make(map[string]int) //key为streamId
+	PlayNumApp   = make(map[string]int) //key为app
+	PlayNumAll   int
+)
+
+//返回错误表示超过限制, 不能播放
+func PlayAdmit(app, sid string) (*PlayTicket, error) {
+	var err error
+	smax := Conf().MaxPlayerNum
+	if s, ok := HubPuberGet(sid); ok == true && s.PubAuth.Data.PlayerMax != 0 {
+		smax = s.PubAuth.Data.PlayerMax
+	}
+	amax := Conf().PlayLimit.AppMax[app]
+	gmax := Conf().PlayLimit.GlobalMax
+
+	PlayNumMutex.Lock()
+	defer PlayNumMutex.Unlock()
+	sn, an, gn := PlayNumSid[sid], PlayNumApp[app], PlayNumAll
+	if Conf().PlayLimit.Enable == true {
+		if smax > 0 && sn >= smax {
+			err = fmt.Errorf("%w, stream %s %d(%d)", ErrPlayLimit, sid, sn, smax)
+			return nil, err
+		}
+		if amax > 0 && an >= amax {
+			err = fmt.Errorf("%w, app %s %d(%d)", ErrPlayLimit, app, an, amax)
+			return nil, err
+		}
+		if gmax > 0 && gn >= gmax {
+			err = fmt.Errorf("%w, global %d(%d)", ErrPlayLimit, gn, gmax)
+			return nil, err
+		}
+	}
+	PlayNumSid[sid] = sn + 1
+	PlayNumApp[app] = an + 1
+	PlayNumAll = gn + 1
+	return &PlayTicket{App: app, Sid: sid}, nil
+}
+
+//t为nil 或 已释放的 不处理
+func PlayRelease(t *PlayTicket) {
+	if t == nil || atomic.CompareAndSwapInt32(&t.Done, 0, 1) == false {
+		return
+	}
+	PlayNumMutex.Lock()
+	PlayNumSid[t.Sid]--
+	if PlayNumSid[t.Sid] <= 0 {
+		delete(PlayNumSid, t.Sid)
+	}
+	PlayNumApp[t.App]--
+	if PlayNumApp[t.App] <= 0 {
+		delete(PlayNumApp, t.App)
+	}
+	PlayNumAll--
+	PlayNumMutex.Unlock()
+}
+
+/*************************************************/
+/* hls会话
+/*************************************************/
+//PlayLimit或Hook开启时才记录会话, 都不开启的 不用判断是否新会话
+//key为streamId, value的key为ip, value为最后请求时间(毫秒), HlsSessionMutex保护
+var HlsSessionMap = make(map[string]map[string]int64)
+var HlsSessionMutex sync.Mutex
+
+//hls会话占用的名额, key为streamId_ip, HlsSessionMutex保护
+var HlsTicketMap = make(map[string]*PlayTicket)
+
+//被踢掉的hls会话, key为streamId_ip, value为踢掉的时间(毫秒)
+var HlsKickMap sync.Map
+
+func HlsSessionUse() bool {
+	return Conf().PlayLimit.Enable == true || Conf().Hook.Enable == true
+}
+
+func HlsSessionIp(addr string) string {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	return ip
+}
+
+func HlsSessionKey(sid, addr string) string {
+	return fmt.Sprintf("%s_%s", sid, HlsSessionIp(addr))
+}
+
+//会话多少毫秒没有请求 就过期
+func HlsSessionTimeout() int64 {
+	sec := Conf().PlayLimit.HlsSessionSec
+	if sec == 0 {
+		sec = 30
+	}
+	return int64(sec) * 1000
+}
+
+//请求m3u8时调用, 已有会话的不检查, 新会话超过限制的 或 生命周期回调拒绝的返回错误
+func HlsSessionAdmit(app, sid, addr, args string) error {
+	if HlsSessionUse() == false {
+		return nil
+	}
+	key := HlsSessionKey(sid, addr)
+	ip := HlsSessionIp(addr)
+	now := utils.GetTimestamp("ms")
+	if HlsKicked(key, now) == true {
+		return HttpErr(http.StatusForbidden, "hls session %s is kicked", key)
+	}
+
+	HlsSessionMutex.Lock()
+	last, ok := HlsSessionMap[sid][ip]
+	HlsSessionMutex.Unlock()
+	var t *PlayTicket
+	if ok == false || now-last >= HlsSessionTimeout() {
+		var err error
+		t, err = PlayAdmit(app, sid)
+		if err != nil {
+			return err
+		}
+		err = HookPlay("hls", app, sid, addr, args)
+		if err != nil {
+			PlayRelease(t)
+			return err
+		}
+	}
+
+	HlsSessionMutex.Lock()
+	ss, ok := HlsSessionMap[sid]
+	if ok == false {
+		ss = make(map[string]int64)
+		HlsSessionMap[sid] = ss
+	}
+	ss[ip] = now
+	//过期后重新占用的 或 同时请求的, 旧的名额要释放
+	if t != nil {
+		PlayRelease(HlsTicketMap[key])
+		HlsTicketMap[key] = t
+	}
+	HlsSessionMutex.Unlock()
+	return nil
+}
+
+//请求ts时调用, 只更新已有会话
+func HlsSessionVisit(sid, addr string) {
+	ip := HlsSessionIp(addr)
+	HlsSessionMutex.Lock()
+	if ss, ok := HlsSessionMap[sid]; ok == true {
+		if _, ok = ss[ip]; ok == true {
+			ss[ip] = utils.GetTimestamp("ms")
+		}
+	}
+	HlsSessionMutex.Unlock()
+}
+
+//删除会话, HlsSessionSec秒内 同一ip不能再请求m3u8, 返回true表示会话存在
+func HlsSessionKick(sid, addr string) bool {
+	key := HlsSessionKey(sid, addr)
+	ip := HlsSessionIp(addr)
+	HlsSessionMutex.Lock()
+	_, ok := HlsSessionMap[sid][ip]
+	if ok == true {
+		delete(HlsSessionMap[sid], ip)
+		PlayRelease(HlsTicketMap[key])
+		delete(HlsTicketMap, key)
+	}
+	HlsSessionMutex.Unlock()
+	if ok == false {
+		return false
+	}
+	log.Printf("kick hls session %s", key)
+	HlsKickMap.Store(key, utils.GetTimestamp("ms"))
+	return true
+}
+
+func HlsKicked(key string, now int64) bool {
+	v, ok := HlsKickMap.Load(key)
+	if ok == false {
+		return false
+	}
+	return now-v.(int64) < HlsSessionTimeout()
+}
+
+//活跃的hls会话个数, 过期的由HlsSessionTimer()删除
+func HlsSessionNum(sid string) int {
+	var n int
+	now := utils.GetTimestamp("ms")
+	to := HlsSessionTimeout()
+	HlsSessionMutex.Lock()
+	for _, last := range HlsSessionMap[sid] {
+		if now-last < to {
+			n++
+		}
+	}
+	HlsSessionMutex.Unlock()
+	return n
+}
+
+//所有流的活跃hls会话个数, key为streamId
+func HlsSessionNums() map[string]int {
+	ns := make(map[string]int)
+	now := utils.GetTimestamp("ms")
+	to := HlsSessionTimeout()
+	HlsSessionMutex.Lock()
+	for sid, ss := range HlsSessionMap {
+		for _, last := range ss {
+			if now-last < to {
+				ns[sid]++
+			}
+		}
+	}
+	HlsSessionMutex.Unlock()
+	return ns
+}
+
+//定时删除过期的hls会话 和 踢掉记录, 没有会话的流也删除
+func HlsSessionTimer() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		now := utils.GetTimestamp("ms")
+		to := HlsSessionTimeout()
+
+		HlsSessionMutex.Lock()
+		for sid, ss := range HlsSessionMap {
+			for ip, last := range ss {
+				if now-last >= to {
+					delete(ss, ip)
+					key := HlsSessionKey(sid, ip)
+					PlayRelease(HlsTicketMap[key])
+					delete(HlsTicketMap, key)
+				}
+			}
+			if len(ss) == 0 {
+				delete(HlsSessionMap, sid)
+			}
+		}
+		HlsSessionMutex.Unlock()
+
+		HlsKickMap.Range(func(k, v interface{}) bool {
+			if now-v.(int64) >= to {
+				HlsKickMap.Delete(k)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*************************************************/
+/* 播放地址签名
+/*************************************************/
+//播放地址带上 ?sign=xxx&expire=yyy, 本地校验 不用请求别的服务
+//1 expire为过期时间(秒级时间戳), sign = hex(hmac_sha256(secret, app/streamId/expire))
+//  BindIp为true时 sign = hex(hmac_sha256(secret, app/streamId/expire/clientIp))
+//2 secret按app取PlaySign.AppSecrets[app], 没有的用PlaySign.Secret, 都为空的 这个app不校验
+//3 rtmp: play命令的streamId后面带参数, 如rtmp://ip/live/test001?sign=xxx&expire=yyy
+//  flv: 请求flv时校验, rtsp: DESCRIBE时校验
+//  hls: 请求m3u8和ts时都校验, m3u8里的ts地址 自动带上m3u8地址里的sign和expire
+//4 校验不通过的 rtmp回复onStatus失败后断开, http返回403, rtsp返回403
+//签名可以用 GET /api/v1/streams?action=get_playSign&app=live&streamId=test001&expire=3600 生成
+//5 get_playSign在管理端口上, 要带 Authorization: Bearer <PlaySign.ApiToken>, ApiToken为空时不能用
+//  管理端口和播放端口相同时 不注册get_playSign, 否则能播放的人 都能给自己签名
+var ErrPlaySign = errors.New("play sign check fail")
+
+//get_playSign接口的鉴权
+func PlaySignApiAuth(r *http.Request) error {
+	tk := Conf().PlaySign.ApiToken
+	if tk == "" {
+		return HttpErr(http.StatusForbidden, "PlaySign.ApiToken is empty, get_playSign is disabled")
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") == false {
+		return HttpErr(http.StatusUnauthorized, "get_playSign need Authorization: Bearer token")
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(tk)) != 1 {
+		return HttpErr(http.StatusUnauthorized, "get_playSign token mismatch")
+	}
+	return nil
+}
+
+//get_playSign的expire最大秒数
+func PlaySignExpireMax() int64 {
+	if Conf().PlaySign.ExpireMax > 0 {
+		return int64(Conf().PlaySign.ExpireMax)
+	}
+	return 86400
+}
+
+func PlaySignSecret(app string) string {
+	if s, ok := Conf().PlaySign.AppSecrets[app]; ok == true && s != "" {
+		return s
+	}
+	return Conf().PlaySign.Secret
+}
+
+//ip为空 表示不绑定客户端ip
+func PlaySignMake(secret, app, sid string, expire int64, ip string) string {
+	s := fmt.Sprintf("%s/%s/%d", app, sid, expire)
+	if ip != "" {
+		s = fmt.Sprintf("%s/%s", s, ip)
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(s))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+//args为url里?后面的内容, addr为客户端地址 ip:port
+func PlaySignCheck(app, sid, args, addr string) error {
+	if Conf().PlaySign.Enable == false {
+		return nil
+	}
+	secret := PlaySignSecret(app)
+	if secret == "" {
+		return nil
+	}
+
+	q, err := url.ParseQuery(args)
+	if err != nil {
+		return fmt.Errorf("%w, %s", ErrPlaySign, err)
+	}
+	sign, expire := q.Get("sign"), q.Get("expire")
+	if sign == "" || expire == "" {
+		return fmt.Errorf("%w, %s/%s no sign or expire", ErrPlaySign, app, sid)
+	}
+	exp, err := strconv.ParseInt(expire, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w, expire=%s", ErrPlaySign, expire)
+	}
+	if exp < time.Now().Unix() {
+		return fmt.Errorf("%w, %s/%s expired at %d", ErrPlaySign, app, sid, exp)
+	}
+
+	var ip string
+	if Conf().PlaySign.BindIp == true {
+		ip, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			ip = addr
+		}
+	}
+	ss := PlaySignMake(secret, app, sid, exp, ip)
+	if hmac.Equal([]byte(sign), []byte(ss)) == false {
+		return fmt.Errorf("%w, %s/%s sign=%s mismatch, ip=%s", ErrPlaySign, app, sid, sign, ip)
+	}
+	return nil
+}
+
+//m3u8里的ts地址 带上m3u8地址里的sign和expire, 这样请求ts时也能校验
+func M3u8SignAdd(d []byte, args string) []byte {
+	if Conf().PlaySign.Enable == false {
+		return d
+	}
+	q, err := url.ParseQuery(args)
+	if err != nil || q.Get("sign") == "" {
+		return d
+	}
+	v := url.Values{}
+	v.Set("sign", q.Get("sign"))
+	v.Set("expire", q.Get("expire"))
+	sa := v.Encode()
+
+	ls := strings.Split(string(d), "\n")
+	for i, l := range ls {
+		if l == "" || strings.HasPrefix(l, "#") == true {
+			continue
+		}
+		if strings.Contains(l, "?") == true {
+			ls[i] = fmt.Sprintf("%s&%s", l, sa)
+		} else {
+			ls[i] = fmt.Sprintf("%s?%s", l, sa)
+		}
+	}
+	return []byte(strings.Join(ls, "\n"))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*************************************************/
+/* 启播方式 rtmp/flv/rtsp/hls共用
+/*************************************************/
+//播放地址里带 startmode=low 或 startmode=fastlow, 不带的为默认方式
+//rtmp://ip/live/sid?startmode=low, http://ip/live/sid.flv?startmode=fastlow
+//rtsp://ip:1554/live/sid?startmode=low, http://ip/live/sid.m3u8?startmode=low
+//1 默认: 先发送缓存的gop, 再发送最新数据. 启播快 但延时较高
+//2 low: 不发送缓存, 等下一个关键帧. 启播慢 但延时最低; hls只返回最新的ts
+//3 fastlow: 从缓存中最新的关键帧开始发送, 时间戳都改为最新的 播放器快速追上; hls从最新的ts开始播
+const (
+	StartModeGop     = ""
+	StartModeLow     = "low"
+	StartModeFastlow = "fastlow"
+)
+
+//args为url中?后面的部分, 不认识的按默认方式
+func PlayStartModeParse(args string) string {
+	v, _ := url.ParseQuery(args)
+	switch v.Get("startmode") {
+	case StartModeLow:
+		return StartModeLow
+	case StartModeFastlow:
+		return StartModeFastlow
+	}
+	return StartModeGop
+}
+
+//s是发布者, p是新播放者, 只在RtmpSender()中调用
+func PlayStartSend(s, p *Stream) {
+	s.log.Printf("<== player %s start, startmode=%s", p.Key, p.PlayStartMode)
+	switch p.PlayStartMode {
+	case StartModeLow:
+		HeadDataSend(s, p)
+	case StartModeFastlow:
+		GopCacheFastlowSend(s, p)
+	default:
+		GopCacheSend(s, p)
+	}
+}
+
+//新播放者要发送的缓存数据, 返回的是拷贝 修改时间戳不影响缓存
+//fastlow: 只要最新关键帧开始的视频帧 和最后一个音频帧(有的播放器要音频数据才能初始化)
+//时间戳都改为最后一个视频帧的, 播放器收到后立即解码 不用等
+func GopStartChunks(gop *GopCache, mode string) []Chunk {
+	if mode == StartModeLow {
+		return nil
+	}
+	goplocks.Lock()
+	defer goplocks.Unlock()
+
+	st := gop.MediaData.Front()
+	var ac *Chunk
+	if mode == StartModeFastlow {
+		for e := gop.MediaData.Back(); e != nil; e = e.Prev() {
+			c := (e.Value).(*Chunk)
+			if ac == nil && AudioFrameCheck(c.DataType) {
+				ac = c
+			}
+			if c.DataType == "VideoKeyFrame" {
+				st = e
+				break
+			}
+		}
+	}
+
+	var cs []Chunk
+	if ac != nil {
+		cs = append(cs, *ac)
+	}
+	var ts uint32
+	for e := st; e != nil; e = e.Next() {
+		c := (e.Value).(*Chunk)
+		if mode == StartModeFastlow {
+			if AudioFrameCheck(c.DataType) {
+				continue
+			}
+			ts = c.Timestamp
+		}
+		cs = append(cs, *c)
+	}
+	if mode == StartModeFastlow {
+		for i := 0; i < len(cs); i++ {
+			cs[i].Timestamp = ts
+		}
+	}
+	return cs
+}
+
+//hls没有gop缓存, 只能在m3u8末尾选择ts, 每个ts都是以关键帧开始的
+//low: 只保留最新的ts, 去掉的ts个数要加到#EXT-X-MEDIA-SEQUENCE上
+//     去掉的#EXT-X-DISCONTINUITY个数要加到#EXT-X-DISCONTINUITY-SEQUENCE上, 没有这个标签的 要加上
+//fastlow: ts都保留, 加#EXT-X-START 让播放器从最新的ts开始播
+func M3u8StartTrim(d []byte, mode string) []byte {
+	if mode == StartModeGop {
+		return d
+	}
+
+	var head []string
+	var segs [][]string
+	var seg []string
+	ls := strings.Split(strings.TrimRight(string(d), "\n"), "\n")
+	for _, l := range ls {
+		if len(segs) == 0 && len(seg) == 0 && strings.HasPrefix(l, "#EXTINF") == false && l != "#EXT-X-DISCONTINUITY" {
+			head = append(head, l)
+			continue
+		}
+		seg = append(seg, l)
+		if l != "" && strings.HasPrefix(l, "#") == false { //ts文件名
+			segs = append(segs, seg)
+			seg = nil
+		}
+	}
+	if len(segs) < 2 {
+		return d
+	}
+	//最后一个ts后面的标签, 如#EXT-X-ENDLIST
+	tail := seg
+
+	var dur float64
+	for _, l := range segs[len(segs)-1] {
+		if strings.HasPrefix(l, "#EXTINF:") {
+			s := strings.Split(strings.TrimPrefix(l, "#EXTINF:"), ",")
+			dur, _ = strconv.ParseFloat(s[0], 64)
+		}
+	}
+
+	var disc int
+	if mode == StartModeLow {
+		for _, seg = range segs[:len(segs)-1] {
+			for _, l := range seg {
+				if l == "#EXT-X-DISCONTINUITY" {
+					disc++
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+	var discSeq bool
+	for _, l := range head {
+		if mode == StartModeLow && strings.HasPrefix(l, "#EXT-X-MEDIA-SEQUENCE:") {
+			seq, _ := strconv.Atoi(strings.TrimPrefix(l, "#EXT-X-MEDIA-SEQUENCE:"))
+			l = fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", seq+len(segs)-1)
+		}
+		if mode == StartModeLow && strings.HasPrefix(l, "#EXT-X-DISCONTINUITY-SEQUENCE:") {
+			seq, _ := strconv.Atoi(strings.TrimPrefix(l, "#EXT-X-DISCONTINUITY-SEQUENCE:"))
+			l = fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d", seq+disc)
+			discSeq = true
+		}
+		b.WriteString(l + "\n")
+	}
+	if mode == StartModeLow {
+		if discSeq == false && disc > 0 {
+			b.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", disc))
+		}
+		segs = segs[len(segs)-1:]
+	} else if dur > 0 {
+		b.WriteString(fmt.Sprintf("#EXT-X-START:TIME-OFFSET=-%.3f,PRECISE=YES\n", dur))
+	}
+	for _, seg = range segs {
+		for _, l := range seg {
+			b.WriteString(l + "\n")
+		}
+	}
+	for _, l := range tail {
+		b.WriteString(l + "\n")
+	}
+	return []byte(b.String())
+}
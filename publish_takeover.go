@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"utils"
+)
+
+/*************************************************/
+/* 重复推流 同一个streamId已有发布者时的处理
+/*************************************************/
+//rtmp推流, rtsp的ANNOUNCE, gb28181的create_pullChannel 都按Publish.Takeover处理
+//reject	拒绝新的发布者, 默认值
+//kick		踢掉旧的发布者
+//idle		旧的发布者IdleSec秒没有收到数据 才踢掉, 否则拒绝新的
+//踢掉旧的发布者时, 旧发布者的协程都要退出, 播放者不断开 转到新的发布者
+func TakeoverPolicy() string {
+	switch Conf().Publish.Takeover {
+	case "kick", "idle":
+		return Conf().Publish.Takeover
+	}
+	return "reject"
+}
+
+//last为旧发布者最后收到数据的时间(毫秒), 返回true表示要踢掉旧的
+func TakeoverCheck(last int64) bool {
+	switch TakeoverPolicy() {
+	case "kick":
+		return true
+	case "idle":
+		sec := Conf().Publish.IdleSec
+		if sec <= 0 {
+			sec = 5
+		}
+		return utils.GetTimestamp("ms")-last >= int64(sec)*1000
+	}
+	return false
+}
+
+//只删除自己, 被踢掉的发布者停止时 不能把新的发布者删掉
+func SyncMapDeleteSelf(m *sync.Map, key, self interface{}) {
+	v, ok := m.Load(key)
+	if ok == true && v == self {
+		m.Delete(key)
+	}
+}
+
+/*************************************************/
+/* rtmp发布者替换
+/*************************************************/
+//播放协程退出时调用, 谁是当前的发布者 就通知谁
+func PlayerPuberDone(p *Stream) {
+	p.PuberMutex.Lock()
+	if p.Puber != nil {
+		p.Puber.Wg.Done()
+		p.Puber = nil
+	}
+	p.PuberMutex.Unlock()
+}
+
+//发布者停止, 通知所有播放协程退出
+func PlayersCancel(s *Stream) {
+	s.Players.Range(func(k, v interface{}) bool {
+		p := v.(*Stream)
+		if p.Cancel != nil {
+			p.Cancel()
+		}
+		return true
+	})
+}
+
+//old的播放者转到s, 播放协程不退出
+//播放协程计入发布者的Wg, 转移时 s加1 old减1, 这样old停止时不会等待这些播放者
+func PlayersMove(old, s *Stream) {
+	var n int
+	old.Players.Range(func(k, v interface{}) bool {
+		p := v.(*Stream)
+		old.Players.Delete(k)
+
+		p.PuberMutex.Lock()
+		if p.Puber == old {
+			s.Wg.Add(1)
+			p.Puber = s
+			old.Wg.Done()
+		}
+		//音视频头的标记 由发送协程在LiveDataSend()里重置
+		p.PuberChanged = true
+		p.PuberMutex.Unlock()
+
+		s.Players.Store(k, p)
+		n++
+		return true
+	})
+	s.log.Printf("takeover %s, move %d players from %s", s.Key, n, old.RemoteAddr)
+}
+
+//s是新的发布者, 要在s存入StreamHub之前调用
+func RtmpPuberKick(old, s *Stream) {
+	old.log.Printf("kicked by new publisher %s", s.RemoteAddr)
+	old.Kicked = true
+	PlayersMove(old, s)
+
+	//关闭连接, RtmpPublisher0()接收出错后 调用RtmpPublishStop()释放资源
+	old.TransmitSwitch = "off"
+	if old.Conn0 != nil {
+		old.Conn0.Close()
+	}
+}
+
+/*************************************************/
+/* rtsp发布者替换
+/*************************************************/
+//rtsp的ANNOUNCE, 同一个streamId的发布者 不管rtmp/rtsp/gb28181接入 都在StreamHub里
+//还没发布到StreamHub的rtsp发布者(如 还没RECORD) 只是rtsp发布者 没有Puber, 也要检查
+//返回nil表示可以发布, 旧的rtsp发布者 由调用者调用RtspPuberKick()
+func RtspTakeoverCheck(rs *RtspStream) error {
+	if old, ok := HubPuberGet(rs.StreamId); ok == true {
+		if TakeoverCheck(old.RecvLastTime) == false {
+			return fmt.Errorf("publisher %s(%s) is exist, takeover=%s", rs.StreamId, old.RemoteAddr, TakeoverPolicy())
+		}
+	}
+	if old, ok := HubRtspGet(rs.Key); ok == true {
+		//StreamHub里的流转rtsp 没有连接, 数据来自StreamHub 上面已检查
+		if old.Conn != nil && TakeoverCheck(old.RecvLastTime) == false {
+			return fmt.Errorf("rtsp %s(%s) is exist, takeover=%s", rs.Key, old.RAddr, TakeoverPolicy())
+		}
+	}
+	return nil
+}
+
+//old的rtsp播放者转到rs, old是StreamHub里的流转rtsp时 只转移播放者
+func RtspPuberKick(old, rs *RtspStream) {
+	old.log.Printf("kicked by new publisher %s", rs.RAddr)
+	var n int
+	old.Players.Range(func(k, v interface{}) bool {
+		p := v.(*RtspStream)
+		old.Players.Delete(k)
+		p.Puber = rs
+		p.NewPlayer = true
+		rs.Players.Store(k, p)
+		n++
+		return true
+	})
+	rs.log.Printf("takeover %s, move %d players from %s", rs.Key, n, old.RAddr)
+
+	if old.Conn == nil {
+		return
+	}
+	//rtp_tcp和rtp_udp的发布者都会停止, 之后调用RtspPuberStop()释放资源
+	RtspPuberCancel(old)
+}
+
+/*************************************************/
+/* gb28181发布者替换
+/*************************************************/
+//gb28181的流 通过rtmp推给自己, 播放者在rtmp发布者上, 由rtmp的替换来转移
+func Gb28181Kick(old *Stream) {
+	old.log.Printf("kicked by new gb28181 task")
+	old.Kicked = true
+	Gb28181Stop(old)
+}
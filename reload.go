@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	utils "utilsGIT"
+)
+
+/*************************************************/
+/* 配置热加载
+/*************************************************/
+//kill -HUP <pid> 或 POST /api/v1/streams?action=reload_config
+//1 重新读取配置文件, 校验不通过的 整个丢弃, 继续用原来的配置
+//2 逐个字段和当前配置比较, 可以在线生效的 改到当前配置的副本里, 再整体替换, 已有的流不断开
+//3 端口 ip 通道长度等启动时才用的字段 不修改, 返回在restart里 要重启或不停服升级才生效
+//4 大部分配置用到时才读Conf(), 修改后对新流 新播放者立即生效
+//  日志文件 cpu个数 已有流的GopCacheMax 在ConfApply()中单独处理
+var ConfMutex sync.Mutex //热加载 不能同时进行
+
+//当前配置, 热加载时 整个替换为新的*Config, 不修改旧的, 读的时候不用加锁
+//同一个函数里多次调用 可能拿到不同的配置, 要求一致的 先保存返回值
+func Conf() *Config {
+	return confVal.Load().(*Config)
+}
+
+//要重启才生效的字段, 只写节名的 整个节都要重启
+var ConfRestartKeys = []string{
+	"IpInner", "IpOuter", "Http", "Https", "GB28181", "RtpRtcp",
+	"Rtsp.Port", "Rtsp.RtpPortMin", "Rtsp.RtpPortMax",
+	"Rtmp.Port", "Rtmps", "Upgrade", "Mqtt", "Nt", "StreamRec",
+	"HlsLive.Enable", "HlsLive.MemPath", "HlsLive.DiskPath",
+	"HlsRec.Enable", "HlsRec.MemPath", "HlsRec.DiskPath", "HlsRec.HlsStoreUse",
+	//已有的chan容量不会变, 调大后 len<容量的检查不再起作用, 写chan会阻塞
+	"DataStockMax", "PlayStockMax", "HlsRec.HlsStockMax", "StreamStatekMax",
+	"Rtmp.Msg2RtmpChanNum", "Rtmp.AvPkt2RtspChanNum",
+	"Rtsp.Rtp2RtspChanNum", "Rtsp.Rtp2RtmpChanNum", "Rtsp.AvPkt2RtspChanNum", "Rtsp.AvPkt2RtmpChanNum",
+}
+
+type ConfReloadRsps struct {
+	Code    int      `json:"code"`
+	Msg     string   `json:"message"`
+	Applied []string `json:"applied"` //已生效的字段
+	Restart []string `json:"restart"` //有修改 但要重启才生效的字段
+}
+
+func ConfReload() (ConfReloadRsps, error) {
+	var rsps ConfReloadRsps
+	ConfMutex.Lock()
+	defer ConfMutex.Unlock()
+
+	s, err := utils.ReadAllFile(c)
+	if err != nil {
+		log.Println(err)
+		return rsps, err
+	}
+	var nc Config
+	err = json.Unmarshal(s, &nc)
+	if err != nil {
+		log.Println(err)
+		return rsps, err
+	}
+	err = ConfCheck(&nc)
+	if err != nil {
+		log.Println(err)
+		return rsps, err
+	}
+
+	rsps.Code = 200
+	rsps.Msg = "ok"
+	rsps.Applied = make([]string, 0)
+	rsps.Restart = make([]string, 0)
+	//在副本上修改, 其他协程还在读当前配置
+	cc := *Conf()
+	ov := reflect.ValueOf(&cc).Elem()
+	nv := reflect.ValueOf(&nc).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := ov.Type().Field(i).Name
+		of, nf := ov.Field(i), nv.Field(i)
+		if of.Kind() != reflect.Struct {
+			ConfFieldSet(&rsps, name, of, nf)
+			continue
+		}
+		for j := 0; j < of.NumField(); j++ {
+			key := fmt.Sprintf("%s.%s", name, of.Type().Field(j).Name)
+			ConfFieldSet(&rsps, key, of.Field(j), nf.Field(j))
+		}
+	}
+	confVal.Store(&cc)
+	ConfApply(rsps.Applied)
+	log.Printf("config reload %s, applied=%v, restart=%v", c, rsps.Applied, rsps.Restart)
+	return rsps, nil
+}
+
+//o为当前配置副本的字段, n为新配置的字段
+func ConfFieldSet(rsps *ConfReloadRsps, key string, o, n reflect.Value) {
+	if reflect.DeepEqual(o.Interface(), n.Interface()) == true {
+		return
+	}
+	if ConfNeedRestart(key) == true {
+		rsps.Restart = append(rsps.Restart, key)
+		return
+	}
+	o.Set(n)
+	rsps.Applied = append(rsps.Applied, key)
+}
+
+func ConfNeedRestart(key string) bool {
+	for _, k := range ConfRestartKeys {
+		if key == k || strings.HasPrefix(key, k+".") {
+			return true
+		}
+	}
+	return false
+}
+
+//校验新配置, 有错误的 整个配置都不用
+func ConfCheck(nc *Config) error {
+	if nc.Log.FileName == "" || nc.Log.StreamLogPath == "" {
+		return fmt.Errorf("Log.FileName or Log.StreamLogPath is empty")
+	}
+	if nc.Http.PortApi == "" || nc.Rtmp.Port == "" || nc.Rtsp.Port == "" {
+		return fmt.Errorf("Http.PortApi or Rtmp.Port or Rtsp.Port is empty")
+	}
+	if nc.DataStockMax <= 0 || nc.PlayStockMax <= 0 {
+		return fmt.Errorf("DataStockMax=%d, PlayStockMax=%d, must > 0", nc.DataStockMax, nc.PlayStockMax)
+	}
+	if nc.Rtmp.GopCacheMax < 0 || nc.Rtsp.GopCacheMax < 0 {
+		return fmt.Errorf("Rtmp.GopCacheMax=%d, Rtsp.GopCacheMax=%d, must >= 0", nc.Rtmp.GopCacheMax, nc.Rtsp.GopCacheMax)
+	}
+	if nc.HlsLive.Enable == true && (nc.HlsLive.TsMaxTime <= 0 || nc.HlsLive.M3u8TsNum == 0) {
+		return fmt.Errorf("HlsLive.TsMaxTime=%f, HlsLive.M3u8TsNum=%d, must > 0", nc.HlsLive.TsMaxTime, nc.HlsLive.M3u8TsNum)
+	}
+	if nc.HlsRec.Enable == true && (nc.HlsRec.TsMaxTime <= 0 || nc.HlsRec.M3u8TsNum == 0) {
+		return fmt.Errorf("HlsRec.TsMaxTime=%f, HlsRec.M3u8TsNum=%d, must > 0", nc.HlsRec.TsMaxTime, nc.HlsRec.M3u8TsNum)
+	}
+	switch nc.Publish.Takeover {
+	case "", "reject", "kick", "idle":
+	default:
+		return fmt.Errorf("Publish.Takeover=%s, must be reject, kick or idle", nc.Publish.Takeover)
+	}
+	if nc.Congest.Enable == true && (nc.Congest.NonRefPct <= 0 || nc.Congest.GopPct <= nc.Congest.NonRefPct || nc.Congest.GopPct > 100) {
+		return fmt.Errorf("Congest.NonRefPct=%d, Congest.GopPct=%d, must 0 < NonRefPct < GopPct <= 100", nc.Congest.NonRefPct, nc.Congest.GopPct)
+	}
+	if nc.PlayLimit.GlobalMax < 0 || nc.MaxPlayerNum < 0 {
+		return fmt.Errorf("PlayLimit.GlobalMax=%d, MaxPlayerNum=%d, must >= 0", nc.PlayLimit.GlobalMax, nc.MaxPlayerNum)
+	}
+	if nc.Hook.TimeoutSec < 0 || nc.Hook.Retry < 0 {
+		return fmt.Errorf("Hook.TimeoutSec=%d, Hook.Retry=%d, must >= 0", nc.Hook.TimeoutSec, nc.Hook.Retry)
+	}
+	for app, n := range nc.PlayLimit.AppMax {
+		if n < 0 {
+			return fmt.Errorf("PlayLimit.AppMax[%s]=%d, must >= 0", app, n)
+		}
+	}
+	return utils.DirExist(nc.Log.StreamLogPath, true)
+}
+
+//只改conf不能生效的 在这里处理
+func ConfApply(keys []string) {
+	var logChange, cpuChange, gopChange bool
+	for _, k := range keys {
+		switch {
+		case strings.HasPrefix(k, "Log.") && k != "Log.StreamLogPath":
+			logChange = true
+		case strings.HasPrefix(k, "Cpu."):
+			cpuChange = true
+		case k == "Rtmp.GopCacheMax":
+			gopChange = true
+		}
+	}
+
+	if logChange == true && LogWriter != nil {
+		LogWriter.Filename = Conf().Log.FileName
+		LogWriter.MaxSize = Conf().Log.FileSize
+		LogWriter.MaxBackups = Conf().Log.FileNum
+		LogWriter.MaxAge = Conf().Log.SaveDay
+		LogWriter.Close() //下次写日志时 按新配置打开文件
+	}
+	if cpuChange == true {
+		ncpu := runtime.NumCPU()
+		if Conf().Cpu.Enable == true && Conf().Cpu.UseNum < ncpu {
+			ncpu = Conf().Cpu.UseNum
+		}
+		runtime.GOMAXPROCS(ncpu)
+	}
+	//已有的流 GopCacheMax是创建时复制的
+	if gopChange == true {
+		goplocks.Lock()
+		HubPuberRange(func(s *Stream) bool {
+			s.GopCacheMax = Conf().Rtmp.GopCacheMax
+			return true
+		})
+		goplocks.Unlock()
+	}
+}
@@ -54,10 +54,26 @@ type AmfInfo struct {
 
 type Object map[string]interface{}
 
+//对象/数组的嵌套层数上限, 恶意数据嵌套太深 递归解码会栈溢出
+const AmfDepthMax = 64
+
+//进入一层嵌套, 超过上限返回错误, 返回nil时 调用者要defer AmfDepthLeave()
+func AmfDepthEnter(s *Stream) error {
+	if s.AmfDepth >= AmfDepthMax {
+		return fmt.Errorf("amf nesting depth > %d", AmfDepthMax)
+	}
+	s.AmfDepth++
+	return nil
+}
+
+func AmfDepthLeave(s *Stream) {
+	s.AmfDepth--
+}
+
 // AMF是Adobe开发的二进制通信协议, 有两种版本 AMF0 和 AMF3
 // 序列化转结构化 AmfUnmarshal();  结构化转序列化 AmfMarshal();
 func AmfHandle(s *Stream, c *Chunk) error {
-	r := bytes.NewReader(c.MsgData)
+	r := bytes.NewReader(AmfMsgData(c))
 	vs, err := AmfUnmarshal(s, r) // 序列化转结构化
 	//这个 && 不能动 ???
 	if err != nil && err != io.EOF {
@@ -66,11 +82,23 @@ func AmfHandle(s *Stream, c *Chunk) error {
 	}
 	s.log.Printf("Amf Unmarshal %#v", vs)
 
+	if len(vs) == 0 {
+		err = fmt.Errorf("AmfCmd is empty")
+		s.log.Println(err)
+		return err
+	}
+	if _, ok := vs[0].(string); ok == false {
+		err = fmt.Errorf("AmfCmd %#v is not string", vs[0])
+		s.log.Println(err)
+		return err
+	}
+
 	switch vs[0].(string) {
 	case "connect":
 		if err = AmfConnectHandle(s, vs); err != nil {
 			return err
 		}
+		HookRtmpConnect(s)
 		if err = AmfConnectResponse(s, c); err != nil {
 			return err
 		}
@@ -89,6 +117,12 @@ func AmfHandle(s *Stream, c *Chunk) error {
 		if err = AmfPublishHandle(s, vs); err != nil {
 			return err
 		}
+		//生命周期回调拒绝的, 回复失败后断开
+		if err = HookRtmpPublish(s); err != nil {
+			s.log.Println(err)
+			AmfPublishFailedResponse(s, c, err.Error())
+			return err
+		}
 		if err = AmfPublishResponse(s, c); err != nil {
 			return err
 		}
@@ -98,7 +132,26 @@ func AmfHandle(s *Stream, c *Chunk) error {
 		if err = AmfPlayHandle(s, vs); err != nil {
 			return err
 		}
+		//播放地址签名不对的, 回复失败后断开
+		if err = PlaySignCheck(s.AmfInfo.App, s.AmfInfo.StreamId, HookArgs(s.AmfInfo.PublishName), s.RemoteAddr); err != nil {
+			s.log.Println(err)
+			AmfPlayFailedResponse(s, c, err.Error())
+			return err
+		}
+		//超过播放者个数限制, 回复失败后断开
+		if s.PlayTicket, err = PlayAdmit(s.AmfInfo.App, s.AmfInfo.StreamId); err != nil {
+			s.log.Println(err)
+			AmfPlayFailedResponse(s, c, err.Error())
+			return err
+		}
+		if err = HookPlay("rtmp", s.AmfInfo.App, s.AmfInfo.StreamId, s.RemoteAddr, HookArgs(s.AmfInfo.PublishName)); err != nil {
+			s.log.Println(err)
+			PlayRelease(s.PlayTicket)
+			AmfPlayFailedResponse(s, c, err.Error())
+			return err
+		}
 		if err = AmfPlayResponse(s, c); err != nil {
+			PlayRelease(s.PlayTicket)
 			return err
 		}
 		s.IsPublisher = false
@@ -125,6 +178,41 @@ func AmfHandle(s *Stream, c *Chunk) error {
 	return nil
 }
 
+//MsgTypeIdCmdAmf3 MsgTypeIdDataAmf3 MsgTypeIdShareAmf3
+//消息体第1个字节是0x00, 后面是amf0编码, 其中的值可以用0x11切换到amf3
+func AmfMsgData(c *Chunk) []byte {
+	switch c.MsgTypeId {
+	case MsgTypeIdCmdAmf3, MsgTypeIdDataAmf3, MsgTypeIdShareAmf3:
+		if len(c.MsgData) > 0 && c.MsgData[0] == 0x00 {
+			return c.MsgData[1:]
+		}
+	}
+	return c.MsgData
+}
+
+//共享对象消息 我们不支持, 只解析消息头并打印
+//ObjectName(2+N) + CurrentVersion(4) + Flags(8) + Events(1+4+N)*n
+func SharedObjectHandle(s *Stream, c *Chunk) error {
+	r := bytes.NewReader(AmfMsgData(c))
+	l, err := ReadUint32(r, 2, BE)
+	if err != nil {
+		s.log.Println(err)
+		return err
+	}
+	name, err := ReadString(r, l)
+	if err != nil {
+		s.log.Println(err)
+		return err
+	}
+	ver, err := ReadUint32(r, 4, BE)
+	if err != nil {
+		s.log.Println(err)
+		return err
+	}
+	s.log.Printf("Untreated SharedObject, MsgTypeId=%d, name=%s, version=%d, len=%d", c.MsgTypeId, name, ver, c.MsgLength)
+	return nil
+}
+
 /*************************************************/
 /* amf decode
 /*************************************************/
@@ -157,6 +245,12 @@ func AmfDecode(s *Stream, r io.Reader) (interface{}, error) {
 	}
 	//s.log.Println("AmfType", t)
 
+	if err = AmfDepthEnter(s); err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+	defer AmfDepthLeave(s)
+
 	switch t {
 	case Amf0MarkerNumber:
 		return Amf0DecodeNumber(s, r)
@@ -170,6 +264,13 @@ func AmfDecode(s *Stream, r io.Reader) (interface{}, error) {
 		return Amf0DecodeNull(s, r)
 	case Amf0MarkerEcmaArray:
 		return Amf0DecodeEcmaArray(s, r)
+	case Amf0MarkerUndefined:
+		return nil, nil
+	case Amf0MarkerArray:
+		return Amf0DecodeStrictArray(s, r)
+	case Amf0MarkerAcmPlusObject:
+		//每个amf3值 都使用新的引用表
+		return Amf3Decode(s, r, NewAmf3RefTable())
 	}
 	err = fmt.Errorf("Untreated AmfType %d", t)
 	s.log.Println(err)
@@ -252,6 +353,29 @@ func Amf0DecodeObject(s *Stream, r io.Reader) (Object, error) {
 	return ret, nil
 }
 
+//StrictArray, 1byte类型后是4byte的value个数, 后面是value
+func Amf0DecodeStrictArray(s *Stream, r io.Reader) ([]interface{}, error) {
+	n, err := ReadUint32(r, 4, BE)
+	if err != nil {
+		if err != io.EOF {
+			s.log.Println(err)
+		}
+		return nil, err
+	}
+
+	var ret []interface{}
+	var v interface{}
+	for i := uint32(0); i < n; i++ {
+		v, err = AmfDecode(s, r)
+		if err != nil {
+			s.log.Println(err)
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
 func Amf0DecodeNull(s *Stream, r io.Reader) (interface{}, error) {
 	return nil, nil
 }
@@ -315,6 +439,11 @@ func AmfEncode(s *Stream, buf io.Writer, v interface{}) (int, error) {
 		return Amf0EncodeNumber(s, buf, float64(val.Float()))
 	case reflect.Map:
 		return Amf0EncodeObject(s, buf, v.(Object))
+	case reflect.Slice:
+		//amf0没有字节数组类型, 切换到amf3编码
+		if b, ok := v.([]byte); ok {
+			return Amf0EncodeAcmPlus(s, buf, b)
+		}
 	}
 	err := fmt.Errorf("Untreated Amf0Marker %s", val.Kind())
 	s.log.Println(err)
@@ -419,6 +548,19 @@ func Amf0EncodeObject(s *Stream, buf io.Writer, o Object) (int, error) {
 	return n + 1, nil
 }
 
+//0x11 + amf3值
+func Amf0EncodeAcmPlus(s *Stream, buf io.Writer, v interface{}) (int, error) {
+	b := []byte{Amf0MarkerAcmPlusObject}
+	buf.Write(b)
+
+	n, err := Amf3Encode(s, buf, v, NewAmf3RefTable())
+	if err != nil {
+		s.log.Println(err)
+		return 0, err
+	}
+	return n + 1, nil
+}
+
 /*************************************************/
 /* amf command handle
 /*************************************************/
@@ -450,6 +592,17 @@ func CreateMessage0(TypeId, Len uint32, Data []byte) *Chunk {
 	}
 }
 
+//命令的回应 和 对方请求用相同的消息类型
+//对方用MsgTypeIdCmdAmf3时, 回应消息体前要加1个字节0x00
+func CreateCmdMessage(c *Chunk, d []byte) Chunk {
+	if c.MsgTypeId == MsgTypeIdCmdAmf3 {
+		dd := make([]byte, 1+len(d))
+		copy(dd[1:], d)
+		return CreateMessage(MsgTypeIdCmdAmf3, uint32(len(dd)), dd)
+	}
+	return CreateMessage(MsgTypeIdCmdAmf0, uint32(len(d)), d)
+}
+
 func AmfConnectHandle(s *Stream, vs []interface{}) error {
 	for _, v := range vs {
 		switch v.(type) {
@@ -474,12 +627,36 @@ func AmfConnectHandle(s *Stream, vs []interface{}) error {
 			if i, ok := o["type"]; ok {
 				s.AmfInfo.Type = i.(string)
 			}
+			//Enhanced RTMP, 播放者支持的视频编码, 如["hvc1","av01","vp09"]
+			if i, ok := o["fourCcList"]; ok {
+				s.FourCcList = AmfFourCcList(i)
+			}
 		}
 	}
 	//s.log.Printf("%#v", s.AmfInfo)
 	return nil
 }
 
+//fourCcList可能是StrictArray 也可能是EcmaArray
+func AmfFourCcList(v interface{}) []string {
+	var ret []string
+	switch vv := v.(type) {
+	case []interface{}:
+		for _, i := range vv {
+			if fc, ok := i.(string); ok {
+				ret = append(ret, fc)
+			}
+		}
+	case Object:
+		for _, i := range vv {
+			if fc, ok := i.(string); ok {
+				ret = append(ret, fc)
+			}
+		}
+	}
+	return ret
+}
+
 func AmfConnectResponse(s *Stream, c *Chunk) error {
 	// 1 Window Acknowledge Size
 	// 2 Set Peer BandWidth
@@ -517,15 +694,15 @@ func AmfConnectResponse(s *Stream, c *Chunk) error {
 	// srs中 in_chunk_size  相当于 B.ChunkSize
 	// srs中 out_chunk_size 相当于 B.RemoteChunkSize
 	// 此处 Set ChunkSize后, srs的 in_chunk_size = 1024
-	s.log.Printf("<---- Set ChunkSize = %d", conf.Rtmp.ChunkSize)
-	d = Uint32ToByte(conf.Rtmp.ChunkSize, nil, BE)
+	s.log.Printf("<---- Set ChunkSize = %d", Conf().Rtmp.ChunkSize)
+	d = Uint32ToByte(Conf().Rtmp.ChunkSize, nil, BE)
 	rc = CreateMessage(MsgTypeIdSetChunkSize, 4, d)
 	err = MessageSplit(s, &rc, false)
 	if err != nil {
 		s.log.Println(err)
 		return err
 	}
-	s.RemoteChunkSize = conf.Rtmp.ChunkSize
+	s.RemoteChunkSize = Conf().Rtmp.ChunkSize
 
 	s.log.Println("<---- ConnectMessageResponse")
 	rsps := make(Object)
@@ -541,7 +718,7 @@ func AmfConnectResponse(s *Stream, c *Chunk) error {
 	d, _ = AmfMarshal(s, "_result", 1, rsps, info) // 结构化转序列化
 	//s.log.Println(d)
 
-	rc = CreateMessage(MsgTypeIdCmdAmf0, uint32(len(d)), d)
+	rc = CreateCmdMessage(c, d)
 	rc.Csid = c.Csid
 	rc.MsgStreamId = c.MsgStreamId
 	err = MessageSplit(s, &rc, true)
@@ -570,7 +747,7 @@ func AmfCreateStreamResponse(s *Stream, c *Chunk) error {
 	d, _ := AmfMarshal(s, "_result", s.AmfInfo.TransactionId, nil, c.MsgStreamId)
 	//s.log.Println(d)
 
-	rc := CreateMessage(MsgTypeIdCmdAmf0, uint32(len(d)), d)
+	rc := CreateCmdMessage(c, d)
 	rc.Csid = c.Csid
 	rc.MsgStreamId = c.MsgStreamId
 	err := MessageSplit(s, &rc, true)
@@ -615,7 +792,7 @@ func AmfPublishResponse(s *Stream, c *Chunk) error {
 	d, _ := AmfMarshal(s, "onStatus", 0, nil, info) // 结构化转序列化
 	//s.log.Println(d)
 
-	rc := CreateMessage(MsgTypeIdCmdAmf0, uint32(len(d)), d)
+	rc := CreateCmdMessage(c, d)
 	rc.Csid = c.Csid
 	rc.MsgStreamId = c.MsgStreamId
 	err := MessageSplit(s, &rc, true)
@@ -636,6 +813,10 @@ func AmfPlayHandle(s *Stream, vs []interface{}) error {
 				s.AmfInfo.PublishName = v.(string)
 				ss := strings.Split(s.AmfInfo.PublishName, "?")
 				s.AmfInfo.StreamId = ss[0]
+				//rtmp://ip/live/sid?startmode=low
+				if len(ss) > 1 {
+					s.PlayStartMode = PlayStartModeParse(ss[1])
+				}
 			}
 		case float64:
 			if k == 1 {
@@ -655,6 +836,45 @@ func AmfPlayHandle(s *Stream, vs []interface{}) error {
 	return nil
 }
 
+//play失败, 如超过播放者个数限制
+func AmfPlayFailedResponse(s *Stream, c *Chunk, desc string) error {
+	s.log.Println("<---- Send onStatus-play failed")
+	info := make(Object)
+	info["level"] = "error"
+	info["code"] = "NetStream.Play.Failed"
+	info["description"] = desc
+	d, _ := AmfMarshal(s, "onStatus", 0, nil, info) // 结构化转序列化
+
+	rc := CreateCmdMessage(c, d)
+	rc.Csid = c.Csid
+	rc.MsgStreamId = c.MsgStreamId
+	err := MessageSplit(s, &rc, true)
+	if err != nil {
+		s.log.Println(err)
+		return err
+	}
+	return nil
+}
+
+func AmfPublishFailedResponse(s *Stream, c *Chunk, desc string) error {
+	s.log.Println("<---- Send onStatus-publish failed")
+	info := make(Object)
+	info["level"] = "error"
+	info["code"] = "NetStream.Publish.Denied"
+	info["description"] = desc
+	d, _ := AmfMarshal(s, "onStatus", 0, nil, info) // 结构化转序列化
+
+	rc := CreateCmdMessage(c, d)
+	rc.Csid = c.Csid
+	rc.MsgStreamId = c.MsgStreamId
+	err := MessageSplit(s, &rc, true)
+	if err != nil {
+		s.log.Println(err)
+		return err
+	}
+	return nil
+}
+
 // User Control Message EventType:
 // StreamBegin		(=0)
 // StreamEOF		(=1)
@@ -703,7 +923,7 @@ func AmfPlayResponse(s *Stream, c *Chunk) error {
 	info["description"] = "Playing and resetting stream."
 	d, _ = AmfMarshal(s, "onStatus", 0, nil, info) // 结构化转序列化
 	//s.log.Println(d)
-	rc = CreateMessage(MsgTypeIdCmdAmf0, uint32(len(d)), d)
+	rc = CreateCmdMessage(c, d)
 	rc.Csid = c.Csid
 	rc.MsgStreamId = c.MsgStreamId
 	err = MessageSplit(s, &rc, false)
@@ -719,7 +939,7 @@ func AmfPlayResponse(s *Stream, c *Chunk) error {
 	info["description"] = "Started playing stream."
 	d, _ = AmfMarshal(s, "onStatus", 0, nil, info) // 结构化转序列化
 	//s.log.Println(d)
-	rc = CreateMessage(MsgTypeIdCmdAmf0, uint32(len(d)), d)
+	rc = CreateCmdMessage(c, d)
 	rc.Csid = c.Csid
 	rc.MsgStreamId = c.MsgStreamId
 	err = MessageSplit(s, &rc, false)
@@ -735,7 +955,7 @@ func AmfPlayResponse(s *Stream, c *Chunk) error {
 	info["description"] = "Started playing stream."
 	d, _ = AmfMarshal(s, "onStatus", 0, nil, info) // 结构化转序列化
 	//s.log.Println(d)
-	rc = CreateMessage(MsgTypeIdCmdAmf0, uint32(len(d)), d)
+	rc = CreateCmdMessage(c, d)
 	rc.Csid = c.Csid
 	rc.MsgStreamId = c.MsgStreamId
 	err = MessageSplit(s, &rc, false)
@@ -751,7 +971,7 @@ func AmfPlayResponse(s *Stream, c *Chunk) error {
 	info["description"] = "Started playing notify."
 	d, _ = AmfMarshal(s, "onStatus", 0, nil, info) // 结构化转序列化
 	//s.log.Println(d)
-	rc = CreateMessage(MsgTypeIdCmdAmf0, uint32(len(d)), d)
+	rc = CreateCmdMessage(c, d)
 	rc.Csid = c.Csid
 	rc.MsgStreamId = c.MsgStreamId
 	err = MessageSplit(s, &rc, true)
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+//amf3_spec_121207.pdf
+//amf0中遇到0x11(Amf0MarkerAcmPlusObject), 表示后面紧跟的一个值是amf3编码
+//MsgTypeIdCmdAmf3(17) MsgTypeIdDataAmf3(15) MsgTypeIdShareAmf3(16)
+//消息体第1个字节是0x00, 后面是amf0编码, 其中可以用0x11切换到amf3
+const (
+	Amf3MarkerUndefined    = 0x00 // 1byte类型, 没有数据
+	Amf3MarkerNull         = 0x01 // 1byte类型, 没有数据
+	Amf3MarkerFalse        = 0x02 // 1byte类型, 没有数据
+	Amf3MarkerTrue         = 0x03 // 1byte类型, 没有数据
+	Amf3MarkerInteger      = 0x04 // 1byte类型, U29数据, 有符号29bit整数
+	Amf3MarkerDouble       = 0x05 // 1byte类型, 8byte数据(double类型)
+	Amf3MarkerString       = 0x06 // 1byte类型, U29S-ref, 最低位为0表示引用字符串表
+	Amf3MarkerXmlDocument  = 0x07 // 1byte类型, U29X-ref, 同string, 引用对象表
+	Amf3MarkerDate         = 0x08 // 1byte类型, U29D-ref, 8byte毫秒数(double类型)
+	Amf3MarkerArray        = 0x09 // 1byte类型, U29A-ref, 关联部分kv + 密集部分value
+	Amf3MarkerObject       = 0x0a // 1byte类型, U29O-ref, traits + 成员
+	Amf3MarkerXml          = 0x0b // 1byte类型, U29X-ref
+	Amf3MarkerByteArray    = 0x0c // 1byte类型, U29B-ref, Nbyte数据
+	Amf3MarkerVectorInt    = 0x0d
+	Amf3MarkerVectorUint   = 0x0e
+	Amf3MarkerVectorDouble = 0x0f
+	Amf3MarkerVectorObject = 0x10
+	Amf3MarkerDictionary   = 0x11
+)
+
+//U29最大值和整数范围, 超出范围的整数要用double编码
+const (
+	Amf3U29Max    = 0x1fffffff
+	Amf3IntMax    = 0x0fffffff
+	Amf3IntMin    = -0x10000000
+	Amf3RefMaxNum = 1024 * 1024 //引用表上限, 防止恶意数据耗尽内存
+)
+
+//对象的类型描述, 相同类型的对象 第2次出现时 只发送traits在表中的序号
+type Amf3Traits struct {
+	ClassName      string
+	Dynamic        bool     //是否有动态成员, 动态成员是kv键值对 以空字符串结束
+	Externalizable bool     //自定义序列化, 格式只有对应的类知道
+	Members        []string //密封成员名, 值按顺序紧跟在traits后面
+}
+
+//amf3有3张引用表, 每个amf3值(从0x11开始)都要用新的引用表
+//解码时 按出现顺序存入切片; 编码时 用map查找是否已经出现过
+//对象/数组 先用Amf3Pending占位, 成员解码完再替换, 成员引用还在解码的对象 返回错误
+//否则会得到有环的map, 打印日志或AmfMarshal()时 无限递归栈溢出
+type Amf3RefTable struct {
+	Strs   []string
+	Objs   []interface{}
+	Traits []*Amf3Traits
+
+	StrIdx map[string]int
+}
+
+//对象表中 还在解码的对象/数组的占位
+type Amf3Pending struct{}
+
+func NewAmf3RefTable() *Amf3RefTable {
+	return &Amf3RefTable{
+		StrIdx: make(map[string]int),
+	}
+}
+
+/*************************************************/
+/* amf3 decode
+/*************************************************/
+//U29是变长整数, 1-4字节, 前3个字节最高位为1表示后面还有, 第4个字节8bit全用
+func Amf3DecodeU29(s *Stream, r io.Reader) (uint32, error) {
+	var ret uint32
+	for i := 0; i < 4; i++ {
+		b, err := ReadUint8(r)
+		if err != nil {
+			if err != io.EOF {
+				s.log.Println(err)
+			}
+			return 0, err
+		}
+
+		if i == 3 {
+			ret = (ret << 8) | uint32(b)
+			break
+		}
+		ret = (ret << 7) | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return ret, nil
+}
+
+func Amf3Decode(s *Stream, r io.Reader, rt *Amf3RefTable) (interface{}, error) {
+	t, err := ReadUint8(r)
+	if err != nil {
+		if err != io.EOF {
+			s.log.Println(err)
+		}
+		return nil, err
+	}
+	//s.log.Println("Amf3Type", t)
+
+	if err = AmfDepthEnter(s); err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+	defer AmfDepthLeave(s)
+
+	switch t {
+	case Amf3MarkerUndefined, Amf3MarkerNull:
+		return nil, nil
+	case Amf3MarkerFalse:
+		return false, nil
+	case Amf3MarkerTrue:
+		return true, nil
+	case Amf3MarkerInteger:
+		return Amf3DecodeInteger(s, r)
+	case Amf3MarkerDouble:
+		return Amf0DecodeNumber(s, r)
+	case Amf3MarkerString:
+		return Amf3DecodeString(s, r, rt)
+	case Amf3MarkerXmlDocument, Amf3MarkerXml:
+		return Amf3DecodeXml(s, r, rt)
+	case Amf3MarkerDate:
+		return Amf3DecodeDate(s, r, rt)
+	case Amf3MarkerArray:
+		return Amf3DecodeArray(s, r, rt)
+	case Amf3MarkerObject:
+		return Amf3DecodeObject(s, r, rt)
+	case Amf3MarkerByteArray:
+		return Amf3DecodeByteArray(s, r, rt)
+	case Amf3MarkerVectorInt, Amf3MarkerVectorUint, Amf3MarkerVectorDouble, Amf3MarkerVectorObject:
+		return Amf3DecodeVector(s, r, rt, t)
+	case Amf3MarkerDictionary:
+		return Amf3DecodeDictionary(s, r, rt)
+	}
+	err = fmt.Errorf("Untreated Amf3Type %d", t)
+	s.log.Println(err)
+	return nil, err
+}
+
+//返回float64, 和amf0的number保持一致, 上层不用区分类型
+func Amf3DecodeInteger(s *Stream, r io.Reader) (float64, error) {
+	u, err := Amf3DecodeU29(s, r)
+	if err != nil {
+		return 0, err
+	}
+
+	//29bit有符号数, 最高位是符号位
+	ret := int32(u)
+	if u&0x10000000 != 0 {
+		ret = int32(u | 0xe0000000)
+	}
+	return float64(ret), nil
+}
+
+//U29S-ref, 最低位为0时 高28位是字符串表的序号
+//空字符串不会放入字符串表
+func Amf3DecodeString(s *Stream, r io.Reader, rt *Amf3RefTable) (string, error) {
+	u, err := Amf3DecodeU29(s, r)
+	if err != nil {
+		return "", err
+	}
+
+	if u&0x01 == 0 {
+		idx := int(u >> 1)
+		if idx >= len(rt.Strs) {
+			err = fmt.Errorf("amf3 string reference %d out of range %d", idx, len(rt.Strs))
+			s.log.Println(err)
+			return "", err
+		}
+		return rt.Strs[idx], nil
+	}
+
+	l := u >> 1
+	if l == 0 {
+		return "", nil
+	}
+
+	ret, err := ReadString(r, l)
+	if err != nil {
+		s.log.Println(err)
+		return "", err
+	}
+	if len(rt.Strs) < Amf3RefMaxNum {
+		rt.Strs = append(rt.Strs, ret)
+	}
+	return ret, nil
+}
+
+//对象表中的引用, 对象/数组/日期/xml/字节数组 共用一张表
+func Amf3DecodeObjRef(s *Stream, rt *Amf3RefTable, u uint32) (interface{}, error) {
+	idx := int(u >> 1)
+	if idx >= len(rt.Objs) {
+		err := fmt.Errorf("amf3 object reference %d out of range %d", idx, len(rt.Objs))
+		s.log.Println(err)
+		return nil, err
+	}
+	if _, ok := rt.Objs[idx].(Amf3Pending); ok == true {
+		err := fmt.Errorf("amf3 object reference %d is still decoding", idx)
+		s.log.Println(err)
+		return nil, err
+	}
+	return rt.Objs[idx], nil
+}
+
+func Amf3AddObjRef(s *Stream, rt *Amf3RefTable, v interface{}) int {
+	if len(rt.Objs) >= Amf3RefMaxNum {
+		s.log.Printf("amf3 object table is full, max %d", Amf3RefMaxNum)
+		return -1
+	}
+	rt.Objs = append(rt.Objs, v)
+	return len(rt.Objs) - 1
+}
+
+func Amf3DecodeXml(s *Stream, r io.Reader, rt *Amf3RefTable) (interface{}, error) {
+	u, err := Amf3DecodeU29(s, r)
+	if err != nil {
+		return nil, err
+	}
+	if u&0x01 == 0 {
+		return Amf3DecodeObjRef(s, rt, u)
+	}
+
+	ret, err := ReadString(r, u>>1)
+	if err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+	Amf3AddObjRef(s, rt, ret)
+	return ret, nil
+}
+
+func Amf3DecodeDate(s *Stream, r io.Reader, rt *Amf3RefTable) (interface{}, error) {
+	u, err := Amf3DecodeU29(s, r)
+	if err != nil {
+		return nil, err
+	}
+	if u&0x01 == 0 {
+		return Amf3DecodeObjRef(s, rt, u)
+	}
+
+	ms, err := Amf0DecodeNumber(s, r)
+	if err != nil {
+		return nil, err
+	}
+	ret := time.Unix(0, int64(ms)*int64(time.Millisecond))
+	Amf3AddObjRef(s, rt, ret)
+	return ret, nil
+}
+
+func Amf3DecodeByteArray(s *Stream, r io.Reader, rt *Amf3RefTable) (interface{}, error) {
+	u, err := Amf3DecodeU29(s, r)
+	if err != nil {
+		return nil, err
+	}
+	if u&0x01 == 0 {
+		return Amf3DecodeObjRef(s, rt, u)
+	}
+
+	ret, err := ReadByte(r, u>>1)
+	if err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+	Amf3AddObjRef(s, rt, ret)
+	return ret, nil
+}
+
+//数组分为关联部分(kv键值对, 以空字符串结束) 和 密集部分(count个value)
+//只有密集部分时 返回[]interface{}, 有关联部分时 返回Object, 密集部分的key为序号
+func Amf3DecodeArray(s *Stream, r io.Reader, rt *Amf3RefTable) (interface{}, error) {
+	u, err := Amf3DecodeU29(s, r)
+	if err != nil {
+		return nil, err
+	}
+	if u&0x01 == 0 {
+		return Amf3DecodeObjRef(s, rt, u)
+	}
+	n := int(u >> 1)
+	//每个成员至少1字节, 个数超过剩余字节数的 是错误数据
+	if err = ReaderLenCheck(r, n); err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+
+	//先占位, 数组成员可能引用数组自己
+	idx := Amf3AddObjRef(s, rt, Amf3Pending{})
+
+	var key string
+	var v interface{}
+	var o Object
+	for {
+		key, err = Amf3DecodeString(s, r, rt)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			break
+		}
+		v, err = Amf3Decode(s, r, rt)
+		if err != nil {
+			return nil, err
+		}
+		if o == nil {
+			o = make(Object)
+		}
+		o[key] = v
+	}
+
+	var ret interface{}
+	var arr []interface{}
+	if o != nil {
+		ret = o
+	} else {
+		arr = make([]interface{}, 0, n)
+	}
+
+	for i := 0; i < n; i++ {
+		v, err = Amf3Decode(s, r, rt)
+		if err != nil {
+			return nil, err
+		}
+		if o != nil {
+			o[strconv.Itoa(i)] = v
+		} else {
+			arr = append(arr, v)
+		}
+	}
+	if o == nil {
+		ret = arr
+	}
+
+	if idx >= 0 {
+		rt.Objs[idx] = ret
+	}
+	return ret, nil
+}
+
+//U29O-traits, 第1bit为0是对象引用, 第2bit为0是traits引用
+//第3bit为1是自定义序列化, 第4bit为1是有动态成员, 高25位是密封成员个数
+func Amf3DecodeTraits(s *Stream, r io.Reader, rt *Amf3RefTable, u uint32) (*Amf3Traits, error) {
+	var err error
+	if u&0x02 == 0 {
+		idx := int(u >> 2)
+		if idx >= len(rt.Traits) {
+			err = fmt.Errorf("amf3 traits reference %d out of range %d", idx, len(rt.Traits))
+			s.log.Println(err)
+			return nil, err
+		}
+		return rt.Traits[idx], nil
+	}
+
+	t := &Amf3Traits{}
+	t.Externalizable = (u & 0x04) != 0
+	t.Dynamic = (u & 0x08) != 0
+	n := int(u >> 4)
+	if err = ReaderLenCheck(r, n); err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+
+	t.ClassName, err = Amf3DecodeString(s, r, rt)
+	if err != nil {
+		return nil, err
+	}
+
+	var m string
+	for i := 0; i < n; i++ {
+		m, err = Amf3DecodeString(s, r, rt)
+		if err != nil {
+			return nil, err
+		}
+		t.Members = append(t.Members, m)
+	}
+
+	if len(rt.Traits) < Amf3RefMaxNum {
+		rt.Traits = append(rt.Traits, t)
+	}
+	return t, nil
+}
+
+func Amf3DecodeObject(s *Stream, r io.Reader, rt *Amf3RefTable) (interface{}, error) {
+	u, err := Amf3DecodeU29(s, r)
+	if err != nil {
+		return nil, err
+	}
+	if u&0x01 == 0 {
+		return Amf3DecodeObjRef(s, rt, u)
+	}
+
+	t, err := Amf3DecodeTraits(s, r, rt, u)
+	if err != nil {
+		return nil, err
+	}
+
+	//先占位, 成员可能引用对象自己
+	ret := make(Object)
+	idx := Amf3AddObjRef(s, rt, Amf3Pending{})
+
+	if t.Externalizable {
+		//flex的集合类 里面就是一个普通的amf3值, 其他的类无法解析
+		switch t.ClassName {
+		case "flex.messaging.io.ArrayCollection", "flex.messaging.io.ObjectProxy":
+			v, err := Amf3Decode(s, r, rt)
+			if err != nil {
+				return nil, err
+			}
+			ret["source"] = v
+			if idx >= 0 {
+				rt.Objs[idx] = ret
+			}
+			return ret, nil
+		}
+		err = fmt.Errorf("Untreated amf3 externalizable class %s", t.ClassName)
+		s.log.Println(err)
+		return nil, err
+	}
+
+	var v interface{}
+	for _, m := range t.Members {
+		v, err = Amf3Decode(s, r, rt)
+		if err != nil {
+			return nil, err
+		}
+		ret[m] = v
+	}
+
+	if t.Dynamic {
+		var key string
+		for {
+			key, err = Amf3DecodeString(s, r, rt)
+			if err != nil {
+				return nil, err
+			}
+			if key == "" {
+				break
+			}
+			v, err = Amf3Decode(s, r, rt)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = v
+		}
+	}
+
+	if idx >= 0 {
+		rt.Objs[idx] = ret
+	}
+	//s.log.Printf("%#v", ret)
+	return ret, nil
+}
+
+//U29V-ref + 1byte fixed标志, object类型的vector 还有类型名
+func Amf3DecodeVector(s *Stream, r io.Reader, rt *Amf3RefTable, t uint8) (interface{}, error) {
+	u, err := Amf3DecodeU29(s, r)
+	if err != nil {
+		return nil, err
+	}
+	if u&0x01 == 0 {
+		return Amf3DecodeObjRef(s, rt, u)
+	}
+	n := int(u >> 1)
+
+	if _, err = ReadUint8(r); err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+	if t == Amf3MarkerVectorObject {
+		if _, err = Amf3DecodeString(s, r, rt); err != nil {
+			return nil, err
+		}
+	}
+
+	//int和uint每个4字节, double每个8字节, object每个至少1字节
+	size := 1
+	switch t {
+	case Amf3MarkerVectorInt, Amf3MarkerVectorUint:
+		size = 4
+	case Amf3MarkerVectorDouble:
+		size = 8
+	}
+	if err = ReaderLenCheck(r, n*size); err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+
+	idx := Amf3AddObjRef(s, rt, Amf3Pending{})
+	ret := make([]interface{}, 0, n)
+
+	var u32 uint32
+	var v interface{}
+	for i := 0; i < n; i++ {
+		switch t {
+		case Amf3MarkerVectorInt:
+			u32, err = ReadUint32(r, 4, BE)
+			v = float64(int32(u32))
+		case Amf3MarkerVectorUint:
+			u32, err = ReadUint32(r, 4, BE)
+			v = float64(u32)
+		case Amf3MarkerVectorDouble:
+			v, err = Amf0DecodeNumber(s, r)
+		default:
+			v, err = Amf3Decode(s, r, rt)
+		}
+		if err != nil {
+			s.log.Println(err)
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+
+	if idx >= 0 {
+		rt.Objs[idx] = ret
+	}
+	return ret, nil
+}
+
+//字典的key可以是任意类型, 这里只保留能转成字符串的key
+func Amf3DecodeDictionary(s *Stream, r io.Reader, rt *Amf3RefTable) (interface{}, error) {
+	u, err := Amf3DecodeU29(s, r)
+	if err != nil {
+		return nil, err
+	}
+	if u&0x01 == 0 {
+		return Amf3DecodeObjRef(s, rt, u)
+	}
+	n := int(u >> 1)
+	if err = ReaderLenCheck(r, n*2); err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+
+	//weak-keys标志
+	if _, err = ReadUint8(r); err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+
+	ret := make(Object)
+	idx := Amf3AddObjRef(s, rt, Amf3Pending{})
+
+	var k, v interface{}
+	for i := 0; i < n; i++ {
+		k, err = Amf3Decode(s, r, rt)
+		if err != nil {
+			return nil, err
+		}
+		v, err = Amf3Decode(s, r, rt)
+		if err != nil {
+			return nil, err
+		}
+		ret[fmt.Sprintf("%v", k)] = v
+	}
+
+	if idx >= 0 {
+		rt.Objs[idx] = ret
+	}
+	return ret, nil
+}
+
+/*************************************************/
+/* amf3 encode
+/*************************************************/
+func Amf3Marshal(s *Stream, args ...interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	rt := NewAmf3RefTable()
+	var err error
+	for _, v := range args {
+		_, err = Amf3Encode(s, buf, v, rt)
+		if err != nil {
+			s.log.Println(err)
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func Amf3EncodeU29(s *Stream, buf io.Writer, u uint32) (int, error) {
+	var b []byte
+	u &= Amf3U29Max
+	switch {
+	case u < 0x80:
+		b = []byte{byte(u)}
+	case u < 0x4000:
+		b = []byte{byte(u>>7) | 0x80, byte(u & 0x7f)}
+	case u < 0x200000:
+		b = []byte{byte(u>>14) | 0x80, byte(u>>7) | 0x80, byte(u & 0x7f)}
+	default:
+		b = []byte{byte(u>>22) | 0x80, byte(u>>15) | 0x80, byte(u>>8) | 0x80, byte(u)}
+	}
+
+	n, err := buf.Write(b)
+	if err != nil {
+		s.log.Println(err)
+		return 0, err
+	}
+	return n, nil
+}
+
+func Amf3Encode(s *Stream, buf io.Writer, v interface{}, rt *Amf3RefTable) (int, error) {
+	if v == nil {
+		return buf.Write([]byte{Amf3MarkerNull})
+	}
+
+	switch vv := v.(type) {
+	case []byte:
+		return Amf3EncodeByteArray(s, buf, vv)
+	case time.Time:
+		return Amf3EncodeDate(s, buf, vv)
+	case Object:
+		return Amf3EncodeObject(s, buf, vv, rt)
+	case []interface{}:
+		return Amf3EncodeArray(s, buf, vv, rt)
+	}
+
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.String:
+		return Amf3EncodeString(s, buf, val.String(), rt, true)
+	case reflect.Bool:
+		if val.Bool() {
+			return buf.Write([]byte{Amf3MarkerTrue})
+		}
+		return buf.Write([]byte{Amf3MarkerFalse})
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Amf3EncodeInteger(s, buf, val.Int())
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if val.Uint() > Amf3IntMax {
+			return Amf3EncodeDouble(s, buf, float64(val.Uint()))
+		}
+		return Amf3EncodeInteger(s, buf, int64(val.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return Amf3EncodeDouble(s, buf, val.Float())
+	}
+	err := fmt.Errorf("Untreated Amf3Marker %s", val.Kind())
+	s.log.Println(err)
+	return 0, err
+}
+
+//超出29bit有符号数范围的整数 要用double编码
+func Amf3EncodeInteger(s *Stream, buf io.Writer, v int64) (int, error) {
+	if v < Amf3IntMin || v > Amf3IntMax {
+		return Amf3EncodeDouble(s, buf, float64(v))
+	}
+
+	buf.Write([]byte{Amf3MarkerInteger})
+	n, err := Amf3EncodeU29(s, buf, uint32(v)&Amf3U29Max)
+	if err != nil {
+		return 0, err
+	}
+	return n + 1, nil
+}
+
+func Amf3EncodeDouble(s *Stream, buf io.Writer, v float64) (int, error) {
+	b := make([]byte, 9)
+	b[0] = Amf3MarkerDouble
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+	n, err := buf.Write(b)
+	if err != nil {
+		s.log.Println(err)
+		return 0, err
+	}
+	return n, nil
+}
+
+//wType为false时 不写类型, 用于对象的key和traits里的类名
+func Amf3EncodeString(s *Stream, buf io.Writer, v string, rt *Amf3RefTable, wType bool) (int, error) {
+	var n int
+	if wType {
+		buf.Write([]byte{Amf3MarkerString})
+		n += 1
+	}
+
+	if idx, ok := rt.StrIdx[v]; ok {
+		m, err := Amf3EncodeU29(s, buf, uint32(idx)<<1)
+		if err != nil {
+			return 0, err
+		}
+		return n + m, nil
+	}
+	if v != "" && len(rt.StrIdx) < Amf3RefMaxNum {
+		rt.StrIdx[v] = len(rt.StrIdx)
+	}
+
+	m, err := Amf3EncodeU29(s, buf, uint32(len(v))<<1|0x01)
+	if err != nil {
+		return 0, err
+	}
+	n += m
+
+	m, err = buf.Write([]byte(v))
+	if err != nil {
+		s.log.Println(err)
+		return 0, err
+	}
+	return n + m, nil
+}
+
+func Amf3EncodeDate(s *Stream, buf io.Writer, v time.Time) (int, error) {
+	buf.Write([]byte{Amf3MarkerDate, 0x01})
+	ms := float64(v.UnixNano() / int64(time.Millisecond))
+	err := binary.Write(buf, binary.BigEndian, &ms)
+	if err != nil {
+		s.log.Println(err)
+		return 0, err
+	}
+	return 2 + 8, nil
+}
+
+func Amf3EncodeByteArray(s *Stream, buf io.Writer, v []byte) (int, error) {
+	buf.Write([]byte{Amf3MarkerByteArray})
+	n, err := Amf3EncodeU29(s, buf, uint32(len(v))<<1|0x01)
+	if err != nil {
+		return 0, err
+	}
+
+	m, err := buf.Write(v)
+	if err != nil {
+		s.log.Println(err)
+		return 0, err
+	}
+	return 1 + n + m, nil
+}
+
+//只编码密集部分
+func Amf3EncodeArray(s *Stream, buf io.Writer, v []interface{}, rt *Amf3RefTable) (int, error) {
+	buf.Write([]byte{Amf3MarkerArray})
+	n, err := Amf3EncodeU29(s, buf, uint32(len(v))<<1|0x01)
+	if err != nil {
+		return 0, err
+	}
+	n += 1
+
+	//关联部分为空, 直接写空字符串
+	buf.Write([]byte{0x01})
+	n += 1
+
+	var m int
+	for _, vv := range v {
+		m, err = Amf3Encode(s, buf, vv, rt)
+		if err != nil {
+			return 0, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+//编码为匿名的动态对象, traits: 0个密封成员, 有动态成员, 不是引用
+//U29O-traits = 0000 1011 = 0x0b, 类名为空字符串 0x01
+func Amf3EncodeObject(s *Stream, buf io.Writer, o Object, rt *Amf3RefTable) (int, error) {
+	buf.Write([]byte{Amf3MarkerObject, 0x0b, 0x01})
+	n := 3
+
+	var m int
+	var err error
+	for k, v := range o {
+		if k == "" {
+			continue
+		}
+		m, err = Amf3EncodeString(s, buf, k, rt, false)
+		if err != nil {
+			return 0, err
+		}
+		n += m
+
+		m, err = Amf3Encode(s, buf, v, rt)
+		if err != nil {
+			return 0, err
+		}
+		n += m
+	}
+
+	buf.Write([]byte{0x01})
+	return n + 1, nil
+}
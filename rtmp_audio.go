@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"utils"
 )
 
 /*************************************************/
@@ -53,6 +52,51 @@ type AudioSpecificConfig struct {
 	ExtensionFlag   uint8 //1bit, 一般为0
 }
 
+//SoundFormat对应的DataType, 只有aac有sequence header
+//mp3/g711/speex每个消息都是一帧, 原样缓存和转发
+func AudioDataType(d []byte) string {
+	if len(d) < 2 {
+		return "AudioFrame"
+	}
+	switch (d[0] & 0xF0) >> 4 {
+	case 10:
+		if d[1] == 0 {
+			return "AudioHeader"
+		}
+		return "AudioAacFrame"
+	case 2, 14:
+		return "AudioMp3Frame"
+	case 7:
+		return "AudioG711aFrame"
+	case 8:
+		return "AudioG711uFrame"
+	case 11:
+		return "AudioSpeexFrame"
+	}
+	return "AudioFrame"
+}
+
+//是否为音频帧(不包括AudioHeader)
+func AudioFrameCheck(dt string) bool {
+	switch dt {
+	case "AudioAacFrame", "AudioMp3Frame", "AudioG711aFrame", "AudioG711uFrame", "AudioSpeexFrame":
+		return true
+	}
+	return false
+}
+
+//mp3在ts里的StreamType, MPEG-1音频为0x03, MPEG-2/2.5音频为0x04
+//mp3帧头 11bit同步字 + 2bit版本(3:MPEG-1, 2:MPEG-2, 0:MPEG-2.5)
+func Mp3StreamType(d []byte) uint8 {
+	if len(d) < 2 || d[0] != 0xff || (d[1]&0xe0) != 0xe0 {
+		return 0x03
+	}
+	if (d[1]&0x18)>>3 == 3 {
+		return 0x03
+	}
+	return 0x04
+}
+
 func AudioHandle(s *Stream, c *Chunk) error {
 	var err error
 	if len(c.MsgData) < 2 {
@@ -64,11 +108,27 @@ func AudioHandle(s *Stream, c *Chunk) error {
 	//SoundSize := (c.MsgData[0] & 0x2) >> 1    // 1bit
 	//SoundType := c.MsgData[0] & 0x1           // 1bit
 
-	// TODO: 需要支持mp3, SoundFormat == 2
-	if SoundFormat == 10 {
+	switch SoundFormat {
+	case 10:
 		s.AudioCodecType = "AAC"
 		//s.log.Println("SoundFormat is AAC")
-	} else {
+	case 2, 14:
+		if s.AudioCodecType != "MP3" {
+			s.AudioStreamType = Mp3StreamType(c.MsgData[1:])
+			s.log.Printf("SoundFormat is MP3, TsStreamType=%#x", s.AudioStreamType)
+		}
+		s.AudioCodecType = "MP3"
+		return AudioFrameHandle(s, c, "AudioMp3Frame")
+	case 7:
+		s.AudioCodecType = "G711a"
+		return AudioFrameHandle(s, c, "AudioG711aFrame")
+	case 8:
+		s.AudioCodecType = "G711u"
+		return AudioFrameHandle(s, c, "AudioG711uFrame")
+	case 11:
+		s.AudioCodecType = "Speex"
+		return AudioFrameHandle(s, c, "AudioSpeexFrame")
+	default:
 		err = fmt.Errorf("untreated SoundFormat %d", SoundFormat)
 		s.log.Println(err)
 		return err
@@ -114,90 +174,7 @@ func AudioHandle(s *Stream, c *Chunk) error {
 	case 1:
 		// Raw AAC frame data
 		//s.log.Println("This frame is AAC raw")
-		if s.FirstAudioTs == 0 {
-			s.FirstAudioTs = c.Timestamp
-			s.PrevAudioTs = c.Timestamp
-		} else {
-			//视频帧率60fps, 帧间隔1000/60=16.7ms
-			//视频帧率25fps, 帧间隔1000/25=  40ms
-			//视频帧率20fps, 帧间隔1000/20=  50ms
-			//视频帧率 2fps, 帧间隔1000/ 5= 500ms
-			//视频帧率 1fps, 帧间隔1000/ 5=1000ms
-			//音画相差400ms, 人类就能明显感觉到不同步
-			if c.Timestamp >= s.PrevAudioTs {
-				s.TotalAudioDelta += c.Timestamp - s.PrevAudioTs
-			}
-
-			s.AudioTsDifValue = c.Timestamp - s.PrevAudioTs
-			if s.AudioTsDifValue > 500 {
-				s.log.Printf("bigjump: c.Ts(%d) - s.Pats(%d) = AtsDv(%d)", c.Timestamp, s.PrevAudioTs, s.AudioTsDifValue)
-			}
-			s.PrevAudioTs = c.Timestamp
-		}
-
-		//judge abnormal timestamp, don't use first A/V 250 packet to calculte, and only calculte 4 times
-		s.PktNum++
-		var deltaCal uint32
-		if s.PktNum > conf.AdjustPktNum && s.CalNumAudio < AdjustSeqNum {
-			var DurationAudio int64
-			s.PktNumAudio++
-			cTime := utils.GetTimestamp("ms")
-			if s.StartTimeAudio == 0 {
-				s.StartTimeAudio = cTime
-			}
-			DurationAudio = cTime - s.StartTimeAudio
-			//use 10 seconds audio packet to calculate
-			if DurationAudio >= 10000 {
-				s.CalNumAudio++
-				deltaCal = uint32(DurationAudio / int64(s.PktNumAudio))
-
-				if (s.TotalAudioDelta / s.PktNumAudio) < 2*deltaCal {
-					//normal
-					s.SeqNumAudio = 0
-				} else {
-					//abnormal timestamp, need adjust
-					s.DeltaCalAudio[s.SeqNumAudio] = deltaCal
-					s.SeqNumAudio++
-					s.log.Printf("aac abnormal delta timestamp:%d, cal delta timestamp:%d, seq num:%d >= 3 wil adjust", s.TotalAudioDelta/s.PktNumAudio, deltaCal, s.SeqNumAudio)
-				}
-
-				s.StartTimeAudio = cTime
-				s.PktNumAudio = 0
-				s.TotalAudioDelta = 0
-			}
-		} else {
-			s.TotalAudioDelta = 0
-		}
-		//when three successive times happened abnormal delta timestamp, should adjust
-		if conf.AdjustDts == true && s.SeqNumAudio >= AdjustSeqNum {
-			if s.FirstAudioAdust == 0 {
-				s.PrevAudioAdust = c.Timestamp
-			} else {
-				if s.DeltaCalVideo[0] == s.DeltaCalVideo[1] {
-					deltaCal = s.DeltaCalVideo[0]
-				} else if s.DeltaCalVideo[1] == s.DeltaCalVideo[2] {
-					deltaCal = s.DeltaCalVideo[1]
-				} else if s.DeltaCalVideo[0] == s.DeltaCalVideo[2] {
-					deltaCal = s.DeltaCalVideo[0]
-				} else {
-					deltaCal = (s.DeltaCalVideo[0] + s.DeltaCalVideo[1] + s.DeltaCalVideo[2]) / AdjustSeqNum
-				}
-				c.Timestamp = s.PrevAudioAdust + deltaCal
-			}
-			s.FirstAudioAdust++
-			s.PrevAudioAdust = c.Timestamp
-		}
-
-		c.DataType = "AudioAacFrame"
-		//c.Fmt = c.FmtFirst
-		if s.GopCache.MediaData.Len() > 0 {
-			goplocks.Lock()
-			s.GopCache.MediaData.PushBack(c)
-			goplocks.Unlock()
-		}
-		//s.CountNum++
-		//s.log.Println(s.CountNum)
-		//s.log.Printf("%x", c.MsgData)
+		return AudioFrameHandle(s, c, "AudioAacFrame")
 	default:
 		err = fmt.Errorf("untreated AACPacketType %d", AACPacketType)
 		s.log.Println(err)
@@ -205,3 +182,35 @@ func AudioHandle(s *Stream, c *Chunk) error {
 	}
 	return nil
 }
+
+//音频帧 时间戳统计和修正后 存入GopCache
+func AudioFrameHandle(s *Stream, c *Chunk, dt string) error {
+	if s.FirstAudioTs == 0 {
+		s.FirstAudioTs = c.Timestamp
+		s.PrevAudioTs = c.Timestamp
+	} else {
+		//视频帧率60fps, 帧间隔1000/60=16.7ms
+		//视频帧率25fps, 帧间隔1000/25=  40ms
+		//视频帧率20fps, 帧间隔1000/20=  50ms
+		//视频帧率 2fps, 帧间隔1000/ 5= 500ms
+		//视频帧率 1fps, 帧间隔1000/ 5=1000ms
+		//音画相差400ms, 人类就能明显感觉到不同步
+		s.AudioTsDifValue = c.Timestamp - s.PrevAudioTs
+		if s.AudioTsDifValue > 500 {
+			s.log.Printf("bigjump: c.Ts(%d) - s.Pats(%d) = AtsDv(%d)", c.Timestamp, s.PrevAudioTs, s.AudioTsDifValue)
+		}
+		s.PrevAudioTs = c.Timestamp
+	}
+
+	c.DataType = dt
+	//c.Fmt = c.FmtFirst
+	if s.GopCache.MediaData.Len() > 0 {
+		goplocks.Lock()
+		s.GopCache.MediaData.PushBack(c)
+		goplocks.Unlock()
+	}
+	//s.CountNum++
+	//s.log.Println(s.CountNum)
+	//s.log.Printf("%x", c.MsgData)
+	return nil
+}
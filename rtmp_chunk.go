@@ -82,6 +82,7 @@ type Chunk struct {
 	DataType    string
 	MsgLenMax   uint32 // 音视频的chunk要复用, MsgLenght > MsgLenMax 要重新make
 	NaluNum     uint32 //当前消息中, 有几个nalu, 写ts文件时, 每个nalu前都要加开始码
+	FourCC      string //Enhanced RTMP的视频编码, hvc1/av01/vp09, 传统格式为空
 }
 
 func ChunkHeaderAssemble(s *Stream, c *Chunk) error {
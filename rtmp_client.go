@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
@@ -11,13 +12,25 @@ import (
 /*************************************************/
 /* rtmp client
 /*************************************************/
-//建连+握手
-func RtmpClient(ip, port string, to int) (*Stream, error) {
+//建连+握手, ptcl为rtmp或rtmps
+func RtmpClient(ptcl, ip, port string, to int) (*Stream, error) {
 	addr := fmt.Sprintf("%s:%s", ip, port)
 	//log.Printf("rtmp conn raddr=%s", addr)
 
-	//c, err := net.Dial("tcp", addr)
-	c, err := net.DialTimeout("tcp", addr, time.Duration(to)*time.Second)
+	var c net.Conn
+	var err error
+	if ptcl == "rtmps" {
+		//云厂商的推流地址 大多只支持rtmps
+		d := &net.Dialer{Timeout: time.Duration(to) * time.Second}
+		tc := &tls.Config{
+			ServerName:         ip,
+			InsecureSkipVerify: Conf().Rtmps.SkipVerify,
+		}
+		c, err = tls.DialWithDialer(d, "tcp", addr, tc)
+	} else {
+		//c, err := net.Dial("tcp", addr)
+		c, err = net.DialTimeout("tcp", addr, time.Duration(to)*time.Second)
+	}
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -29,6 +42,7 @@ func RtmpClient(ip, port string, to int) (*Stream, error) {
 		rs.log.Println(err)
 		return nil, err
 	}
+	rs.RemotePtcl = ptcl
 	rs.RemoteIp = ip
 	rs.RemotePort = port
 
@@ -62,7 +76,7 @@ func RtmpPublishMsgInteract(rs *Stream) error {
 
 	//设置自己发送的chunksize
 	SetRemoteChunkSize(rs)
-	rs.log.Printf("<== Set RemoteChunkSize = %d", conf.Rtmp.ChunkSize)
+	rs.log.Printf("<== Set RemoteChunkSize = %d", Conf().Rtmp.ChunkSize)
 
 	err = SendCreateStreamMsg(rs)
 	if err != nil {
@@ -90,8 +104,8 @@ func RtmpPublishMsgInteract(rs *Stream) error {
 	return nil
 }
 
-func RtmpPusher(ip, port, app, sid string) (*Stream, error) {
-	rs, err := RtmpClient(ip, port, 10)
+func RtmpPusher(ptcl, ip, port, app, sid string) (*Stream, error) {
+	rs, err := RtmpClient(ptcl, ip, port, 10)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -107,7 +121,7 @@ func RtmpPusher(ip, port, app, sid string) (*Stream, error) {
 	}
 	rs.log.Println("RtmpPublishMsgInteract() ok")
 
-	fn := fmt.Sprintf("%s/%s/rtsp_rtmp_%s:%s.log", conf.Log.StreamLogPath, sid, ip, port)
+	fn := fmt.Sprintf("%s/%s/rtsp_rtmp_%s:%s.log", Conf().Log.StreamLogPath, sid, ip, port)
 	StreamLogRename(rs.LogFn, fn)
 	rs.LogFn = fn
 	return rs, nil
@@ -131,7 +145,7 @@ func RtmpPlayMsgInteract(rs *Stream) error {
 
 	//设置自己发送的chunksize
 	SetRemoteChunkSize(rs)
-	rs.log.Printf("<== Set RemoteChunkSize = %d", conf.Rtmp.ChunkSize)
+	rs.log.Printf("<== Set RemoteChunkSize = %d", Conf().Rtmp.ChunkSize)
 
 	err = SendCreateStreamMsg(rs)
 	if err != nil {
@@ -167,20 +181,19 @@ func RtmpPlayMsgInteract(rs *Stream) error {
 	return nil
 }
 
-func RtmpPuller(ip, port, app, sid string, to int, cc chan bool) (*Stream, error) {
+func RtmpPuller(ptcl, ip, port, app, sid string, to int, cc chan bool) (*Stream, error) {
 	var rs *Stream
 	var err error
 
 	key := fmt.Sprintf("%s_%s", app, sid)
-	v, ok := RtmpPuberMap.Load(key)
+	rs, ok := HubPuberGet(key)
 	if ok == true {
-		rs = v.(*Stream)
 		rs.log.Printf("rtmp %s is exist", key)
 		cc <- true
 		return rs, nil
 	}
 
-	rs, err = RtmpClient(ip, port, to)
+	rs, err = RtmpClient(ptcl, ip, port, to)
 	if err != nil {
 		log.Println(err)
 		cc <- false
@@ -191,7 +204,7 @@ func RtmpPuller(ip, port, app, sid string, to int, cc chan bool) (*Stream, error
 	rs.App = app
 	rs.StreamId = sid
 
-	fn := fmt.Sprintf("%s/%s/pull_rtmp_%s:%s_%d.log", conf.Log.StreamLogPath, sid, ip, port, utils.GetTimestamp("ns"))
+	fn := fmt.Sprintf("%s/%s/pull_rtmp_%s:%s_%d.log", Conf().Log.StreamLogPath, sid, ip, port, utils.GetTimestamp("ns"))
 	StreamLogRename(rs.LogFn, fn)
 	rs.LogFn = fn
 
@@ -205,9 +218,10 @@ func RtmpPuller(ip, port, app, sid string, to int, cc chan bool) (*Stream, error
 
 	log.Printf("PuberKey=%s(rtmp)", rs.Key)
 	rs.log.Printf("PuberKey=%s(rtmp)", rs.Key)
-	RtmpPuberMap.Store(key, rs)
+	HubPuberStore(rs)
+	ForwardStart(rs)
 
-	go RtmpMem2RtspServer(rs)
+	//rtsp播放时 RtmpSender()把数据转为AvFrame 给RtmpMem2RtspServer()
 	//go RtmpMem2RtmpPlayers()
 	go RtmpSender(rs) // 给所有播放者发送数据
 	cc <- true
@@ -224,9 +238,9 @@ func RtmpPuller(ip, port, app, sid string, to int, cc chan bool) (*Stream, error
 		if err != nil {
 			rs.log.Println(err)
 			rs.log.Println("RtmpReceiver close")
-			close(rs.AvPkg2RtspChan)
 			close(rs.Msg2RtmpChan)
-			RtmpPuberMap.Delete(key)
+			ForwardStopAll(rs)
+			HubPuberDelete(rs)
 			return nil, err
 		}
 		rs.log.Printf("%d: type:%d(%s), ts=%d, len=%d, naluNum:%d", i, msg.MsgTypeId, msg.DataType, msg.Timestamp, msg.MsgLength, msg.NaluNum)
@@ -235,26 +249,18 @@ func RtmpPuller(ip, port, app, sid string, to int, cc chan bool) (*Stream, error
 		err = SendAckMessage(rs, msg.MsgLength)
 		if err != nil {
 			rs.log.Println(err)
-			close(rs.AvPkg2RtspChan)
 			close(rs.Msg2RtmpChan)
-			RtmpPuberMap.Delete(key)
+			ForwardStopAll(rs)
+			HubPuberDelete(rs)
 			return nil, err
 		}
 
 		l = len(rs.Msg2RtmpChan)
-		//rs.log.Printf("Msg2RtmpChanNum=%d(%d)", l, conf.Rtmp.Msg2RtmpChanNum)
-		if l < conf.Rtmp.Msg2RtmpChanNum {
+		//rs.log.Printf("Msg2RtmpChanNum=%d(%d)", l, Conf().Rtmp.Msg2RtmpChanNum)
+		if l < Conf().Rtmp.Msg2RtmpChanNum {
 			rs.Msg2RtmpChan <- msg
 		} else {
-			rs.log.Printf("Msg2RtmpChanNum=%d(%d)", l, conf.Rtmp.Msg2RtmpChanNum)
-		}
-
-		l = len(rs.AvPkg2RtspChan)
-		//rs.log.Printf("AvPkt2RtspChanNum=%d(%d)", l, conf.Rtmp.AvPkt2RtspChanNum)
-		if l < conf.Rtmp.AvPkt2RtspChanNum {
-			rs.AvPkg2RtspChan <- msg
-		} else {
-			rs.log.Printf("AvPkt2RtspChanNum=%d(%d)", l, conf.Rtmp.AvPkt2RtspChanNum)
+			rs.log.Printf("Msg2RtmpChanNum=%d(%d)", l, Conf().Rtmp.Msg2RtmpChanNum)
 		}
 	}
 	rs.Conn0.Close()
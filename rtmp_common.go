@@ -19,6 +19,7 @@ const (
 	MsgTypeIdShareAmf0        = 19 //AMF0共享对象消息
 	MsgTypeIdCmdAmf3          = 17 //AMF3命令消息
 	MsgTypeIdCmdAmf0          = 20 //AMF0命令消息
+	MsgTypeIdAggregate        = 22 //聚合消息, 多个音视频消息打包在一起
 )
 
 var (
@@ -31,5 +32,4 @@ var (
 	VideoKeyFrame   sync.Map
 	PlayerMap       sync.Map
 	StreamStateChan chan StreamStateInfo //send stream and stat to cc
-	AdjustSeqNum    uint32
 )
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"utils"
+)
+
+/*************************************************/
+/* RtmpForwarder 把发布者的流 转推给第三方(cdn)
+/*************************************************/
+//一个发布者可以有多个转推目标, 每个转推目标:
+//1 有独立的协程和数据队列, 某个cdn网络差 不影响别的转推和播放
+//2 推流失败或断开后自动重推, 重推间隔从RetryMinSec开始翻倍 最大RetryMaxSec
+//3 状态(发送字节数 重推次数 最后错误)可以通过http api查询
+type Forwarder struct {
+	Url      string
+	Ua       UrlArgs
+	PuberKey string
+	DataChan chan Chunk
+	Ctx      context.Context
+	Cancel   context.CancelFunc
+	Mutex    sync.Mutex
+	Status   ForwardStatus
+}
+
+type ForwardStatus struct {
+	Url          string `json:"url"`
+	State        string `json:"state"` //connecting, pushing, retrying, stopped
+	BytesSent    uint64 `json:"bytesSent"`
+	DropNum      uint64 `json:"dropNum"` //队列满 扔掉的消息个数
+	ReconnectNum uint32 `json:"reconnectNum"`
+	LastError    string `json:"lastError"`
+	StartTime    int64  `json:"startTime"` //本次推流成功的时间, 毫秒
+}
+
+func ForwardStatusSet(f *Forwarder, state string, err error) {
+	f.Mutex.Lock()
+	f.Status.State = state
+	if err != nil {
+		f.Status.LastError = err.Error()
+	}
+	f.Mutex.Unlock()
+}
+
+func ForwardStatusGet(f *Forwarder) ForwardStatus {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	return f.Status
+}
+
+//推流开始时, 添加配置文件里的转推目标
+func ForwardStart(s *Stream) {
+	if Conf().Forward.Enable == false {
+		return
+	}
+
+	urls, ok := Conf().Forward.Targets[s.Key]
+	if ok == false {
+		return
+	}
+	for _, url := range urls {
+		_, err := ForwardAdd(s, url)
+		if err != nil {
+			s.log.Println(err)
+		}
+	}
+}
+
+func ForwardAdd(s *Stream, url string) (*Forwarder, error) {
+	ua, err := UrlParse(url)
+	if err != nil {
+		s.log.Println(err)
+		return nil, err
+	}
+	if ua.Ptcl != "rtmp" && ua.Ptcl != "rtmps" {
+		err = fmt.Errorf("forward url %s ptcl must be rtmp or rtmps", url)
+		s.log.Println(err)
+		return nil, err
+	}
+	if len(ua.Path) < 2 {
+		err = fmt.Errorf("forward url %s need app and streamId", url)
+		s.log.Println(err)
+		return nil, err
+	}
+
+	n := Conf().Forward.ChanNum
+	if n <= 0 {
+		n = Conf().Rtmp.Msg2RtmpChanNum
+	}
+	f := &Forwarder{
+		Url:      url,
+		Ua:       ua,
+		PuberKey: s.Key,
+		DataChan: make(chan Chunk, n),
+	}
+	f.Status.Url = url
+	f.Status.State = "connecting"
+
+	pctx := s.Ctx
+	if pctx == nil {
+		pctx = context.Background()
+	}
+	f.Ctx, f.Cancel = context.WithCancel(pctx)
+
+	_, ok := s.Forwards.LoadOrStore(url, f)
+	if ok == true {
+		f.Cancel()
+		err = HttpErr(http.StatusConflict, "forward %s is exist", url)
+		s.log.Println(err)
+		return nil, err
+	}
+	s.log.Printf("forward %s add", url)
+
+	go ForwardRun(s, f)
+	return f, nil
+}
+
+func ForwardDelete(s *Stream, url string) error {
+	v, ok := s.Forwards.Load(url)
+	if ok == false {
+		err := HttpErr(http.StatusNotFound, "forward %s is not exist", url)
+		s.log.Println(err)
+		return err
+	}
+	f := v.(*Forwarder)
+	f.Cancel()
+	s.Forwards.Delete(url)
+	s.log.Printf("forward %s delete", url)
+	return nil
+}
+
+func ForwardStopAll(s *Stream) {
+	s.Forwards.Range(func(k, v interface{}) bool {
+		f := v.(*Forwarder)
+		f.Cancel()
+		s.Forwards.Delete(k)
+		return true
+	})
+}
+
+//s是发布者, 队列满了就扔掉, 不能阻塞发布者的发送协程
+func ForwardDataSend(s *Stream, c Chunk) {
+	s.Forwards.Range(func(k, v interface{}) bool {
+		f := v.(*Forwarder)
+		select {
+		case f.DataChan <- c:
+		default:
+			f.Mutex.Lock()
+			f.Status.DropNum++
+			if f.Status.DropNum%100 == 1 {
+				s.log.Printf("forward %s ChanNum=%d, DropDataType=%s", f.Url, len(f.DataChan), c.DataType)
+			}
+			f.Mutex.Unlock()
+		}
+		return true
+	})
+}
+
+//建连 握手 发送publish
+func ForwardConnect(s *Stream, f *Forwarder) (*Stream, error) {
+	ua := f.Ua
+	rs, err := RtmpClient(ua.Ptcl, ua.Ip, ua.Port, 10)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	rs.Type = "RtmpForwarder"
+	rs.App = ua.Path[0]
+	rs.StreamId = ua.Path[len(ua.Path)-1]
+	rs.RemoteArgs = ua.Args
+
+	sid := s.AmfInfo.StreamId
+	if sid == "" {
+		sid = s.StreamId
+	}
+	fn := fmt.Sprintf("%s/%s/forward_rtmp_%s:%s.log", Conf().Log.StreamLogPath, sid, ua.Ip, ua.Port)
+	StreamLogRename(rs.LogFn, fn)
+	rs.LogFn = fn
+
+	err = RtmpPublishMsgInteract(rs)
+	if err != nil {
+		rs.log.Println(err)
+		ForwardClose(rs)
+		return nil, err
+	}
+	rs.log.Printf("forward %s publish ok", f.Url)
+	return rs, nil
+}
+
+func ForwardClose(rs *Stream) {
+	if rs.Conn0 != nil {
+		rs.Conn0.Close()
+	}
+	if rs.LogFp != nil {
+		rs.LogFp.Close()
+	}
+}
+
+func ForwardRun(s *Stream, f *Forwarder) {
+	min := time.Duration(Conf().Forward.RetryMinSec) * time.Second
+	if min <= 0 {
+		min = time.Second
+	}
+	max := time.Duration(Conf().Forward.RetryMaxSec) * time.Second
+	if max < min {
+		max = min
+	}
+	wait := min
+
+	for {
+		ForwardStatusSet(f, "connecting", nil)
+		rs, err := ForwardConnect(s, f)
+		if err == nil {
+			wait = min
+			f.Mutex.Lock()
+			f.Status.State = "pushing"
+			f.Status.StartTime = utils.GetTimestamp("ms")
+			f.Mutex.Unlock()
+
+			err = ForwardTransmit(s, f, rs)
+			ForwardClose(rs)
+		}
+
+		select {
+		case <-f.Ctx.Done():
+			ForwardStatusSet(f, "stopped", nil)
+			s.log.Printf("forward %s stop", f.Url)
+			return
+		default:
+		}
+
+		s.log.Printf("forward %s error: %v, retry after %v", f.Url, err, wait)
+		f.Mutex.Lock()
+		f.Status.ReconnectNum++
+		f.Mutex.Unlock()
+		ForwardStatusSet(f, "retrying", err)
+
+		select {
+		case <-f.Ctx.Done():
+			ForwardStatusSet(f, "stopped", nil)
+			s.log.Printf("forward %s stop", f.Url)
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if wait > max {
+			wait = max
+		}
+	}
+}
+
+//新连接先发送metadata和音视频头, 再从关键帧开始发送
+func ForwardTransmit(s *Stream, f *Forwarder, rs *Stream) error {
+	var err error
+	//断开期间积压的数据 已经没用了
+	for len(f.DataChan) > 0 {
+		<-f.DataChan
+	}
+
+	//对方发来的ack等消息 要读走, 否则对方发送阻塞
+	//对方断开时 关闭连接, 让发送出错返回
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, rs.Conn)
+		rs.Conn0.Close()
+	}()
+
+	var hs []*Chunk
+	if v, ok := s.GopCache.MetaData.Load(s.Key); ok {
+		hs = append(hs, v.(*Chunk))
+	}
+	vh, hasVideo := s.GopCache.VideoHeader.Load(s.Key)
+	if hasVideo {
+		hs = append(hs, vh.(*Chunk))
+	}
+	if v, ok := s.GopCache.AudioHeader.Load(s.Key); ok {
+		hs = append(hs, v.(*Chunk))
+	}
+
+	var c Chunk
+	var ok bool
+	start := false
+	for {
+		select {
+		case c, ok = <-f.DataChan:
+			if ok == false {
+				return nil
+			}
+		case <-f.Ctx.Done():
+			return nil
+		}
+
+		//有视频的流 要从关键帧开始发送, 头信息用关键帧的时间戳
+		if start == false {
+			if hasVideo && c.DataType != "VideoKeyFrame" {
+				continue
+			}
+			start = true
+			for _, h := range hs {
+				hc := *h
+				hc.Timestamp = c.Timestamp
+				if err = ForwardChunkSend(f, rs, hc); err != nil {
+					rs.log.Println(err)
+					return err
+				}
+			}
+		}
+
+		if err = ForwardChunkSend(f, rs, c); err != nil {
+			rs.log.Println(err)
+			return err
+		}
+	}
+}
+
+func ForwardChunkSend(f *Forwarder, rs *Stream, c Chunk) error {
+	//音视频数据发给publish的流, createStream返回的流id一般为1
+	c.MsgStreamId = 1
+	err := MessageSplit(rs, &c, true)
+	if err != nil {
+		return err
+	}
+	f.Mutex.Lock()
+	f.Status.BytesSent += uint64(c.MsgLength)
+	f.Mutex.Unlock()
+	return nil
+}
@@ -23,97 +23,38 @@ func MetaSendRtmp(p, s *Stream) {
 	}
 }
 
+//从缓存中最新的关键帧开始发送, 见GopStartChunks()
+//音视频头的时间戳 用发送的第一帧的, 头是缓存里的 要拷贝后再改
 func GopCacheFastlowSendRtmp(p, s *Stream, gop *GopCache) {
-	goplocks.Lock()
-	var chunkNum, videoChunkNum, audioChunkNum int
-	var lastChunk, videoChunk, audioChunk Chunk
-
-	for e := gop.MediaData.Back(); e != nil; e = e.Prev() {
-		c := (e.Value).(*Chunk)
-		if chunkNum == 0 {
-			lastChunk = *c
-		}
-		chunkNum++
-		if videoChunkNum == 0 && (c.DataType == "VideoKeyFrame" || c.DataType == "VideoInterFrame") {
-			videoChunk = *c
-			videoChunkNum++
-		}
-		if audioChunkNum == 0 && c.DataType == "AudioAacFrame" {
-			audioChunk = *c
-			audioChunkNum++
-		}
-		s.log.Printf("<== videoChunkNum :%d, audioChunkNum %d: DataType:%s, Timestamp:%d", videoChunkNum, audioChunkNum, c.DataType, c.Timestamp)
-		if videoChunkNum > 0 && audioChunkNum > 0 {
-			break
-		}
-	}
-	s.log.Printf("<== videoChunkNum :%d, audioChunkNum %d", videoChunkNum, audioChunkNum)
-
-	// 1 发送Metadata
-	v, ok := gop.MetaData.Load(p.Key)
-	if ok == false {
-		s.log.Printf("meta data is not exist %v", p.Key)
-	} else {
-		s.log.Println("<== send Metadata")
-		if chunkNum > 0 {
-			v1 := v.(*Chunk)
-			v1.Timestamp = lastChunk.Timestamp
-			s.PlayChan <- v1
-		} else {
-			s.PlayChan <- v.(*Chunk)
-		}
-	}
-
-	// 2 发送VideoHeader
-	v, ok = gop.VideoHeader.Load(p.Key)
-	if ok == false {
-		s.log.Printf("video header is not exist %v", p.Key)
-	} else {
-		s.log.Println("<== send VideoHeader")
-		if videoChunkNum > 0 {
-			v1 := v.(*Chunk)
-			v1.Timestamp = videoChunk.Timestamp
-			s.PlayChan <- v1
-		} else {
-			s.PlayChan <- v.(*Chunk)
-		}
-	}
-
-	// 3 发送AudioHeader
-	v, ok = gop.AudioHeader.Load(p.Key)
-	if ok == false {
-		s.log.Printf("audio header is not exist %v", p.Key)
-	} else {
-		s.log.Println("<== send AudioHeader")
-		v1 := v.(*Chunk)
-		if audioChunkNum > 0 {
-			v1.Timestamp = audioChunk.Timestamp
-			s.PlayChan <- v1
-			s.PlayChan <- &audioChunk
-		} else {
-			if videoChunkNum > 0 {
-				v1.Timestamp = videoChunk.Timestamp
-			}
-			s.PlayChan <- v1
+	cs := GopStartChunks(gop, StartModeFastlow)
+	s.log.Printf("<== GopCacheFastlowSendRtmp() ChunkNum=%d", len(cs))
+
+	var ts uint32
+	hs := []*sync.Map{&gop.MetaData, &gop.VideoHeader, &gop.AudioHeader}
+	ns := []string{"meta data", "video header", "audio header"}
+	if len(cs) > 0 {
+		ts = cs[0].Timestamp
+	} else if v, ok := gop.MetaData.Load(p.Key); ok == true {
+		ts = v.(*Chunk).Timestamp
+	}
+	// 1 发送Metadata, 2 发送VideoHeader, 3 发送AudioHeader
+	for i, h := range hs {
+		v, ok := h.Load(p.Key)
+		if ok == false {
+			s.log.Printf("%s is not exist %v", ns[i], p.Key)
+			continue
 		}
+		c := *(v.(*Chunk))
+		c.Timestamp = ts
+		s.log.Println("<== send", ns[i])
+		s.PlayChan <- &c
 	}
 
 	// 4 发送MediaData(包含最后收到的数据)
-	s.log.Println("<== send MediaData, GopCache.MediaData len", gop.MediaData.Len())
-	i := 0
-	var c *Chunk
-
-	for e := gop.MediaData.Front(); e != nil; e = e.Next() {
-		c = (e.Value).(*Chunk)
-		if c.DataType == "AudioAacFrame" {
-			continue
-		}
-		c.Timestamp = videoChunk.Timestamp
-		s.PlayChan <- c
-		s.log.Println("<== GopCacheFastlowSendRtmp", i, c.DataType, c.MsgLength, c.Timestamp)
-		i++
+	for i := 0; i < len(cs); i++ {
+		s.PlayChan <- &cs[i]
+		s.log.Println("<== GopCacheFastlowSendRtmp", i, cs[i].DataType, cs[i].MsgLength, cs[i].Timestamp)
 	}
-	goplocks.Unlock()
 	s.log.Println("<== GopCacheFastlowSendRtmp() ok")
 }
 
@@ -144,7 +85,7 @@ func CalcGopBitrate(s *Stream, c Chunk) {
 	}
 
 	//10个gop一般是20秒, 线上建议30个gop 统计并打印一次
-	if s.GopNum > conf.Rtmp.BitrateGopNum {
+	if s.GopNum > Conf().Rtmp.BitrateGopNum {
 		s.GopEndTs = utils.GetTimestamp("s")
 		//发送来的是字节, 码率是bit 所以要乘8
 		if uint32(s.GopEndTs-s.GopStartTs) == 0 {
@@ -442,7 +383,7 @@ func GopGetIframeH265(s *Stream) ([]byte, error) {
 
 func GopCacheNew() GopCache {
 	return GopCache{
-		GopCacheMax: conf.Rtmp.GopCacheMax,
+		GopCacheMax: Conf().Rtmp.GopCacheMax,
 		MediaData:   list.New(),
 	}
 }
@@ -481,7 +422,7 @@ func GopCacheUpdate(s *Stream) {
 		if c.DataType == "VideoKeyFrame" || c.DataType == "VideoInterFrame" {
 			vFrameNum++
 		}
-		if c.DataType == "AudioAacFrame" {
+		if AudioFrameCheck(c.DataType) {
 			aFrameNum++
 		}
 		DataSize += c.MsgLength
@@ -562,7 +503,7 @@ func GopCacheSendRtmp(p, s *Stream, gop *GopCache) {
 			videoChunk = *c
 			videoChunkNum++
 		}
-		if audioChunkNum == 0 && c.DataType == "AudioAacFrame" {
+		if audioChunkNum == 0 && AudioFrameCheck(c.DataType) {
 			audioChunk = *c
 			audioChunkNum++
 		}
@@ -30,6 +30,17 @@ func MessageMerge(s *Stream, c *Chunk) (Chunk, error) {
 	var id0, id1 uint32
 	var sc Chunk
 	var ok bool
+
+	//上个聚合消息拆分出的子消息 要先取走
+	if len(s.AggChunks) > 0 {
+		sc = s.AggChunks[0]
+		s.AggChunks = s.AggChunks[1:]
+		if c != nil {
+			*c = sc
+		}
+		return sc, nil
+	}
+
 	//i := 0
 	for {
 		//s.log.Println("----> chunk", i)
@@ -95,6 +106,18 @@ func MessageMerge(s *Stream, c *Chunk) (Chunk, error) {
 		s.Chunks[csid] = sc
 		if sc.Full {
 			//s.log.Println("chunk Full")
+			if sc.MsgTypeId == MsgTypeIdAggregate {
+				cs, err := AggregateSplit(s, &sc)
+				if err != nil {
+					s.log.Println(err)
+					return sc, err
+				}
+				if len(cs) == 0 {
+					continue
+				}
+				sc = cs[0]
+				s.AggChunks = cs[1:]
+			}
 			if c != nil {
 				*c = sc
 			}
@@ -103,6 +126,65 @@ func MessageMerge(s *Stream, c *Chunk) (Chunk, error) {
 	}
 }
 
+//聚合消息的消息体 由多个子消息组成, 每个子消息结构如下
+//MsgType(1) + Length(3) + Timestamp(3) + TimestampExtend(1) + StreamId(3) + Data(Length) + BackPointer(4)
+//子消息的时间戳 要以第1个子消息为基准 换算到聚合消息的时间戳上
+//拆分后的子消息 和普通消息一样 交给AudioHandle/VideoHandle/MetadataHandle处理
+func AggregateSplit(s *Stream, c *Chunk) ([]Chunk, error) {
+	var err error
+	var cs []Chunk
+	var t uint8
+	var l, ts, base, sum uint32
+	first := true
+	d := c.MsgData
+	n := uint32(len(d))
+
+	for i := uint32(0); i+11 <= n; {
+		t = d[i]
+		l = ByteToUint32(d[i+1:i+4], BE)
+		ts = ByteToUint32(d[i+4:i+7], BE) | uint32(d[i+7])<<24
+		i += 11
+
+		if i+l > n {
+			err = fmt.Errorf("aggregate sub message len %d out of range %d", l, n-i)
+			s.log.Println(err)
+			return nil, err
+		}
+		if first == true {
+			first = false
+			base = ts
+		}
+
+		switch t {
+		case MsgTypeIdAudio, MsgTypeIdVideo, MsgTypeIdDataAmf0, MsgTypeIdDataAmf3:
+			sc := Chunk{
+				Fmt:         c.Fmt,
+				Csid:        c.Csid,
+				Timestamp:   c.Timestamp + ts - base,
+				MsgLength:   l,
+				MsgTypeId:   uint32(t),
+				MsgStreamId: c.MsgStreamId,
+				MsgData:     d[i : i+l],
+				Full:        true,
+			}
+			cs = append(cs, sc)
+		default:
+			s.log.Printf("aggregate sub message type %d is not supported, drop it", t)
+		}
+		sum += l
+
+		//BackPointer 是前一个子消息的长度, 用不到
+		i += l + 4
+	}
+
+	//ACK要按实际接收的字节数计算, 子消息头的长度也要算上
+	if c.MsgLength > sum {
+		s.RecvMsgLen += c.MsgLength - sum
+	}
+	//s.log.Printf("aggregate message len=%d, ts=%d, split %d sub message", c.MsgLength, c.Timestamp, len(cs))
+	return cs, nil
+}
+
 func MessageSplit(s *Stream, c *Chunk, flush bool) error {
 	var err error
 	if c == nil {
@@ -160,12 +242,10 @@ func MessageTypeCheck(c *Chunk) {
 	switch c.MsgTypeId {
 	case MsgTypeIdCmdAmf0: // 20
 		c.DataType = "CmdAmf0"
+	case MsgTypeIdCmdAmf3: // 17
+		c.DataType = "CmdAmf3"
 	case MsgTypeIdAudio: // 8
-		c.DataType = "AudioAacFrame"
-		AACPacketType := c.MsgData[1]
-		if AACPacketType == 0 {
-			c.DataType = "AudioHeader"
-		}
+		c.DataType = AudioDataType(c.MsgData)
 	case MsgTypeIdVideo: // 9
 		c.DataType = "VideoFrame"
 		FrameType := c.MsgData[0] >> 4 // 4bit
@@ -191,14 +271,14 @@ func MessageTypeCheck(c *Chunk) {
 /* 建连阶段message交互
 /*************************************************/
 func SetRemoteChunkSize(s *Stream) error {
-	d := Uint32ToByte(conf.Rtmp.ChunkSize, nil, BE)
+	d := Uint32ToByte(Conf().Rtmp.ChunkSize, nil, BE)
 	rc := CreateMessage(MsgTypeIdSetChunkSize, 4, d)
 	err := MessageSplit(s, &rc, false)
 	if err != nil {
 		s.log.Println(err)
 		return err
 	}
-	s.RemoteChunkSize = conf.Rtmp.ChunkSize
+	s.RemoteChunkSize = Conf().Rtmp.ChunkSize
 	return nil
 }
 
@@ -212,7 +292,12 @@ func SendConnMsg(s *Stream) error {
 	info["type"] = "nonprivate"
 	//info["flashVer"] = "FMS.3.1"
 	info["flashVer"] = "yuankang"
-	info["tcUrl"] = fmt.Sprintf("rtmp://127.0.0.1:1935/%s", s.App)
+	if s.RemotePtcl != "" {
+		//有些云厂商会校验tcUrl, 必须和推流地址一致
+		info["tcUrl"] = fmt.Sprintf("%s://%s:%s/%s", s.RemotePtcl, s.RemoteIp, s.RemotePort, s.App)
+	} else {
+		info["tcUrl"] = fmt.Sprintf("rtmp://127.0.0.1:1935/%s", s.App)
+	}
 	s.log.Printf("%#v", info)
 
 	d, _ := AmfMarshal(s, "connect", 1, info)
@@ -255,6 +340,14 @@ func SendPublishMsg(s *Stream) error {
 	PubName := fmt.Sprintf("%s?app=slivegateway&pbto=30", s.StreamId)
 	//PubName := fmt.Sprintf("%s?app=slivegateway&pbto=30&%s", s.StreamId, BackDoor)
 	PubType := s.App
+	//转推给第三方, 推流名要和转推地址里的一致, 不能加我们自己的参数
+	if s.Type == "RtmpForwarder" {
+		PubName = s.StreamId
+		if s.RemoteArgs != "" {
+			PubName = fmt.Sprintf("%s?%s", s.StreamId, s.RemoteArgs)
+		}
+		PubType = "live"
+	}
 
 	d, _ := AmfMarshal(s, "publish", 3, nil, PubName, PubType)
 	//s.log.Printf("%x", d)
@@ -293,7 +386,13 @@ func SendPlayMsg(s *Stream) error {
 	s.log.Println("<== Send Play Message")
 	s.log.Printf("play streamid %s", s.StreamId)
 
-	d, _ := AmfMarshal(s, "play", 3, nil, s.StreamId, -2000)
+	//拉第三方的流, 播放名要和拉流地址里的一致
+	PlayName := s.StreamId
+	if s.RemoteArgs != "" {
+		PlayName = fmt.Sprintf("%s?%s", s.StreamId, s.RemoteArgs)
+	}
+
+	d, _ := AmfMarshal(s, "play", 3, nil, PlayName, -2000)
 	//s.log.Printf("%x", d)
 
 	msg := CreateMessage(MsgTypeIdCmdAmf0, uint32(len(d)), d)
@@ -361,11 +460,16 @@ func MessageHandle(s *Stream, c *Chunk) error {
 	case MsgTypeIdWindowAckSize:
 		s.RemoteWindowAckSize = ByteToUint32(c.MsgData, BE)
 		s.log.Println("MsgTypeIdWindowAckSize", s.RemoteWindowAckSize)
-	case MsgTypeIdDataAmf0, MsgTypeIdShareAmf0, MsgTypeIdCmdAmf0:
+	case MsgTypeIdDataAmf0, MsgTypeIdCmdAmf0, MsgTypeIdDataAmf3, MsgTypeIdCmdAmf3:
 		if err := AmfHandle(s, c); err != nil {
 			s.log.Println(err)
 			return err
 		}
+	case MsgTypeIdShareAmf0, MsgTypeIdShareAmf3:
+		if err := SharedObjectHandle(s, c); err != nil {
+			s.log.Println(err)
+			return err
+		}
 	case MsgTypeIdSetPeerBandwidth:
 		bw := ByteToUint32(c.MsgData[:4], BE)
 		//Limit Type: 0 is Hard, 1 is Soft, 2 is Dynamic
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"utils"
+)
+
+/*************************************************/
+/* RtmpPullProxy 拉第三方rtmp/rtmps流, 以指定的app/streamId发布到本服务
+/*************************************************/
+//1 拉流成功后 同rtmp推流一样存入StreamHub, rtmp/flv/hls都可以播放
+//2 对方断流或拉流失败 按间隔重试, 间隔从PullRetryMinSec开始翻倍 最大PullRetryMaxSec
+//3 连续失败超过retry次 任务自动删除, retry为-1时一直重试
+//4 状态变化时 回调hookUrl
+type RtmpPullRqst struct {
+	PullUrl   string `json:"sourceUrl"` //拉流地址, rtmp或rtmps
+	App       string `json:"app"`       //发布到本服务的app, 默认live
+	StreamId  string `json:"streamId"`  //发布到本服务的流id
+	PullRetry int    `json:"retry"`     //连续失败重试次数, 默认3次, -1一直重试
+	ReportUrl string `json:"hookUrl"`   //任务状态回调地址
+}
+
+type RtmpPullTask struct {
+	Rqst   RtmpPullRqst
+	Ua     UrlArgs
+	Ctx    context.Context
+	Cancel context.CancelFunc
+	Mutex  sync.Mutex
+	Conn   net.Conn //当前的拉流连接, 删除任务时关闭
+	Status RtmpPullStatus
+}
+
+type RtmpPullStatus struct {
+	App       string `json:"app"`
+	StreamId  string `json:"streamId"`
+	PullUrl   string `json:"sourceUrl"`
+	State     string `json:"state"`    //connecting, pulling, retrying, stopped
+	RetryNum  int    `json:"retryNum"` //连续失败次数, 拉流成功后清零
+	LastError string `json:"lastError"`
+	StartTime int64  `json:"startTime"` //本次拉流成功的时间, 毫秒
+}
+
+type RtmpPullReport struct {
+	RtmpPullStatus
+	Timestamp int64 `json:"timestamp"`
+}
+
+func RtmpPullStatusGet(t *RtmpPullTask) RtmpPullStatus {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	return t.Status
+}
+
+//状态变化 回调hookUrl
+func RtmpPullStatusSet(t *RtmpPullTask, state string, err error) {
+	t.Mutex.Lock()
+	t.Status.State = state
+	if err != nil {
+		t.Status.LastError = err.Error()
+	}
+	var r RtmpPullReport
+	r.RtmpPullStatus = t.Status
+	t.Mutex.Unlock()
+
+	if t.Rqst.ReportUrl == "" {
+		return
+	}
+	r.Timestamp = utils.GetTimestamp("ms")
+	d, err := json.Marshal(r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	go func() {
+		_, err := HttpRequest("POST", t.Rqst.ReportUrl, d, 5, 1)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+func RtmpPullCreate(rqst RtmpPullRqst) (*RtmpPullTask, error) {
+	ua, err := UrlParse(rqst.PullUrl)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if ua.Ptcl != "rtmp" && ua.Ptcl != "rtmps" {
+		err = fmt.Errorf("pull url %s ptcl must be rtmp or rtmps", rqst.PullUrl)
+		log.Println(err)
+		return nil, err
+	}
+	if len(ua.Path) < 2 {
+		err = fmt.Errorf("pull url %s need app and streamId", rqst.PullUrl)
+		log.Println(err)
+		return nil, err
+	}
+	if rqst.StreamId == "" {
+		rqst.StreamId = ua.Path[len(ua.Path)-1]
+	}
+	if rqst.App == "" {
+		rqst.App = "live"
+	}
+	if rqst.PullRetry == 0 {
+		rqst.PullRetry = 3
+	}
+
+	t := &RtmpPullTask{
+		Rqst: rqst,
+		Ua:   ua,
+	}
+	t.Status.App = rqst.App
+	t.Status.StreamId = rqst.StreamId
+	t.Status.PullUrl = rqst.PullUrl
+	t.Status.State = "connecting"
+	t.Ctx, t.Cancel = context.WithCancel(context.Background())
+
+	//先创建ctx再存入map, 存入后RtmpPullStop()就可能拿到t; 已存在时要释放ctx
+	_, ok := RtmpPullMap.LoadOrStore(rqst.StreamId, t)
+	if ok == true {
+		t.Cancel()
+		err = HttpErr(http.StatusConflict, "rtmp pull %s is exist", rqst.StreamId)
+		log.Println(err)
+		return nil, err
+	}
+
+	go RtmpPullRun(t)
+	return t, nil
+}
+
+func RtmpPullDelete(sid string) error {
+	v, ok := RtmpPullMap.Load(sid)
+	if ok == false {
+		err := HttpErr(http.StatusNotFound, "rtmp pull %s is not exist", sid)
+		log.Println(err)
+		return err
+	}
+	t := v.(*RtmpPullTask)
+	t.Cancel()
+
+	//关闭连接, RtmpPublisher0()接收出错后 会释放发布者资源
+	t.Mutex.Lock()
+	if t.Conn != nil {
+		t.Conn.Close()
+	}
+	t.Mutex.Unlock()
+
+	RtmpPullMap.Delete(sid)
+	return nil
+}
+
+//建连 握手 发送play
+func RtmpPullConnect(t *RtmpPullTask) (*Stream, error) {
+	ua := t.Ua
+	rs, err := RtmpClient(ua.Ptcl, ua.Ip, ua.Port, 10)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	rs.Type = "RtmpPullProxy"
+	rs.App = ua.Path[0]
+	rs.StreamId = ua.Path[len(ua.Path)-1]
+	rs.RemoteArgs = ua.Args
+
+	fn := fmt.Sprintf("%s/%s/pull_rtmp_%s:%s_%d.log", Conf().Log.StreamLogPath, t.Rqst.StreamId, ua.Ip, ua.Port, utils.GetTimestamp("ns"))
+	StreamLogRename(rs.LogFn, fn)
+	rs.LogFn = fn
+
+	err = RtmpPlayMsgInteract(rs)
+	if err != nil {
+		rs.log.Println(err)
+		RtmpStop(rs)
+		return nil, err
+	}
+	rs.log.Printf("rtmp pull %s ok", t.Rqst.PullUrl)
+	return rs, nil
+}
+
+//拉到的流 当作rtmp推流来处理, 发布者key为streamId
+func RtmpPullPublish(t *RtmpPullTask, rs *Stream) error {
+	rs.IsPublisher = true
+	rs.AmfInfo.App = t.Rqst.App
+	rs.AmfInfo.StreamId = t.Rqst.StreamId
+	rs.AmfInfo.PublishName = t.Rqst.StreamId
+	rs.PlaybackTimeout = Conf().Rtmp.PublishTimeout
+	rs.DataChan = make(chan Chunk, Conf().DataStockMax)
+
+	//拉流代理不需要鉴权, 不加密 不录制
+	rs.PubAuth = PubAuthRsps{}
+	rs.PubAuth.Data.ResultCode = 1
+
+	_, ok := HubPuberGet(rs.AmfInfo.StreamId)
+	if ok == true {
+		err := fmt.Errorf("publisher %s is exist", rs.AmfInfo.StreamId)
+		rs.log.Println(err)
+		RtmpStop(rs)
+		return err
+	}
+
+	t.Mutex.Lock()
+	t.Conn = rs.Conn0
+	t.Status.RetryNum = 0
+	t.Status.StartTime = utils.GetTimestamp("ms")
+	t.Mutex.Unlock()
+	RtmpPullStatusSet(t, "pulling", nil)
+
+	//阻塞到对方断流
+	RtmpPublisher0(rs)
+
+	t.Mutex.Lock()
+	t.Conn = nil
+	t.Mutex.Unlock()
+	return fmt.Errorf("rtmp pull %s upstream end", t.Rqst.PullUrl)
+}
+
+func RtmpPullRun(t *RtmpPullTask) {
+	min := time.Duration(Conf().Rtmp.PullRetryMinSec) * time.Second
+	if min <= 0 {
+		min = time.Second
+	}
+	max := time.Duration(Conf().Rtmp.PullRetryMaxSec) * time.Second
+	if max < min {
+		max = min
+	}
+	wait := min
+
+	for {
+		RtmpPullStatusSet(t, "connecting", nil)
+		rs, err := RtmpPullConnect(t)
+		if err == nil {
+			wait = min
+			err = RtmpPullPublish(t, rs)
+		}
+
+		select {
+		case <-t.Ctx.Done():
+			RtmpPullStatusSet(t, "stopped", nil)
+			log.Printf("rtmp pull %s stop", t.Rqst.StreamId)
+			return
+		default:
+		}
+
+		t.Mutex.Lock()
+		t.Status.RetryNum++
+		n := t.Status.RetryNum
+		t.Mutex.Unlock()
+
+		//连续失败次数用完, 任务自动删除
+		if t.Rqst.PullRetry >= 0 && n > t.Rqst.PullRetry {
+			log.Printf("rtmp pull %s retry %d times, stop", t.Rqst.StreamId, n-1)
+			//只删自己, 期间可能已被stop后重新创建了同名任务
+			SyncMapDeleteSelf(&RtmpPullMap, t.Rqst.StreamId, t)
+			t.Cancel()
+			RtmpPullStatusSet(t, "stopped", err)
+			return
+		}
+
+		log.Printf("rtmp pull %s error: %v, retry%d after %v", t.Rqst.StreamId, err, n, wait)
+		RtmpPullStatusSet(t, "retrying", err)
+
+		select {
+		case <-t.Ctx.Done():
+			RtmpPullStatusSet(t, "stopped", nil)
+			log.Printf("rtmp pull %s stop", t.Rqst.StreamId)
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if wait > max {
+			wait = max
+		}
+	}
+}
@@ -33,6 +33,9 @@ func RtspSendRtmpGop(rs *Stream, s *RtspStream) {
 		i++
 
 		s.log.Printf("%d: type:%d(%s), ts=%d, len=%d, naluNum:%d", i, c.MsgTypeId, c.DataType, c.Timestamp, c.MsgLength, c.NaluNum)
+		if c.MsgTypeId == MsgTypeIdAudio && RtspAudioCodecCheck(rs.AudioCodecType) == false {
+			continue
+		}
 
 		rps, err := RtpPkgCreate(rs, s, c)
 		if err != nil {
@@ -69,19 +72,24 @@ func RtspSendMediaData(rs *Stream, s *RtspStream, rp *RtpPacket) error {
 	return nil
 }
 
-func RtmpMem2RtspServer(rs *Stream) {
+//rs是StreamHub里的发布者, key为rtsp播放用的app_streamId
+//ch由调用者创建 只在这里读取, 调用者关闭ch后 这里退出, 收到的是与协议无关的AvFrame
+//因为没有sps/pps等原因提前退出时 取消rtsp订阅, RtmpSender()不再给数据
+func RtmpMem2RtspServer(rs *Stream, key string, ch <-chan *AvFrame) {
 	s := NewRtspStream(nil)
 	s.log.Println("----------")
-	s.Key = rs.Key
+	s.Key = key
+	s.StreamId = rs.StreamId
 	s.log.Printf("PuberKey:%s", s.Key)
 
-	fn := fmt.Sprintf("%s/%s/publish_rtsp_%d.log", conf.Log.StreamLogPath, rs.StreamId, utils.GetTimestamp("ns"))
+	fn := fmt.Sprintf("%s/%s/publish_rtsp_%d.log", Conf().Log.StreamLogPath, rs.StreamId, utils.GetTimestamp("ns"))
 	StreamLogRename(s.LogFn, fn)
 	s.LogFn = fn
 
 	i := 0
 	for i = 0; i < 10; i++ {
-		if rs.AvcC != nil && rs.AacC != nil {
+		//非aac的音频没有sequence header, 有音频帧就可以
+		if rs.AvcC != nil && (rs.AacC != nil || (rs.AudioCodecType != "" && rs.AudioCodecType != "AAC")) {
 			break
 		}
 		s.log.Printf("rs.Avcc or rs.AacC == nil, wait%d for moment", i)
@@ -89,52 +97,52 @@ func RtmpMem2RtspServer(rs *Stream) {
 	}
 	if i == 10 {
 		s.log.Printf("%s RtmpMem2RtspServer stop", s.Key)
+		HubRtspUnsubscribe(rs)
 		return
 	}
 
 	s.log.Printf("Sps:%x", rs.AvcC.SpsData)
 	s.log.Printf("Pps:%x", rs.AvcC.PpsData)
-	s.log.Printf("%#v", rs.AacC)
+	s.log.Printf("AudioCodecType:%s, %#v", rs.AudioCodecType, rs.AacC)
 
 	var err error
-	s.Sdp, err = CreateSdpUseSpsPps(rs.AvcC.SpsData, rs.AvcC.PpsData)
+	s.Sdp, err = CreateSdpUseSpsPps(rs.AvcC.SpsData, rs.AvcC.PpsData, rs.AudioCodecType)
 	if err != nil {
 		s.log.Println(err)
+		HubRtspUnsubscribe(rs)
 		return
 	}
 	s.log.Printf("width:%d, height:%d, RawSdp:%s", s.Sdp.Width, s.Sdp.Height, string(s.Sdp.RawSdp))
 
 	log.Printf("PuberKey=%s(rtsp)", s.Key)
 	s.log.Printf("PuberKey=%s(rtsp)", s.Key)
-	RtspPuberMap.Store(s.Key, s)
+	HubRtspStore(s.Key, s)
 
 	go RtspMem2RtspPlayers(s)
 	//go RtspRtpCacheSort(s)
 
 	//开始通过chan接收数据并发送给rtsp播放者
-	var ok bool
 	i = 0
 	for {
-		var p Chunk
-		p, ok = <-rs.AvPkg2RtspChan
+		f, ok := <-ch
 		if ok == false {
 			s.log.Printf("%s RtmpMem2RtspServer() stop", rs.StreamId)
+			HubRtspDelete(s.Key, s)
 			close(s.Rtp2RtspChan)
 			close(s.Rtp2RtmpChan)
 			return
 		}
-		MessageTypeCheck(&p)
-
-		if p.DataType == "DataAmfx" || p.DataType == "VideoHeader" || p.DataType == "AudioHeader" {
+		//aac的参数集在sdp里, 不用发送
+		if f.Track == AvTrackAudio && (f.IsHeader == true || RtspAudioCodecCheck(rs.AudioCodecType) == false) {
 			continue
 		}
 
-		rps, err := RtpPkgCreate(rs, s, &p)
+		rps, err := AvFrame2Rtps(s, f)
 		if err != nil {
 			s.log.Println(err)
 			continue
 		}
-		s.log.Printf("%d, type:%d(%s), ts=%d, len=%d, naluNum:%d, rpsLen=%d", i, p.MsgTypeId, p.DataType, p.Timestamp, p.MsgLength, p.NaluNum, len(rps))
+		s.log.Printf("%d, track:%d, codec:%s, pts=%d, key=%t, header=%t, rpsLen=%d", i, f.Track, f.CodecId, f.Pts, f.IsKey, f.IsHeader, len(rps))
 		i++
 
 		for j := 0; j < len(rps); j++ {
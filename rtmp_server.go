@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	utils "utilsGIT"
 )
@@ -16,7 +18,10 @@ import (
 /* RtmpPlayer 别人拉我们的流
 /*************************************************/
 func RtmpTransmit(p *Stream, s *Stream) {
-	defer p.Wg.Done()
+	//发布者可能被替换, 退出时通知当前的发布者
+	defer PlayerPuberDone(s)
+	defer HookPlayerStop(s)
+	defer PlayRelease(s.PlayTicket)
 	var c *Chunk
 	var ok bool
 	var err error
@@ -28,12 +33,12 @@ func RtmpTransmit(p *Stream, s *Stream) {
 				s.log.Printf("%s RtmpTransmit stop", s.Key)
 				return
 			}
-		case <-p.Ctx.Done():
-			p.log.Printf("publish stop then rtmp play stop")
+		case <-s.Ctx.Done():
+			s.log.Printf("publish stop then rtmp play stop")
 			return
 		}
-		//发送数据给播放器
-		err = MessageSplit(s, c, false)
+		//发送数据给播放器, 支持Enhanced RTMP的播放者 hevc用hvc1格式发送
+		err = MessageSplit(s, ExVideoTagForPlayer(s, c), false)
 		if err != nil {
 			s.log.Println(err)
 			if strings.Contains(err.Error(), "error: chunk point is nil") {
@@ -47,6 +52,8 @@ func RtmpTransmit(p *Stream, s *Stream) {
 			s.PlayClose = true
 			return
 		}
+		MetricsAdd(MetricsOutBytes, "rtmp", uint64(c.MsgLength))
+		PlayerOutBytesAdd(s, int(c.MsgLength))
 		//s.log.Printf("SendData, type:%s, size:%d", c.DataType, c.MsgLength)
 	}
 }
@@ -67,23 +74,25 @@ func RtmpPlayer(s *Stream) {
 	}
 
 	info = fmt.Sprintf("publisher %s isn't exist", key)
-	v, ok := RtmpPuberMap.Load(key)
+	p, ok := HubPuberGet(key)
 	if ok == false { // 发布者不存在, 断开连接并返回错误
 		log.Printf(info)
 		s.log.Printf(info)
 		RtmpStop(s)
 		return
 	}
-	p, _ := v.(*Stream)
 	p.Wg.Add(1)
+	s.Puber = p
+	s.Ctx, s.Cancel = context.WithCancel(context.Background())
 	//先启动播放转发协程, 再添加到发布者的players里
-	s.PlayChan = make(chan *Chunk, conf.PlayStockMax)
+	s.PlayChan = make(chan *Chunk, Conf().PlayStockMax)
 	// TODO: 网络io写设置4秒超时
 	go RtmpTransmit(p, s)
 	s.log.Printf("%s RtmpTransmit() start", s.AmfInfo.StreamId)
 
 	s.Key = fmt.Sprintf("%s_%s_%s", s.AmfInfo.App, s.AmfInfo.StreamId, s.RemoteAddr)
 	s.log.Println("player key is", s.Key)
+	s.BeginTime = utils.GetTimestamp("ms")
 	p.Players.Store(s.Key, s)
 }
 
@@ -106,8 +115,8 @@ func MessageSendRtmp(s, p *Stream, c Chunk) error {
 
 	//为了 play_rtmp_xxx.log 能有周期性打印
 	p.FlvSendDataSize += c.MsgLength
-	if p.FlvSendDataSize >= conf.Flv.FlvSendDataSize {
-		p.log.Printf("send data %d(2MB) + %d byte", conf.Flv.FlvSendDataSize, p.FlvSendDataSize-conf.Flv.FlvSendDataSize)
+	if p.FlvSendDataSize >= Conf().Flv.FlvSendDataSize {
+		p.log.Printf("send data %d(2MB) + %d byte", Conf().Flv.FlvSendDataSize, p.FlvSendDataSize-Conf().Flv.FlvSendDataSize)
 		p.FlvSendDataSize = 0
 	}
 
@@ -115,7 +124,7 @@ func MessageSendRtmp(s, p *Stream, c Chunk) error {
 	//support rtmp play, so report datasize
 	//return nil
 
-	if conf.Nt.Enable == false {
+	if Conf().Nt.Enable == false {
 		return nil
 	}
 
@@ -126,7 +135,7 @@ func MessageSendRtmp(s, p *Stream, c Chunk) error {
 		p.StartTime = cTime
 	}
 	p.Duration = cTime - p.StartTime
-	if p.Duration >= conf.Nt.Interval {
+	if p.Duration >= Conf().Nt.Interval {
 		go TrafficReport(p, p.TrafficInfo, "play", "rtmp")
 		p.StartTime = cTime
 		p.DataSize = 0
@@ -140,18 +149,31 @@ func MessageSendRtmp(s, p *Stream, c Chunk) error {
 
 //s: server, p: player
 func LiveDataSend(s, p *Stream, c Chunk) {
+	//拥塞处理方式为drop的, 按积压逐级丢帧 不断开播放者
+	if PlayCongestDrop(s, p, &c) == true {
+		return
+	}
 	n := len(p.PlayChan)
 	//播放积压已经到最大值, 这时音视频数据都不发送
 	//flv播放器不正常关闭, 导致PlayChanNum=600日志打印太多，增加ticker解决此问题
 	//如果持续阻塞800次发送(约30秒), 服务器主动断开播放器的连接
-	if n == conf.PlayStockMax {
-		s.log.Printf("%s PlayChanNum=%d(%d), stop send data", p.Key, n, conf.PlayStockMax)
+	if n == Conf().PlayStockMax {
+		s.log.Printf("%s PlayChanNum=%d(%d), stop send data", p.Key, n, Conf().PlayStockMax)
 		p.PlayClose = true
 
 		return
 	}
 
-	if p.PlayStartMode == "low" {
+	//发布者被替换时, 播放者按低延时启播的方式 等新发布者的关键帧 重发音视频头
+	p.PuberMutex.Lock()
+	if p.PuberChanged == true {
+		p.PuberChanged = false
+		p.PuberWaitKey = true
+		p.PlaySendAHeaderFlag = false
+		p.PlaySendVHeaderFlag = false
+	}
+	p.PuberMutex.Unlock()
+	if p.PlayStartMode == StartModeLow || p.PuberWaitKey == true {
 		if p.PlaySendAHeaderFlag == false && c.DataType == "AudioAacFrame" {
 			p.log.Println("<== low latency send AudioHeader", c.DataType)
 			v, ok := s.GopCache.AudioHeader.Load(s.Key)
@@ -191,6 +213,7 @@ func LiveDataSend(s, p *Stream, c Chunk) {
 						}
 					}
 					p.PlaySendVHeaderFlag = true
+					p.PuberWaitKey = false
 				}
 			} else if c.DataType == "VideoInterFrame" {
 				//p.log.Println("<== low latency no send", c.DataType)
@@ -207,9 +230,10 @@ func LiveDataSend(s, p *Stream, c Chunk) {
 	}
 }
 
-//启播方式: 默认采用快速启播
+//启播方式: 默认采用快速启播, rtmp/flv/rtsp/hls都一样 详见play_start.go
 //1 快速启播: 先发送缓存的gop数据, 再发送最新数据. 启播快 但延时交高
 //2 低延时启播: 直接发送最新数据. 启播交慢 但是延时最低
+//3 快速追赶: 从缓存中最新的关键帧开始发送, 时间戳改为最新的
 func RtmpSender(s *Stream) {
 	var ok bool
 	var n int
@@ -218,6 +242,7 @@ func RtmpSender(s *Stream) {
 	td := time.Duration(s.PlaybackTimeout)
 	ticker := time.NewTicker(td * time.Second)
 	defer ticker.Stop()
+	defer RtspOutStop(s)
 
 	i := 0
 	for {
@@ -234,16 +259,26 @@ func RtmpSender(s *Stream) {
 				return
 			}
 		case <-ticker.C:
+			//发布者断线 等待重连期间 不能退出
+			if s.PuberGrace == true {
+				continue
+			}
 			s.log.Printf("rtmp recv timeout %d second", td)
 			s.TransmitSwitch = "off"
 			return
 		}
 
+		MetricsAdd(MetricsInBytes, MetricsPuberPtcl(s), uint64(c.MsgLength))
+		atomic.AddUint64(&s.InBytes, uint64(c.MsgLength))
+		TsFixHandle(s, &c)
 		switch c.MsgTypeId {
-		case MsgTypeIdCmdAmf0: // 20
+		case MsgTypeIdCmdAmf0, MsgTypeIdCmdAmf3: // 20 17
 			err = AmfHandle(s, &c)
 			//TODO: maybe give response
 			continue
+		case MsgTypeIdShareAmf0, MsgTypeIdShareAmf3: // 19 16
+			err = SharedObjectHandle(s, &c)
+			continue
 		case MsgTypeIdAudio: // 8
 			//s.log.Printf("audio timestamp=%d", c.Timestamp)
 			err = AudioHandle(s, &c)
@@ -275,20 +310,20 @@ func RtmpSender(s *Stream) {
 			continue
 		}
 
-		if conf.HlsRec.Enable == true {
+		if Conf().HlsRec.Enable == true {
 			n = len(s.HlsChan)
-			if n < conf.HlsRec.HlsStockMax { //发送数据给hls生产协程
+			if n < Conf().HlsRec.HlsStockMax { //发送数据给hls生产协程
 				s.HlsChan <- c
 			} else { //硬盘io异常会导致阻塞
-				s.log.Printf("HlsChanNum=%d(%d), DropDataType=%s", n, conf.HlsRec.HlsStockMax, c.DataType)
+				s.log.Printf("HlsChanNum=%d(%d), DropDataType=%s", n, Conf().HlsRec.HlsStockMax, c.DataType)
 			}
 		}
-		if conf.HlsLive.Enable == true {
+		if Conf().HlsLive.Enable == true {
 			n = len(s.HlsLiveChan)
-			if n < conf.HlsRec.HlsStockMax { //发送数据给hls生产协程
+			if n < Conf().HlsRec.HlsStockMax { //发送数据给hls生产协程
 				s.HlsLiveChan <- c
 			} else { //硬盘io异常会导致阻塞
-				s.log.Printf("HlsLiveChanNum=%d(%d), DropDataType=%s", n, conf.HlsRec.HlsStockMax, c.DataType)
+				s.log.Printf("HlsLiveChanNum=%d(%d), DropDataType=%s", n, Conf().HlsRec.HlsStockMax, c.DataType)
 			}
 		}
 		s.log.Printf("%d, xxx111", i)
@@ -315,19 +350,18 @@ func RtmpSender(s *Stream) {
 			if p.NewPlayer == true {
 				s.log.Printf("<== player %s is NewPlayer", p.Key)
 				p.NewPlayer = false
-				if p.PlayStartMode == "low" {
-					HeadDataSend(s, p)
-				} else if p.PlayStartMode == "fastlow" {
-					GopCacheFastlowSend(s, p)
-				} else {
-					GopCacheSend(s, p)
-				}
+				PlayStartSend(s, p)
 			} else {
 				LiveDataSend(s, p, c)
 			}
 			return true
 		})
 		s.log.Printf("%d, xxx222", i)
+
+		//转推给第三方, 每个转推目标有独立的队列
+		ForwardDataSend(s, c)
+		//有rtsp播放时, 在内存中转为rtsp
+		RtspOutSend(s, c)
 		i++
 	}
 }
@@ -340,6 +374,19 @@ func RtmpReceiver(s *Stream) error {
 		s.log.Println("RtmpReceiver close")
 		return err
 	}
+	s.RecvLastTime = utils.GetTimestamp("ms")
+
+	//发布者断线重连后, 时间戳接着断线前的继续
+	switch c.MsgTypeId {
+	case MsgTypeIdAudio, MsgTypeIdVideo, MsgTypeIdDataAmf3, MsgTypeIdDataAmf0:
+		if s.TsRebase == true {
+			s.TsRebase = false
+			s.TsOffset = s.LastMediaTs + 40 - c.Timestamp
+			s.log.Printf("timestamp rebase, last=%d, cur=%d, offset=%d", s.LastMediaTs, c.Timestamp, s.TsOffset)
+		}
+		c.Timestamp += s.TsOffset
+		s.LastMediaTs = c.Timestamp
+	}
 
 	err = SendAckMessage(s, c.MsgLength)
 	if err != nil {
@@ -347,11 +394,11 @@ func RtmpReceiver(s *Stream) error {
 		return err
 	}
 
-	//s.log.Printf("DataChanNum=%d(%d)", len(s.DataChan), conf.DataStockMax)
-	if len(s.DataChan) < conf.DataStockMax {
+	//s.log.Printf("DataChanNum=%d(%d)", len(s.DataChan), Conf().DataStockMax)
+	if len(s.DataChan) < Conf().DataStockMax {
 		s.DataChan <- c
 	} else {
-		s.log.Printf("DataChanNum=%d(%d)", len(s.DataChan), conf.DataStockMax)
+		s.log.Printf("DataChanNum=%d(%d)", len(s.DataChan), Conf().DataStockMax)
 	}
 	return nil
 }
@@ -414,6 +461,8 @@ type RtmpPublisher struct {
 	AudioChunk   Chunk
 	AvcC         AVCDecoderConfigurationRecord  // h264 header
 	HevcC        HEVCDecoderConfigurationRecord // h265 header
+	//PublishAuth
+	PubAuthDone chan struct{} //异步鉴权结束时关闭, 见PublishAuthWait()
 }
 
 func RtmpPublisher0(s *Stream) {
@@ -421,34 +470,28 @@ func RtmpPublisher0(s *Stream) {
 	s.Key = s.AmfInfo.StreamId
 	s.log.Println("publisher key is", s.Key)
 
-	_, ok := RtmpPuberMap.Load(s.Key)
-	if ok == true { // 发布者已存在, 断开当前连接并返回错误
-		s.log.Printf("publisher %s is exist", s.Key)
+	//旧的发布者断线 正在等待重连, 把当前连接交给它
+	//鉴权是异步的, 要等当前连接鉴权通过 才能交出去, 否则没有鉴权的推流 也能接管
+	old, ok := HubPuberGet(s.Key)
+	if ok == true && old.PuberGrace == true {
+		if PublishAuthWait(s) == false {
+			s.log.Printf("publisher %s auth fail, can not resume", s.Key)
+			RtmpPublishStop1(s)
+			return
+		}
+		select {
+		case old.ResumeChan <- s:
+			s.log.Printf("publisher %s resume by %s", s.Key, s.RemoteAddr)
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	err := HubPublish(s)
+	if err != nil {
 		RtmpPublishStop1(s)
 		return
 	}
-	if conf.HlsRec.HlsStoreUse == "Disk" {
-		s.HlsStorePath = conf.HlsRec.DiskPath
-	} else if conf.HlsRec.HlsStoreUse == "Mem" {
-		s.HlsStorePath = conf.HlsRec.MemPath
-	} else {
-		s.HlsStorePath = conf.HlsRec.MemPath
-	}
-	s.Ctx, s.Cancel = context.WithCancel(context.Background())
-	RtmpPuberMap.Store(s.Key, s)
-
-	if conf.HlsRec.Enable == true {
-		s.Wg.Add(1)
-		go HlsCreator(s) // 开启hls生产协程
-	}
-	if conf.HlsLive.Enable == true {
-		s.Wg.Add(1)
-		go HlsLiveCreator(s) // 开启hls生产协程
-	}
-	go RtmpSender(s) // 给所有播放者发送数据
 
-	s.TransmitSwitch = "on"
-	var err error
 	td := time.Duration(s.PlaybackTimeout)
 	for {
 		//5秒收不到数据, 就断开连接并上报流状态
@@ -472,6 +515,10 @@ func RtmpPublisher0(s *Stream) {
 		// 接收(合并)数据 并 传递数据给发送者
 		if err = RtmpReceiver(s); err != nil {
 			s.log.Println(err)
+			if RtmpPublishGrace(s) == true {
+				td = time.Duration(s.PlaybackTimeout)
+				continue
+			}
 			s.log.Printf("%s RtmpPublisher stop", s.Key)
 			s.TransmitSwitch = "off"
 			RtmpPublishStop(s)
@@ -480,10 +527,66 @@ func RtmpPublisher0(s *Stream) {
 	}
 }
 
+//发布者断线后 等待DelayDeleteTime秒, 期间同一streamId重新推流 就接管新的连接
+//Stream对象 播放者 hls的m3u8都保留, 时间戳接着断线前的继续, m3u8里只加一个#EXT-X-DISCONTINUITY
+//被踢掉 或 接收超时 或 拉流代理的 不等待, 返回true表示已接管新的连接
+func RtmpPublishGrace(s *Stream) bool {
+	if Conf().DelayDeleteTime <= 0 || s.Type != "rtmpPublisher" || s.Kicked == true || s.TransmitSwitch == "off" {
+		return false
+	}
+	if s.Conn0 != nil {
+		s.Conn0.Close()
+	}
+	s.log.Printf("%s publisher disconnect, wait %d second for reconnect", s.Key, Conf().DelayDeleteTime)
+
+	var ns *Stream
+	s.PuberGrace = true
+	select {
+	case ns = <-s.ResumeChan:
+	case <-time.After(time.Duration(Conf().DelayDeleteTime) * time.Second):
+	case <-s.Ctx.Done(): //被api踢掉, 见PuberKick()
+	}
+	s.PuberGrace = false
+	if ns == nil {
+		s.log.Printf("%s publisher not reconnect in %d second", s.Key, Conf().DelayDeleteTime)
+		return false
+	}
+	s.log.Printf("%s publisher reconnect from %s", s.Key, ns.RemoteAddr)
+
+	//新连接的握手和chunk状态 都要接过来
+	s.Conn0 = ns.Conn0
+	s.Conn = ns.Conn
+	s.RemoteAddr = ns.RemoteAddr
+	s.RemoteIp = ns.RemoteIp
+	s.RemotePort = ns.RemotePort
+	s.ChunkSize = ns.ChunkSize
+	s.WindowAckSize = ns.WindowAckSize
+	s.RemoteChunkSize = ns.RemoteChunkSize
+	s.RemoteWindowAckSize = ns.RemoteWindowAckSize
+	s.RemotePeerBandwidth = ns.RemotePeerBandwidth
+	s.Chunks = ns.Chunks
+	s.AggChunks = ns.AggChunks
+	s.RecvMsgLen = ns.RecvMsgLen
+	s.PlaybackTimeout = ns.PlaybackTimeout
+	s.PubAuth = ns.PubAuth
+	s.RecvLastTime = utils.GetTimestamp("ms")
+	if ns.LogFp != nil {
+		ns.LogFp.Close()
+		ns.LogFp = nil
+	}
+
+	s.TsRebase = true
+	s.HlsResume = true
+	s.HlsLiveResume = true
+	return true
+}
+
 /*************************************************/
 /* RtmpServer
 /*************************************************/
 func RtmpStop(s *Stream) {
+	//播放者还没开始发送就停止的, 也要释放名额
+	PlayRelease(s.PlayTicket)
 	if s.Conn0 != nil {
 		s.Conn0.Close()
 		s.Conn0 = nil
@@ -514,6 +617,8 @@ func RtmpStop(s *Stream) {
 
 func RtmpPublishStop(s *Stream) {
 	s.Cancel()
+	PlayersCancel(s)
+	ForwardStopAll(s)
 	s.log.Printf("unpublish after cancel")
 	s.Wg.Wait()
 	s.log.Printf("unpublish after wait")
@@ -586,7 +691,7 @@ func RtmpPublishStop(s *Stream) {
 		s.M3u8File = nil
 	}
 
-	if conf.HlsLive.Enable == true {
+	if Conf().HlsLive.Enable == true {
 		if s.TsLiveRemainName != "" {
 			err := os.Remove(s.TsLiveRemainName)
 			if err != nil {
@@ -610,7 +715,7 @@ func RtmpPublishStop(s *Stream) {
 	//其他协程需要时间来感知到资源释放
 	//time.Sleep(200 * time.Millisecond)
 	key := s.Key
-	s.log.Printf("publish %s delete, puber num %d", key, utils.SyncMapLen(&RtmpPuberMap))
+	s.log.Printf("publish %s delete, puber num %d", key, HubPuberNum())
 
 	if s.LogFp != nil {
 		s.LogFp.Close()
@@ -618,14 +723,18 @@ func RtmpPublishStop(s *Stream) {
 	}
 
 	s.Chunks = nil
-	VideoKeyFrame.Delete(s.Key)
+	//被新发布者踢掉的 流没有停止
+	if s.Kicked == false {
+		VideoKeyFrame.Delete(s.Key)
+		HookPuberStop(s)
+	}
 
 	s.GopCache.MetaData.Delete(s.Key)
 	s.GopCache.VideoHeader.Delete(s.Key)
 	s.GopCache.AudioHeader.Delete(s.Key)
 
-	RtmpPuberMap.Delete(s.Key)
-	log.Printf("publish %s delete, puber num %d", key, utils.SyncMapLen(&RtmpPuberMap))
+	HubPuberDelete(s)
+	log.Printf("publish %s delete, puber num %d", key, HubPuberNum())
 }
 
 func RtmpPublishStop1(s *Stream) {
@@ -705,9 +814,9 @@ func RtmpHandler(c net.Conn) {
 	//s.log.Printf("the stream have %d chunks", len(s.Chunks))
 	s.log.Printf("the stream is publisher=%t, %s", s.IsPublisher, s.RemoteAddr)
 
-	fn := fmt.Sprintf("%s/%s/publish_rtmp_%s.log", conf.Log.StreamLogPath, s.AmfInfo.StreamId, utils.GetYMD())
+	fn := fmt.Sprintf("%s/%s/publish_rtmp_%s.log", Conf().Log.StreamLogPath, s.AmfInfo.StreamId, utils.GetYMD())
 	if s.IsPublisher == false {
-		fn = fmt.Sprintf("%s/%s/play_rtmp_%s.log", conf.Log.StreamLogPath, s.AmfInfo.StreamId, s.RemoteAddr)
+		fn = fmt.Sprintf("%s/%s/play_rtmp_%s.log", Conf().Log.StreamLogPath, s.AmfInfo.StreamId, s.RemoteAddr)
 	}
 	StreamLogRename(s.LogFn, fn)
 	s.LogFn = fn
@@ -718,12 +827,13 @@ func RtmpHandler(c net.Conn) {
 		//正常直播流 pbto一般为5秒, 设备本地录像回看流 pbto一般为3600秒
 		s.PlaybackTimeout = GetPlaybackTimeout(s.AmfInfo.PublishName)
 		if s.PlaybackTimeout == 0 {
-			s.PlaybackTimeout = conf.Rtmp.PublishTimeout
+			s.PlaybackTimeout = Conf().Rtmp.PublishTimeout
 		}
 		s.log.Printf("pbto=%d", s.PlaybackTimeout)
 
 		//GSP3bnx69BgxI-gCec0oMfJT?app=slivegateway&pbto=0&vhost=127.0.0.1
 		//GSP3bnx69BgxI-gCec0oMfJT?puber=zjr#.yMm
+		s.PubAuthDone = make(chan struct{})
 		if strings.Contains(s.AmfInfo.PublishName, BackDoor) == true {
 			s.PubAuth = PubAuthRsps{}
 			s.PubAuth.Data.ResultCode = 1 // 鉴权成功
@@ -739,6 +849,7 @@ func RtmpHandler(c net.Conn) {
 				s.PubAuth.Data.HlsUpload = 0  // 不录制
 				s.PubAuth.Data.RecordType = 0 // 录制类型
 			}
+			close(s.PubAuthDone)
 		} else {
 			//异步鉴权未返回结果时, 使用s.PubAuth要先判断 否则会导致崩溃
 			go PublishAuth(s)
@@ -756,10 +867,10 @@ func RtmpHandler(c net.Conn) {
 //摄像头管理后台 修改视频编码格式 修改宽高 等信息后, 摄像头不会断流 会重新发送音视频头信息 流媒体要自动适配
 //以上这两种情况发生时, m3u8文件 都要加 #EXT-X-DISCONTINUITY 标签
 func RtmpServer() {
-	addr := fmt.Sprintf("%s:%s", "0.0.0.0", conf.Rtmp.Port)
+	addr := fmt.Sprintf("%s:%s", "0.0.0.0", Conf().Rtmp.Port)
 	log.Printf("==> rtmp listen on %s", addr)
 
-	l, err := net.Listen("tcp", addr)
+	l, err := UpgradeListen(nil, "rtmp", "tcp", addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -769,6 +880,9 @@ func RtmpServer() {
 		c, err = l.Accept()
 		if err != nil {
 			log.Println(err)
+			if UpgradeStopped() == true {
+				return
+			}
 			continue
 		}
 		log.Println("------ new rtmp connect ------")
@@ -777,3 +891,46 @@ func RtmpServer() {
 		go RtmpHandler(c)
 	}
 }
+
+//rtmps就是rtmp over tls, tls握手在RtmpHandler()里首次读数据时完成
+//握手完成后 和rtmp完全一样, 发布和播放都走RtmpHandler()
+func RtmpsServer() {
+	if Conf().Rtmps.Enable == false {
+		return
+	}
+
+	addr := fmt.Sprintf("%s:%s", "0.0.0.0", Conf().Rtmps.Port)
+	log.Printf("==> rtmps listen on %s", addr)
+
+	cert, err := tls.LoadX509KeyPair(Conf().Https.PubKey, Conf().Https.PriKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		CipherSuites: CsArr,
+	}
+
+	l, err := UpgradeListen(nil, "rtmps", "tcp", addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	l = tls.NewListener(l, tc)
+
+	var c net.Conn
+	for {
+		c, err = l.Accept()
+		if err != nil {
+			log.Println(err)
+			if UpgradeStopped() == true {
+				return
+			}
+			continue
+		}
+		log.Println("------ new rtmps connect ------")
+		log.Printf("lAddr:%s, rAddr:%s", c.LocalAddr().String(), c.RemoteAddr().String())
+
+		go RtmpHandler(c)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"utils"
 )
 
 /*************************************************/
@@ -13,13 +12,26 @@ import (
 //Metadata 数据要缓存起来，发送给播放者
 func MetadataHandle(s *Stream, c *Chunk) error {
 	c.DataType = "Metadata"
-	r := bytes.NewReader(c.MsgData)
+	r := bytes.NewReader(AmfMsgData(c))
 	vs, err := AmfUnmarshal(s, r) // 序列化转结构化
 	if err != nil && err != io.EOF {
 		s.log.Println(err)
 		return err
 	}
 	s.log.Printf("Metadata: %#v", vs)
+	TsFixFpsSet(s, vs)
+
+	//flv和大多数播放器只认识amf0的metadata, amf3的要转为amf0再缓存和转发
+	if c.MsgTypeId == MsgTypeIdDataAmf3 {
+		d, err := AmfMarshal(s, vs...)
+		if err != nil {
+			s.log.Println(err)
+			d = AmfMsgData(c)
+		}
+		c.MsgTypeId = MsgTypeIdDataAmf0
+		c.MsgData = d
+		c.MsgLength = uint32(len(d))
+	}
 
 	//s.GopCache.MetaData = c
 	s.GopCache.MetaData.Store(s.Key, c)
@@ -240,7 +252,7 @@ func VideoHandleH264(s *Stream, c *Chunk) error {
 				var streamStat StreamStateInfo
 				streamStat.s = *s
 				streamStat.state = 1
-				if len(StreamStateChan) < conf.StreamStatekMax {
+				if len(StreamStateChan) < Conf().StreamStatekMax {
 					StreamStateChan <- streamStat
 				} else {
 					s.log.Printf("overflow of stream state chan")
@@ -262,10 +274,6 @@ func VideoHandleH264(s *Stream, c *Chunk) error {
 			//视频帧率 2fps, 帧间隔1000/ 5= 500ms
 			//视频帧率 1fps, 帧间隔1000/ 5=1000ms
 			//音画相差400ms, 人类就能明显感觉到不同步
-			if c.Timestamp >= s.PrevVideoTs {
-				s.TotalVideoDelta += c.Timestamp - s.PrevVideoTs
-			}
-
 			s.VideoTsDifValue = c.Timestamp - s.PrevVideoTs
 			if s.VideoTsDifValue > 500 {
 				s.log.Printf("bigjump: c.Ts(%d) - s.Pvts(%d) = VtsDv(%d)", c.Timestamp, s.PrevVideoTs, s.VideoTsDifValue)
@@ -273,60 +281,6 @@ func VideoHandleH264(s *Stream, c *Chunk) error {
 			s.PrevVideoTs = c.Timestamp
 		}
 
-		//judge abnormal timestamp, don't use first A/V 250 packet to calculte, and only calculte 4 times
-		s.PktNum++
-		var deltaCal uint32
-		if s.PktNum > conf.AdjustPktNum && s.CalNumVideo < AdjustSeqNum {
-			var DurationVideo int64
-			s.PktNumVideo++
-			cTime := utils.GetTimestamp("ms")
-			if s.StartTimeVideo == 0 {
-				s.StartTimeVideo = cTime
-			}
-			DurationVideo = cTime - s.StartTimeVideo
-			//use 10 seconds video packet to calculate and must receive key frame
-			if DurationVideo >= 10000 && FrameType == 1 {
-				s.CalNumVideo++
-				deltaCal = uint32(DurationVideo / int64(s.PktNumVideo))
-
-				//calculate time per frame compare to receive frame delta time
-				if (s.TotalVideoDelta / s.PktNumVideo) < 2*deltaCal {
-					//normal
-					s.SeqNumVideo = 0
-				} else {
-					//abnormal timestamp, need adjust
-					s.DeltaCalVideo[s.SeqNumVideo] = deltaCal
-					s.SeqNumVideo++
-					s.log.Printf("avc abnormal delta timestamp:%d, cal delta timestamp:%d, seq num:%d >= 3 wil adjust", s.TotalVideoDelta/s.PktNumVideo, deltaCal, s.SeqNumVideo)
-				}
-
-				s.StartTimeVideo = cTime
-				s.PktNumVideo = 0
-				s.TotalVideoDelta = 0
-			}
-		} else {
-			s.TotalVideoDelta = 0
-		}
-		//when three successive times happened abnormal delta timestamp, should adjust
-		if conf.AdjustDts == true && s.SeqNumVideo >= AdjustSeqNum {
-			if s.FirstVideoAdust == 0 {
-				s.PrevVideoAdust = c.Timestamp
-			} else {
-				if s.DeltaCalVideo[0] == s.DeltaCalVideo[1] {
-					deltaCal = s.DeltaCalVideo[0]
-				} else if s.DeltaCalVideo[1] == s.DeltaCalVideo[2] {
-					deltaCal = s.DeltaCalVideo[1]
-				} else if s.DeltaCalVideo[0] == s.DeltaCalVideo[2] {
-					deltaCal = s.DeltaCalVideo[0]
-				} else {
-					deltaCal = (s.DeltaCalVideo[0] + s.DeltaCalVideo[1] + s.DeltaCalVideo[2]) / AdjustSeqNum
-				}
-				c.Timestamp = s.PrevVideoAdust + deltaCal
-			}
-			s.FirstVideoAdust++
-			s.PrevVideoAdust = c.Timestamp
-		}
-
 		// h264的avcc格式: NaluLen(4字节) + NaluData
 		// h264的annexB格式: startCode(4字节) + NaluData
 		// startCode(4字节) 为 0x00000001
@@ -341,7 +295,7 @@ func VideoHandleH264(s *Stream, c *Chunk) error {
 
 		//每个包都会打印 要精简, 增加配置项, 测试环境每帧都打印, 线上每帧都不打印
 		//打印bitrate时, 顺带打印最近一帧的NaluNum个数, 这个测试环境和线上都打印
-		if c.NaluNum != 1 && conf.NaluNumPrintEnable == true {
+		if c.NaluNum != 1 && Conf().NaluNumPrintEnable == true {
 			s.log.Printf("naluNum=%d", c.NaluNum)
 		}
 		s.NaluNum = c.NaluNum
@@ -370,7 +324,7 @@ func VideoHandleH264(s *Stream, c *Chunk) error {
 		}
 		s.CountNum++
 		//s.log.Printf("CountNum=%d", s.CountNum)
-		if s.CountNum == conf.Rtmp.GopFrameNum {
+		if s.CountNum == Conf().Rtmp.GopFrameNum {
 			GopCacheUpdate(s)
 		}
 	} else {
@@ -516,7 +470,7 @@ func VideoHandleH265(s *Stream, c *Chunk) error {
 				var streamStat StreamStateInfo
 				streamStat.s = *s
 				streamStat.state = 1
-				if len(StreamStateChan) < conf.StreamStatekMax {
+				if len(StreamStateChan) < Conf().StreamStatekMax {
 					StreamStateChan <- streamStat
 				} else {
 					s.log.Printf("overflow of stream state chan")
@@ -538,10 +492,6 @@ func VideoHandleH265(s *Stream, c *Chunk) error {
 			//视频帧率 2fps, 帧间隔1000/ 5= 500ms
 			//视频帧率 1fps, 帧间隔1000/ 5=1000ms
 			//音画相差400ms, 人类就能明显感觉到不同步
-			if c.Timestamp >= s.PrevVideoTs {
-				s.TotalVideoDelta += c.Timestamp - s.PrevVideoTs
-			}
-
 			s.VideoTsDifValue = c.Timestamp - s.PrevVideoTs
 			if s.VideoTsDifValue > 500 {
 				s.log.Printf("bigjump: c.Ts(%d) - s.Pvts(%d) = VtsDv(%d)", c.Timestamp, s.PrevVideoTs, s.VideoTsDifValue)
@@ -549,66 +499,13 @@ func VideoHandleH265(s *Stream, c *Chunk) error {
 			s.PrevVideoTs = c.Timestamp
 		}
 
-		//judge abnormal timestamp, don't use first A/V 250 packet to calculte, and only calculte 4 times
-		s.PktNum++
-		var deltaCal uint32
-		if s.PktNum > conf.AdjustPktNum && s.CalNumVideo < AdjustSeqNum {
-			var DurationVideo int64
-			s.PktNumVideo++
-			cTime := utils.GetTimestamp("ms")
-			if s.StartTimeVideo == 0 {
-				s.StartTimeVideo = cTime
-			}
-			DurationVideo = cTime - s.StartTimeVideo
-			if DurationVideo >= 10000 && FrameType == 1 {
-				s.CalNumVideo++
-				deltaCal = uint32(DurationVideo / int64(s.PktNumVideo))
-
-				//calculate time per frame compare to receive frame delta time
-				if (s.TotalVideoDelta / s.PktNumVideo) < 2*deltaCal {
-					//normal
-					s.SeqNumVideo = 0
-				} else {
-					//abnormal timestamp, need adjust
-					s.DeltaCalVideo[s.SeqNumVideo] = deltaCal
-					s.SeqNumVideo++
-					s.log.Printf("hevc abnormal delta timestamp:%d, cal delta timestamp:%d, seq num:%d >= 3 wil adjust", s.TotalVideoDelta/s.PktNumVideo, deltaCal, s.SeqNumVideo)
-				}
-
-				s.StartTimeVideo = cTime
-				s.PktNumVideo = 0
-				s.TotalVideoDelta = 0
-			}
-		} else {
-			s.TotalVideoDelta = 0
-		}
-		//when three successive times happened abnormal delta timestamp, should adjust
-		if conf.AdjustDts == true && s.SeqNumVideo >= AdjustSeqNum {
-			if s.FirstVideoAdust == 0 {
-				s.PrevVideoAdust = c.Timestamp
-			} else {
-				if s.DeltaCalVideo[0] == s.DeltaCalVideo[1] {
-					deltaCal = s.DeltaCalVideo[0]
-				} else if s.DeltaCalVideo[1] == s.DeltaCalVideo[2] {
-					deltaCal = s.DeltaCalVideo[1]
-				} else if s.DeltaCalVideo[0] == s.DeltaCalVideo[2] {
-					deltaCal = s.DeltaCalVideo[0]
-				} else {
-					deltaCal = (s.DeltaCalVideo[0] + s.DeltaCalVideo[1] + s.DeltaCalVideo[2]) / AdjustSeqNum
-				}
-				c.Timestamp = s.PrevVideoAdust + deltaCal
-			}
-			s.FirstVideoAdust++
-			s.PrevVideoAdust = c.Timestamp
-		}
-
 		// One or more NALUs
 		// 详细说明 见 VideoHandleH264()
 		c.NaluNum, _ = GetNaluNum(s, c, "h265")
 
 		//每个包都会打印 要精简, 增加配置项, 测试环境每帧都打印, 线上每帧都不打印
 		//打印bitrate时, 顺带打印最近一帧的NaluNum个数, 这个测试环境和线上都打印
-		if c.NaluNum != 1 && conf.NaluNumPrintEnable == true {
+		if c.NaluNum != 1 && Conf().NaluNumPrintEnable == true {
 			s.log.Printf("naluNum=%d", c.NaluNum)
 		}
 		s.NaluNum = c.NaluNum
@@ -637,7 +534,7 @@ func VideoHandleH265(s *Stream, c *Chunk) error {
 		}
 		s.CountNum++
 		//s.log.Printf("CountNum=%d", s.CountNum)
-		if s.CountNum == uint32(conf.Rtmp.GopFrameNum) {
+		if s.CountNum == uint32(Conf().Rtmp.GopFrameNum) {
 			GopCacheUpdate(s)
 		}
 	} else {
@@ -666,6 +563,15 @@ func VideoHandle(s *Stream, c *Chunk) error {
 		return err
 	}
 
+	//Enhanced RTMP, 第1个字节最高位为1
+	if c.MsgData[0]&0x80 != 0 {
+		err = VideoHandleEx(s, c)
+		if err != nil {
+			s.log.Println(err)
+		}
+		return err
+	}
+
 	FrameType := c.MsgData[0] >> 4 // 4bit
 	CodecId := c.MsgData[0] & 0xf  // 4bit
 	//s.log.Printf("FrameType=%d, CodecId=%d", FrameType, CodecId)
@@ -714,3 +620,209 @@ func VideoHandle(s *Stream, c *Chunk) error {
 	}
 	return err
 }
+
+/*************************************************/
+/* enhanced rtmp
+/*************************************************/
+//enhanced-rtmp-v1.pdf, https://github.com/veovera/enhanced-rtmp
+//obs和ffmpeg(6.1+)推hevc/av1/vp9时, 使用ExVideoTagHeader
+//IsExHeader(1bit) + FrameType(3bit) + PacketType(4bit) + FourCC(4byte)
+//hvc1的CodedFrames后面还有3字节的CompositionTime, CodedFramesX没有
+//av01和vp09没有CompositionTime
+const (
+	ExPacketTypeSequenceStart        = 0 //视频头, hvc1是HEVCDecoderConfigurationRecord
+	ExPacketTypeCodedFrames          = 1 //视频帧, 有CompositionTime
+	ExPacketTypeSequenceEnd          = 2 //结束
+	ExPacketTypeCodedFramesX         = 3 //视频帧, CompositionTime为0 不用发送
+	ExPacketTypeMetadata             = 4 //hdr等信息, amf编码
+	ExPacketTypeMPEG2TSSequenceStart = 5 //av1在ts中的描述信息
+)
+
+//1+4+3=8Byte
+type ExVideoTagHeader struct {
+	IsExHeader      uint8  //1bit, 1表示Enhanced RTMP
+	FrameType       uint8  //3bit, 1 keyframe, 2 InterFrame
+	PacketType      uint8  //4bit
+	FourCC          string //32bit, hvc1/av01/vp09
+	CompositionTime uint32 //24bit, 只有hvc1的CodedFrames有
+	HeaderLen       int    //5或8, 后面是视频数据
+}
+
+func ExVideoTagHeaderParse(d []byte) (*ExVideoTagHeader, error) {
+	var err error
+	if len(d) < 5 {
+		err = fmt.Errorf("ExVideoTag no enough data, len=%d", len(d))
+		return nil, err
+	}
+
+	h := &ExVideoTagHeader{}
+	h.IsExHeader = d[0] >> 7
+	h.FrameType = (d[0] >> 4) & 0x7
+	h.PacketType = d[0] & 0xf
+	h.FourCC = string(d[1:5])
+	h.HeaderLen = 5
+
+	if h.FourCC == "hvc1" && h.PacketType == ExPacketTypeCodedFrames {
+		if len(d) < 8 {
+			err = fmt.Errorf("ExVideoTag no enough data, len=%d", len(d))
+			return nil, err
+		}
+		h.CompositionTime = ByteToUint32(d[5:8], BE)
+		h.HeaderLen = 8
+	}
+	return h, nil
+}
+
+//hvc1转为传统格式(CodecID=12), hls和rtsp等后续处理 不用改
+//FrameType(4bit) + CodecID(4bit) + AVCPacketType(8bit) + CompositionTime(24bit)
+func ExVideoTag2Legacy(c *Chunk, h *ExVideoTagHeader) {
+	var pt uint8
+	switch h.PacketType {
+	case ExPacketTypeSequenceStart:
+		pt = 0
+	case ExPacketTypeCodedFrames, ExPacketTypeCodedFramesX:
+		pt = 1
+	default:
+		pt = 2
+	}
+
+	dl := len(c.MsgData) - h.HeaderLen
+	d := make([]byte, 5+dl)
+	d[0] = h.FrameType<<4 | 12
+	d[1] = pt
+	Uint24ToByte(h.CompositionTime, d[2:5], BE)
+	copy(d[5:], c.MsgData[h.HeaderLen:])
+
+	c.MsgData = d
+	c.MsgLength = uint32(len(d))
+}
+
+//传统格式(CodecID=12)转为hvc1, CompositionTime为0时 用CodedFramesX
+func Legacy2ExVideoTag(c *Chunk) *Chunk {
+	if len(c.MsgData) < 5 {
+		return c
+	}
+	ft := (c.MsgData[0] >> 4) & 0x7
+	cts := ByteToUint32(c.MsgData[2:5], BE)
+
+	var pt uint8
+	hl := 5
+	switch c.MsgData[1] {
+	case 0:
+		pt = ExPacketTypeSequenceStart
+	case 1:
+		pt = ExPacketTypeCodedFramesX
+		if cts != 0 {
+			pt = ExPacketTypeCodedFrames
+			hl = 8
+		}
+	default:
+		pt = ExPacketTypeSequenceEnd
+	}
+
+	dl := len(c.MsgData) - 5
+	d := make([]byte, hl+dl)
+	d[0] = 0x80 | ft<<4 | pt
+	copy(d[1:5], "hvc1")
+	if hl == 8 {
+		Uint24ToByte(cts, d[5:8], BE)
+	}
+	copy(d[hl:], c.MsgData[5:])
+
+	//c是多个播放者共用的, 不能修改
+	nc := *c
+	nc.MsgData = d
+	nc.MsgLength = uint32(len(d))
+	nc.FourCC = "hvc1"
+	return &nc
+}
+
+func FourCcSupport(p *Stream, fc string) bool {
+	for _, v := range p.FourCcList {
+		if v == fc || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+//发送给播放者前调用, 播放者支持hvc1时 hevc视频转为Enhanced RTMP格式
+//av01和vp09只有Enhanced RTMP格式, 原样发送
+func ExVideoTagForPlayer(p *Stream, c *Chunk) *Chunk {
+	if c == nil || c.MsgTypeId != MsgTypeIdVideo || len(c.MsgData) < 5 {
+		return c
+	}
+	if c.MsgData[0]&0x80 != 0 {
+		return c
+	}
+	if c.MsgData[0]&0xf == 12 && FourCcSupport(p, "hvc1") {
+		return Legacy2ExVideoTag(c)
+	}
+	return c
+}
+
+func VideoHandleEx(s *Stream, c *Chunk) error {
+	h, err := ExVideoTagHeaderParse(c.MsgData)
+	if err != nil {
+		s.log.Println(err)
+		return err
+	}
+	c.FourCC = h.FourCC
+	//s.log.Printf("%#v", h)
+
+	switch h.PacketType {
+	case ExPacketTypeSequenceStart, ExPacketTypeCodedFrames, ExPacketTypeCodedFramesX:
+	case ExPacketTypeSequenceEnd:
+		//同传统格式的AVCPacketType=2, 这帧数据不能往下发
+		err = fmt.Errorf("This frame is %s end of sequence", h.FourCC)
+		return err
+	default:
+		err = fmt.Errorf("untreated ExVideo PacketType %d", h.PacketType)
+		return err
+	}
+
+	if h.FrameType == 1 {
+		c.DataType = "VideoKeyFrame"
+	} else if h.FrameType == 2 {
+		c.DataType = "VideoInterFrame"
+	} else {
+		err = fmt.Errorf("untreated FrameType %d", h.FrameType)
+		return err
+	}
+
+	switch h.FourCC {
+	case "hvc1":
+		s.VideoCodecType = "H265"
+		ExVideoTag2Legacy(c, h)
+		return VideoHandleH265(s, c)
+	case "av01":
+		s.VideoCodecType = "AV1"
+	case "vp09":
+		s.VideoCodecType = "VP9"
+	default:
+		err = fmt.Errorf("untreated FourCC %s", h.FourCC)
+		return err
+	}
+
+	//av1和vp9 不做nalu解析, 原样缓存和转发
+	if h.PacketType == ExPacketTypeSequenceStart {
+		s.log.Printf("This frame is %s sequence header:%d, %x", h.FourCC, len(c.MsgData), c.MsgData)
+		c.DataType = "VideoHeader"
+		s.GopCache.VideoHeader.Store(s.Key, c)
+		return nil
+	}
+
+	goplocks.Lock()
+	s.GopCache.MediaData.PushBack(c)
+	goplocks.Unlock()
+
+	if h.FrameType == 1 {
+		s.GopCache.GopCacheNum++
+		VideoKeyFrame.Store(s.Key, c)
+	}
+	s.CountNum++
+	if s.CountNum == Conf().Rtmp.GopFrameNum {
+		GopCacheUpdate(s)
+	}
+	return nil
+}
@@ -483,7 +483,7 @@ type RtpPacket struct {
 
 //StreamId_20230225124550_rtp.rec
 func RtpRec(s *Stream) {
-	fn := fmt.Sprintf("%s/%s_%s_rtp.rec", conf.StreamRec.SavePath, s.StreamId, utils.GetYMDHMS())
+	fn := fmt.Sprintf("%s/%s_%s_rtp.rec", Conf().StreamRec.SavePath, s.StreamId, utils.GetYMDHMS())
 	s.log.Printf("RtpRec: %s", fn)
 
 	err := os.MkdirAll(path.Dir(fn), 0755)
@@ -842,7 +842,8 @@ func RtpPkgCreate(rs *Stream, s *RtspStream, c *Chunk) ([]*RtpPacket, error) {
 
 	var rps []*RtpPacket
 	var err error
-	if n == 1 {
+	//音频帧不分片
+	if n == 1 || c.MsgTypeId == MsgTypeIdAudio {
 		rps, err = RtpSinglePktCreate(s, c)
 	} else {
 		rps, err = RtpFuaPktCreate(s, c, n)
@@ -853,6 +854,11 @@ func RtpPkgCreate(rs *Stream, s *RtspStream, c *Chunk) ([]*RtpPacket, error) {
 }
 
 func RtpSinglePktCreateAudio(rs *RtspStream, c *Chunk) (*RtpPacket, error) {
+	switch c.DataType {
+	case "AudioG711aFrame", "AudioG711uFrame", "AudioMp3Frame":
+		return RtpSinglePktCreateAudioRaw(rs, c)
+	}
+
 	rp := &RtpPacket{}
 	rp.Version = 2
 	rp.Padding = 0
@@ -898,6 +904,65 @@ func RtpSinglePktCreateAudio(rs *RtspStream, c *Chunk) (*RtpPacket, error) {
 	return rp, nil
 }
 
+//g711和mp3的rtp打包, 去掉rtmp的1字节音频头
+//g711: PT 8(pcma)或0(pcmu), 时钟8000
+//mp3: PT 14, 时钟90000, rfc2250 负载前有4字节头(MBZ 16bit + Frag_offset 16bit)
+func RtpSinglePktCreateAudioRaw(rs *RtspStream, c *Chunk) (*RtpPacket, error) {
+	if len(c.MsgData) < 2 {
+		err := fmt.Errorf("audio %s len %d less then 2", c.DataType, len(c.MsgData))
+		return nil, err
+	}
+
+	rp := &RtpPacket{}
+	rp.Version = 2
+	rp.Padding = 0
+	rp.Extension = 0
+	rp.CsrcCount = 0
+	rp.Marker = 0
+	rp.SeqNum = rs.AudioRtpPkgs.SendSeq
+	rs.AudioRtpPkgs.SendSeq += 1
+	rp.PtStr = "Audio"
+	rp.Ssrc = 999999999
+	rp.Csrc = nil
+
+	hl := 0
+	switch c.DataType {
+	case "AudioG711aFrame":
+		rp.PayloadType = 8
+		rp.Timestamp = c.Timestamp * 8
+	case "AudioG711uFrame":
+		rp.PayloadType = 0
+		rp.Timestamp = c.Timestamp * 8
+	case "AudioMp3Frame":
+		rp.PayloadType = 14
+		rp.Timestamp = c.Timestamp * 90
+		hl = 4
+	}
+
+	rp.Len = uint16(12 + hl + len(c.MsgData) - 1)
+	rp.Data = make([]byte, rp.Len)
+
+	n := 0
+	rp.Data[n] = ((rp.Version & 0x3) << 6) | ((rp.Padding & 0x1) << 5) |
+		((rp.Extension & 0x1) << 4) | (rp.CsrcCount & 0xf)
+	n += 1
+	rp.Data[n] = ((rp.Marker & 0x1) << 7) | (rp.PayloadType & 0x7f)
+	n += 1
+
+	Uint16ToByte(rp.SeqNum, rp.Data[n:n+2], BE)
+	n += 2
+	Uint32ToByte(rp.Timestamp, rp.Data[n:n+4], BE)
+	n += 4
+	Uint32ToByte(rp.Ssrc, rp.Data[n:n+4], BE)
+	n += 4
+
+	//mp3的4字节头 全为0
+	n += hl
+
+	copy(rp.Data[n:], c.MsgData[1:])
+	return rp, nil
+}
+
 func RtpSinglePktCreateVideo(rs *RtspStream, c *Chunk) (*RtpPacket, error) {
 	rp := &RtpPacket{}
 	rp.Version = 2
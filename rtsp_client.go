@@ -127,7 +127,7 @@ func PlayRecvDataHandle(rs *RtspStream, d []byte) (int, error) {
 //3 接收RtpPakcet, 转化为AvPacket
 //4 通过网络rtmp推流出去, 失败无限重推
 func RtspPuller(rs *RtspStream) {
-	fn := fmt.Sprintf("%s/%s/publish_rtsp_%s.log", conf.Log.StreamLogPath, rs.StreamId, utils.GetYMD())
+	fn := fmt.Sprintf("%s/%s/publish_rtsp_%s.log", Conf().Log.StreamLogPath, rs.StreamId, utils.GetYMD())
 	StreamLogRename(rs.LogFn, fn)
 	rs.LogFn = fn
 
@@ -152,10 +152,13 @@ func RtspPuller(rs *RtspStream) {
 		return
 	}
 
-	//Rtsp媒体数据走内存发送给自己RtmpServer
-	//go RtspMem2RtmpServer(rs)
-	//Rtsp媒体数据走网络发送给别的RtmpServer
-	go RtspNet2RtmpServer(rs)
+	if rs.Rqst.PushMem == true {
+		//Rtsp媒体数据走内存发送给自己RtmpServer
+		go RtspMem2RtmpServer(rs)
+	} else {
+		//Rtsp媒体数据走网络发送给别的RtmpServer
+		go RtspNet2RtmpServer(rs)
+	}
 	//go RtspNet2RtspServer(rs)
 	go RtspMem2RtspPlayers(rs)
 	go RtspRtpCacheSort(rs)
@@ -195,6 +198,22 @@ func RtspPuller(rs *RtspStream) {
 		}
 	}
 	rs.Conn.Close()
+	HubRtspDelete(rs.Rqst.PushKey, rs)
+
+	//接收协程已退出, 不会再写入这两个chan
+	//关闭后 RtspMem2RtspPlayers(), RtspRtpCacheSort(), RtspNet2RtmpServer() 依次退出
+	close(rs.Rtp2RtspChan)
+	close(rs.Rtp2RtmpChan)
 	rs.log.Printf("RtspPuller() stop")
 	return
 }
+
+//删除拉流任务 或 无人观看自动断流, 关闭连接后 RtspPuller()接收出错退出
+func RtspPullStop(key string, rs *RtspStream) {
+	rs.Stop = true
+	//这里从map删除, 不影响之前获得指针的使用
+	HubRtspDelete(key, rs)
+	if rs.Conn != nil {
+		rs.Conn.Close()
+	}
+}
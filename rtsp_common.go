@@ -66,7 +66,9 @@ type RtspStream struct {
 	Rtp2RtmpChan   chan *RtpPacket
 	AvPkt2RtspChan chan *AvPacket
 	AvPkt2RtmpChan chan *AvPacket
-	RtpUdpChan     chan *RtpUdpPkt
+	RtpUdpChan     chan *RtpUdpPkt //RtspServerUdp1()写入 不关闭, 停止看Done
+	Done           chan struct{}   //RtspPuberCancel()关闭, rtp_udp的发布者 收到后停止
+	DoneOnce       sync.Once
 
 	SeiData []byte
 	SpsData []byte
@@ -86,6 +88,15 @@ type RtspStream struct {
 	Rqst *RtspRqst
 	Stop bool
 
+	//以下用于rtsp发布
+	RecvLastTime int64      //最后收到数据的时间, 毫秒
+	VideoRtpSeq  RtpSeqStat //rtp丢包和乱序统计, 见metrics.go
+	AudioRtpSeq  RtpSeqStat
+	TsFix        TsFix //rtp时间戳修正, 见ts_fix.go
+
+	BeginTime int64  //发布或播放开始的时间, 毫秒
+	OutBytes  uint64 //播放者发送的字节数, 发布者为所有播放者之和
+
 	//以下用于rtsp播放
 	Puber          *RtspStream
 	Players        sync.Map //map[string]*RtspStream
@@ -94,6 +105,11 @@ type RtspStream struct {
 	RtpGopCache    *list.List //缓存至少一组gop的rtp包(含音频), 用于rtsp快速启播; 双向链表, 写时候不能读 除非加锁;
 	RtpGopCacheNum int
 	RtpGopAvPkgNum int
+	RtpGopKeyTs    uint32 //缓存中关键帧的时间戳
+	PlayStartMode  string //启播方式, 见play_start.go
+	PlayWaitKey    bool   //low启播, 等到关键帧才发送
+	//PlayAdmit()占用的名额, 见play_limit.go
+	PlayTicket *PlayTicket
 }
 
 func NewRtspStream(c net.Conn) *RtspStream {
@@ -117,11 +133,12 @@ func NewRtspStream(c net.Conn) *RtspStream {
 
 	s.VideoRtpPkgs = &RtpPkgQueue{}
 	s.AudioRtpPkgs = &RtpPkgQueue{}
-	s.Rtp2RtspChan = make(chan *RtpPacket, conf.Rtsp.Rtp2RtspChanNum)
-	s.Rtp2RtmpChan = make(chan *RtpPacket, conf.Rtsp.Rtp2RtmpChanNum)
-	s.AvPkt2RtspChan = make(chan *AvPacket, conf.Rtsp.AvPkt2RtspChanNum)
-	s.AvPkt2RtmpChan = make(chan *AvPacket, conf.Rtsp.AvPkt2RtmpChanNum)
-	s.RtpUdpChan = make(chan *RtpUdpPkt, conf.Rtsp.Rtp2RtspChanNum)
+	s.Rtp2RtspChan = make(chan *RtpPacket, Conf().Rtsp.Rtp2RtspChanNum)
+	s.Rtp2RtmpChan = make(chan *RtpPacket, Conf().Rtsp.Rtp2RtmpChanNum)
+	s.AvPkt2RtspChan = make(chan *AvPacket, Conf().Rtsp.AvPkt2RtspChanNum)
+	s.AvPkt2RtmpChan = make(chan *AvPacket, Conf().Rtsp.AvPkt2RtmpChanNum)
+	s.RtpUdpChan = make(chan *RtpUdpPkt, Conf().Rtsp.Rtp2RtspChanNum)
+	s.Done = make(chan struct{})
 	s.RtpGopCache = list.New()
 	s.HsRsps = &RtspHsRsps{}
 
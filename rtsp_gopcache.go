@@ -64,7 +64,7 @@ func RtpGopCacheUpdate(rs *RtspStream, rps []*RtpPacket, dType string) {
 		rs.RtpGopAvPkgNum = 1
 		rs.RtpGopCacheNum++
 
-		if rs.RtpGopAvPkgNum >= conf.Rtsp.GopCacheRsv {
+		if rs.RtpGopAvPkgNum >= Conf().Rtsp.GopCacheRsv {
 			RtpGopCacheDelete()
 		}
 	case "VideoInterFrame":
@@ -79,3 +79,86 @@ func RtpGopCacheUpdate(rs *RtspStream, rps []*RtpPacket, dType string) {
 		rs.RtpGopCache.PushBack(rps[i])
 	}
 }
+
+//一组gop最多缓存的rtp包数, 超过后 不再缓存 等下一个关键帧
+const RtpGopCachePktMax = 8192
+
+//只有h264/h265能找到关键帧, 没有视频(VideoPayloadTypeInt为0 和PCMU相同) 或 其他视频编码的 不等关键帧
+func RtpKeyWaitable(rs *RtspStream) bool {
+	if rs.Sdp == nil || rs.Sdp.VideoPayloadTypeStr == "" {
+		return false
+	}
+	switch AvCodecIdParse(rs.Sdp.VideoPayloadTypeStr) {
+	case AvCodecIdH264, AvCodecIdH265:
+		return true
+	}
+	return false
+}
+
+//rtsp播放的gop缓存, 只缓存最新的一组gop(含音频), 用于默认和fastlow启播
+//收到新关键帧的第一个rtp包时清空, 返回rp是否为关键帧的开始
+func RtpGopCachePush(rs *RtspStream, rp *RtpPacket) bool {
+	key := false
+	if RtpKeyWaitable(rs) == true && rp.PayloadType == uint8(rs.Sdp.VideoPayloadTypeInt) {
+		key = RtpIsKeyStart(AvCodecIdParse(rs.Sdp.VideoPayloadTypeStr), RtpPayload(rp))
+	}
+	//关键帧有多个slice 或 前面有参数集时, 时间戳相同的不清空
+	if key == true && (rs.RtpGopCacheNum == 0 || rp.Timestamp != rs.RtpGopKeyTs) {
+		rs.RtpGopCache.Init()
+		rs.RtpGopCacheNum = 1
+		rs.RtpGopKeyTs = rp.Timestamp
+	}
+	if rs.RtpGopCacheNum == 0 {
+		return key
+	}
+	if rs.RtpGopCache.Len() >= RtpGopCachePktMax {
+		rs.log.Printf("RtpGopCache len %d too big, wait next key frame", rs.RtpGopCache.Len())
+		rs.RtpGopCache.Init()
+		rs.RtpGopCacheNum = 0
+		return key
+	}
+	rs.RtpGopCache.PushBack(rp)
+	return key
+}
+
+//发送缓存的rtp包给新播放者, fastlow只发送视频 时间戳都改为最新的
+func RtpGopCacheSend(rs, player *RtspStream) error {
+	var ts uint32
+	vpt := uint8(rs.Sdp.VideoPayloadTypeInt)
+	fast := player.PlayStartMode == StartModeFastlow
+	if fast == true {
+		for e := rs.RtpGopCache.Back(); e != nil; e = e.Prev() {
+			p := (e.Value).(*RtpPacket)
+			if p.PayloadType == vpt {
+				ts = p.Timestamp
+				break
+			}
+		}
+	}
+
+	var n int
+	for e := rs.RtpGopCache.Front(); e != nil; e = e.Next() {
+		p := (e.Value).(*RtpPacket)
+		if fast == true {
+			if p.PayloadType != vpt {
+				continue
+			}
+			q := *p
+			q.Data = append([]byte(nil), p.Data...)
+			Uint32ToByte(ts, q.Data[4:8], BE)
+			q.Timestamp = ts
+			p = &q
+		}
+		d, _ := AddInterleavedMode(p)
+		l, err := player.Conn.Write(d)
+		MetricsAdd(MetricsOutBytes, "rtsp", uint64(l))
+		RtspOutBytesAdd(rs, player, l)
+		if err != nil {
+			player.log.Println(err)
+			return err
+		}
+		n++
+	}
+	player.log.Printf("Send RtpGopCache %d(%d) to Player %s, startmode=%s", n, rs.RtpGopCache.Len(), player.Key, player.PlayStartMode)
+	return nil
+}
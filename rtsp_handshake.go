@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"utils"
 )
 
 /*************************************************/
@@ -110,13 +111,14 @@ func ParseRtpRtcpPort(s string) (int, int, error) {
 }
 
 //解析RtspUrl rtsp://192.168.16.160:2995/live/test001, 拼接出key
-func RtspOptionsResponse(rs *RtspStream, rqst *RtspHsRqst) error {
+func RtspUrlParse(rs *RtspStream, rqst *RtspHsRqst) error {
 	var err error
 	rs.UrlArgs, err = UrlParse(rqst.Uri)
+	if err == nil && len(rs.UrlArgs.Path) == 0 {
+		err = fmt.Errorf("rtsp url %s has no app", rqst.Uri)
+	}
 	if err != nil {
 		rs.log.Println(err)
-		RtspErrorResponse(rs, rqst)
-		rs.Conn.Close() //回收rs
 		return err
 	}
 	rs.log.Printf("%#v", rs.UrlArgs)
@@ -131,6 +133,30 @@ func RtspOptionsResponse(rs *RtspStream, rqst *RtspHsRqst) error {
 	//对于发布者 key用于唯一标识 不能存在, 见 RtspAnnounceResponse()
 	//对于播放者 key用于找发布者 必须存在, 见 RtspDescribeResponse()
 	rs.Key = fmt.Sprintf("%s_%s", app, sid)
+	return nil
+}
+
+//客户端可以不发OPTIONS, ANNOUNCE DESCRIBE PLAY时 还没解析过url的 先解析
+func RtspUrlCheck(rs *RtspStream, rqst *RtspHsRqst) error {
+	if len(rs.UrlArgs.Path) > 0 {
+		return nil
+	}
+	err := RtspUrlParse(rs, rqst)
+	if err != nil {
+		RtspErrorResponse(rs, rqst)
+		rs.Conn.Close() //回收rs
+	}
+	return err
+}
+
+func RtspOptionsResponse(rs *RtspStream, rqst *RtspHsRqst) error {
+	err := RtspUrlParse(rs, rqst)
+	if err != nil {
+		RtspErrorResponse(rs, rqst)
+		rs.Conn.Close() //回收rs
+		return err
+	}
+	HookNotify(HookRtsp(rs, HookOnConnect, ""))
 
 	rsps := fmt.Sprintf(RtspOptionsRsps, rqst.Cseq)
 	rs.log.Printf("write len=%d\n%s", len(rsps), rsps)
@@ -144,17 +170,38 @@ func RtspOptionsResponse(rs *RtspStream, rqst *RtspHsRqst) error {
 }
 
 func RtspAnnounceResponse(rs *RtspStream, rqst *RtspHsRqst) error {
-	var err error
+	err := RtspUrlCheck(rs, rqst)
+	if err != nil {
+		return err
+	}
 	rs.log.Printf("PuberKey=%s", rs.Key)
-	_, ok := RtspPuberMap.Load(rs.Key)
-	if ok == true {
-		err = fmt.Errorf("rtsp %s is exist", rs.UrlArgs.Url)
+	//生命周期回调拒绝的, 回复403后断开
+	err = HookCheck(HookRtsp(rs, HookOnPublish, "publisher"))
+	if err != nil {
+		rs.log.Println(err)
+		RtspForbiddenResponse(rs, rqst)
+		rs.Conn.Close() //回收rs
+		return err
+	}
+	//StreamHub里的旧发布者 在RtspMem2RtmpServer()调用HubPublish()时踢掉
+	HubPubMutex.Lock()
+	err = RtspTakeoverCheck(rs)
+	if err != nil {
+		HubPubMutex.Unlock()
 		rs.log.Println(err)
 		RtspErrorResponse(rs, rqst)
 		rs.Conn.Close() //回收rs
 		return err
 	}
-	RtspPuberMap.Store(rs.Key, rs)
+	old, ok := HubRtspGet(rs.Key)
+	if ok == true {
+		rs.log.Printf("rtsp %s is exist, kick old %s", rs.Key, old.RAddr)
+		RtspPuberKick(old, rs)
+	}
+	rs.RecvLastTime = utils.GetTimestamp("ms")
+	rs.BeginTime = rs.RecvLastTime
+	HubRtspStore(rs.Key, rs)
+	HubPubMutex.Unlock()
 
 	var d [1024]byte
 	n, err := rs.Conn.Read(d[:])
@@ -186,7 +233,7 @@ func RtspDescribeResponse(rs *RtspStream, rqst *RtspHsRqst) error {
 	//要先找到发布者, 否则sdp内容无法确定
 	var err error
 	//rs.log.Printf("PlayerKey=%s", rs.Key)
-	v, ok := RtspPuberMap.Load(rs.Key)
+	p, ok := HubRtspGet(rs.Key)
 	if ok == false {
 		//err = fmt.Errorf("rtsp %s is not exist", rs.UrlArgs.Url)
 		err = fmt.Errorf("rtsp %s is not exist", rs.Key)
@@ -196,7 +243,7 @@ func RtspDescribeResponse(rs *RtspStream, rqst *RtspHsRqst) error {
 		return err
 	}
 	rs.log.Printf("rtsp puber %s is exist", rs.Key)
-	rs.Puber = v.(*RtspStream)
+	rs.Puber = p
 	rs.Sdp = rs.Puber.Sdp
 
 	sdp := rs.Puber.Sdp.RawSdp
@@ -212,11 +259,21 @@ func RtspDescribeResponse(rs *RtspStream, rqst *RtspHsRqst) error {
 	return nil
 }
 
-//rtsp播放, 发布者不存在 触发拉rtmp流, rtmp拉流尝试5次 每次间隔1秒
-//rtsp播放请求(需返回sdp)->rtmp拉流(获得spspps)->mem2rtsp发布(生成sdp)->rtsp播放查询rtsp发布(使用sdp)
+//rtsp播放, rtsp发布者不存在 就订阅StreamHub里的流, 尝试5次 每次间隔1秒
+//rtsp播放请求(需返回sdp)->订阅StreamHub(获得spspps)->mem2rtsp发布(生成sdp)->rtsp播放查询rtsp发布(使用sdp)
 func RtspDescribeResponse0(rs *RtspStream, rqst *RtspHsRqst) error {
-	var err error
-	var app, sid, url string
+	err := RtspUrlCheck(rs, rqst)
+	if err != nil {
+		return err
+	}
+	//播放地址签名不对的, 回复403后断开
+	err = PlaySignCheck(rs.UrlArgs.Path[0], rs.StreamId, rs.UrlArgs.Args, rs.RAddr)
+	if err != nil {
+		rs.log.Println(err)
+		RtspForbiddenResponse(rs, rqst)
+		rs.Conn.Close() //回收rs
+		return err
+	}
 	for i := 0; i < 5; i++ {
 		err = RtspDescribeResponse(rs, rqst)
 		if err == nil {
@@ -224,23 +281,12 @@ func RtspDescribeResponse0(rs *RtspStream, rqst *RtspHsRqst) error {
 		}
 		//rs.log.Println(err)
 
-		//触发rtmp拉流
-		app = rs.UrlArgs.Path[0]
-		sid = rs.UrlArgs.Path[1]
-		url = fmt.Sprintf("rtmp://127.0.0.1:1935/%s/%s", app, sid)
-		//rs.log.Printf("try%d to pull %s", i, url)
-
-		//拉rtmp流并mem2rtsp
-		cc := make(chan bool)
-		go RtmpPuller("127.0.0.1", "1935", app, sid, 1, cc)
-		//等待从cc读取数据 或者 cc被关闭, 否则一直阻塞
-		tf := <-cc
-		if tf == true {
-			rs.log.Printf("pull%d %s succ", i, url)
-			//等sps和pps
-			//time.Sleep(200 * time.Millisecond)
+		//数据在内存中传递, 不再从127.0.0.1:1935拉流
+		sid := rs.StreamId
+		if HubRtspSubscribe(sid, rs.Key) == true {
+			rs.log.Printf("subscribe%d %s succ", i, sid)
 		} else {
-			rs.log.Printf("pull%d %s fail", i, url)
+			rs.log.Printf("subscribe%d %s fail, publisher is not exist", i, sid)
 		}
 		time.Sleep(1 * time.Second)
 	}
@@ -296,16 +342,18 @@ func RtspSetupUdpResponse(rs *RtspStream, rqst *RtspHsRqst, s string) error {
 		rs.VideoRtcpUdpPort = RtcpPort
 		rs.log.Printf("Video RtpPort=%d, RtcpPort=%d", RtpPort, RtcpPort)
 		RtspRtpPortMap.Store(RtpPort, rs)
+		RtspRtpPortMap.Store(RtcpPort, rs)
 	}
 	if strings.HasSuffix(rqst.Uri, rs.Sdp.AudioAControl) {
 		rs.AudioRtpUdpPort = RtpPort
 		rs.AudioRtcpUdpPort = RtcpPort
 		rs.log.Printf("Audio RtpPort=%d, RtcpPort=%d", RtpPort, RtcpPort)
 		RtspRtpPortMap.Store(RtpPort, rs)
+		RtspRtpPortMap.Store(RtcpPort, rs)
 	}
 
 	date := time.Now().Format(time.RFC1123)
-	s = fmt.Sprintf("%s;server_port=%s-%s", s, conf.Rtsp.Port, conf.Rtsp.Port)
+	s = fmt.Sprintf("%s;server_port=%s-%s", s, Conf().Rtsp.Port, Conf().Rtsp.Port)
 	rsps := fmt.Sprintf(RtspSetupUdpRsps, rqst.Cseq, date, rs.Session, s)
 	rs.log.Printf("write len=%d\n%s", len(rsps), rsps)
 
@@ -389,6 +437,30 @@ func RtspErrorResponse(rs *RtspStream, rqst *RtspHsRqst) error {
 	return nil
 }
 
+func RtspLimitResponse(rs *RtspStream, rqst *RtspHsRqst) error {
+	rsps := fmt.Sprintf(RtspLimitRsps, rqst.Cseq)
+	rs.log.Printf("write len=%d\n%s", len(rsps), rsps)
+
+	_, err := rs.Conn.Write([]byte(rsps))
+	if err != nil {
+		rs.log.Println(err)
+		return err
+	}
+	return nil
+}
+
+func RtspForbiddenResponse(rs *RtspStream, rqst *RtspHsRqst) error {
+	rsps := fmt.Sprintf(RtspForbiddenRsps, rqst.Cseq)
+	rs.log.Printf("write len=%d\n%s", len(rsps), rsps)
+
+	_, err := rs.Conn.Write([]byte(rsps))
+	if err != nil {
+		rs.log.Println(err)
+		return err
+	}
+	return nil
+}
+
 //rtsp推流: OPTIONS, ANNOUNCE, SETUP, SETUP, RECORD
 //rtsp播放: OPTIONS, DESCRIBE, SETUP, SETUP, PLAY
 func RtspHandshakeServer(rs *RtspStream) error {
@@ -426,7 +498,29 @@ func RtspHandshakeServer(rs *RtspStream) error {
 			err = RtspRecordResponse(rs, rqst)
 			stop = true //后续就是推流过来的音视频数据了
 		case "PLAY":
+			err = RtspUrlCheck(rs, rqst)
+			if err != nil {
+				break
+			}
+			//超过播放者个数限制, 回复453后断开
+			rs.PlayTicket, err = PlayAdmit(rs.UrlArgs.Path[0], rs.StreamId)
+			if err != nil {
+				RtspLimitResponse(rs, rqst)
+				rs.Conn.Close() //回收rs
+				break
+			}
+			//生命周期回调拒绝的, 回复403后断开
+			err = HookCheck(HookRtsp(rs, HookOnPlay, "player"))
+			if err != nil {
+				PlayRelease(rs.PlayTicket)
+				RtspForbiddenResponse(rs, rqst)
+				rs.Conn.Close() //回收rs
+				break
+			}
 			err = RtspPlayResponse(rs, rqst)
+			if err != nil {
+				PlayRelease(rs.PlayTicket)
+			}
 			stop = true //后续应该发送音视频数据给对方了
 		case "TEARDOWN":
 			err = RtspTeardownResponse(rs, rqst)
@@ -863,3 +957,11 @@ var RtspGetParameterRsps = ""
 var RtspErrorRsps = "RTSP/1.0 400 ERROR\r\n" +
 	"CSeq: %s\r\n" +
 	"\r\n"
+
+var RtspLimitRsps = "RTSP/1.0 453 Not Enough Bandwidth\r\n" +
+	"CSeq: %s\r\n" +
+	"\r\n"
+
+var RtspForbiddenRsps = "RTSP/1.0 403 Forbidden\r\n" +
+	"CSeq: %s\r\n" +
+	"\r\n"
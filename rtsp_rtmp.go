@@ -8,8 +8,52 @@ import (
 /*************************************************/
 /* Rtsp媒体数据走内存发送给自己RtmpServer
 /*************************************************/
+//rtsp推流或拉流 作为内存发布者发布到StreamHub, rtmp/flv/hls播放 不再经过127.0.0.1:1935
+//AvPkt2RtmpChan关闭 或 发布者被踢掉 就停止发布
 func RtspMem2RtmpServer(rs *RtspStream) {
+	app := "live"
+	if rs.Rqst != nil && rs.Rqst.PushApp != "" {
+		app = rs.Rqst.PushApp
+	}
+
+	s, err := HubMemPuberNew(app, rs.StreamId, "rtsp")
+	if err != nil {
+		rs.log.Println(err)
+		return
+	}
+	err = HubPublish(s)
+	if err != nil {
+		rs.log.Println(err)
+		RtmpPublishStop1(s)
+		return
+	}
+	rs.log.Printf("publish %s to StreamHub", rs.StreamId)
 
+	var p *AvPacket
+	var ok bool
+	for {
+		p, ok = <-rs.AvPkt2RtmpChan
+		if ok == false {
+			rs.log.Printf("%s RtspMem2RtmpServer() stop", rs.StreamId)
+			HubUnpublish(s)
+			return
+		}
+		if s.TransmitSwitch == "off" {
+			rs.log.Printf("%s RtspMem2RtmpServer() stop, publisher is kicked", rs.StreamId)
+			HubUnpublish(s)
+			//AvPkt2RtmpChan还会写入, 要读走
+			for range rs.AvPkt2RtmpChan {
+			}
+			return
+		}
+
+		if rs.RtmpMetaData == nil {
+			RtmpSendMetadata(rs, s)
+			RtmpSendVideoSeqHeader(rs, s)
+			RtmpSendAudioSeqHeader(rs, s)
+		}
+		RtmpSendMediaData(rs, s, p)
+	}
 }
 
 /*************************************************/
@@ -47,7 +91,7 @@ func RtmpSendMetadata(rs *RtspStream, s *Stream) error {
 	rs.RtmpMetaData = d
 
 	rc := CreateMessage(MsgTypeIdDataAmf0, uint32(len(d)), d)
-	err := MessageSplit(s, &rc, true)
+	err := PuberMsgSend(s, &rc, true)
 	if err != nil {
 		s.log.Println(err)
 		return err
@@ -132,7 +176,7 @@ func RtmpSendVideoSeqHeader(rs *RtspStream, s *Stream) error {
 	rs.RtmpVideoSeqHeader = d
 
 	rc := CreateMessage(MsgTypeIdVideo, uint32(len(d)), d)
-	err := MessageSplit(s, &rc, true)
+	err := PuberMsgSend(s, &rc, true)
 	if err != nil {
 		s.log.Println(err)
 		return err
@@ -230,7 +274,7 @@ func RtmpSendAudioSeqHeader(rs *RtspStream, s *Stream) error {
 	rs.RtmpAudioSeqHeader = d
 
 	rc := CreateMessage(MsgTypeIdAudio, uint32(len(d)), d)
-	err := MessageSplit(s, &rc, true)
+	err := PuberMsgSend(s, &rc, true)
 	if err != nil {
 		s.log.Println(err)
 		return err
@@ -302,7 +346,7 @@ func RtmpSendMediaData(rs *RtspStream, s *Stream, p *AvPacket) error {
 
 	rc := CreateMessage(TypeId, uint32(len(d)), d)
 	rc.Timestamp = p.Timestamp
-	err = MessageSplit(s, &rc, true)
+	err = PuberMsgSend(s, &rc, true)
 	if err != nil {
 		s.log.Println(err)
 		return err
@@ -313,13 +357,14 @@ func RtmpSendMediaData(rs *RtspStream, s *Stream, p *AvPacket) error {
 func RtspNet2RtmpServer(rs *RtspStream) {
 	if rs.Rqst == nil {
 		rs.Rqst = &RtspRqst{}
+		rs.Rqst.PushPtcl = "rtmp"
 		rs.Rqst.PushIp = "127.0.0.1"
 		rs.Rqst.PushPort = "1935"
 		rs.Rqst.PushApp = "live"
 		rs.Rqst.PushUrl = "rtmp://127.0.0.1:1935/live/" + rs.StreamId
 	}
 
-	s, err := RtmpPusher(rs.Rqst.PushIp, rs.Rqst.PushPort, rs.Rqst.PushApp, rs.StreamId)
+	s, err := RtmpPusher(rs.Rqst.PushPtcl, rs.Rqst.PushIp, rs.Rqst.PushPort, rs.Rqst.PushApp, rs.StreamId)
 	if err != nil {
 		rs.log.Println(err)
 		return
@@ -332,6 +377,8 @@ func RtspNet2RtmpServer(rs *RtspStream) {
 		p, ok = <-rs.AvPkt2RtmpChan
 		if ok == false {
 			rs.log.Printf("%s RtspNet2RtmpServer() stop", rs.StreamId)
+			//断开rtmp推流, 否则rtmp发布者会一直存在
+			RtmpStop(s)
 			return
 		}
 
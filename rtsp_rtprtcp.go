@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"utils"
 )
 
 /*************************************************/
@@ -148,7 +149,7 @@ func RtspRtps2AvPacket(rs *RtspStream, rps []*RtpPacket, isVideo bool) error {
 
 	//通过chan发送给rtmp处理函数
 	l := len(rs.AvPkt2RtmpChan)
-	if l < conf.Rtsp.AvPkt2RtmpChanNum {
+	if l < Conf().Rtsp.AvPkt2RtmpChanNum {
 		if s == "video" {
 			rs.AvPkt2RtmpChan <- p
 			return nil
@@ -157,7 +158,7 @@ func RtspRtps2AvPacket(rs *RtspStream, rps []*RtpPacket, isVideo bool) error {
 			rs.AvPkt2RtmpChan <- ps[i]
 		}
 	} else {
-		rs.log.Printf("%s AvPkt2RtmpChanNum=%d(%d) drop %s data", rs.StreamId, l, conf.Rtsp.AvPkt2RtmpChanNum, s)
+		rs.log.Printf("%s AvPkt2RtmpChanNum=%d(%d) drop %s data", rs.StreamId, l, Conf().Rtsp.AvPkt2RtmpChanNum, s)
 	}
 	return nil
 }
@@ -324,6 +325,8 @@ func RtspRtpCacheSort(rs *RtspStream) {
 		p, ok = <-rs.Rtp2RtmpChan
 		if ok == false {
 			rs.log.Printf("%s RtspRtpCacheSort() stop", rs.StreamId)
+			//AvPkt2RtmpChan只有这里写入, 通知RtspNet2RtmpServer()退出
+			close(rs.AvPkt2RtmpChan)
 			return
 		}
 		//rs.log.Printf("P=%d, X=%d, CC=%d, M=%d, PT=%d(%s), Seq=%d, TS=%d, SSRC=%d", p.Padding, p.Extension, p.CsrcCount, p.Marker, p.PayloadType, p.PtStr, p.SeqNum, p.Timestamp, p.Ssrc)
@@ -357,19 +360,26 @@ func RtspRtpHandler(rs *RtspStream, d []byte, RtmpSend bool) error {
 
 	l := len(rs.Rtp2RtmpChan)
 	if RtmpSend == true {
-		//rs.log.Printf("l=%d, Rtp2RtmpChanNum=%d", l, conf.Rtsp.Rtp2RtmpChanNum)
-		if l < conf.Rtsp.Rtp2RtmpChanNum {
+		RtpTsFix(rs, p)
+		rs.RecvLastTime = utils.GetTimestamp("ms")
+		if pt == rs.Sdp.VideoPayloadTypeInt {
+			RtpSeqCount("rtsp", &rs.VideoRtpSeq, p.SeqNum)
+		} else {
+			RtpSeqCount("rtsp", &rs.AudioRtpSeq, p.SeqNum)
+		}
+		//rs.log.Printf("l=%d, Rtp2RtmpChanNum=%d", l, Conf().Rtsp.Rtp2RtmpChanNum)
+		if l < Conf().Rtsp.Rtp2RtmpChanNum {
 			rs.Rtp2RtmpChan <- p
 		} else {
-			rs.log.Printf("%s Rtp2RtmpChanNum=%d(%d) drop seq=%d(%s) data", rs.StreamId, l, conf.Rtsp.Rtp2RtmpChanNum, p.SeqNum, p.PtStr)
+			rs.log.Printf("%s Rtp2RtmpChanNum=%d(%d) drop seq=%d(%s) data", rs.StreamId, l, Conf().Rtsp.Rtp2RtmpChanNum, p.SeqNum, p.PtStr)
 		}
 	}
 
 	l = len(rs.Rtp2RtspChan)
-	if l < conf.Rtsp.Rtp2RtspChanNum {
+	if l < Conf().Rtsp.Rtp2RtspChanNum {
 		rs.Rtp2RtspChan <- p
 	} else {
-		rs.log.Printf("%s Rtp2RtspChanNum=%d(%d) drop seq=%d(%s) data", rs.StreamId, l, conf.Rtsp.Rtp2RtspChanNum, p.SeqNum, p.PtStr)
+		rs.log.Printf("%s Rtp2RtspChanNum=%d(%d) drop seq=%d(%s) data", rs.StreamId, l, Conf().Rtsp.Rtp2RtspChanNum, p.SeqNum, p.PtStr)
 	}
 	return nil
 }
@@ -85,31 +85,64 @@ m=video 0 RTP/AVP 96
 a=rtpmap:96 H264/90000
 a=fmtp:96 packetization-mode=1; sprop-parameter-sets=%s,%s; profile-level-id=%X
 a=control:streamid=0
-m=audio 0 RTP/AVP 97
+`
+
+//不同音频编码的m=audio部分, 静态PT: 0 PCMU, 8 PCMA, 14 MPA(rfc3551)
+var SdpAacFmt = `m=audio 0 RTP/AVP 97
 a=rtpmap:97 MPEG4-GENERIC/%d/%d
 a=fmtp:97 profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3; config=%X
 a=control:streamid=1
 `
 
+var SdpG711Fmt = `m=audio 0 RTP/AVP %d
+a=rtpmap:%d %s/8000/1
+a=control:streamid=1
+`
+
+var SdpMpaFmt = `m=audio 0 RTP/AVP 14
+a=rtpmap:14 MPA/90000
+a=control:streamid=1
+`
+
 type SdpInfo struct {
-	Oip  string
-	Cip  string //可以同Oip
-	App  string
-	Tool string //可以同App
-	Sps  string //base64编码的sps
-	Pps  string //base64编码的pps
-	Vsc  []byte //3B, 16进制 就是Sps去掉NaluHeader后的前3字节
-	Asr  int    //audio samplerate
-	Acn  int    //audio channel num
-	Asc  []byte //2B, 16进制, AudioSpecificConfig
+	Oip    string
+	Cip    string //可以同Oip
+	App    string
+	Tool   string //可以同App
+	Sps    string //base64编码的sps
+	Pps    string //base64编码的pps
+	Vsc    []byte //3B, 16进制 就是Sps去掉NaluHeader后的前3字节
+	Asr    int    //audio samplerate
+	Acn    int    //audio channel num
+	Asc    []byte //2B, 16进制, AudioSpecificConfig
+	Acodec string //AAC, G711a, G711u, MP3, 其他编码sdp里没有音频
 }
 
 func CreateSdp(si *SdpInfo) (string, error) {
 	//log.Printf("%#v", si)
-	sdp := fmt.Sprintf(SdpFmt, si.Oip, si.App, si.Cip, si.Tool, si.Sps, si.Pps, si.Vsc, si.Asr, si.Acn, si.Asc)
+	sdp := fmt.Sprintf(SdpFmt, si.Oip, si.App, si.Cip, si.Tool, si.Sps, si.Pps, si.Vsc)
+	switch si.Acodec {
+	case "AAC":
+		sdp += fmt.Sprintf(SdpAacFmt, si.Asr, si.Acn, si.Asc)
+	case "G711a":
+		sdp += fmt.Sprintf(SdpG711Fmt, 8, 8, "PCMA")
+	case "G711u":
+		sdp += fmt.Sprintf(SdpG711Fmt, 0, 0, "PCMU")
+	case "MP3":
+		sdp += SdpMpaFmt
+	}
 	return sdp, nil
 }
 
+//rtsp能承载的音频编码, speex等没有对应的sdp 不发送
+func RtspAudioCodecCheck(acodec string) bool {
+	switch acodec {
+	case "AAC", "G711a", "G711u", "MP3":
+		return true
+	}
+	return false
+}
+
 type Sdp struct {
 	RawSdp      []byte
 	NetProtocol string //tcp or udp
@@ -268,7 +301,8 @@ func ParseSdp(d []byte) (*Sdp, error) {
 	return sdp, nil
 }
 
-func CreateSdpUseSpsPps(sps, pps []byte) (*Sdp, error) {
+//acodec为发布者的AudioCodecType
+func CreateSdpUseSpsPps(sps, pps []byte, acodec string) (*Sdp, error) {
 	sdp := &Sdp{}
 	sdp.RawSdp = nil
 	sdp.NetProtocol = "tcp"
@@ -297,6 +331,21 @@ func CreateSdpUseSpsPps(sps, pps []byte) (*Sdp, error) {
 	d[1] = (sdp.AacC.SamplingIdx&0xf)<<7 | (sdp.AacC.ChannelNum&0xf)<<3 | (sdp.AacC.FrameLenFlag&0x1)<<2 | (sdp.AacC.DependCoreCoder&0x1)<<1 | sdp.AacC.ExtensionFlag&0x1
 	sdp.AacCData = d
 
+	switch acodec {
+	case "G711a":
+		sdp.AudioPayloadTypeInt = 8
+		sdp.AudioPayloadTypeStr = "pcma"
+		sdp.AudioClockRate = 8000
+	case "G711u":
+		sdp.AudioPayloadTypeInt = 0
+		sdp.AudioPayloadTypeStr = "pcmu"
+		sdp.AudioClockRate = 8000
+	case "MP3":
+		sdp.AudioPayloadTypeInt = 14
+		sdp.AudioPayloadTypeStr = "mpa"
+		sdp.AudioClockRate = 90000
+	}
+
 	sdp.SpsBase64 = base64.StdEncoding.EncodeToString(sps)
 	sdp.PpsBase64 = base64.StdEncoding.EncodeToString(pps)
 	sdp.SpsData = sps
@@ -315,7 +364,7 @@ func CreateSdpUseSpsPps(sps, pps []byte) (*Sdp, error) {
 	//si.Oip = rs.Puber.LIp
 	//si.Cip = rs.Puber.RIp
 	si.Oip = "127.0.0.1"
-	si.Cip = conf.IpOuter
+	si.Cip = Conf().IpOuter
 	si.App = AppName
 	si.Tool = AppName
 	si.Sps = sdp.SpsBase64
@@ -324,6 +373,7 @@ func CreateSdpUseSpsPps(sps, pps []byte) (*Sdp, error) {
 	si.Asr = sdp.AudioClockRate
 	si.Acn = sdp.AudioChannelNum
 	si.Asc = sdp.AacCData
+	si.Acodec = acodec
 	s, err := CreateSdp(si)
 	sdp.RawSdp = []byte(s)
 	return sdp, nil
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"context"
 	"fmt"
 	"io"
 	"log"
@@ -19,51 +18,56 @@ import (
 /*************************************************/
 func RtspNet2RtspPlayers(rs *RtspStream, rp *RtpPacket) {
 	var player *RtspStream
-	var p *RtpPacket
 	var d []byte
 	var err error
 	var n int
 
+	//缓存里已经包含当前rtp包
+	key := RtpGopCachePush(rs, rp)
+	//找不到关键帧的(如 只有音频) 播放者不等关键帧
+	waitable := RtpKeyWaitable(rs)
+
 	//m := utils.SyncMapLen(&rs.Players)
 	//rs.log.Printf("key=%s, sid=%s PlayerNum=%d", rs.Key, rs.StreamId, m)
 	rs.Players.Range(func(k, v interface{}) bool {
 		player, _ = v.(*RtspStream)
 
+		//新播放者 按启播方式发送缓存, 缓存为空的 同low等下一个关键帧
 		if player.NewPlayer == true {
-			rs.log.Printf("Send RtpCache to NewPlayer %s", player.Key)
 			player.NewPlayer = false
-
-			/*
-				//发送 缓存SpsPpsRtpPkg + 缓存AvRtpPkg(含当前rtp包)
-				p, _ = GetRtpSpsPpsPkg(rs)
-				//依据RtpAvPktCache中第1个rtp包的信息, 修改RtpSpsPpsPkg的SeqNum和Timestamp
-				//RtpSpsPpsPkg的SeqNum=RtpAvPktCache1.SeqNum-1, 注意回绕
-				//RtpSpsPpsPkg的Timestamp=RtpAvPktCache1.Timestamp
-				UpdateRtpSpsPpsPkg(rs, p)
-				player.Conn.Write(p.Data)
-			*/
-
-			for e := rs.RtpGopCache.Front(); e != nil; e = e.Next() {
-				p = (e.Value).(*RtpPacket)
-				d, _ = AddInterleavedMode(p)
-				n, err = player.Conn.Write(d)
-				player.log.Printf("Send RtpSeq=%d(%s) DL=%d SL=%d to Player %s", p.SeqNum, p.PtStr, len(p.Data), n, player.Key)
+			if rs.RtpGopCache.Len() > 0 {
+				rs.log.Printf("Send RtpCache to NewPlayer %s", player.Key)
+				err = RtpGopCacheSend(rs, player)
 				if err != nil {
 					player.log.Printf("delete %s player", player.Key)
 					rs.log.Printf("delete %s player", player.Key)
 					rs.Players.Delete(player.Key)
-					break
+					HookRtspPlayerStop(player)
+					PlayRelease(player.PlayTicket)
 				}
+				return true
 			}
-		} else {
-			d, _ = AddInterleavedMode(rp)
-			n, err = player.Conn.Write(d)
-			player.log.Printf("Send V=%d, P=%d, X=%d, CC=%d, M=%d, PT=%d(%s), Seq=%d, TS=%d, SSRC=%d, Len=%d", rp.Version, rp.Padding, rp.Extension, rp.CsrcCount, rp.Marker, rp.PayloadType, rp.PtStr, rp.SeqNum, rp.Timestamp, rp.Ssrc, rp.Len)
-			if err != nil {
-				player.log.Printf("delete %s player", player.Key)
-				rs.log.Printf("delete %s player", player.Key)
-				rs.Players.Delete(player.Key)
+			player.PlayWaitKey = true
+		}
+		if player.PlayWaitKey == true {
+			if key == false && waitable == true {
+				return true
 			}
+			player.PlayWaitKey = false
+			player.log.Printf("start at key frame(%t), Seq=%d, TS=%d", key, rp.SeqNum, rp.Timestamp)
+		}
+
+		d, _ = AddInterleavedMode(rp)
+		n, err = player.Conn.Write(d)
+		MetricsAdd(MetricsOutBytes, "rtsp", uint64(n))
+		RtspOutBytesAdd(rs, player, n)
+		player.log.Printf("Send V=%d, P=%d, X=%d, CC=%d, M=%d, PT=%d(%s), Seq=%d, TS=%d, SSRC=%d, Len=%d, SL=%d", rp.Version, rp.Padding, rp.Extension, rp.CsrcCount, rp.Marker, rp.PayloadType, rp.PtStr, rp.SeqNum, rp.Timestamp, rp.Ssrc, rp.Len, n)
+		if err != nil {
+			player.log.Printf("delete %s player", player.Key)
+			rs.log.Printf("delete %s player", player.Key)
+			rs.Players.Delete(player.Key)
+			HookRtspPlayerStop(player)
+			PlayRelease(player.PlayTicket)
 		}
 		return true
 	})
@@ -81,6 +85,15 @@ func RtspMem2RtspPlayers(s *RtspStream) {
 		rp, ok = <-s.Rtp2RtspChan
 		if ok == false {
 			s.log.Printf("%s RtspMem2RtspPlayers() stop", s.StreamId)
+			//发布者停止了 同rtmp播放, 剩下的播放者断开, 被新发布者接管的 已经转走
+			s.Players.Range(func(k, v interface{}) bool {
+				p := v.(*RtspStream)
+				p.Conn.Close()
+				s.Players.Delete(k)
+				HookRtspPlayerStop(p)
+				PlayRelease(p.PlayTicket)
+				return true
+			})
 			return
 		}
 		//s.RtpGopCache.PushBack(rp)
@@ -103,10 +116,18 @@ func RtspMem2RtspPlayers(s *RtspStream) {
 	}
 }
 
+//rtsp://ip:1554/live/sid?startmode=low, 启播方式见play_start.go
 func RtspPlayer(rs *RtspStream) {
-	rs.NewPlayer = false
+	rs.PlayStartMode = PlayStartModeParse(rs.UrlArgs.Args)
+	rs.NewPlayer = true
+	rs.PlayWaitKey = false
+	if rs.PlayStartMode == StartModeLow {
+		rs.NewPlayer = false
+		rs.PlayWaitKey = true
+	}
 	//log.Printf("PubKey:%s, Sid=%s", rs.Puber.Key, rs.Puber.StreamId)
 	n := utils.SyncMapLen(&rs.Puber.Players)
+	rs.BeginTime = utils.GetTimestamp("ms")
 	rs.Puber.Players.Store(rs.Key, rs)
 	m := utils.SyncMapLen(&rs.Puber.Players)
 	log.Printf("Puber %s BeforePlayerNum=%d, AfterPlayerNum=%d", rs.StreamId, n, m)
@@ -201,8 +222,8 @@ func RtspPuber(rs *RtspStream) {
 		return
 	}
 
-	//go RtspMem2RtmpServer(rs)
-	go RtspNet2RtmpServer(rs)
+	go RtspMem2RtmpServer(rs)
+	//go RtspNet2RtmpServer(rs)
 	go RtspMem2RtspPlayers(rs)
 	//go RtspNet2RtspServer(rs)
 	go RtspRtpCacheSort(rs)
@@ -234,23 +255,26 @@ func RtspPuber(rs *RtspStream) {
 }
 
 func RtspUdpHandle(rs *RtspStream) {
-	//go RtspMem2RtmpServer(rs)
-	go RtspNet2RtmpServer(rs)
+	go RtspMem2RtmpServer(rs)
+	//go RtspNet2RtmpServer(rs)
 	go RtspMem2RtspPlayers(rs)
 	//go RtspNet2RtspServer(rs)
 	go RtspRtpCacheSort(rs)
 
 	rs.log.Printf("vRtpPort=%d, vRtcpPort=%d, aRtpPort=%d, aRtcpPort=%d", rs.VideoRtpUdpPort, rs.VideoRtcpUdpPort, rs.AudioRtpUdpPort, rs.AudioRtcpUdpPort)
 
+	//rtp走udp时 rtsp连接上没有数据, 连接断开(客户端断开 被踢掉)时 停止发布
+	go RtspUdpConnWatch(rs)
+
 	var i int
 	var p *RtpUdpPkt
-	var ok bool
 	var StartRtmp = true
 	for {
 		//rs.log.Printf("======== RtpUdpData %d ========", i)
 
-		p, ok = <-rs.RtpUdpChan
-		if ok == false {
+		select {
+		case p = <-rs.RtpUdpChan:
+		case <-rs.Done:
 			rs.log.Printf("%s RtspUdpHandle() stop", rs.StreamId)
 			return
 		}
@@ -268,6 +292,30 @@ func RtspUdpHandle(rs *RtspStream) {
 	}
 }
 
+//读rtsp连接 直到出错, 客户端的心跳等请求 不处理
+func RtspUdpConnWatch(rs *RtspStream) {
+	var d [1024]byte
+	for {
+		n, err := rs.Conn.Read(d[:])
+		if err != nil {
+			rs.log.Println(err)
+			RtspPuberCancel(rs)
+			return
+		}
+		rs.log.Printf("ignore rtsp data len=%d\n%s", n, d[:n])
+	}
+}
+
+//通知rtsp发布者停止, 可以重复调用
+//rtp_tcp的发布者 关闭连接后RtspPuber()读出错返回, rtp_udp的发布者 RtspUdpHandle()收到Done返回
+//之后都由RtspHandler()调用RtspPuberStop()释放资源
+func RtspPuberCancel(rs *RtspStream) {
+	rs.DoneOnce.Do(func() {
+		close(rs.Done)
+	})
+	rs.Conn.Close()
+}
+
 func RtspPuberStop(rs *RtspStream) {
 	log.Printf("rtsp puber %s stop", rs.Key)
 	if rs == nil {
@@ -275,8 +323,18 @@ func RtspPuberStop(rs *RtspStream) {
 	}
 	rs.log.Printf("rtsp puber %s stop", rs.Key)
 
-	rs.Conn.Close()
-	RtspPuberMap.Delete(rs.Key)
+	RtspPuberCancel(rs)
+	HubRtspDelete(rs.Key, rs)
+	for _, port := range []int{rs.VideoRtpUdpPort, rs.VideoRtcpUdpPort, rs.AudioRtpUdpPort, rs.AudioRtcpUdpPort} {
+		if port != 0 {
+			SyncMapDeleteSelf(&RtspRtpPortMap, port, rs)
+		}
+	}
+
+	//接收协程已退出, 不会再写入这两个chan
+	//关闭后 RtspMem2RtspPlayers(), RtspRtpCacheSort(), RtspNet2RtmpServer() 依次退出
+	close(rs.Rtp2RtspChan)
+	close(rs.Rtp2RtmpChan)
 }
 
 /*************************************************/
@@ -291,9 +349,9 @@ func RtspHandler(c net.Conn) {
 		return
 	}
 
-	fn := fmt.Sprintf("%s/%s/play_rtsp_%s.log", conf.Log.StreamLogPath, rs.StreamId, rs.RAddr)
+	fn := fmt.Sprintf("%s/%s/play_rtsp_%s.log", Conf().Log.StreamLogPath, rs.StreamId, rs.RAddr)
 	if rs.IsPuber == true {
-		fn = fmt.Sprintf("%s/%s/publish_rtsp_%s.log", conf.Log.StreamLogPath, rs.StreamId, utils.GetYMD())
+		fn = fmt.Sprintf("%s/%s/publish_rtsp_%s.log", Conf().Log.StreamLogPath, rs.StreamId, utils.GetYMD())
 	}
 	StreamLogRename(rs.LogFn, fn)
 	rs.LogFn = fn
@@ -315,7 +373,7 @@ func RtspHandler(c net.Conn) {
 }
 
 func RtspServerTcp() {
-	addr := fmt.Sprintf("%s:%s", "0.0.0.0", conf.Rtsp.Port)
+	addr := fmt.Sprintf("%s:%s", "0.0.0.0", Conf().Rtsp.Port)
 	log.Printf("==> rtsp listen on %s tcp", addr)
 
 	l, err := reuseport.Listen("tcp", addr)
@@ -342,7 +400,7 @@ func RtspServerTcp() {
 }
 
 func RtspServerUdp() {
-	addr := fmt.Sprintf("%s:%s", "0.0.0.0", conf.Rtsp.Port)
+	addr := fmt.Sprintf("%s:%s", "0.0.0.0", Conf().Rtsp.Port)
 	log.Printf("==> rtsp listen on %s udp", addr)
 
 	pc, err := reuseport.ListenPacket("udp", addr)
@@ -353,7 +411,6 @@ func RtspServerUdp() {
 
 	var n int
 	var raddr *net.UDPAddr
-	var rs *RtspStream
 	for {
 		p := &RtpUdpPkt{}
 		p.Data = make([]byte, 1600)
@@ -370,30 +427,28 @@ func RtspServerUdp() {
 		//log.Println("------ new rtsp UdpRtpPkt ------")
 		//log.Printf("rAddr:%s:%d, len=%d, data=%x", p.Ip, p.Port, n, p.Data[:10])
 
-		if rs == nil {
-			v, ok := RtspRtpPortMap.Load(p.Port)
-			if ok == false {
-				log.Printf("rtsp rtp port %d is not exist", p.Port)
-				continue
-			}
-			rs = v.(*RtspStream)
+		//发布者停止后 RtspPuberStop()删除端口, 每个包都要查找
+		v, ok := RtspRtpPortMap.Load(p.Port)
+		if ok == false {
+			log.Printf("rtsp rtp port %d is not exist", p.Port)
+			continue
 		}
+		rs := v.(*RtspStream)
 
 		l := len(rs.RtpUdpChan)
-		if l < conf.Rtsp.Rtp2RtspChanNum {
+		if l < Conf().Rtsp.Rtp2RtspChanNum {
 			rs.RtpUdpChan <- p
 		} else {
-			log.Println("%s, l=%d, cn=%d", rs.Key, l, conf.Rtsp.Rtp2RtspChanNum)
+			log.Println("%s, l=%d, cn=%d", rs.Key, l, Conf().Rtsp.Rtp2RtspChanNum)
 		}
 	}
 }
 
 func RtspServerTcp1(lc net.ListenConfig) {
-	addr := fmt.Sprintf("%s:%s", "0.0.0.0", conf.Rtsp.Port)
+	addr := fmt.Sprintf("%s:%s", "0.0.0.0", Conf().Rtsp.Port)
 	log.Printf("==> rtsp listen on %s tcp", addr)
 
-	ctx := context.Background()
-	l, err := lc.Listen(ctx, "tcp", addr)
+	l, err := UpgradeListen(&lc, "rtsp_tcp", "tcp", addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -403,6 +458,9 @@ func RtspServerTcp1(lc net.ListenConfig) {
 		c, err = l.Accept()
 		if err != nil {
 			log.Println(err)
+			if UpgradeStopped() == true {
+				return
+			}
 			continue
 		}
 		log.Println("------ new rtsp connect ------")
@@ -417,19 +475,16 @@ func RtspServerTcp1(lc net.ListenConfig) {
 }
 
 func RtspServerUdp1(lc net.ListenConfig) {
-	addr := fmt.Sprintf("%s:%s", "0.0.0.0", conf.Rtsp.Port)
+	addr := fmt.Sprintf("%s:%s", "0.0.0.0", Conf().Rtsp.Port)
 	log.Printf("==> rtsp listen on %s udp", addr)
 
-	ctx := context.Background()
-	pc, err := lc.ListenPacket(ctx, "udp", addr)
+	l, err := UpgradeListenPacket(&lc, "rtsp_udp", "udp", addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	l := pc.(*net.UDPConn)
 
 	var n int
 	var raddr *net.UDPAddr
-	var rs *RtspStream
 	for {
 		p := &RtpUdpPkt{}
 		p.Data = make([]byte, 1600)
@@ -437,6 +492,9 @@ func RtspServerUdp1(lc net.ListenConfig) {
 		n, raddr, err = l.ReadFromUDP(p.Data)
 		if err != nil {
 			log.Println(err)
+			if UpgradeStopped() == true {
+				return
+			}
 			continue
 		}
 		p.Ip = raddr.IP.String()
@@ -446,23 +504,30 @@ func RtspServerUdp1(lc net.ListenConfig) {
 		//log.Println("------ new rtsp UdpRtpPkt ------")
 		//log.Printf("rAddr:%s:%d, len=%d, data=%x", p.Ip, p.Port, n, p.Data[:10])
 
-		if rs == nil {
-			v, ok := RtspRtpPortMap.Load(p.Port)
-			if ok == false {
-				log.Printf("rtsp rtp port %d is not exist", p.Port)
-				continue
-			}
-			rs = v.(*RtspStream)
+		//升级后 不是本进程的会话 可能是老进程的, 转给老进程
+		if RtspUdpPktDispatch(p) == false && UpgradeFwdSend(p) == false {
+			log.Printf("rtsp rtp port %d is not exist", p.Port)
 		}
+	}
+}
 
-		l := len(rs.RtpUdpChan)
-		//rs.log.Printf("%s, l=%d, cn=%d", rs.Key, l, conf.Rtsp.Rtp2RtspChanNum)
-		if l < conf.Rtsp.Rtp2RtspChanNum {
-			rs.RtpUdpChan <- p
-		} else {
-			log.Printf("%s, l=%d, cn=%d", rs.Key, l, conf.Rtsp.Rtp2RtspChanNum)
-		}
+//按端口找到发布者 交给RtspUdpHandle(), 端口不存在返回false
+//发布者停止后 RtspPuberStop()删除端口, 每个包都要查找
+func RtspUdpPktDispatch(p *RtpUdpPkt) bool {
+	v, ok := RtspRtpPortMap.Load(p.Port)
+	if ok == false {
+		return false
+	}
+	rs := v.(*RtspStream)
+
+	l := len(rs.RtpUdpChan)
+	//rs.log.Printf("%s, l=%d, cn=%d", rs.Key, l, Conf().Rtsp.Rtp2RtspChanNum)
+	if l < Conf().Rtsp.Rtp2RtspChanNum {
+		rs.RtpUdpChan <- p
+	} else {
+		log.Printf("%s, l=%d, cn=%d", rs.Key, l, Conf().Rtsp.Rtp2RtspChanNum)
 	}
+	return true
 }
 
 func FdSet(fd uintptr) {
@@ -496,8 +561,8 @@ func RtspServer() {
 	//go RtspServerTcp() //rtsp支持RtpTcp单端口
 	//go RtspServerUdp() //rtsp支持RtpUdp单端口
 
-	log.Printf("rtsp RtpRtcp tcp&udp multiple port use [%d-%d)", conf.Rtsp.RtpPortMin, conf.Rtsp.RtpPortMax)
-	for i := conf.Rtsp.RtpPortMin; i < conf.Rtsp.RtpPortMax; i++ {
+	log.Printf("rtsp RtpRtcp tcp&udp multiple port use [%d-%d)", Conf().Rtsp.RtpPortMin, Conf().Rtsp.RtpPortMax)
+	for i := Conf().Rtsp.RtpPortMin; i < Conf().Rtsp.RtpPortMax; i++ {
 		//log.Printf("rtsp rtp listen on %d tcp&udp", i)
 	}
 	select {}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"unsafe"
@@ -175,8 +176,24 @@ func Uint64ToByte(u uint64, b []byte, bo ByteOrder) []byte {
 /*************************************************/
 /* 已uintX为数据 socket的读写
 /*************************************************/
+//r是bytes.Reader等 知道剩余长度的, n超过剩余字节数 直接返回错误
+//n来自对方发来的数据, 不检查 恶意的长度会导致按n分配内存时 内存耗尽
+func ReaderLenCheck(r io.Reader, n int) error {
+	lr, ok := r.(interface{ Len() int })
+	if ok == false {
+		return nil
+	}
+	if n < 0 || n > lr.Len() {
+		return fmt.Errorf("need %d bytes, only %d bytes left", n, lr.Len())
+	}
+	return nil
+}
+
 // 从 socket中 读取 n个字节, 以大/小端字节序 转 uintX
 func ReadByte(r io.Reader, n uint32) ([]byte, error) {
+	if err := ReaderLenCheck(r, int(n)); err != nil {
+		return nil, err
+	}
 	b := make([]byte, n)
 	_, err := io.ReadFull(r, b)
 	if err != nil {
@@ -189,6 +206,10 @@ func ReadByte(r io.Reader, n uint32) ([]byte, error) {
 }
 
 func ReadString(r io.Reader, n uint32) (string, error) {
+	if err := ReaderLenCheck(r, int(n)); err != nil {
+		log.Println(err)
+		return "", err
+	}
 	b := make([]byte, n)
 	_, err := io.ReadFull(r, b)
 	if err != nil {
@@ -219,7 +219,7 @@ func SipRegister1Rsps(sr *SipRqst) []byte {
 		"WWW-Authenticate: Digest realm=\"1100000012\",nonce=\"%s\",opaque=\"%s\",algorithm=md5\r\n" +
 		"Content-Length: 0\r\n\r\n"
 
-	s := fmt.Sprintf(rsps, sr.ViaIp, sr.ViaPort, sr.ViaPort, conf.GB28181.SipIp, sr.ViaBranch, sr.FromSip, sr.FromTag, sr.ToSip, "z9hG4bK2078339622", sr.CallId, "43b4f4162cfa5a35", "040feeef38b042e6")
+	s := fmt.Sprintf(rsps, sr.ViaIp, sr.ViaPort, sr.ViaPort, Conf().GB28181.SipIp, sr.ViaBranch, sr.FromSip, sr.FromTag, sr.ToSip, "z9hG4bK2078339622", sr.CallId, "43b4f4162cfa5a35", "040feeef38b042e6")
 	return []byte(s)
 }
 
@@ -273,7 +273,7 @@ func SipRegister2Rsps(sr *SipRqst) []byte {
 	//2022-04-03T20:51:12.413
 	date := utils.GetYMDHMS1()
 
-	s := fmt.Sprintf(rsps, sr.ViaIp, sr.ViaPort, sr.ViaPort, conf.GB28181.SipIp, sr.ViaBranch, sr.FromSip, sr.FromTag, sr.ToSip, "z9hG4bK360295267", sr.CallId, date)
+	s := fmt.Sprintf(rsps, sr.ViaIp, sr.ViaPort, sr.ViaPort, Conf().GB28181.SipIp, sr.ViaBranch, sr.FromSip, sr.FromTag, sr.ToSip, "z9hG4bK360295267", sr.CallId, date)
 	return []byte(s)
 }
 
@@ -289,7 +289,7 @@ func SipMessageRsps(sr *SipRqst) []byte {
 		"CSeq: %s\r\n" +
 		"Content-Length: 0\r\n\r\n"
 
-	s := fmt.Sprintf(rsps, sr.ViaIp, sr.ViaPort, sr.ViaPort, conf.GB28181.SipIp, sr.ViaBranch, sr.FromSip, sr.FromTag, sr.ToSip, "z9hG4bK360295267", sr.CallId, sr.CSeq)
+	s := fmt.Sprintf(rsps, sr.ViaIp, sr.ViaPort, sr.ViaPort, Conf().GB28181.SipIp, sr.ViaBranch, sr.FromSip, sr.FromTag, sr.ToSip, "z9hG4bK360295267", sr.CallId, sr.CSeq)
 	return []byte(s)
 }
 
@@ -315,10 +315,10 @@ func SipHandlerTcp(c net.Conn) {
 }
 
 func SipServerTcp() {
-	addr := fmt.Sprintf(":%s", conf.GB28181.SipPort)
+	addr := fmt.Sprintf(":%s", Conf().GB28181.SipPort)
 	log.Printf("listen sip(tcp) on %s", addr)
 
-	l, err := net.Listen("tcp", addr)
+	l, err := UpgradeListen(nil, "sip_tcp", "tcp", addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -327,6 +327,9 @@ func SipServerTcp() {
 		c, err := l.Accept()
 		if err != nil {
 			log.Println(err)
+			if UpgradeStopped() == true {
+				return
+			}
 			continue
 		}
 		log.Println("---------->> new sip(tcp) connect")
@@ -391,11 +394,10 @@ func SipHandlerUdp(l *net.UDPConn) {
 }
 
 func SipServerUdp() {
-	addr := fmt.Sprintf(":%s", conf.GB28181.SipPort)
+	addr := fmt.Sprintf(":%s", Conf().GB28181.SipPort)
 	log.Printf("listen sip(udp) on %s", addr)
 
-	laddr, _ := net.ResolveUDPAddr("udp", addr)
-	l, err := net.ListenUDP("udp", laddr)
+	l, err := UpgradeListenPacket(nil, "sip_udp", "udp", addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -68,10 +68,25 @@ type Stream struct {
 	PubAuth     PubAuthRsps // 业务逻辑 推流鉴权结果
 	GbPub
 	RtmpPublisher
-	Players   sync.Map //发布者才会有播放者
-	PlayClose bool     //播放者是否已断开连接
+	Players      sync.Map     //发布者才会有播放者
+	Forwards     sync.Map     //发布者才会有转推目标, key为转推地址
+	PlayClose    bool         //播放者是否已断开连接
+	Puber        *Stream      //播放者当前的发布者, 发布者被踢掉时 指向新的发布者
+	PuberMutex   sync.Mutex   //Puber切换和播放者退出 不能同时进行
+	PuberChanged bool         //发布者被替换, 播放者要等新发布者的关键帧 重发音视频头, PuberMutex保护
+	PuberWaitKey bool         //收到PuberChanged后 等新发布者的关键帧, 只有发送协程读写
+	Kicked       bool         //发布者被新的发布者踢掉, 停止时不能删除新发布者的资源
+	RecvLastTime int64        //发布者最后收到数据的时间, 毫秒
+	PuberGrace   bool         //发布者断线, 等待DelayDeleteTime秒内重连
+	ResumeChan   chan *Stream //重连的发布者 通过它交给断线的发布者
+	TsRebase     bool         //重连后 下一个音视频消息要重新计算TsOffset
+	TsOffset     uint32       //重连后 接收的时间戳要加上这个值, 保证时间戳连续
+	LastMediaTs  uint32       //最后收到的音视频消息的时间戳(已加TsOffset)
+	TsFix        TsFix        //音视频时间戳修正, 只有发布者用
 
 	RemoteAddr string
+	RemotePtcl string //rtmp或rtmps, 我们是客户端时才有值
+	RemoteArgs string //推拉流地址?后面的参数, 转推或拉第三方的流时才有值
 	RemoteIp   string
 	RemotePort string
 	//RemoteConn      net.Conn          //需要Close()
@@ -87,21 +102,27 @@ type Stream struct {
 	RemoteWindowAckSize uint32
 	RemotePeerBandwidth uint32
 	Chunks              map[uint32]Chunk
+	AggChunks           []Chunk //聚合消息拆分后 还没有取走的子消息
 	AmfInfo             AmfInfo
+	AmfDepth            int    //amf0/amf3解码的嵌套层数, 见AmfDepthMax
 	MessageHandleDone   bool   //
 	RecvMsgLen          uint32 //用于ACK回应,接收消息的总长度(不包括ChunkHeader)
 	TransmitSwitch      string //
 
-	PsPktChan      chan *PsPacket
-	RtpPktChan     chan *RtpPacket
-	RtpRecChan     chan RtpPacket
-	FrameChan      chan Chunk //每个播放者一个
-	AvPkg2RtspChan chan Chunk
-
-	VideoCodecType string // "H264" or "H265"
-	AudioCodecType string // "AAC" or "G711a"
-	Width          int
-	Height         int
+	PsPktChan   chan *PsPacket
+	RtpPktChan  chan *RtpPacket
+	RtpRecChan  chan RtpPacket
+	FrameChan   chan Chunk    //每个播放者一个
+	RtspOut     bool          //有rtsp播放, RtmpSender()要把数据给RtmpMem2RtspServer(), HubMutex保护
+	RtspOutKey  string        //rtsp播放的key, app_streamId, HubMutex保护
+	RtspOutChan chan *AvFrame //给RtmpMem2RtspServer()的数据, 只有RtmpSender()读写这个字段
+	RtspOutDone chan struct{} //RtmpMem2RtspServer()退出时关闭, 只有RtmpSender()读写这个字段
+
+	VideoCodecType  string // "H264" or "H265"
+	AudioCodecType  string // "AAC", "MP3", "G711a", "G711u" or "Speex"
+	AudioStreamType uint8  // ts里的音频StreamType, 0表示aac(0x0f)
+	Width           int
+	Height          int
 
 	FlvPlayBackDoor     bool //flv不加密播放 方便自测
 	FlvPlayEncrypt      bool //flv play, encrypt = 0 no encrypt
@@ -111,11 +132,24 @@ type Stream struct {
 	HlsChan             chan Chunk  // 发布者和hls生产者的数据通道
 	HlsLiveChan         chan Chunk  // 发布者和hls live生产者的数据通道
 	PlayStartMode       string
-	PlaySendAHeaderFlag bool   // 低延时启播发送音频头
-	PlaySendVHeaderFlag bool   // 低延时启播发送视频头
-	HlsAddDiscFlag      bool   //
-	HlsLiveAddDiscFlag  bool   //
-	FlvSendDataSize     uint32 //play_flv_xxx.log, 每发送1MB数据打一条日志
+	FourCcList          []string //播放者支持的Enhanced RTMP视频编码, 如hvc1/av01/vp09
+	PlaySendAHeaderFlag bool     // 低延时启播发送音频头
+	PlaySendVHeaderFlag bool     // 低延时启播发送视频头
+	HlsAddDiscFlag      bool     //
+	HlsLiveAddDiscFlag  bool     //
+	HlsResume           bool     //发布者重连后 hls要从关键帧切新ts
+	HlsLiveResume       bool     //发布者重连后 hls live要从关键帧切新ts
+	FlvSendDataSize     uint32   //play_flv_xxx.log, 每发送1MB数据打一条日志
+
+	PlayDrop     PlayDropStat //播放者拥塞丢帧统计, 见play_congest.go
+	PlayDropGop  bool         //正在丢gop, 等下一个关键帧
+	PlayBlockNum int          //PlayChan连续满的次数
+
+	BeginTime int64  //发布或播放开始的时间, 毫秒
+	InBytes   uint64 //发布者收到的字节数
+	OutBytes  uint64 //播放者发送的字节数, 发布者为所有播放者之和
+	//PlayAdmit()占用的名额, 见play_limit.go
+	PlayTicket *PlayTicket
 
 	Ctx    context.Context
 	Wg     sync.WaitGroup
@@ -151,23 +185,6 @@ type Stream struct {
 	AacC             *AudioSpecificConfig
 	AvcC             *AVCDecoderConfigurationRecord  // h264 header
 	HevcC            *HEVCDecoderConfigurationRecord // h265 header
-	PktNum           uint32
-	StartTimeVideo   int64
-	PktNumVideo      uint32
-	CalNumVideo      uint32
-	SeqNumVideo      uint32
-	TotalVideoDelta  uint32
-	FirstVideoAdust  uint32
-	PrevVideoAdust   uint32
-	DeltaCalVideo    [3]uint32
-	StartTimeAudio   int64
-	PktNumAudio      uint32
-	CalNumAudio      uint32
-	SeqNumAudio      uint32
-	TotalAudioDelta  uint32
-	FirstAudioAdust  uint32
-	PrevAudioAdust   uint32
-	DeltaCalAudio    [3]uint32
 }
 
 func NewStream(c net.Conn) (s *Stream, err error) {
@@ -180,14 +197,13 @@ func NewStream(c net.Conn) (s *Stream, err error) {
 		RemotePeerBandwidth: 2500000,
 		Chunks:              make(map[uint32]Chunk),
 		NewPlayer:           true,
-		Msg2RtmpChan:        make(chan Chunk, conf.Rtmp.Msg2RtmpChanNum),
-		HlsChan:             make(chan Chunk, conf.HlsRec.HlsStockMax),
-		HlsLiveChan:         make(chan Chunk, conf.HlsRec.HlsStockMax),
+		Msg2RtmpChan:        make(chan Chunk, Conf().Rtmp.Msg2RtmpChanNum),
+		HlsChan:             make(chan Chunk, Conf().HlsRec.HlsStockMax),
+		HlsLiveChan:         make(chan Chunk, Conf().HlsRec.HlsStockMax),
 		PsPktChan:           make(chan *PsPacket, 1000),
 		GopCache:            GopCacheNew(),
 		MediaData:           list.New(),
 	}
-	s.AvPkg2RtspChan = make(chan Chunk, conf.Rtmp.AvPkt2RtspChanNum)
 	s.PlaybackTimeout = 20
 	s.RtpPktCrtTs = -1
 
@@ -208,7 +224,7 @@ func NewStream(c net.Conn) (s *Stream, err error) {
 		s.RemoteIp = ip[0]
 	}
 
-	//s.LogFn = fmt.Sprintf("%s/%s/push_rtmp_%s.log", conf.Log.StreamLogPath, s.StreamId, s.RemoteAddr)
+	//s.LogFn = fmt.Sprintf("%s/%s/push_rtmp_%s.log", Conf().Log.StreamLogPath, s.StreamId, s.RemoteAddr)
 	//磁盘满时, 日志创建失败, 没做判断 继续执行 会导致打印日志时崩溃
 	s.log, s.LogFp, err = StreamLogCreate(s.LogFn)
 	if err != nil {
@@ -216,8 +232,8 @@ func NewStream(c net.Conn) (s *Stream, err error) {
 		return nil, err
 	}
 
-	if conf.StreamRec.Enable == true && strings.Contains(s.StreamId, conf.StreamRec.StreamId) {
-		s.RecRtmpFn = fmt.Sprintf("%s/%s_%d_rtmp.rec", conf.StreamRec.SavePath, s.StreamId, utils.GetTimestamp("s"))
+	if Conf().StreamRec.Enable == true && strings.Contains(s.StreamId, Conf().StreamRec.StreamId) {
+		s.RecRtmpFn = fmt.Sprintf("%s/%s_%d_rtmp.rec", Conf().StreamRec.SavePath, s.StreamId, utils.GetTimestamp("s"))
 		s.log.Printf("RecFile:%s", s.RecRtmpFn)
 	}
 	return s, err
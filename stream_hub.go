@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"utils"
+)
+
+/*************************************************/
+/* StreamHub 进程内的流中心
+/*************************************************/
+//以前rtsp和gb28181接入的流 要通过网络推给127.0.0.1:1935, rtsp播放rtmp的流 要从127.0.0.1:1935拉
+//现在所有接入的流 都发布到StreamHub, 所有输出 都从StreamHub订阅, 数据只在内存中传递
+//1 StreamHub里是rtmp格式的*Stream, key为streamId, app只记录不参与 与cc的接口一致
+//2 rtmp推流 数据从网络接收后放入DataChan
+//3 rtsp/gb28181推流 创建内存发布者, 封装为rtmp消息后 通过HubWrite()放入DataChan
+//4 RtmpSender() 负责GopCache hls rtmp/flv播放者 转推, 有rtsp播放时 还要给RtmpMem2RtspServer()
+//  rtmp/flv/hls/转推 输出的本来就是rtmp消息, 直接用Chunk
+//  rtsp输出 用与协议无关的AvFrame, 在RtspOutSend()中转换一次, 见transformer.go
+//5 发布者是否存在 以StreamHub为准, rtmp推流 rtsp的ANNOUNCE gb28181都检查StreamHub
+//6 同一个streamId的 发布者 rtsp发布者 gb28181会话 都在一个HubStream里, 没有各协议自己的map
+//  rtsp推流的rtp直接转给rtsp播放者 不经过rtmp封装, 所以rtsp发布者单独存放, key为app_streamId
+//  gb28181会话 cc创建后 设备推流前 只有它, 按ssrc查找时 遍历StreamHub
+var HubMutex sync.Mutex //rtsp订阅 不能同时进行
+
+/*************************************************/
+/* StreamHub 流的注册表
+/*************************************************/
+//一把锁保护所有HubStream, 不能在锁内做网络操作
+//Range类函数 在锁内复制后 在锁外回调, 回调里可以增删
+type HubStream struct {
+	Puber *Stream                //发布者, rtmp推流/拉流 或 rtsp/gb28181的内存发布者
+	Rtsps map[string]*RtspStream //rtsp推流/拉流 或 Puber转rtsp, key为app_streamId, rtsp播放者在它们上面
+	Gb    *Stream                //gb28181会话
+}
+
+var (
+	StreamHub   = make(map[string]*HubStream) //key为streamId
+	HubRtspKeys = make(map[string]string)     //rtsp的app_streamId -> streamId
+	HubMapMutex sync.RWMutex
+)
+
+//调用者要持有HubMapMutex写锁
+func HubStreamGet(sid string) *HubStream {
+	h, ok := StreamHub[sid]
+	if ok == false {
+		h = &HubStream{Rtsps: make(map[string]*RtspStream)}
+		StreamHub[sid] = h
+	}
+	return h
+}
+
+//都没有了 就删除, 调用者要持有HubMapMutex写锁
+func HubStreamFree(sid string, h *HubStream) {
+	if h.Puber == nil && h.Gb == nil && len(h.Rtsps) == 0 {
+		delete(StreamHub, sid)
+	}
+}
+
+func HubPuberGet(sid string) (*Stream, bool) {
+	HubMapMutex.RLock()
+	defer HubMapMutex.RUnlock()
+	h, ok := StreamHub[sid]
+	if ok == false || h.Puber == nil {
+		return nil, false
+	}
+	return h.Puber, true
+}
+
+func HubPuberStore(s *Stream) {
+	HubMapMutex.Lock()
+	HubStreamGet(s.Key).Puber = s
+	HubMapMutex.Unlock()
+}
+
+//只删除自己, 已被新发布者替换的 不删
+func HubPuberDelete(s *Stream) {
+	HubMapMutex.Lock()
+	defer HubMapMutex.Unlock()
+	h, ok := StreamHub[s.Key]
+	if ok == true && h.Puber == s {
+		h.Puber = nil
+		HubStreamFree(s.Key, h)
+	}
+}
+
+func HubPuberRange(f func(s *Stream) bool) {
+	var ss []*Stream
+	HubMapMutex.RLock()
+	for _, h := range StreamHub {
+		if h.Puber != nil {
+			ss = append(ss, h.Puber)
+		}
+	}
+	HubMapMutex.RUnlock()
+
+	for _, s := range ss {
+		if f(s) == false {
+			return
+		}
+	}
+}
+
+func HubPuberNum() int {
+	n := 0
+	HubMapMutex.RLock()
+	for _, h := range StreamHub {
+		if h.Puber != nil {
+			n++
+		}
+	}
+	HubMapMutex.RUnlock()
+	return n
+}
+
+func HubRtspGet(key string) (*RtspStream, bool) {
+	HubMapMutex.RLock()
+	defer HubMapMutex.RUnlock()
+	h, ok := StreamHub[HubRtspKeys[key]]
+	if ok == false {
+		return nil, false
+	}
+	rs, ok := h.Rtsps[key]
+	return rs, ok
+}
+
+//rs.StreamId要先赋值
+func HubRtspStore(key string, rs *RtspStream) {
+	HubMapMutex.Lock()
+	defer HubMapMutex.Unlock()
+	HubRtspStore0(key, rs)
+}
+
+//key不存在时才存入, 返回是否存入
+func HubRtspStoreNew(key string, rs *RtspStream) bool {
+	HubMapMutex.Lock()
+	defer HubMapMutex.Unlock()
+	if h, ok := StreamHub[HubRtspKeys[key]]; ok == true {
+		if _, ok = h.Rtsps[key]; ok == true {
+			return false
+		}
+	}
+	HubRtspStore0(key, rs)
+	return true
+}
+
+//调用者要持有HubMapMutex写锁
+func HubRtspStore0(key string, rs *RtspStream) {
+	HubStreamGet(rs.StreamId).Rtsps[key] = rs
+	HubRtspKeys[key] = rs.StreamId
+}
+
+//只删除自己, 已被新发布者替换的 不删
+func HubRtspDelete(key string, rs *RtspStream) {
+	HubMapMutex.Lock()
+	defer HubMapMutex.Unlock()
+	sid := HubRtspKeys[key]
+	h, ok := StreamHub[sid]
+	if ok == false || h.Rtsps[key] != rs {
+		return
+	}
+	delete(h.Rtsps, key)
+	delete(HubRtspKeys, key)
+	HubStreamFree(sid, h)
+}
+
+func HubRtspRange(f func(key string, rs *RtspStream) bool) {
+	var keys []string
+	var rss []*RtspStream
+	HubMapMutex.RLock()
+	for _, h := range StreamHub {
+		for k, rs := range h.Rtsps {
+			keys = append(keys, k)
+			rss = append(rss, rs)
+		}
+	}
+	HubMapMutex.RUnlock()
+
+	for i := 0; i < len(rss); i++ {
+		if f(keys[i], rss[i]) == false {
+			return
+		}
+	}
+}
+
+//一个streamId的所有rtsp发布者, 返回的是复制的map
+func HubRtspsGet(sid string) map[string]*RtspStream {
+	m := make(map[string]*RtspStream)
+	HubMapMutex.RLock()
+	if h, ok := StreamHub[sid]; ok == true {
+		for k, rs := range h.Rtsps {
+			m[k] = rs
+		}
+	}
+	HubMapMutex.RUnlock()
+	return m
+}
+
+func HubGbGet(sid string) (*Stream, bool) {
+	HubMapMutex.RLock()
+	defer HubMapMutex.RUnlock()
+	h, ok := StreamHub[sid]
+	if ok == false || h.Gb == nil {
+		return nil, false
+	}
+	return h.Gb, true
+}
+
+func HubGbStore(s *Stream) {
+	HubMapMutex.Lock()
+	HubStreamGet(s.Key).Gb = s
+	HubMapMutex.Unlock()
+}
+
+//只删除自己, 已被新会话替换的 不删
+func HubGbDelete(s *Stream) {
+	HubMapMutex.Lock()
+	defer HubMapMutex.Unlock()
+	h, ok := StreamHub[s.Key]
+	if ok == true && h.Gb == s {
+		h.Gb = nil
+		HubStreamFree(s.Key, h)
+	}
+}
+
+func HubGbRange(f func(s *Stream) bool) {
+	var ss []*Stream
+	HubMapMutex.RLock()
+	for _, h := range StreamHub {
+		if h.Gb != nil {
+			ss = append(ss, h.Gb)
+		}
+	}
+	HubMapMutex.RUnlock()
+
+	for _, s := range ss {
+		if f(s) == false {
+			return
+		}
+	}
+}
+
+//设备推流上来 只有ssrc, gb28181会话不多 遍历查找
+func HubGbBySsrc(ssrc uint32) (*Stream, bool) {
+	HubMapMutex.RLock()
+	defer HubMapMutex.RUnlock()
+	for _, h := range StreamHub {
+		if h.Gb != nil && h.Gb.RtpSsrcUint == ssrc {
+			return h.Gb, true
+		}
+	}
+	return nil, false
+}
+
+//返回复制的HubStream, Rtsps也是复制的map
+func HubStreamCopy(sid string) (HubStream, bool) {
+	HubMapMutex.RLock()
+	defer HubMapMutex.RUnlock()
+	h, ok := StreamHub[sid]
+	if ok == false {
+		return HubStream{}, false
+	}
+	c := *h
+	c.Rtsps = make(map[string]*RtspStream)
+	for k, rs := range h.Rtsps {
+		c.Rtsps[k] = rs
+	}
+	return c, true
+}
+
+//所有streamId, 有发布者 rtsp发布者 gb28181会话之一的 都算
+func HubSidsGet() []string {
+	HubMapMutex.RLock()
+	sids := make([]string, 0, len(StreamHub))
+	for sid := range StreamHub {
+		sids = append(sids, sid)
+	}
+	HubMapMutex.RUnlock()
+	return sids
+}
+
+//发布者的 检查是否存在 踢掉旧的 存入新的 要一起完成, 否则同时来的两个发布者都能通过检查
+//rtmp/rtsp/gb28181的发布 都用这个锁
+var HubPubMutex sync.Mutex
+
+//发布到StreamHub, 同一个key已有发布者时 按Publish.Takeover处理
+//成功后 开启hls生产协程和RtmpSender(), 调用者把rtmp消息放入s.DataChan
+func HubPublish(s *Stream) error {
+	HubPubMutex.Lock()
+	defer HubPubMutex.Unlock()
+
+	old, ok := HubPuberGet(s.Key)
+	if ok == true { // 发布者已存在, 按配置 拒绝当前的 或 踢掉旧的发布者
+		if TakeoverCheck(old.RecvLastTime) == false {
+			err := fmt.Errorf("publisher %s is exist, takeover=%s", s.Key, TakeoverPolicy())
+			s.log.Println(err)
+			return err
+		}
+		s.log.Printf("publisher %s is exist, kick old %s", s.Key, old.RemoteAddr)
+	}
+	if Conf().HlsRec.HlsStoreUse == "Disk" {
+		s.HlsStorePath = Conf().HlsRec.DiskPath
+	} else if Conf().HlsRec.HlsStoreUse == "Mem" {
+		s.HlsStorePath = Conf().HlsRec.MemPath
+	} else {
+		s.HlsStorePath = Conf().HlsRec.MemPath
+	}
+	s.Ctx, s.Cancel = context.WithCancel(context.Background())
+	s.RecvLastTime = utils.GetTimestamp("ms")
+	s.BeginTime = s.RecvLastTime
+	s.ResumeChan = make(chan *Stream)
+	if ok == true {
+		RtmpPuberKick(old, s)
+	}
+	HubPuberStore(s)
+	ForwardStart(s)
+
+	if Conf().HlsRec.Enable == true {
+		s.Wg.Add(1)
+		go HlsCreator(s) // 开启hls生产协程
+	}
+	if Conf().HlsLive.Enable == true {
+		s.Wg.Add(1)
+		go HlsLiveCreator(s) // 开启hls生产协程
+	}
+	go RtmpSender(s) // 给所有播放者发送数据
+
+	s.TransmitSwitch = "on"
+	return nil
+}
+
+//内存发布者 没有网络连接, ptcl为接入协议 rtsp或gb28181
+//不鉴权 不加密, 同rtmp拉流代理
+func HubMemPuberNew(app, sid, ptcl string) (*Stream, error) {
+	s, err := NewStream(nil)
+	if err != nil {
+		return nil, err
+	}
+	s.Type = "MemPuber"
+	s.Key = sid
+	s.App = app
+	s.StreamId = sid
+	s.RemoteAddr = ptcl
+	s.IsPublisher = true
+	s.AmfInfo.App = app
+	s.AmfInfo.StreamId = sid
+	s.AmfInfo.PublishName = sid
+	s.PlaybackTimeout = Conf().Rtmp.PublishTimeout
+	s.DataChan = make(chan Chunk, Conf().DataStockMax)
+	s.PubAuth.Data.ResultCode = 1
+
+	fn := fmt.Sprintf("%s/%s/publish_%s_mem_%s.log", Conf().Log.StreamLogPath, sid, ptcl, utils.GetYMD())
+	StreamLogRename(s.LogFn, fn)
+	s.LogFn = fn
+	return s, nil
+}
+
+//内存发布者的rtmp消息 放入DataChan, 效果同RtmpReceiver()
+//发布者被踢掉或接收超时后返回错误, 调用者要调用HubUnpublish()
+func HubWrite(s *Stream, c Chunk) error {
+	if s.TransmitSwitch == "off" {
+		return fmt.Errorf("publisher %s is stop", s.Key)
+	}
+	if c.MsgLength == 0 {
+		return nil
+	}
+	//rtmp推流时 音视频一般用不同的csid, 播放者收到的消息要和推流一样
+	if c.Csid < 3 {
+		switch c.MsgTypeId {
+		case MsgTypeIdAudio:
+			c.Csid = 4
+		case MsgTypeIdVideo:
+			c.Csid = 6
+		default:
+			c.Csid = 5
+		}
+	}
+	c.MsgStreamId = 1
+	s.RecvLastTime = utils.GetTimestamp("ms")
+
+	if len(s.DataChan) < Conf().DataStockMax {
+		s.DataChan <- c
+	} else {
+		s.log.Printf("DataChanNum=%d(%d)", len(s.DataChan), Conf().DataStockMax)
+	}
+	return nil
+}
+
+//内存发布者停止, 只能由调用HubWrite()的协程调用
+func HubUnpublish(s *Stream) {
+	s.log.Printf("%s MemPuber stop", s.Key)
+	s.TransmitSwitch = "off"
+	RtmpPublishStop(s)
+}
+
+//rtmp消息发给发布者, 内存发布者放入DataChan, 否则通过网络推流 flush同MessageSplit()
+func PuberMsgSend(s *Stream, c *Chunk, flush bool) error {
+	if s.Type == "MemPuber" {
+		return HubWrite(s, *c)
+	}
+	return MessageSplit(s, c, flush)
+}
+
+/*************************************************/
+/* StreamHub的流 转rtsp播放
+/*************************************************/
+//rtsp播放时 StreamHub里有这个流, 就订阅它
+//RtmpSender()收到下一个消息时 开启RtmpMem2RtspServer(), 生成sdp后存入StreamHub
+func HubRtspSubscribe(sid, key string) bool {
+	s, ok := HubPuberGet(sid)
+	if ok == false {
+		return false
+	}
+
+	HubMutex.Lock()
+	if s.RtspOut == false {
+		s.RtspOutKey = key
+		s.RtspOut = true
+		s.log.Printf("rtsp subscribe %s", key)
+	}
+	HubMutex.Unlock()
+	return true
+}
+
+//没有rtsp播放时 可以取消订阅, RtmpMem2RtspServer()会退出
+//RtmpMem2RtspServer()自己退出时(如 不是h264) 也要取消订阅, 否则RtmpSender()会一直给它数据
+func HubRtspUnsubscribe(s *Stream) {
+	HubMutex.Lock()
+	s.RtspOut = false
+	HubMutex.Unlock()
+}
+
+//返回是否有rtsp订阅 和 rtsp播放的key
+func HubRtspOut(s *Stream) (bool, string) {
+	HubMutex.Lock()
+	defer HubMutex.Unlock()
+	return s.RtspOut, s.RtspOutKey
+}
+
+//只在RtmpSender()中调用, RtspOutChan只有这里创建 写入, RtspOutStop()关闭
+//每次开启RtmpMem2RtspServer() 都用新的chan, 通过参数传给它, 之后不再修改它用的chan
+//音视频消息转为AvFrame后 放入chan, metadata等其他消息 不需要
+func RtspOutSend(s *Stream, c Chunk) {
+	if s.RtspOutChan != nil {
+		select {
+		case <-s.RtspOutDone: //RtmpMem2RtspServer()已退出
+			RtspOutStop(s)
+		default:
+		}
+	}
+	on, key := HubRtspOut(s)
+	if on == false {
+		RtspOutStop(s)
+		return
+	}
+	if s.RtspOutChan == nil {
+		ch := make(chan *AvFrame, Conf().Rtmp.AvPkt2RtspChanNum)
+		done := make(chan struct{})
+		s.RtspOutChan = ch
+		s.RtspOutDone = done
+		go func() {
+			RtmpMem2RtspServer(s, key, ch)
+			close(done)
+		}()
+	}
+
+	if c.MsgTypeId != MsgTypeIdAudio && c.MsgTypeId != MsgTypeIdVideo {
+		return
+	}
+	f, err := Chunk2AvFrame(&c)
+	if err != nil {
+		s.log.Println(err)
+		return
+	}
+
+	//RtmpMem2RtspServer()退出后 chan满了就丢弃, 不会阻塞
+	n := len(s.RtspOutChan)
+	if n < Conf().Rtmp.AvPkt2RtspChanNum {
+		s.RtspOutChan <- f
+	} else {
+		s.log.Printf("RtspOutChanNum=%d(%d), DropDataType=%s", n, Conf().Rtmp.AvPkt2RtspChanNum, c.DataType)
+	}
+}
+
+//只在RtmpSender()中调用, 关闭后RtmpMem2RtspServer()读完数据退出
+func RtspOutStop(s *Stream) {
+	if s.RtspOutChan == nil {
+		return
+	}
+	close(s.RtspOutChan)
+	s.RtspOutChan = nil
+	s.RtspOutDone = nil
+}
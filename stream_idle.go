@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"time"
+	"utils"
+)
+
+/*************************************************/
+/* 按需拉流 无人观看时自动断流
+/*************************************************/
+//create_streamProxy(rtsp拉流) create_rtmpProxy(rtmp拉流) create_pullChannel(gb28181) 都是按需拉流, rtsp播放触发的rtsp订阅 也按需取消
+//rtmp/flv播放者在StreamHub的发布者上, rtsp播放者在StreamHub的rtsp发布者上
+//1 每CheckSec秒检查一次, 有播放者 或 HlsVisitMap里有hls请求 就更新最后活跃时间
+//2 最后活跃时间 超过对应的分钟数, 停止拉流(gb28181断开连接, 由cc发送BYE)
+//3 停止后 通过流状态回调上报直播结束, reason为idle
+func IdleStopTimer() {
+	if Conf().IdleStop.Enable == false {
+		return
+	}
+	sec := Conf().IdleStop.CheckSec
+	if sec <= 0 {
+		sec = 10
+	}
+	log.Printf("idle stop check every %d second", sec)
+
+	last := make(map[string]int64) //key为 类型_streamId, value为最后活跃时间(毫秒)
+	ticker := time.NewTicker(time.Duration(sec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		now := utils.GetTimestamp("ms")
+		live := make(map[string]int64)
+
+		if Conf().IdleStop.RtspPullMin > 0 {
+			HubRtspRange(func(k string, rs *RtspStream) bool {
+				if rs.Rqst == nil { //rtsp推流 不是按需拉流
+					return true
+				}
+				key := "rtsp_" + rs.StreamId
+				n := RtmpPlayerNum(rs.StreamId) + RtspPlayerNum(rs)
+				if IdleCheck(last, live, key, rs.StreamId, n, now, Conf().IdleStop.RtspPullMin) == true {
+					log.Printf("rtsp pull %s idle %d minute, stop", rs.StreamId, Conf().IdleStop.RtspPullMin)
+					StreamStopReport(rs.StreamId, "idle")
+					RtspPullStop(k, rs)
+				}
+				return true
+			})
+		}
+
+		if Conf().IdleStop.RtmpPullMin > 0 {
+			RtmpPullMap.Range(func(k, v interface{}) bool {
+				t := v.(*RtmpPullTask)
+				sid := t.Rqst.StreamId
+				key := "rtmp_" + sid
+				n := RtmpPlayerNum(sid)
+				if IdleCheck(last, live, key, sid, n, now, Conf().IdleStop.RtmpPullMin) == true {
+					log.Printf("rtmp pull %s idle %d minute, stop", sid, Conf().IdleStop.RtmpPullMin)
+					StreamStopReport(sid, "idle")
+					_ = RtmpPullDelete(sid)
+				}
+				return true
+			})
+		}
+
+		if Conf().IdleStop.Gb28181Min > 0 {
+			HubGbRange(func(s *Stream) bool {
+				key := "gb28181_" + s.Key
+				n := RtmpPlayerNum(s.Key)
+				if IdleCheck(last, live, key, s.Key, n, now, Conf().IdleStop.Gb28181Min) == true {
+					log.Printf("gb28181 %s idle %d minute, stop", s.Key, Conf().IdleStop.Gb28181Min)
+					StreamStopReport(s.Key, "idle")
+					Gb28181Stop(s)
+				}
+				return true
+			})
+		}
+
+		if Conf().IdleStop.RtspPlayMin > 0 {
+			HubPuberRange(func(s *Stream) bool {
+				on, rkey := HubRtspOut(s)
+				if on == false {
+					return true
+				}
+				key := "rtspout_" + s.Key
+				var n int
+				if rs, ok := HubRtspGet(rkey); ok == true {
+					n = RtspPlayerNum(rs)
+				}
+				//只取消rtsp订阅, 发布者还有别的播放者 不能断流
+				if IdleCheck(last, live, key, "", n, now, Conf().IdleStop.RtspPlayMin) == true {
+					log.Printf("rtsp out %s idle %d minute, stop", rkey, Conf().IdleStop.RtspPlayMin)
+					HubRtspUnsubscribe(s)
+				}
+				return true
+			})
+		}
+
+		//已经停止的流 不再记录
+		last = live
+	}
+}
+
+//返回true表示要断流, 刚开始拉流的 从第一次检查开始计时
+func IdleCheck(last, live map[string]int64, key, sid string, n int, now int64, min int) bool {
+	t, ok := last[key]
+	if ok == false || n > 0 {
+		t = now
+	}
+	v, ok := HlsVisitMap.Load(sid)
+	if ok == true && v.(int64) > t {
+		t = v.(int64)
+	}
+	if now-t >= int64(min)*60*1000 {
+		return true
+	}
+	live[key] = t
+	return false
+}
+
+//rtmp和flv的播放者个数
+func RtmpPlayerNum(sid string) int {
+	s, ok := HubPuberGet(sid)
+	if ok == false {
+		return 0
+	}
+
+	var n int
+	s.Players.Range(func(k, v interface{}) bool {
+		p := v.(*Stream)
+		if p.PlayClose == false {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+func RtspPlayerNum(rs *RtspStream) int {
+	var n int
+	rs.Players.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+//hls播放 没有连接, 请求m3u8和ts时记录时间
+func HlsVisit(sid string) {
+	HlsVisitMap.Store(sid, utils.GetTimestamp("ms"))
+}
+
+//上报流状态为直播结束, key为StreamHub的key, 发布者还在时 带上它的宽高编码等信息
+//reason为idle(无人观看) 或 kick(被api踢掉)
+func StreamStopReport(key, reason string) {
+	HlsVisitMap.Delete(key)
+	s, ok := HubPuberGet(key)
+	if ok == false {
+		log.Printf("publisher %s is not exist, no report", key)
+		return
+	}
+	go StreamStateReport(s, 2, reason)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"utils"
+)
+
+/*************************************************/
+/* 流列表和详情 rtmp/rtsp/gb28181通用
+/*************************************************/
+//一个streamId的都在StreamHub的同一个HubStream里
+//1 Puber: 所有在推的流, 码率 帧率 编码 rtmp/flv播放者都在这里
+//2 Rtsps: rtsp推流 和 转rtsp播放的流, rtsp播放者在这里, key为app_streamId
+//3 Gb: gb28181的流, 还没收到rtp的 只有它
+//字节数: 接收的按rtmp消息长度算, 发送的按写给播放者的长度算, 同metrics.go
+type StreamInfo struct {
+	App         string       `json:"app"`
+	StreamId    string       `json:"streamId"`
+	Protocol    string       `json:"protocol"` //rtmp rtsp gb28181
+	Type        string       `json:"type"`     //rtmpPublisher RtmpPullProxy MemPuber等
+	RemoteAddr  string       `json:"remoteAddr"`
+	VideoCodec  string       `json:"videoCodec"`
+	AudioCodec  string       `json:"audioCodec"`
+	Width       int          `json:"width"`
+	Height      int          `json:"height"`
+	VideoFps    uint32       `json:"videoFps"`
+	AudioFps    uint32       `json:"audioFps"`
+	GopBitrate  uint32       `json:"gopBitrate"` //kbps
+	StartTime   int64        `json:"startTime"`  //毫秒, 0表示还没有开始推流
+	Uptime      int64        `json:"uptime"`     //秒
+	BytesIn     uint64       `json:"bytesIn"`
+	BytesOut    uint64       `json:"bytesOut"`
+	PlayerNum   int          `json:"playerNum"`   //rtmp flv rtsp播放者
+	HlsSessions int          `json:"hlsSessions"` //活跃的hls会话
+	Players     []PlayerInfo `json:"players,omitempty"`
+}
+
+type PlayerInfo struct {
+	Protocol      string `json:"protocol"` //rtmp flv rtsp
+	RemoteAddr    string `json:"remoteAddr"`
+	StartTime     int64  `json:"startTime"` //毫秒
+	BytesSent     uint64 `json:"bytesSent"`
+	DroppedFrames uint32 `json:"droppedFrames"` //拥塞丢弃的音视频帧, 见play_congest.go
+}
+
+//播放者发送数据后调用, 同时累加到当前的发布者
+func PlayerOutBytesAdd(p *Stream, n int) {
+	atomic.AddUint64(&p.OutBytes, uint64(n))
+	if pub := p.Puber; pub != nil {
+		atomic.AddUint64(&pub.OutBytes, uint64(n))
+	}
+}
+
+func RtspOutBytesAdd(rs, player *RtspStream, n int) {
+	atomic.AddUint64(&player.OutBytes, uint64(n))
+	atomic.AddUint64(&rs.OutBytes, uint64(n))
+}
+
+//所有流的streamId
+func StreamIdsGet() []string {
+	sids := HubSidsGet()
+	sort.Strings(sids)
+	return sids
+}
+
+//app和ptcl为空的不过滤, hls会话 按streamId分好 只遍历一次
+func StreamInfoList(app, ptcl string) []StreamInfo {
+	sis := make([]StreamInfo, 0)
+	hls := HlsSessionNums()
+	for _, sid := range StreamIdsGet() {
+		si, ok := StreamInfoMake(sid, false, hls)
+		if ok == false {
+			continue
+		}
+		if (app != "" && si.App != app) || (ptcl != "" && si.Protocol != ptcl) {
+			continue
+		}
+		sis = append(sis, si)
+	}
+	return sis
+}
+
+//detail为true时 返回播放者列表
+func StreamInfoGet(sid string, detail bool) (StreamInfo, bool) {
+	return StreamInfoMake(sid, detail, HlsSessionNums())
+}
+
+func StreamInfoMake(sid string, detail bool, hls map[string]int) (StreamInfo, bool) {
+	var si StreamInfo
+	var rp *RtspStream //rtsp推流的发布者
+	h, ok := HubStreamCopy(sid)
+	if ok == false {
+		return si, false
+	}
+	hs, gs := h.Puber, h.Gb
+	for k, rs := range h.Rtsps {
+		if rs.IsPuber == true {
+			rp = rs
+		}
+		if si.App == "" {
+			si.App = strings.TrimSuffix(k, "_"+sid)
+		}
+	}
+	si.StreamId = sid
+
+	switch {
+	case hs != nil:
+		si.App = hs.App
+		if si.App == "" {
+			si.App = hs.AmfInfo.App
+		}
+		si.Protocol = MetricsPuberPtcl(hs)
+		si.Type = hs.Type
+		si.RemoteAddr = hs.RemoteAddr
+		StreamInfoMedia(&si, hs)
+		si.StartTime = hs.BeginTime
+		si.BytesIn = atomic.LoadUint64(&hs.InBytes)
+		si.BytesOut = atomic.LoadUint64(&hs.OutBytes)
+	case rp != nil:
+		si.Protocol = "rtsp"
+		si.Type = "rtspPublisher"
+		si.Width, si.Height = rp.Width, rp.Height
+		si.StartTime = rp.BeginTime
+	case gs != nil:
+		si.Protocol = "gb28181"
+	default:
+		si.Protocol = "rtsp"
+	}
+	//内存发布者的RemoteAddr是协议名, 用原始连接的地址
+	if rp != nil {
+		si.RemoteAddr = rp.RAddr
+	}
+	if gs != nil {
+		if si.App == "" {
+			si.App = gs.GbRqst.App
+		}
+		si.RemoteAddr = gs.RemoteAddr
+		if hs == nil {
+			si.Type = gs.Type
+			StreamInfoMedia(&si, gs)
+		}
+	}
+	if si.StartTime > 0 {
+		si.Uptime = (utils.GetTimestamp("ms") - si.StartTime) / 1000
+	}
+
+	if hs != nil {
+		hs.Players.Range(func(k, v interface{}) bool {
+			p := v.(*Stream)
+			si.PlayerNum++
+			if detail == true {
+				pi := PlayerInfo{Protocol: MetricsPlayerPtcl(p), RemoteAddr: p.RemoteAddr, StartTime: p.BeginTime}
+				pi.BytesSent = atomic.LoadUint64(&p.OutBytes)
+				ds := PlayDropGet(p)
+				pi.DroppedFrames = ds.VideoNum + ds.AudioNum + ds.NonRefNum
+				si.Players = append(si.Players, pi)
+			}
+			return true
+		})
+	}
+	for _, rs := range h.Rtsps {
+		si.BytesOut += atomic.LoadUint64(&rs.OutBytes)
+		rs.Players.Range(func(k, v interface{}) bool {
+			p := v.(*RtspStream)
+			si.PlayerNum++
+			if detail == true {
+				pi := PlayerInfo{Protocol: "rtsp", RemoteAddr: p.RAddr, StartTime: p.BeginTime}
+				pi.BytesSent = atomic.LoadUint64(&p.OutBytes)
+				si.Players = append(si.Players, pi)
+			}
+			return true
+		})
+	}
+	si.HlsSessions = hls[sid]
+	return si, true
+}
+
+func StreamInfoMedia(si *StreamInfo, s *Stream) {
+	si.VideoCodec = s.VideoCodecType
+	si.AudioCodec = s.AudioCodecType
+	si.Width, si.Height = s.Width, s.Height
+	si.VideoFps, si.AudioFps = s.VideoFps, s.AudioFps
+	si.GopBitrate = s.GopBitrate
+}
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"fmt"
+)
+
 //Type    string
 //"Metadata", "VideoHeader", "AudioHeader",
 //"VideoKeyFrame", "VideoInterFrame"
@@ -12,6 +16,782 @@ type AvPacket struct {
 	Data      []byte
 }
 
-//帧结构体, 存储未压缩(编码)数据, 视频YUV 音频PCM
+/*************************************************/
+/* AvFrame 与协议无关的音视频帧
+/*************************************************/
+//rtmp接入是Chunk, rtsp接入是RtpPacket, gb28181接入是PsPacket
+//都转为AvFrame后, 新的输出(封装)只需要按AvFrame写一次, 不用每个接入协议写一遍
+//1 时间戳统一为毫秒, 和rtmp一致, rtp的90000Hz等 转换后再赋值
+//2 视频的nalu不带开始码和长度, Nalus里的切片 尽量引用原始数据 不拷贝
+//3 参数集(vps/sps/pps 或 aac的AudioSpecificConfig)单独存放, IsHeader表示这帧只有参数集
+type AvCodecId uint8
+
+const (
+	AvCodecIdUnknown AvCodecId = 0
+	AvCodecIdH264    AvCodecId = 1
+	AvCodecIdH265    AvCodecId = 2
+	AvCodecIdAv1     AvCodecId = 3
+	AvCodecIdVp9     AvCodecId = 4
+	AvCodecIdAac     AvCodecId = 10
+	AvCodecIdG711a   AvCodecId = 11
+	AvCodecIdG711u   AvCodecId = 12
+	AvCodecIdMp3     AvCodecId = 13
+	AvCodecIdSpeex   AvCodecId = 14
+)
+
+type AvTrack uint8
+
+const (
+	AvTrackVideo AvTrack = 0
+	AvTrackAudio AvTrack = 1
+)
+
 type AvFrame struct {
+	CodecId  AvCodecId
+	Track    AvTrack
+	Pts      uint32 //毫秒
+	Dts      uint32 //毫秒, 没有b帧时 和Pts相同
+	IsKey    bool   //视频关键帧, 音频帧都为true
+	IsHeader bool   //只有参数集, 没有音视频数据
+	Vps      []byte //h265才有
+	Sps      []byte
+	Pps      []byte
+	Asc      []byte   //aac的AudioSpecificConfig
+	Nalus    [][]byte //h264/h265, 不带开始码和长度
+	Data     []byte   //音频数据(aac不带adts) 或 av1/vp9的视频数据
+}
+
+//VideoCodecType/AudioCodecType/sdp中的编码名称 转为AvCodecId
+func AvCodecIdParse(name string) AvCodecId {
+	switch name {
+	case "H264", "h264":
+		return AvCodecIdH264
+	case "H265", "h265", "HEVC", "hvc1":
+		return AvCodecIdH265
+	case "AV1", "av01":
+		return AvCodecIdAv1
+	case "VP9", "vp09":
+		return AvCodecIdVp9
+	case "AAC", "mpeg4-generic", "MPEG4-GENERIC":
+		return AvCodecIdAac
+	case "G711a", "PCMA":
+		return AvCodecIdG711a
+	case "G711u", "PCMU":
+		return AvCodecIdG711u
+	case "MP3", "MPA":
+		return AvCodecIdMp3
+	case "Speex", "speex":
+		return AvCodecIdSpeex
+	}
+	return AvCodecIdUnknown
+}
+
+func (id AvCodecId) String() string {
+	switch id {
+	case AvCodecIdH264:
+		return "H264"
+	case AvCodecIdH265:
+		return "H265"
+	case AvCodecIdAv1:
+		return "AV1"
+	case AvCodecIdVp9:
+		return "VP9"
+	case AvCodecIdAac:
+		return "AAC"
+	case AvCodecIdG711a:
+		return "G711a"
+	case AvCodecIdG711u:
+		return "G711u"
+	case AvCodecIdMp3:
+		return "MP3"
+	case AvCodecIdSpeex:
+		return "Speex"
+	}
+	return "unknow"
+}
+
+func AvCodecIsVideo(id AvCodecId) bool {
+	return id >= AvCodecIdH264 && id <= AvCodecIdVp9
+}
+
+//nalu是否为关键帧(h264的idr, h265的irap)
+func NaluIsKey(id AvCodecId, nalu []byte) bool {
+	if len(nalu) == 0 {
+		return false
+	}
+	switch id {
+	case AvCodecIdH264:
+		return nalu[0]&0x1f == 5
+	case AvCodecIdH265:
+		t := (nalu[0] >> 1) & 0x3f
+		return t >= 16 && t <= 21
+	}
+	return false
+}
+
+//nalu是参数集的 存入Vps/Sps/Pps, 否则加入Nalus, 返回值表示是否为参数集
+func AvFrameNaluAdd(f *AvFrame, nalu []byte) bool {
+	if len(nalu) == 0 {
+		return false
+	}
+	switch f.CodecId {
+	case AvCodecIdH264:
+		switch nalu[0] & 0x1f {
+		case 7:
+			f.Sps = nalu
+			return true
+		case 8:
+			f.Pps = nalu
+			return true
+		}
+	case AvCodecIdH265:
+		switch (nalu[0] >> 1) & 0x3f {
+		case 32:
+			f.Vps = nalu
+			return true
+		case 33:
+			f.Sps = nalu
+			return true
+		case 34:
+			f.Pps = nalu
+			return true
+		}
+	}
+	if NaluIsKey(f.CodecId, nalu) == true {
+		f.IsKey = true
+	}
+	f.Nalus = append(f.Nalus, nalu)
+	return false
+}
+
+/*************************************************/
+/* Chunk 转 AvFrame
+/*************************************************/
+//c是rtmp的音视频消息, metadata等其他消息 返回错误
+//传统格式 和 Enhanced RTMP格式 都支持, NaluLen按4字节处理
+func Chunk2AvFrame(c *Chunk) (*AvFrame, error) {
+	var err error
+	switch c.MsgTypeId {
+	case MsgTypeIdVideo:
+		return ChunkVideo2AvFrame(c)
+	case MsgTypeIdAudio:
+		return ChunkAudio2AvFrame(c)
+	}
+	err = fmt.Errorf("MsgTypeId=%d is not audio or video", c.MsgTypeId)
+	return nil, err
+}
+
+func ChunkVideo2AvFrame(c *Chunk) (*AvFrame, error) {
+	var err error
+	d := c.MsgData
+	if len(d) < 5 {
+		err = fmt.Errorf("video body no enough data, len=%d", len(d))
+		return nil, err
+	}
+
+	f := &AvFrame{Track: AvTrackVideo, Dts: c.Timestamp, Pts: c.Timestamp}
+	var ft, pt uint8
+	var cts uint32
+	var n int
+	if d[0]&0x80 != 0 { //Enhanced RTMP
+		h, err := ExVideoTagHeaderParse(d)
+		if err != nil {
+			return nil, err
+		}
+		f.CodecId = AvCodecIdParse(h.FourCC)
+		ft = h.FrameType
+		cts = h.CompositionTime
+		n = h.HeaderLen
+		switch h.PacketType {
+		case ExPacketTypeSequenceStart:
+			pt = 0
+		case ExPacketTypeCodedFrames, ExPacketTypeCodedFramesX:
+			pt = 1
+		default:
+			err = fmt.Errorf("untreated ExVideo PacketType %d", h.PacketType)
+			return nil, err
+		}
+	} else {
+		ft = d[0] >> 4
+		switch d[0] & 0xf {
+		case 7:
+			f.CodecId = AvCodecIdH264
+		case 12:
+			f.CodecId = AvCodecIdH265
+		}
+		pt = d[1]
+		cts = ByteToUint32(d[2:5], BE)
+		n = 5
+	}
+	if f.CodecId == AvCodecIdUnknown {
+		err = fmt.Errorf("untreated video codec, data:%x", d[:5])
+		return nil, err
+	}
+	f.IsKey = ft == 1
+	//CompositionTime是有符号的24bit, 高位扩展符号后再加, 负数时Pts小于Dts
+	f.Pts = uint32(int64(c.Timestamp) + int64(int32(cts<<8)>>8))
+
+	switch {
+	case pt == 0:
+		f.IsHeader = true
+		err = AvFrameConfigParse(f, d[n:])
+	case pt != 1:
+		err = fmt.Errorf("untreated AVCPacketType %d", pt)
+	case f.CodecId == AvCodecIdAv1 || f.CodecId == AvCodecIdVp9:
+		f.Data = d[n:]
+	default:
+		err = AvccSplit(f, d[n:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//AVCDecoderConfigurationRecord 或 HEVCDecoderConfigurationRecord 中取出参数集
+//av1/vp9的配置原样放在Data里
+func AvFrameConfigParse(f *AvFrame, d []byte) error {
+	var err error
+	switch f.CodecId {
+	case AvCodecIdH264:
+		//version(8) profile(8) compat(8) level(8) 0xfc|lenSize(8) 0xe0|spsNum(8)
+		if len(d) < 6 {
+			err = fmt.Errorf("AVC sequence header no enough data, len=%d", len(d))
+			return err
+		}
+		n := 5
+		sn := int(d[n] & 0x1f)
+		n++
+		for i := 0; i < sn; i++ {
+			if n+2 > len(d) {
+				return fmt.Errorf("AVC sequence header sps error")
+			}
+			l := int(ByteToUint16(d[n:n+2], BE))
+			n += 2
+			if n+l > len(d) {
+				return fmt.Errorf("AVC sequence header sps error")
+			}
+			if f.Sps == nil {
+				f.Sps = d[n : n+l]
+			}
+			n += l
+		}
+		if n >= len(d) {
+			return fmt.Errorf("AVC sequence header no pps")
+		}
+		pn := int(d[n])
+		n++
+		for i := 0; i < pn; i++ {
+			if n+2 > len(d) {
+				return fmt.Errorf("AVC sequence header pps error")
+			}
+			l := int(ByteToUint16(d[n:n+2], BE))
+			n += 2
+			if n+l > len(d) {
+				return fmt.Errorf("AVC sequence header pps error")
+			}
+			if f.Pps == nil {
+				f.Pps = d[n : n+l]
+			}
+			n += l
+		}
+	case AvCodecIdH265:
+		//前22字节是profile等信息, 第23字节是NumOfArrays
+		if len(d) < 23 {
+			err = fmt.Errorf("HEVC sequence header no enough data, len=%d", len(d))
+			return err
+		}
+		n := 22
+		an := int(d[n])
+		n++
+		for i := 0; i < an; i++ {
+			if n+3 > len(d) {
+				return fmt.Errorf("HEVC sequence header array error")
+			}
+			nn := int(ByteToUint16(d[n+1:n+3], BE))
+			n += 3
+			for j := 0; j < nn; j++ {
+				if n+2 > len(d) {
+					return fmt.Errorf("HEVC sequence header nalu error")
+				}
+				l := int(ByteToUint16(d[n:n+2], BE))
+				n += 2
+				if n+l > len(d) {
+					return fmt.Errorf("HEVC sequence header nalu error")
+				}
+				nalu := d[n : n+l]
+				n += l
+				if l == 0 {
+					continue
+				}
+				//同类型的只取第一个
+				t := (nalu[0] >> 1) & 0x3f
+				if (t == 32 && f.Vps != nil) || (t == 33 && f.Sps != nil) || (t == 34 && f.Pps != nil) {
+					continue
+				}
+				AvFrameNaluAdd(f, nalu)
+			}
+		}
+		//sei等 不属于参数集
+		f.Nalus = nil
+	default:
+		f.Data = d
+	}
+	return nil
+}
+
+//NaluLen(4字节) + NaluData, 切片引用原始数据
+func AvccSplit(f *AvFrame, d []byte) error {
+	n := 0
+	l := len(d)
+	for n+4 <= l {
+		nl := int(ByteToUint32(d[n:n+4], BE))
+		n += 4
+		if nl > l-n {
+			err := fmt.Errorf("avcc nalu len %d > remain %d", nl, l-n)
+			return err
+		}
+		AvFrameNaluAdd(f, d[n:n+nl])
+		n += nl
+	}
+	return nil
+}
+
+func ChunkAudio2AvFrame(c *Chunk) (*AvFrame, error) {
+	var err error
+	d := c.MsgData
+	if len(d) < 2 {
+		err = fmt.Errorf("audio body has no data")
+		return nil, err
+	}
+
+	f := &AvFrame{Track: AvTrackAudio, Dts: c.Timestamp, Pts: c.Timestamp, IsKey: true}
+	switch d[0] >> 4 {
+	case 10:
+		f.CodecId = AvCodecIdAac
+		//0: AAC sequence header, 1: AAC raw
+		if d[1] == 0 {
+			f.IsHeader = true
+			f.Asc = d[2:]
+		} else {
+			f.Data = d[2:]
+		}
+		return f, nil
+	case 2, 14:
+		f.CodecId = AvCodecIdMp3
+	case 7:
+		f.CodecId = AvCodecIdG711a
+	case 8:
+		f.CodecId = AvCodecIdG711u
+	case 11:
+		f.CodecId = AvCodecIdSpeex
+	default:
+		err = fmt.Errorf("untreated SoundFormat %d", d[0]>>4)
+		return nil, err
+	}
+	f.Data = d[1:]
+	return f, nil
+}
+
+/*************************************************/
+/* RtpPacket 转 AvFrame
+/*************************************************/
+//rps是时间戳相同的一组rtp包(一帧视频 或 一个rtp包的音频), 按SeqNum排好序
+//clock是rtp时钟频率, 视频一般为90000, 音频为采样率, 来自sdp
+//一个rtp包可能有多个aac帧, 所以返回多个AvFrame
+//单个nalu和STAP-A 引用原始数据, FU-A要拼接 只能拷贝
+func Rtps2AvFrames(id AvCodecId, clock uint32, rps []*RtpPacket) ([]*AvFrame, error) {
+	var err error
+	if len(rps) == 0 {
+		err = fmt.Errorf("rtp packet num is 0")
+		return nil, err
+	}
+	if clock == 0 {
+		err = fmt.Errorf("rtp clock rate is 0")
+		return nil, err
+	}
+
+	ts := uint32(uint64(rps[0].Timestamp) * 1000 / uint64(clock))
+	switch id {
+	case AvCodecIdH264, AvCodecIdH265:
+		f := &AvFrame{CodecId: id, Track: AvTrackVideo, Dts: ts, Pts: ts}
+		var fu []byte
+		for _, rp := range rps {
+			fu, err = RtpVideoDepack(f, RtpPayload(rp), fu)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(f.Nalus) == 0 && (f.Sps != nil || f.Pps != nil) {
+			f.IsHeader = true
+		}
+		return []*AvFrame{f}, nil
+	case AvCodecIdAac:
+		var fs []*AvFrame
+		for _, rp := range rps {
+			rts := rp.Timestamp
+			aus, err := RtpAacDepack(RtpPayload(rp))
+			if err != nil {
+				return nil, err
+			}
+			for i, au := range aus {
+				//每个aac帧 1024个采样点
+				t := uint32(uint64(rts+uint32(i)*1024) * 1000 / uint64(clock))
+				fs = append(fs, &AvFrame{CodecId: id, Track: AvTrackAudio, Dts: t, Pts: t, IsKey: true, Data: au})
+			}
+		}
+		return fs, nil
+	case AvCodecIdG711a, AvCodecIdG711u, AvCodecIdMp3, AvCodecIdSpeex:
+		var fs []*AvFrame
+		for _, rp := range rps {
+			t := uint32(uint64(rp.Timestamp) * 1000 / uint64(clock))
+			d := RtpPayload(rp)
+			if id == AvCodecIdMp3 && len(d) > 4 {
+				//rfc2250, mpeg音频前有4字节的MBZ和FragOffset
+				d = d[4:]
+			}
+			fs = append(fs, &AvFrame{CodecId: id, Track: AvTrackAudio, Dts: t, Pts: t, IsKey: true, Data: d})
+		}
+		return fs, nil
+	}
+	err = fmt.Errorf("untreated rtp codec %s", id)
+	return nil, err
+}
+
+//去掉rtp头(含csrc和扩展头)和padding, 返回负载
+func RtpPayload(rp *RtpPacket) []byte {
+	d := rp.Data
+	if rp.Len > 0 && int(rp.Len) <= len(d) {
+		d = d[:rp.Len]
+	}
+	n := 12 + 4*int(rp.CsrcCount)
+	if rp.Extension == 1 && n+4 <= len(d) {
+		n += 4 + 4*int(ByteToUint16(d[n+2:n+4], BE))
+	}
+	e := len(d)
+	if rp.Padding == 1 && e > 0 {
+		e -= int(d[e-1])
+	}
+	if n > e {
+		return nil
+	}
+	return d[n:e]
+}
+
+//h264: rfc6184, 单个nalu(1-23) STAP-A(24) FU-A(28)
+//h265: rfc7798, 单个nalu(0-47) AP(48) FU(49)
+//fu是正在拼接的分片nalu, 返回给下一个rtp包继续拼接
+func RtpVideoDepack(f *AvFrame, d []byte, fu []byte) ([]byte, error) {
+	var err error
+	if len(d) < 2 {
+		return fu, nil
+	}
+
+	hl := 1 //nalu头长度
+	var t uint8
+	var stap, fua uint8
+	if f.CodecId == AvCodecIdH264 {
+		t = d[0] & 0x1f
+		stap, fua = 24, 28
+	} else {
+		t = (d[0] >> 1) & 0x3f
+		stap, fua = 48, 49
+		hl = 2
+	}
+
+	switch {
+	case t == stap:
+		n := hl
+		for n+2 <= len(d) {
+			l := int(ByteToUint16(d[n:n+2], BE))
+			n += 2
+			if l > len(d)-n {
+				err = fmt.Errorf("rtp aggregation nalu len %d error", l)
+				return nil, err
+			}
+			AvFrameNaluAdd(f, d[n:n+l])
+			n += l
+		}
+	case t == fua:
+		if len(d) < hl+2 {
+			return fu, nil
+		}
+		fh := d[hl] //FuHeader: S(1bit) E(1bit) R(1bit) Type
+		if fh&0x80 != 0 {
+			//还原nalu头
+			if f.CodecId == AvCodecIdH264 {
+				fu = []byte{d[0]&0xe0 | fh&0x1f}
+			} else {
+				fu = []byte{d[0]&0x81 | (fh&0x3f)<<1, d[1]}
+			}
+		}
+		if fu == nil { //没有收到开始分片
+			return nil, nil
+		}
+		fu = append(fu, d[hl+1:]...)
+		if fh&0x40 != 0 {
+			AvFrameNaluAdd(f, fu)
+			fu = nil
+		}
+	case f.CodecId == AvCodecIdH264 && t > 23:
+		err = fmt.Errorf("untreated h264 rtp nalu type %d", t)
+	case f.CodecId == AvCodecIdH265 && t > 47:
+		err = fmt.Errorf("untreated h265 rtp nalu type %d", t)
+	default:
+		AvFrameNaluAdd(f, d)
+	}
+	return fu, err
+}
+
+//rtp包是否为关键帧的开始, 参数集在关键帧前面 也算开始
+//关键帧有多个slice时 每个slice的第一个包都返回true, 调用者按时间戳区分
+func RtpIsKeyStart(id AvCodecId, d []byte) bool {
+	if len(d) < 3 {
+		return false
+	}
+	switch id {
+	case AvCodecIdH264:
+		t := d[0] & 0x1f
+		switch t {
+		case 24: //STAP-A, 看第一个nalu
+			if len(d) < 4 {
+				return false
+			}
+			t = d[3] & 0x1f
+		case 28: //FU-A, 看开始分片
+			if d[1]&0x80 == 0 {
+				return false
+			}
+			t = d[1] & 0x1f
+		}
+		return t == 5 || t == 7
+	case AvCodecIdH265:
+		t := (d[0] >> 1) & 0x3f
+		switch t {
+		case 48: //AP, 看第一个nalu
+			if len(d) < 5 {
+				return false
+			}
+			t = (d[4] >> 1) & 0x3f
+		case 49: //FU, 看开始分片
+			if d[2]&0x80 == 0 {
+				return false
+			}
+			t = d[2] & 0x3f
+		}
+		return (t >= 16 && t <= 21) || t == 32 || t == 33
+	}
+	return false
+}
+
+//rfc3640, AuHeadersLength(16bit) + AuHeader(16bit)*n + AuData*n
+//AuHeader是 AuSize(13bit) + AuIndex(3bit)
+func RtpAacDepack(d []byte) ([][]byte, error) {
+	var err error
+	if len(d) < 2 {
+		err = fmt.Errorf("rtp aac no enough data")
+		return nil, err
+	}
+	hl := int(ByteToUint16(d[0:2], BE))
+	if hl%16 != 0 || 2+hl/8 > len(d) {
+		err = fmt.Errorf("RtpAac AuHeaderLen=%d error", hl)
+		return nil, err
+	}
+
+	n := 2 + hl/8
+	var aus [][]byte
+	for i := 0; i < hl/16; i++ {
+		l := int(ByteToUint16(d[2+2*i:4+2*i], BE) >> 3)
+		if l > len(d)-n {
+			err = fmt.Errorf("RtpAac AuSize=%d error", l)
+			return nil, err
+		}
+		aus = append(aus, d[n:n+l])
+		n += l
+	}
+	return aus, nil
+}
+
+/*************************************************/
+/* PsPacket 转 AvFrame
+/*************************************************/
+//p是ParsePs()分离出的音频或视频, 已去掉pes头
+//视频是annexB格式, 按开始码拆分nalu, 切片引用原始数据
+//音频是aac时 带有adts头, 要去掉
+func PsPkt2AvFrame(id AvCodecId, p *PsPacket) (*AvFrame, error) {
+	var err error
+	//ps的时间戳是90000Hz
+	ts := p.Timestamp / 90
+	f := &AvFrame{CodecId: id, Dts: ts, Pts: ts}
+
+	switch p.Type {
+	case "video":
+		f.Track = AvTrackVideo
+		if id != AvCodecIdH264 && id != AvCodecIdH265 {
+			err = fmt.Errorf("untreated ps video codec %s", id)
+			return nil, err
+		}
+		nis, err := FindAnnexbStartCode(p.Data, id.String())
+		if err != nil {
+			return nil, err
+		}
+		for _, ni := range nis {
+			AvFrameNaluAdd(f, ni.Data)
+		}
+		if len(f.Nalus) == 0 && (f.Sps != nil || f.Pps != nil) {
+			f.IsHeader = true
+		}
+	case "audio":
+		f.Track = AvTrackAudio
+		f.IsKey = true
+		f.Data = p.Data
+		//adts头 7字节, protection_absent=0时 还有2字节crc
+		if id == AvCodecIdAac && len(p.Data) > 7 && p.Data[0] == 0xff && p.Data[1]&0xf0 == 0xf0 {
+			hl := 7
+			if p.Data[1]&0x1 == 0 {
+				hl = 9
+			}
+			f.Data = p.Data[hl:]
+		}
+	default:
+		err = fmt.Errorf("undefined ps packet type %s", p.Type)
+		return nil, err
+	}
+	return f, nil
+}
+
+/*************************************************/
+/* AvFrame 转 RtpPacket
+/*************************************************/
+//StreamHub的流转rtsp时用, pt和时钟 同CreateSdpUseSpsPps()生成的sdp
+//1 视频只有h264, nalu不超过RtpPayloadMax的 单个nalu打包, 否则FU-A分片, 帧的最后一个包Marker为1
+//2 参数集帧 用STAP-A打包sps和pps, 码流中途换参数集时 播放者也能收到
+//3 aac按rfc3640 每个包一个AuHeader, g711不带头, mp3按rfc2250 负载前有4字节头
+const RtpPayloadMax = 1400
+
+func AvFrame2Rtps(s *RtspStream, f *AvFrame) ([]*RtpPacket, error) {
+	var err error
+	if f.Track == AvTrackAudio {
+		rp, err := AvFrame2RtpAudio(s, f)
+		if err != nil {
+			return nil, err
+		}
+		return []*RtpPacket{rp}, nil
+	}
+	if f.CodecId != AvCodecIdH264 {
+		err = fmt.Errorf("rtsp out untreated video codec %s", f.CodecId)
+		return nil, err
+	}
+
+	ts := f.Pts * 90
+	if f.IsHeader == true {
+		if f.Sps == nil || f.Pps == nil {
+			err = fmt.Errorf("video header no sps or pps")
+			return nil, err
+		}
+		rp, err := RtpStapaPktCreate(s, f.Sps, f.Pps, ts)
+		if err != nil {
+			return nil, err
+		}
+		return []*RtpPacket{rp}, nil
+	}
+
+	var rps []*RtpPacket
+	for _, nalu := range f.Nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		if len(nalu) <= RtpPayloadMax {
+			rps = append(rps, RtpPktMake(s, 96, ts, nil, nalu))
+			continue
+		}
+		//FuIndicator: F NRI 和 Type=28, FuHeader: S E R 和 nalu的Type
+		fui := nalu[0]&0xe0 | 28
+		d := nalu[1:]
+		for i := 0; i < len(d); i += RtpPayloadMax {
+			fuh := nalu[0] & 0x1f
+			if i == 0 {
+				fuh |= 0x80
+			}
+			e := i + RtpPayloadMax
+			if e >= len(d) {
+				e = len(d)
+				fuh |= 0x40
+			}
+			rps = append(rps, RtpPktMake(s, 96, ts, []byte{fui, fuh}, d[i:e]))
+		}
+	}
+	if len(rps) == 0 {
+		err = fmt.Errorf("video frame has no nalu")
+		return nil, err
+	}
+	rp := rps[len(rps)-1]
+	rp.Marker = 1
+	rp.Data[1] |= 0x80
+	return rps, nil
+}
+
+func AvFrame2RtpAudio(s *RtspStream, f *AvFrame) (*RtpPacket, error) {
+	var err error
+	if f.IsHeader == true || len(f.Data) == 0 {
+		err = fmt.Errorf("audio frame has no data")
+		return nil, err
+	}
+	//毫秒转为sdp中的音频时钟
+	ts := uint32(uint64(f.Pts) * uint64(s.Sdp.AudioClockRate) / 1000)
+
+	var pt uint8
+	var h []byte
+	switch f.CodecId {
+	case AvCodecIdAac:
+		//AuHeadersLength=16, AuHeader为 AuSize(13bit) + AuIndex(3bit)
+		pt = 97
+		h = make([]byte, 4)
+		Uint16ToByte(16, h[0:2], BE)
+		Uint16ToByte(uint16(len(f.Data)<<3), h[2:4], BE)
+	case AvCodecIdG711a:
+		pt = 8
+	case AvCodecIdG711u:
+		pt = 0
+	case AvCodecIdMp3:
+		//MBZ(16bit) + Frag_offset(16bit) 全为0
+		pt = 14
+		h = make([]byte, 4)
+	default:
+		err = fmt.Errorf("rtsp out untreated audio codec %s", f.CodecId)
+		return nil, err
+	}
+	rp := RtpPktMake(s, pt, ts, h, f.Data)
+	rp.Marker = 1
+	rp.Data[1] |= 0x80
+	return rp, nil
+}
+
+//h是负载前的头(FU-A的2字节 aac的AuHeader等), 可以为nil
+func RtpPktMake(s *RtspStream, pt uint8, ts uint32, h, d []byte) *RtpPacket {
+	rp := &RtpPacket{}
+	rp.Version = 2
+	rp.PayloadType = pt
+	rp.Timestamp = ts
+	rp.Ssrc = 999999999
+	if pt == 96 {
+		rp.PtStr = "Video"
+		rp.SeqNum = s.VideoRtpPkgs.SendSeq
+		s.VideoRtpPkgs.SendSeq += 1
+	} else {
+		rp.PtStr = "Audio"
+		rp.SeqNum = s.AudioRtpPkgs.SendSeq
+		s.AudioRtpPkgs.SendSeq += 1
+	}
+
+	rp.Len = uint16(12 + len(h) + len(d))
+	rp.Data = make([]byte, rp.Len)
+	rp.Data[0] = (rp.Version & 0x3) << 6
+	rp.Data[1] = (rp.Marker&0x1)<<7 | (rp.PayloadType & 0x7f)
+	Uint16ToByte(rp.SeqNum, rp.Data[2:4], BE)
+	Uint32ToByte(rp.Timestamp, rp.Data[4:8], BE)
+	Uint32ToByte(rp.Ssrc, rp.Data[8:12], BE)
+	copy(rp.Data[12:], h)
+	copy(rp.Data[12+len(h):], d)
+	return rp
 }
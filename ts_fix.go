@@ -0,0 +1,279 @@
+package main
+
+import (
+	"sync"
+	"utils"
+)
+
+/*************************************************/
+/* TsFix 音视频时间戳修正
+/*************************************************/
+//rtmp/rtsp/gb28181接入的流 都经过RtmpSender(), 在这里按音频和视频分别修正时间戳
+//rtsp接入的rtp包 直接转给rtsp播放者 不经过RtmpSender(), 在RtspRtpHandler()中用RtpTsFix()修正
+//1 单调递增, 时间戳回退的 取上一帧时间戳+1
+//2 跳变检测, 相邻两帧差值超过JumpMs 重新计算偏移, 接着上一帧继续
+//3 差值为0的 按帧间隔填充, 帧间隔来自metadata的framerate 或 统计的平均值
+//4 音频超前或落后视频超过DriftMs, 音频时间戳按半速或1.5倍速走 直到回到范围内
+//  比如g711转aac后 每秒22个包 每个包差值92ms, 音频会越来越超前视频
+//5 修正次数按流统计, 通过action=get_tsFix查询
+type TsFixStat struct {
+	JumpNum  uint32 `json:"jumpNum"`  //跳变 重新计算偏移的次数
+	BackNum  uint32 `json:"backNum"`  //时间戳回退的次数
+	ZeroNum  uint32 `json:"zeroNum"`  //差值为0 按帧间隔填充的次数
+	DriftNum uint32 `json:"driftNum"` //音频相对视频漂移 修正的次数
+	DeltaMs  uint32 `json:"deltaMs"`  //当前估算的帧间隔
+}
+
+type TsFixTrack struct {
+	Init     bool
+	LastIn   uint32 //上一帧原始时间戳
+	LastOut  uint32 //上一帧修正后的时间戳
+	LastTime int64  //上一帧的接收时间, 毫秒
+	Offset   int64  //修正后的时间戳 = 原始时间戳 + Offset
+	TsFixStat
+}
+
+type TsFix struct {
+	Mutex sync.Mutex
+	Fps   float64 //metadata里的framerate
+	Video TsFixTrack
+	Audio TsFixTrack
+}
+
+//只在RtmpSender()中调用, 音视频头用上一帧修正后的时间戳
+func TsFixHandle(s *Stream, c *Chunk) {
+	if Conf().TsFix.Enable == false || len(c.MsgData) < 2 {
+		return
+	}
+
+	f := &s.TsFix
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	var t, o *TsFixTrack
+	var dd uint32
+	switch c.MsgTypeId {
+	case MsgTypeIdVideo:
+		t, o = &f.Video, &f.Audio
+		dd = Conf().TsFix.VideoDeltaMs
+		if f.Fps > 0 {
+			dd = uint32(1000 / f.Fps)
+		}
+	case MsgTypeIdAudio:
+		t, o = &f.Audio, &f.Video
+		dd = Conf().TsFix.AudioDeltaMs
+	default:
+		return
+	}
+
+	if TsFixIsHeader(c) == true {
+		if t.Init == true {
+			c.Timestamp = t.LastOut
+		}
+		return
+	}
+
+	in := c.Timestamp
+	now := utils.GetTimestamp("ms")
+	jump := int64(Conf().TsFix.JumpMs)
+	if jump == 0 {
+		jump = 1000
+	}
+	if t.Init == false {
+		t.Init = true
+		t.DeltaMs = dd
+		if t.DeltaMs == 0 {
+			t.DeltaMs = 1
+		}
+		//音视频起始时间戳相差太大, 以先到的为准
+		if o.Init == true {
+			d := int64(in) - int64(o.LastIn)
+			if d > jump || d < -jump {
+				t.Offset = int64(o.LastOut) - int64(in)
+				s.log.Printf("TsFix: first ts %d, other track ts %d, offset=%d", in, o.LastIn, t.Offset)
+			}
+		}
+		t.LastIn = in
+		t.LastOut = uint32(int64(in) + t.Offset)
+		t.LastTime = now
+		c.Timestamp = t.LastOut
+		return
+	}
+
+	d := int64(in) - int64(t.LastIn)
+	if d > jump || d < -jump {
+		t.Offset = int64(t.LastOut) + int64(t.DeltaMs) - int64(in)
+		t.JumpNum++
+		s.log.Printf("TsFix: ts jump %d -> %d, offset=%d", t.LastIn, in, t.Offset)
+	} else if d > 0 {
+		//帧间隔 取最近的平均值
+		t.DeltaMs = (t.DeltaMs*7 + uint32(d)) / 8
+		if t.DeltaMs == 0 {
+			t.DeltaMs = 1
+		}
+	}
+
+	out := int64(in) + t.Offset
+	if t == &f.Audio {
+		out = TsFixDrift(t, o, out, d, now)
+	}
+	if out <= int64(t.LastOut) {
+		if d == 0 {
+			//通过Offset填充, 后面的帧接着填充后的时间戳走 不会再回退
+			t.ZeroNum++
+			fill := int64(t.LastOut) + int64(t.DeltaMs)
+			t.Offset += fill - out
+			out = fill
+		} else {
+			t.BackNum++
+			out = int64(t.LastOut) + 1
+		}
+	}
+
+	t.LastIn = in
+	t.LastOut = uint32(out)
+	t.LastTime = now
+	c.Timestamp = t.LastOut
+}
+
+//a是音频, v是视频, 视频1秒内没有更新的 不修正
+func TsFixDrift(a, v *TsFixTrack, out, d, now int64) int64 {
+	lim := int64(Conf().TsFix.DriftMs)
+	if lim == 0 || d <= 0 || v.Init == false || now-v.LastTime > 1000 {
+		return out
+	}
+
+	var adj int64
+	drift := out - int64(v.LastOut)
+	if drift > lim {
+		adj = -(drift - lim)
+		if adj < -d/2 {
+			adj = -d / 2
+		}
+	} else if drift < -lim {
+		adj = -drift - lim
+		if adj > d/2 {
+			adj = d / 2
+		}
+	}
+	if adj == 0 {
+		return out
+	}
+	a.Offset += adj
+	a.DriftNum++
+	return out + adj
+}
+
+func TsFixIsHeader(c *Chunk) bool {
+	switch c.MsgTypeId {
+	case MsgTypeIdVideo:
+		if c.MsgData[0]&0x80 != 0 { //Enhanced RTMP
+			return c.MsgData[0]&0xf == ExPacketTypeSequenceStart
+		}
+		return c.MsgData[1] == 0
+	case MsgTypeIdAudio:
+		return c.MsgData[0]>>4 == 10 && c.MsgData[1] == 0
+	}
+	return false
+}
+
+//metadata里有framerate的, 用它算视频帧间隔
+func TsFixFpsSet(s *Stream, vs []interface{}) {
+	for _, v := range vs {
+		o, ok := v.(Object)
+		if ok == false {
+			continue
+		}
+		fps, ok := o["framerate"].(float64)
+		if ok == true && fps > 0 {
+			s.TsFix.Mutex.Lock()
+			s.TsFix.Fps = fps
+			s.TsFix.Mutex.Unlock()
+		}
+	}
+}
+
+//rtsp接入的rtp包的时间戳修正, 单位为rtp时钟 不是毫秒, 只在接收协程中调用
+//rtp时间戳是pts, 有b帧时不是递增的, 一帧的多个rtp包时间戳相同, 所以只做跳变检测
+//修正后的时间戳 写回rtp包, rtsp播放和转rtmp 用的都是修正后的
+func RtpTsFix(rs *RtspStream, p *RtpPacket) {
+	if Conf().TsFix.Enable == false || rs.Sdp == nil || len(p.Data) < 12 {
+		return
+	}
+
+	f := &rs.TsFix
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	var t *TsFixTrack
+	var rate int
+	if int(p.PayloadType) == rs.Sdp.VideoPayloadTypeInt {
+		t, rate = &f.Video, rs.Sdp.VideoClockRate
+	} else {
+		t, rate = &f.Audio, rs.Sdp.AudioClockRate
+	}
+	if rate <= 0 {
+		rate = 90000
+	}
+	jump := int64(Conf().TsFix.JumpMs)
+	if jump == 0 {
+		jump = 1000
+	}
+	jump = jump * int64(rate) / 1000
+
+	in := p.Timestamp
+	now := utils.GetTimestamp("ms")
+	if t.Init == false {
+		t.Init = true
+		t.LastIn = in
+		t.LastOut = in
+		t.LastTime = now
+		return
+	}
+
+	//rtp时间戳会回绕, 按int32算差值
+	d := int64(int32(in - t.LastIn))
+	if d > jump || d < -jump {
+		ms := t.DeltaMs
+		if ms == 0 {
+			ms = 1
+		}
+		t.Offset = int64(int32(t.LastOut-in)) + int64(ms)*int64(rate)/1000
+		t.JumpNum++
+		rs.log.Printf("RtpTsFix: pt=%d ts jump %d -> %d, offset=%d", p.PayloadType, t.LastIn, in, t.Offset)
+	} else if d > 0 {
+		ms := uint32(d * 1000 / int64(rate))
+		if t.DeltaMs == 0 {
+			t.DeltaMs = ms
+		} else {
+			t.DeltaMs = (t.DeltaMs*7 + ms) / 8
+		}
+	}
+
+	out := uint32(int64(in) + t.Offset)
+	t.LastIn = in
+	t.LastOut = out
+	t.LastTime = now
+	if out != in {
+		p.Timestamp = out
+		Uint32ToByte(out, p.Data[4:8], BE)
+	}
+}
+
+//rtsp接入的流 加上rtp包修正的次数
+func TsFixStatGet(s *Stream) (TsFixStat, TsFixStat) {
+	s.TsFix.Mutex.Lock()
+	v, a := s.TsFix.Video.TsFixStat, s.TsFix.Audio.TsFixStat
+	s.TsFix.Mutex.Unlock()
+
+	for _, rs := range HubRtspsGet(s.Key) {
+		if rs.Conn == nil {
+			continue
+		}
+		rs.TsFix.Mutex.Lock()
+		v.JumpNum += rs.TsFix.Video.JumpNum
+		a.JumpNum += rs.TsFix.Audio.JumpNum
+		rs.TsFix.Mutex.Unlock()
+	}
+	return v, a
+}
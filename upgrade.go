@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"utils"
+)
+
+/*************************************************/
+/* 不停服升级
+/*************************************************/
+//替换可执行文件后 kill -USR2 <pid>, 新进程接管监听的端口, ipc推流不中断
+//1 老进程把监听的socket(rtmp rtsp sip rtp http等) 通过ExtraFiles传给新进程
+// 环境变量LIVE_UPGRADE_FDS记录socket的名称, 第i个名称对应的fd为3+i
+//2 新进程启动时 有同名的socket就直接使用, 没有的才新监听
+//  继承的socket都用上后, 通过管道(名称为upgrade_ready)通知老进程, 老进程最多等UpgradeReadySec秒
+//  新进程没有通知就退出 或 超时的, 老进程杀掉新进程 不关闭任何socket, 升级失败
+//3 老进程关闭tcp监听, 不再accept新连接, 新的推流和播放都到新进程
+//  两个进程读同一个udp socket时 每个包只有一个进程收到, 所以老进程不再读rtsp_udp, 都由新进程读
+//  新进程收到的rtsp rtp包 端口不是自己的会话的, 通过unix socket(名称为upgrade_fwd)转给老进程
+//  老进程退出后 转发失败, 新进程就不再转发
+//4 gb28181的会话是cc通过api创建的, 老进程通过管道(名称为upgrade_gb) 把还没有连接的会话交给新进程
+//  设备之后的rtp(tcp)连接到新进程 能找到ssrc; 已有连接的会话 继续在老进程接收, 不停止
+//  rtp_udp(gb28181)在本项目中还没有实现按ssrc分发, 不用转发
+//5 拉流任务(rtmp rtsp拉流)不会自己断开, 老进程开始等待时就停止, 由调用方在新进程重新创建
+//6 老进程已有的连接继续工作, 发布者都断开 或 超过Upgrade.DrainSec秒后 老进程退出
+//注意: 以系统服务运行时, 服务管理器不能在主进程退出时 杀掉整个进程组
+const (
+	UpgradeEnv       = "LIVE_UPGRADE_FDS"
+	UpgradeReadyName = "upgrade_ready"
+	UpgradeReadySec  = 30
+	UpgradeFwdName   = "upgrade_fwd"
+	UpgradeGbName    = "upgrade_gb"
+)
+
+type UpgradeSock struct {
+	Name string
+	L    net.Listener   //tcp
+	Pc   net.PacketConn //udp
+}
+
+var (
+	UpgradeMutex   sync.Mutex
+	UpgradeSocks   []UpgradeSock  //本进程监听的socket, 升级时传给新进程
+	UpgradeStop    bool           //已开始升级, 不再accept和读udp
+	UpgradeFds     map[string]int //从老进程继承的socket, key为名称 value为fd
+	UpgradeFdsOnce sync.Once
+	UpgradeReadyFd int       //通知老进程的管道, 0表示不是升级启动的
+	UpgradeReadyOk sync.Once //只通知一次
+
+	UpgradeFwdMutex sync.Mutex
+	UpgradeFwdConn  net.Conn //新进程把不是自己的rtsp rtp包 转给老进程, nil表示不转发
+)
+
+//老进程传过来的socket, 每个只能取一次
+func UpgradeInherit(name string) *os.File {
+	UpgradeFdsOnce.Do(func() {
+		UpgradeFds = make(map[string]int)
+		v := os.Getenv(UpgradeEnv)
+		if v == "" {
+			return
+		}
+		for i, n := range strings.Split(v, ",") {
+			UpgradeFds[n] = 3 + i
+		}
+		log.Printf("upgrade inherit fds %v", UpgradeFds)
+		if fd, ok := UpgradeFds[UpgradeReadyName]; ok == true {
+			UpgradeReadyFd = fd
+			delete(UpgradeFds, UpgradeReadyName)
+			//新配置不用的socket 一直不会被取走, 启动后这么久还没取完的 也通知
+			time.AfterFunc(UpgradeReadySec/2*time.Second, UpgradeReady)
+		}
+	})
+
+	UpgradeMutex.Lock()
+	fd, ok := UpgradeFds[name]
+	if ok == true {
+		delete(UpgradeFds, name)
+	}
+	n := len(UpgradeFds)
+	UpgradeMutex.Unlock()
+	if ok == false {
+		return nil
+	}
+	//最后一个socket 调用者马上就会用上
+	if n == 0 {
+		UpgradeReady()
+	}
+	return os.NewFile(uintptr(fd), name)
+}
+
+//新进程通知老进程 可以关闭监听了
+func UpgradeReady() {
+	if UpgradeReadyFd == 0 {
+		return
+	}
+	UpgradeReadyOk.Do(func() {
+		UpgradeMutex.Lock()
+		if len(UpgradeFds) > 0 {
+			log.Printf("upgrade ready, unused fds %v", UpgradeFds)
+		}
+		UpgradeMutex.Unlock()
+
+		f := os.NewFile(uintptr(UpgradeReadyFd), UpgradeReadyName)
+		_, err := f.Write([]byte{1})
+		if err != nil {
+			log.Println(err)
+		}
+		f.Close()
+		log.Printf("upgrade ready, pid=%d", os.Getpid())
+	})
+}
+
+//老进程等新进程通知, 新进程退出时管道关闭 读到EOF
+func UpgradeReadyWait(r *os.File) error {
+	ch := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := r.Read(b[:])
+		ch <- err
+	}()
+
+	var err error
+	select {
+	case err = <-ch:
+	case <-time.After(UpgradeReadySec * time.Second):
+		err = fmt.Errorf("wait new process ready timeout %ds", UpgradeReadySec)
+	}
+	r.Close()
+	return err
+}
+
+//tcp监听, lc为nil的用默认配置
+func UpgradeListen(lc *net.ListenConfig, name, network, addr string) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if f := UpgradeInherit(name); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+		if err == nil {
+			log.Printf("==> %s inherit listener %s", name, l.Addr().String())
+		} else {
+			log.Println(err)
+		}
+	}
+	if l == nil {
+		if lc == nil {
+			lc = &net.ListenConfig{}
+		}
+		l, err = lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	UpgradeMutex.Lock()
+	UpgradeSocks = append(UpgradeSocks, UpgradeSock{Name: name, L: l})
+	UpgradeMutex.Unlock()
+	return l, nil
+}
+
+//udp监听, lc为nil的用默认配置
+func UpgradeListenPacket(lc *net.ListenConfig, name, network, addr string) (*net.UDPConn, error) {
+	var pc net.PacketConn
+	var err error
+	if f := UpgradeInherit(name); f != nil {
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+		if err == nil {
+			log.Printf("==> %s inherit udp %s", name, pc.LocalAddr().String())
+		} else {
+			log.Println(err)
+		}
+	}
+	if pc == nil {
+		if lc == nil {
+			lc = &net.ListenConfig{}
+		}
+		pc, err = lc.ListenPacket(context.Background(), network, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c, ok := pc.(*net.UDPConn)
+	if ok == false {
+		pc.Close()
+		err = fmt.Errorf("%s %s is not udp", name, addr)
+		return nil, err
+	}
+
+	UpgradeMutex.Lock()
+	UpgradeSocks = append(UpgradeSocks, UpgradeSock{Name: name, Pc: c})
+	UpgradeMutex.Unlock()
+	return c, nil
+}
+
+//accept或读udp出错时调用, 返回true表示正在升级 要退出循环
+func UpgradeStopped() bool {
+	UpgradeMutex.Lock()
+	defer UpgradeMutex.Unlock()
+	return UpgradeStop
+}
+
+func UpgradeSignal() {
+	if Conf().Upgrade.Enable == false {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	for {
+		<-ch
+		log.Printf("recv SIGUSR2, upgrade start, pid=%d", os.Getpid())
+		err := UpgradeStart()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+//启动新进程, 成功后关闭本进程的监听
+func UpgradeStart() error {
+	UpgradeMutex.Lock()
+	defer UpgradeMutex.Unlock()
+	var err error
+	if UpgradeStop == true {
+		err = fmt.Errorf("upgrade is running")
+		return err
+	}
+
+	var fs []*os.File
+	var ns []string
+	defer func() {
+		for _, f := range fs {
+			f.Close()
+		}
+	}()
+	for _, us := range UpgradeSocks {
+		var s interface{} = us.L
+		if us.Pc != nil {
+			s = us.Pc
+		}
+		fl, ok := s.(interface{ File() (*os.File, error) })
+		if ok == false {
+			log.Printf("upgrade %s can't get fd", us.Name)
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		fs = append(fs, f)
+		ns = append(ns, us.Name)
+	}
+
+	//fwd是老进程接收转发的一端, 新进程启动就会转发 马上开始读, 否则新进程写阻塞
+	//gw是老进程写gb28181会话的一端, 升级成功才写
+	fwd, gw, err := UpgradeHandoverCreate(&fs, &ns)
+	if err != nil {
+		return err
+	}
+	go UpgradeFwdRecv(fwd)
+	ok := false
+	defer func() {
+		if ok == false {
+			fwd.Close()
+			gw.Close()
+		}
+	}()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	fs = append(fs, w)
+	ns = append(ns, UpgradeReadyName)
+
+	exe, err := os.Executable()
+	if err != nil {
+		r.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", UpgradeEnv, strings.Join(ns, ",")))
+	cmd.ExtraFiles = fs
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		r.Close()
+		return err
+	}
+	log.Printf("upgrade new process pid=%d, %s %v, fds %v", cmd.Process.Pid, exe, os.Args[1:], ns)
+	go cmd.Wait()
+
+	//要关闭管道的写端, 新进程退出时 才能读到EOF
+	for _, f := range fs {
+		f.Close()
+	}
+	fs = nil
+	err = UpgradeReadyWait(r)
+	if err != nil {
+		log.Printf("upgrade new process pid=%d not ready, kill it", cmd.Process.Pid)
+		cmd.Process.Kill()
+		return fmt.Errorf("upgrade fail, %s", err)
+	}
+
+	//新进程已经在accept了, 关闭后 新连接都到新进程, udp的socket留着 老进程退出时关闭
+	//rtsp_udp不再读, 读协程超时出错 UpgradeStopped()为true 就退出, 老会话的包由新进程转过来
+	UpgradeStop = true
+	var us []UpgradeSock
+	for _, s := range UpgradeSocks {
+		if s.L != nil {
+			s.L.Close()
+		}
+		if s.Pc != nil {
+			if s.Name == "rtsp_udp" {
+				s.Pc.SetReadDeadline(time.Now())
+			}
+			us = append(us, s)
+		}
+	}
+	UpgradeSocks = us
+	ok = true
+
+	go UpgradeGbSend(gw)
+	go UpgradeDrain()
+	return nil
+}
+
+/*************************************************/
+/* 升级时 老进程的会话交给新进程
+/*************************************************/
+//创建转发用的unix socket对 和 gb28181会话的管道, 新进程用的一端 加入fs和ns
+func UpgradeHandoverCreate(fs *[]*os.File, ns *[]string) (net.Conn, *os.File, error) {
+	sp, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	f0 := os.NewFile(uintptr(sp[0]), UpgradeFwdName)
+	fwd, err := net.FileConn(f0)
+	f0.Close()
+	if err != nil {
+		syscall.Close(sp[1])
+		return nil, nil, err
+	}
+
+	gr, gw, err := os.Pipe()
+	if err != nil {
+		fwd.Close()
+		syscall.Close(sp[1])
+		return nil, nil, err
+	}
+	*fs = append(*fs, os.NewFile(uintptr(sp[1]), UpgradeFwdName), gr)
+	*ns = append(*ns, UpgradeFwdName, UpgradeGbName)
+	return fwd, gw, nil
+}
+
+//新进程启动时调用, 不是升级启动的 什么都不做
+func UpgradeHandover() {
+	if f := UpgradeInherit(UpgradeFwdName); f != nil {
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			log.Println(err)
+		} else {
+			UpgradeFwdConn = c
+		}
+	}
+	if f := UpgradeInherit(UpgradeGbName); f != nil {
+		go UpgradeGbRecv(f)
+	}
+}
+
+//转发的包: port(2byte) + ipLen(1byte) + ip + rtp数据
+func UpgradeFwdSend(p *RtpUdpPkt) bool {
+	UpgradeFwdMutex.Lock()
+	defer UpgradeFwdMutex.Unlock()
+	if UpgradeFwdConn == nil {
+		return false
+	}
+
+	d := make([]byte, 3+len(p.Ip)+p.Len)
+	Uint16ToByte(uint16(p.Port), d[0:2], BE)
+	d[2] = uint8(len(p.Ip))
+	n := 3 + copy(d[3:], p.Ip)
+	copy(d[n:], p.Data[:p.Len])
+
+	_, err := UpgradeFwdConn.Write(d)
+	if err != nil {
+		//老进程已退出
+		log.Printf("upgrade fwd stop, %s", err)
+		UpgradeFwdConn.Close()
+		UpgradeFwdConn = nil
+		return false
+	}
+	return true
+}
+
+//老进程接收新进程转过来的rtsp rtp包, 老进程退出时结束
+func UpgradeFwdRecv(c net.Conn) {
+	defer c.Close()
+	for {
+		d := make([]byte, 1700)
+		n, err := c.Read(d)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if n < 3 || n < 3+int(d[2]) {
+			log.Printf("upgrade fwd data len=%d error", n)
+			continue
+		}
+
+		p := &RtpUdpPkt{}
+		p.Port = int(ByteToUint16(d[0:2], BE))
+		il := int(d[2])
+		p.Ip = string(d[3 : 3+il])
+		p.Data = d[3+il : n]
+		p.Len = len(p.Data)
+		if RtspUdpPktDispatch(p) == false {
+			log.Printf("upgrade fwd rtsp rtp port %d is not exist", p.Port)
+		}
+	}
+}
+
+//老进程把还没有连接的gb28181会话 写给新进程, 已有连接的 继续在老进程接收
+func UpgradeGbSend(w *os.File) {
+	defer w.Close()
+	var rqsts []GbRqst
+	HubGbRange(func(s *Stream) bool {
+		if s.Conn0 == nil {
+			rqsts = append(rqsts, s.GbRqst)
+		}
+		return true
+	})
+	log.Printf("upgrade hand over %d gb28181 session", len(rqsts))
+
+	d, _ := json.Marshal(rqsts)
+	if _, err := w.Write(d); err != nil {
+		log.Println(err)
+	}
+}
+
+//新进程创建老进程交过来的gb28181会话, 同GB28181Create(), 已存在的不覆盖
+func UpgradeGbRecv(r *os.File) {
+	defer r.Close()
+	d, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var rqsts []GbRqst
+	if err = json.Unmarshal(d, &rqsts); err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, rqst := range rqsts {
+		key := rqst.StreamId
+		HubPubMutex.Lock()
+		if _, ok := HubGbGet(key); ok == true {
+			HubPubMutex.Unlock()
+			continue
+		}
+		s, _ := NewGb28181Stream(key, rqst)
+		s.RecvLastTime = utils.GetTimestamp("ms")
+		s.log.Printf("upgrade take over %#v", rqst)
+		HubGbStore(s)
+		HubPubMutex.Unlock()
+	}
+	log.Printf("upgrade take over %d gb28181 session", len(rqsts))
+}
+
+//拉流任务停止前 通过流状态回调上报直播结束, reason为upgrade
+//gb28181不停止, 已有连接的继续接收, 没有连接的已交给新进程
+func UpgradePullStop() {
+	RtmpPullMap.Range(func(k, v interface{}) bool {
+		sid := k.(string)
+		log.Printf("upgrade stop rtmp pull %s", sid)
+		StreamStopReport(sid, "upgrade")
+		_ = RtmpPullDelete(sid)
+		return true
+	})
+	HubRtspRange(func(k string, rs *RtspStream) bool {
+		if rs.Rqst == nil {
+			return true
+		}
+		log.Printf("upgrade stop rtsp pull %s", rs.Key)
+		StreamStopReport(rs.StreamId, "upgrade")
+		RtspPullStop(k, rs)
+		return true
+	})
+}
+
+//等已有的发布者都断开 再退出, 最多等DrainSec秒
+func UpgradeDrain() {
+	sec := Conf().Upgrade.DrainSec
+	if sec == 0 {
+		sec = 600
+	}
+	UpgradePullStop()
+	for i := 0; i < sec; i++ {
+		n := HubPuberNum()
+		if n == 0 {
+			break
+		}
+		if i%10 == 0 {
+			log.Printf("upgrade drain, PublisherNum=%d, %d(%d)s", n, i, sec)
+		}
+		time.Sleep(1 * time.Second)
+	}
+	log.Printf("upgrade drain done, pid=%d exit", os.Getpid())
+	os.Exit(0)
+}